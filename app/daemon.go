@@ -35,6 +35,7 @@ const (
 	FlagSupportBundleManagerImage = "support-bundle-manager-image"
 	FlagServiceAccount            = "service-account"
 	FlagKubeConfig                = "kube-config"
+	FlagUpgradeBudget             = "upgrade-budget"
 )
 
 func DaemonCmd() cli.Command {
@@ -73,6 +74,10 @@ func DaemonCmd() cli.Command {
 				Name:  FlagKubeConfig,
 				Usage: "Specify path to kube config (optional)",
 			},
+			cli.DurationFlag{
+				Name:  FlagUpgradeBudget,
+				Usage: "Specify the maximum duration of the resource upgrade, 0 means no limit (optional)",
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := startManager(c); err != nil {
@@ -116,6 +121,7 @@ func startManager(c *cli.Context) error {
 		return fmt.Errorf("require %v", FlagServiceAccount)
 	}
 	kubeconfigPath := c.String(FlagKubeConfig)
+	upgradeBudget := c.Duration(FlagUpgradeBudget)
 
 	if err := environmentCheck(); err != nil {
 		logrus.Errorf("Failed environment check, please make sure you " +
@@ -148,7 +154,7 @@ func startManager(c *cli.Context) error {
 		return err
 	}
 
-	if err := upgrade.Upgrade(kubeconfigPath, currentNodeID); err != nil {
+	if err := upgrade.Upgrade(kubeconfigPath, currentNodeID, upgradeBudget, nil); err != nil {
 		return err
 	}
 
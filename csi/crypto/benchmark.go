@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CipherBenchmark is the in-memory throughput of a cipher measured by cryptsetup benchmark.
+type CipherBenchmark struct {
+	// Cipher is the cipher and the block mode, e.g. aes-xts
+	Cipher string
+	// KeySize is the key size in bits
+	KeySize int
+	// EncryptionMiBps and DecryptionMiBps are the throughput in MiB/s
+	EncryptionMiBps float64
+	DecryptionMiBps float64
+}
+
+// throughputUnits are the units cryptsetup may report the throughput in, relative to MiB/s.
+// Older versions report MB/s which is actually MiB/s.
+var throughputUnits = map[string]float64{
+	"KiB/s": 1.0 / 1024,
+	"MiB/s": 1,
+	"MB/s":  1,
+	"GiB/s": 1024,
+}
+
+var benchmarkKeySizeRegex = regexp.MustCompile(`^(\d+)b$`)
+
+// BenchmarkCiphers runs cryptsetup benchmark on the node and returns the throughput of the ciphers
+// available in the kernel. The ciphers the kernel doesn't support are reported as N/A by cryptsetup
+// and left out. The benchmark measures the memory only without any storage IO, and takes seconds.
+func BenchmarkCiphers() ([]CipherBenchmark, error) {
+	stdout, err := cryptSetup("benchmark")
+	if err != nil {
+		return nil, fmt.Errorf("failed to benchmark ciphers: %w", err)
+	}
+	return parseCipherBenchmarks(stdout)
+}
+
+// parseCipherBenchmarks parses the cipher lines of cryptsetup benchmark, e.g.
+//
+//	#     Algorithm |       Key |      Encryption |      Decryption
+//	        aes-xts        256b      2150.3 MiB/s      2163.6 MiB/s
+//
+// The PBKDF lines and the comments are skipped.
+func parseCipherBenchmarks(output string) ([]CipherBenchmark, error) {
+	benchmarks := []CipherBenchmark{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		matches := benchmarkKeySizeRegex.FindStringSubmatch(fields[1])
+		if matches == nil {
+			continue
+		}
+		if len(fields) != 6 {
+			// N/A
+			continue
+		}
+		keySize, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key size in benchmark line %q: %w", line, err)
+		}
+		encryption, err := parseThroughput(fields[2], fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption throughput in benchmark line %q: %w", line, err)
+		}
+		decryption, err := parseThroughput(fields[4], fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid decryption throughput in benchmark line %q: %w", line, err)
+		}
+		benchmarks = append(benchmarks, CipherBenchmark{
+			Cipher:          fields[0],
+			KeySize:         keySize,
+			EncryptionMiBps: encryption,
+			DecryptionMiBps: decryption,
+		})
+	}
+	if len(benchmarks) == 0 {
+		return nil, fmt.Errorf("no cipher benchmark found in cryptsetup output")
+	}
+	return benchmarks, nil
+}
+
+func parseThroughput(value, unit string) (float64, error) {
+	multiplier, ok := throughputUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown throughput unit %v", unit)
+	}
+	throughput, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return throughput * multiplier, nil
+}
+
+// RecommendedCipher benchmarks the ciphers and returns the XTS cipher with the highest throughput,
+// e.g. aes-xts-plain64, which can be used as the KeyCipher. The throughput of a cipher is the
+// slower of the encryption and the decryption. The key size isn't part of the cipher, the KeySize
+// is still up to the operator.
+func RecommendedCipher() (string, error) {
+	benchmarks, err := BenchmarkCiphers()
+	if err != nil {
+		return "", err
+	}
+	return recommendCipher(benchmarks)
+}
+
+func recommendCipher(benchmarks []CipherBenchmark) (string, error) {
+	best := ""
+	bestThroughput := 0.0
+	for _, b := range benchmarks {
+		if !strings.HasSuffix(b.Cipher, "-xts") {
+			continue
+		}
+		throughput := b.EncryptionMiBps
+		if b.DecryptionMiBps < throughput {
+			throughput = b.DecryptionMiBps
+		}
+		if best == "" || throughput > bestThroughput {
+			best, bestThroughput = b.Cipher, throughput
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no XTS cipher is available")
+	}
+	return best + "-plain64", nil
+}
@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testBenchmarkOutput = `# Tests are approximate using memory only (no storage IO).
+PBKDF2-sha1      1598439 iterations per second for 256-bit key
+PBKDF2-sha256    2063368 iterations per second for 256-bit key
+argon2id      4 iterations, 1048576 memory, 4 parallel threads (CPUs) for 256-bit key (requested 2000 ms time)
+#     Algorithm |       Key |      Encryption |      Decryption
+        aes-cbc        128b      1180.4 MiB/s      3730.9 MiB/s
+    serpent-cbc        128b        98.6 MiB/s       340.9 MiB/s
+        aes-xts        256b       150.2 MiB/s       148.7 MiB/s
+    serpent-xts        256b       336.5 MiB/s       328.1 MiB/s
+    twofish-xts        256b            N/A            N/A
+        aes-xts        512b       140.0 MiB/s       139.1 MiB/s
+`
+
+func TestParseCipherBenchmarks(t *testing.T) {
+	benchmarks, err := parseCipherBenchmarks(testBenchmarkOutput)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []CipherBenchmark{
+		{Cipher: "aes-cbc", KeySize: 128, EncryptionMiBps: 1180.4, DecryptionMiBps: 3730.9},
+		{Cipher: "serpent-cbc", KeySize: 128, EncryptionMiBps: 98.6, DecryptionMiBps: 340.9},
+		{Cipher: "aes-xts", KeySize: 256, EncryptionMiBps: 150.2, DecryptionMiBps: 148.7},
+		{Cipher: "serpent-xts", KeySize: 256, EncryptionMiBps: 336.5, DecryptionMiBps: 328.1},
+		{Cipher: "aes-xts", KeySize: 512, EncryptionMiBps: 140.0, DecryptionMiBps: 139.1},
+	}
+	if !reflect.DeepEqual(benchmarks, expected) {
+		t.Fatalf("benchmarks = %+v, expected %+v", benchmarks, expected)
+	}
+
+	if _, err := parseCipherBenchmarks("# Tests are approximate using memory only (no storage IO).\n"); err == nil {
+		t.Fatalf("expected an error for the output without cipher benchmarks")
+	}
+	if _, err := parseCipherBenchmarks("aes-xts 256b 150.2 TiB/s 148.7 MiB/s\n"); err == nil {
+		t.Fatalf("expected an error for an unknown unit")
+	}
+}
+
+func TestRecommendedCipher(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		return testBenchmarkOutput, nil
+	})
+
+	cipher, err := RecommendedCipher()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// aes-cbc is the fastest, but only the XTS ciphers are recommended
+	if cipher != "serpent-xts-plain64" {
+		t.Fatalf("cipher = %v, expected serpent-xts-plain64", cipher)
+	}
+	if call := f.lastCall("benchmark"); !reflect.DeepEqual(call, []string{"benchmark"}) {
+		t.Fatalf("cryptsetup args = %v, expected benchmark", call)
+	}
+
+	if _, err := recommendCipher([]CipherBenchmark{{Cipher: "aes-cbc", KeySize: 128, EncryptionMiBps: 1000, DecryptionMiBps: 1000}}); err == nil {
+		t.Fatalf("expected an error without any XTS cipher")
+	}
+}
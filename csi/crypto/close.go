@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The default close is attempted 5 times, waiting for about 10s in total between the attempts
+// for an unmount to settle.
+const (
+	defaultCloseRetries = 4
+	defaultCloseBackoff = 650 * time.Millisecond
+)
+
+// closeRetryPolicy controls how a busy device is closed. The close is retried with the backoff
+// doubled for each retry, and deferred to the last user of the device if deferredFallback is set.
+type closeRetryPolicy struct {
+	retries          int
+	backoff          time.Duration
+	deferredFallback bool
+}
+
+var (
+	closePolicyLock sync.RWMutex
+	closePolicy     = closeRetryPolicy{retries: defaultCloseRetries, backoff: defaultCloseBackoff}
+)
+
+// SetCloseRetryPolicy sets the number of the retries and the initial backoff for closing a busy
+// device. If deferredFallback is set, the close is deferred once the retries are exhausted, so
+// the mapping is removed as soon as the last user of the device goes away.
+func SetCloseRetryPolicy(retries int, backoff time.Duration, deferredFallback bool) error {
+	if retries < 0 {
+		return fmt.Errorf("invalid close retries %v, it should not be negative", retries)
+	}
+	if backoff < 0 {
+		return fmt.Errorf("invalid close backoff %v, it should not be negative", backoff)
+	}
+	closePolicyLock.Lock()
+	defer closePolicyLock.Unlock()
+	closePolicy = closeRetryPolicy{retries: retries, backoff: backoff, deferredFallback: deferredFallback}
+	return nil
+}
+
+// closeRetrySleep waits for the backoff before retrying the close, unless the context is done first.
+// It's replaced by the tests to not sleep for real.
+var closeRetrySleep = func(ctx context.Context, backoff time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(backoff):
+		return nil
+	}
+}
+
+func getCloseRetryPolicy() closeRetryPolicy {
+	closePolicyLock.RLock()
+	defer closePolicyLock.RUnlock()
+	return closePolicy
+}
+
+// isDeviceBusy returns whether cryptsetup failed since the device is still in use.
+func isDeviceBusy(err error) bool {
+	if errors.Is(err, ErrDeviceBusy) {
+		return true
+	}
+	if code, ok := ExitCode(err); ok && code == cryptSetupExitCodeBusy {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "is still in use")
+}
+
+// CloseAllOnShutdown waits for the context to be cancelled, then closes the mappings of all the
+// volumes. A device still busy after the retries is closed deferred, so the teardown doesn't block
+// on it. The close errors of all the volumes are aggregated.
+func CloseAllOnShutdown(ctx context.Context, knownVolumes []string) error {
+	<-ctx.Done()
+
+	policy := getCloseRetryPolicy()
+	policy.deferredFallback = true
+
+	var errs []error
+	for _, volume := range knownVolumes {
+		if isOpen, err := IsDeviceOpen(VolumeMapper(volume)); err == nil && !isOpen {
+			continue
+		}
+		logrus.Infof("Closing LUKS device %s on shutdown", volume)
+		// The shutdown context is already cancelled, the closes must still run to the end
+		if err := closeWithRetryPolicy(context.Background(), MapperName(volume), policy); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close volume %s: %w", volume, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeWithRetry closes the mapping, retrying only if the device is busy. Other errors are
+// returned immediately.
+func closeWithRetry(ctx context.Context, mapper string) error {
+	return closeWithRetryPolicy(ctx, mapper, getCloseRetryPolicy())
+}
+
+func closeWithRetryPolicy(ctx context.Context, mapper string, policy closeRetryPolicy) error {
+	backoff := policy.backoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if _, err = luksClose(ctx, mapper); err == nil || !isDeviceBusy(err) {
+			return err
+		}
+		if attempt >= policy.retries {
+			break
+		}
+
+		logrus.Debugf("LUKS device %s is busy, flushing and retrying the close in %v", mapper, backoff)
+		if _, flushErr := hostCommandRunner(ctx, "blockdev", "--flushbufs", path.Join(mapperFilePathPrefix, mapper)); flushErr != nil {
+			logrus.Debugf("failed to flush LUKS device %s: %v", mapper, flushErr)
+		}
+		if err := closeRetrySleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+
+	if !policy.deferredFallback {
+		return err
+	}
+	logrus.Warnf("LUKS device %s is still busy after %v retries, deferring the close", mapper, policy.retries)
+	if _, deferredErr := luksCloseDeferred(ctx, mapper); deferredErr != nil {
+		return fmt.Errorf("failed to defer the close of busy device %s: %w", mapper, deferredErr)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCloseRetryPolicy(t *testing.T, retries int, deferredFallback bool) {
+	oldPolicy := getCloseRetryPolicy()
+	if err := SetCloseRetryPolicy(retries, 0, deferredFallback); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		closePolicyLock.Lock()
+		defer closePolicyLock.Unlock()
+		closePolicy = oldPolicy
+	})
+}
+
+func newBusyError(mapper string) error {
+	return &CommandError{Command: "cryptsetup", ExitCode: cryptSetupExitCodeBusy, Stderr: fmt.Sprintf("Device %s is still in use.", mapper), Err: fmt.Errorf("exit status 5")}
+}
+
+func TestCloseVolumeRetry(t *testing.T) {
+	testCases := map[string]struct {
+		busyTimes        int
+		closeErr         error
+		retries          int
+		deferredFallback bool
+		expectedCloses   int
+		expectedDeferred bool
+		expectedError    bool
+	}{
+		"transient busy": {
+			busyTimes:      2,
+			retries:        3,
+			expectedCloses: 3,
+		},
+		"busy exhausting retries": {
+			busyTimes:      10,
+			retries:        2,
+			expectedCloses: 3,
+			expectedError:  true,
+		},
+		"busy with deferred fallback": {
+			busyTimes:        10,
+			retries:          2,
+			deferredFallback: true,
+			expectedCloses:   3,
+			expectedDeferred: true,
+		},
+		"non-busy error": {
+			closeErr:       &CommandError{Command: "cryptsetup", ExitCode: 4, Err: fmt.Errorf("exit status 4")},
+			retries:        3,
+			expectedCloses: 1,
+			expectedError:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		newTestCloseRetryPolicy(t, tc.retries, tc.deferredFallback)
+		closes := 0
+		deferred := false
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			switch args[0] {
+			case "status":
+				return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/"+args[1]), nil
+			case "luksClose":
+				closes++
+				if tc.closeErr != nil {
+					return "", tc.closeErr
+				}
+				if closes <= tc.busyTimes {
+					return "", newBusyError(args[1])
+				}
+			case "close":
+				if !reflect.DeepEqual(args, []string{"close", "--deferred", MapperName("vol")}) {
+					return "", fmt.Errorf("unexpected args %v", args)
+				}
+				deferred = true
+			}
+			return "", nil
+		})
+		var flushes []string
+		newFakeHostCommand(t, func(command string, args []string) (string, error) {
+			if command == "blockdev" && args[0] == "--flushbufs" {
+				flushes = append(flushes, args[1])
+			}
+			return "", nil
+		})
+
+		err := CloseVolume("vol")
+		if tc.expectedError != (err != nil) {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if closes != tc.expectedCloses {
+			t.Fatalf("%v: closes = %v, expected %v", name, closes, tc.expectedCloses)
+		}
+		if deferred != tc.expectedDeferred {
+			t.Fatalf("%v: deferred = %v, expected %v", name, deferred, tc.expectedDeferred)
+		}
+		if len(flushes) != tc.expectedCloses-1 {
+			t.Fatalf("%v: flushes = %v, expected one before each retry", name, flushes)
+		}
+	}
+}
+
+func TestCloseVolumeNotOpen(t *testing.T) {
+	testCases := map[string]struct {
+		status         func(mapper string) (string, error)
+		closeErr       error
+		expectedCloses int
+		expectedError  bool
+	}{
+		"closed": {
+			status: func(mapper string) (string, error) {
+				return fmt.Sprintf("/dev/mapper/%s is inactive.\n", mapper), nil
+			},
+			expectedCloses: 0,
+		},
+		"missing device": {
+			status: func(mapper string) (string, error) {
+				return "", &CommandError{Command: "cryptsetup", ExitCode: 4, Err: fmt.Errorf("device %s not found", mapper)}
+			},
+			expectedCloses: 0,
+		},
+		"open": {
+			status: func(mapper string) (string, error) {
+				return fmt.Sprintf(testStatusTemplate, mapper, "/dev/longhorn/vol"), nil
+			},
+			expectedCloses: 1,
+		},
+		"open with close failure": {
+			status: func(mapper string) (string, error) {
+				return fmt.Sprintf(testStatusTemplate, mapper, "/dev/longhorn/vol"), nil
+			},
+			closeErr:       &CommandError{Command: "cryptsetup", ExitCode: 4, Err: fmt.Errorf("exit status 4")},
+			expectedCloses: 1,
+			expectedError:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		newTestCloseRetryPolicy(t, 0, false)
+		closes := 0
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			switch args[0] {
+			case "status":
+				return tc.status(args[1])
+			case "luksClose":
+				closes++
+				return "", tc.closeErr
+			}
+			return "", fmt.Errorf("unexpected args %v", args)
+		})
+
+		err := CloseVolume("vol")
+		if tc.expectedError != (err != nil) {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if closes != tc.expectedCloses {
+			t.Fatalf("%v: closes = %v, expected %v", name, closes, tc.expectedCloses)
+		}
+	}
+}
+
+func TestSetCloseRetryPolicy(t *testing.T) {
+	newTestCloseRetryPolicy(t, defaultCloseRetries, false)
+	if err := SetCloseRetryPolicy(-1, time.Second, false); err == nil {
+		t.Fatalf("expected an error for the negative retries")
+	}
+	if err := SetCloseRetryPolicy(1, -time.Second, false); err == nil {
+		t.Fatalf("expected an error for the negative backoff")
+	}
+}
+
+func TestCloseVolumeRetryBackoff(t *testing.T) {
+	var backoffs []time.Duration
+	oldCloseRetrySleep := closeRetrySleep
+	closeRetrySleep = func(ctx context.Context, backoff time.Duration) error {
+		backoffs = append(backoffs, backoff)
+		return nil
+	}
+	defer func() {
+		closeRetrySleep = oldCloseRetrySleep
+	}()
+
+	closes := 0
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status":
+			return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/"+args[1]), nil
+		case "luksClose":
+			closes++
+			return "", newBusyError(args[1])
+		}
+		return "", nil
+	})
+
+	// The default policy makes 5 attempts with the backoff doubled each time, about 10s in total
+	if err := CloseVolume("vol"); !isDeviceBusy(err) {
+		t.Fatalf("err = %v, expected the busy error after the retries", err)
+	}
+	if closes != 5 {
+		t.Fatalf("closes = %v, expected 5 attempts", closes)
+	}
+	expected := []time.Duration{650 * time.Millisecond, 1300 * time.Millisecond, 2600 * time.Millisecond, 5200 * time.Millisecond}
+	if !reflect.DeepEqual(backoffs, expected) {
+		t.Fatalf("backoffs = %v, expected %v", backoffs, expected)
+	}
+	total := time.Duration(0)
+	for _, backoff := range backoffs {
+		total += backoff
+	}
+	if total < 9*time.Second || total > 11*time.Second {
+		t.Fatalf("total backoff = %v, expected about 10s", total)
+	}
+
+	// The context cancelled during the backoff stops the retries
+	closeRetrySleep = func(ctx context.Context, backoff time.Duration) error {
+		return context.Canceled
+	}
+	closes = 0
+	if err := CloseVolume("vol"); err != context.Canceled {
+		t.Fatalf("err = %v, expected %v", err, context.Canceled)
+	}
+	if closes != 1 {
+		t.Fatalf("closes = %v, expected no retry after the cancellation", closes)
+	}
+}
+
+func TestCloseAllOnShutdown(t *testing.T) {
+	newTestCloseRetryPolicy(t, 1, false)
+	open := map[string]bool{MapperName("vol-1"): true, MapperName("vol-busy"): true, MapperName("vol-broken"): true}
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status":
+			if !open[args[1]] {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/"+args[1]), nil
+		case "luksClose":
+			switch args[1] {
+			case MapperName("vol-busy"):
+				return "", newBusyError(args[1])
+			case MapperName("vol-broken"):
+				return "", &CommandError{Command: "cryptsetup", ExitCode: 4, Err: fmt.Errorf("exit status 4")}
+			}
+			return "", nil
+		case "close":
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- CloseAllOnShutdown(ctx, []string{"vol-1", "vol-busy", "vol-broken", "vol-closed"})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the context is cancelled: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	err := <-done
+
+	if err == nil || !strings.Contains(err.Error(), "vol-broken") || strings.Contains(err.Error(), "vol-busy") {
+		t.Fatalf("expected the aggregated error of vol-broken only, got %v", err)
+	}
+	closed := map[string]int{}
+	for _, call := range f.calls {
+		switch call[0] {
+		case "luksClose":
+			closed[call[1]]++
+		case "close":
+			closed["deferred "+call[len(call)-1]]++
+		}
+	}
+	expected := map[string]int{
+		MapperName("vol-1"):                  1,
+		MapperName("vol-busy"):               2,
+		"deferred " + MapperName("vol-busy"): 1,
+		MapperName("vol-broken"):             1,
+	}
+	if !reflect.DeepEqual(closed, expected) {
+		t.Fatalf("close attempts = %v, expected %v", closed, expected)
+	}
+}
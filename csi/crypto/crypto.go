@@ -1,20 +1,50 @@
 package crypto
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	mapperFilePathPrefix = "/dev/mapper"
+	// longhornDevicePathPrefix is where the Longhorn block devices named after the volumes are
+	longhornDevicePathPrefix = "/dev/longhorn"
+	// dmMaxNameLength is the device mapper name limit, excluding the trailing NUL
+	dmMaxNameLength = 127
 
 	CryptoKeyDefaultCipher = "aes-xts-plain64"
 	CryptoKeyDefaultHash   = "sha256"
 	CryptoKeyDefaultSize   = "256"
 	CryptoDefaultPBKDF     = "argon2i"
+	CryptoLUKS1PBKDF       = "pbkdf2"
+
+	CryptoDefaultLUKSVersion = luksTypeLUKS2
+
+	luksTypeLUKS1 = "luks1"
+	luksTypeLUKS2 = "luks2"
+
+	// The default header sizes, including the keyslots area, and the minimal data size
+	luks1HeaderSize = 2 << 20
+	luks2HeaderSize = 16 << 20
+	luksMinDataSize = 4096
+
+	// luksSubsystemLonghorn marks the LUKS2 headers tagged with the Longhorn volume UUID
+	luksSubsystemLonghorn = "longhorn"
+
+	// The encryption sector sizes supported by dm-crypt
+	minKeySectorSize = 512
+	maxKeySectorSize = 4096
 )
 
 // EncryptParams keeps the customized cipher options from the secret CR
@@ -24,10 +54,84 @@ type EncryptParams struct {
 	KeyHash     string
 	KeySize     string
 	PBKDF       string
+
+	// LUKSVersion is the LUKS format version passed to luksFormat, either luks1 or luks2.
+	// LUKS2 is used if it's empty.
+	LUKSVersion string
+
+	// PBKDFParallel is the number of the parallel threads of the argon2 PBKDFs at format time.
+	// It's ignored by cryptsetup for pbkdf2, so it's rejected for the non-argon2 PBKDFs.
+	PBKDFParallel string
+
+	// PBKDFMemoryKB and PBKDFIterations are the memory cost in KiB and the iteration (time)
+	// cost of the argon2 PBKDFs at format time. cryptsetup benchmarks them if they are empty,
+	// which may ask for more memory than a small node has, so they are only accepted for argon2.
+	PBKDFMemoryKB   string
+	PBKDFIterations string
+
+	// Integrity is the dm-integrity algorithm protecting the sectors against silent corruption at
+	// format time, see allowedIntegrityAlgorithms. It requires LUKS2, and the open is refused if
+	// the device turns out to have no integrity protection, since the storage is not trusted.
+	Integrity string
+
+	// KeySectorSize is the encryption sector size in bytes passed as --sector-size at format time,
+	// a power of two between 512 and 4096. It requires LUKS2, and cryptsetup picks it if it's empty.
+	// The device size is checked to be a multiple of it at format and open time, see
+	// StrictSectorAlignment.
+	KeySectorSize string
+
+	// StrictSectorAlignment refuses the device whose size is not a multiple of KeySectorSize, rather
+	// than only warning about the unusable tail of the device.
+	StrictSectorAlignment bool
+
+	// HeaderFile is the path of the detached LUKS header on the host if set, so the data device
+	// holds no LUKS metadata at all. It's passed as --header to every cryptsetup invocation
+	// on the device or its mapping.
+	HeaderFile string
+
+	// WipeBeforeFormat zeroes the header region of the device before the format, and the whole
+	// device as well if WipeFullDevice is set, so the stale plaintext of a reused device is not
+	// recoverable. See WipeDevice.
+	WipeBeforeFormat bool
+	WipeFullDevice   bool
+
+	// PassphraseEncoding is the encoding of the passphrase, see the PassphraseEncoding constants.
+	// An encoded passphrase is decoded into the raw bytes before being fed to cryptsetup.
+	PassphraseEncoding string
+
+	// VolumeUUID is stored in the LUKS2 header label at format time if set,
+	// so the device can be correlated back to the Longhorn volume.
+	VolumeUUID string
+
+	// Confirmation has to be DestructiveOperationConfirmation to format a device
+	// holding data while the safe mode is on.
+	Confirmation string
+
+	// MappingUUID is set as the device mapper UUID of the mapping after open if set,
+	// so the Longhorn mappings are identifiable via `dmsetup info`.
+	MappingUUID string
+
+	// OpenCipher is passed as the cipher spec at open time if set. It's only a compatibility
+	// shim for the legacy volumes formatted with a nonstandard cipher spec, and has to be one
+	// of the allowedOpenCiphers.
+	OpenCipher string
+
+	// PerformanceProfile is the named set of the cryptsetup performance flags used on open,
+	// see the PerformanceProfile constants. The default profile is used if it's empty.
+	PerformanceProfile string
+
+	// VerifyPassphraseBeforeOpen verifies the passphrase via VerifyPassphrase before the open,
+	// which costs another key derivation but doesn't leave anything behind on a wrong passphrase.
+	VerifyPassphraseBeforeOpen bool
+
+	// IntegrityRecoveryMode opens an integrity protected volume read-only with the integrity
+	// tag checking disabled. It's a recovery-only path to salvage the data after a partial
+	// corruption, and must never be used for the regular attachment.
+	IntegrityRecoveryMode bool
 }
 
-func NewEncryptParams(keyProvider, keyCipher, keyHash, keySize, pbkdf string) *EncryptParams {
-	return &EncryptParams{KeyProvider: keyProvider, KeyCipher: keyCipher, KeyHash: keyHash, KeySize: keySize, PBKDF: pbkdf}
+func NewEncryptParams(keyProvider, keyCipher, keyHash, keySize, pbkdf, luksVersion string) *EncryptParams {
+	return &EncryptParams{KeyProvider: keyProvider, KeyCipher: keyCipher, KeyHash: keyHash, KeySize: keySize, PBKDF: pbkdf, LUKSVersion: luksVersion}
 }
 
 func (cp *EncryptParams) GetKeyCipher() string {
@@ -53,56 +157,859 @@ func (cp *EncryptParams) GetKeySize() string {
 
 func (cp *EncryptParams) GetPBKDF() string {
 	if cp.PBKDF == "" {
+		// LUKS1 only supports pbkdf2
+		if cp.GetLUKSVersion() == luksTypeLUKS1 {
+			return CryptoLUKS1PBKDF
+		}
 		return CryptoDefaultPBKDF
 	}
 	return cp.PBKDF
 }
 
-// VolumeMapper returns the path for mapped encrypted device.
+func (cp *EncryptParams) GetPBKDFMemoryKB() string {
+	return strings.TrimSpace(cp.PBKDFMemoryKB)
+}
+
+func (cp *EncryptParams) GetPBKDFIterations() string {
+	return strings.TrimSpace(cp.PBKDFIterations)
+}
+
+func (cp *EncryptParams) GetPBKDFParallel() string {
+	return strings.TrimSpace(cp.PBKDFParallel)
+}
+
+func (cp *EncryptParams) GetLUKSVersion() string {
+	if cp.LUKSVersion == "" {
+		return CryptoDefaultLUKSVersion
+	}
+	return cp.LUKSVersion
+}
+
+// ResolvedEncryptParams holds the effective values of the EncryptParams with the defaults
+// applied, so the hot paths don't have to resolve the defaults on every access.
+type ResolvedEncryptParams struct {
+	KeyCipher string
+	KeyHash   string
+	KeySize   string
+	PBKDF     string
+	LUKSType  string
+}
+
+// Resolved materializes the defaulted values of the params once.
+func (cp *EncryptParams) Resolved() ResolvedEncryptParams {
+	return ResolvedEncryptParams{
+		KeyCipher: cp.GetKeyCipher(),
+		KeyHash:   cp.GetKeyHash(),
+		KeySize:   cp.GetKeySize(),
+		PBKDF:     cp.GetPBKDF(),
+		LUKSType:  cp.GetLUKSVersion(),
+	}
+}
+
+// DiffEncryptParams describes the effective fields changed from the old params to the new
+// ones, e.g. "cipher: aes-cbc-essiv:sha256 -> aes-xts-plain64". Since the defaulted values
+// are compared, an empty field and the explicit default value are not reported as a change.
+func DiffEncryptParams(old, new *EncryptParams) []string {
+	if old == nil {
+		old = &EncryptParams{}
+	}
+	if new == nil {
+		new = &EncryptParams{}
+	}
+
+	fields := []struct {
+		name     string
+		oldValue string
+		newValue string
+	}{
+		{"key provider", old.KeyProvider, new.KeyProvider},
+		{"cipher", old.GetKeyCipher(), new.GetKeyCipher()},
+		{"hash", old.GetKeyHash(), new.GetKeyHash()},
+		{"key size", old.GetKeySize(), new.GetKeySize()},
+		{"LUKS version", old.GetLUKSVersion(), new.GetLUKSVersion()},
+		{"pbkdf", old.GetPBKDF(), new.GetPBKDF()},
+		{"pbkdf memory", old.GetPBKDFMemoryKB(), new.GetPBKDFMemoryKB()},
+		{"pbkdf iterations", old.GetPBKDFIterations(), new.GetPBKDFIterations()},
+		{"pbkdf parallel", old.GetPBKDFParallel(), new.GetPBKDFParallel()},
+		{"integrity", old.Integrity, new.Integrity},
+		{"key sector size", old.KeySectorSize, new.KeySectorSize},
+	}
+
+	changes := []string{}
+	for _, f := range fields {
+		if f.oldValue != f.newValue {
+			changes = append(changes, fmt.Sprintf("%v: %v -> %v", f.name, f.oldValue, f.newValue))
+		}
+	}
+	return changes
+}
+
+// sysBlockDir is where the block device holders are looked up.
+var sysBlockDir = "/sys/class/block"
+
+// The argon2 cost limits enforced by cryptsetup
+const (
+	argon2MinMemoryKB   = 32
+	argon2MaxMemoryKB   = 4 * 1024 * 1024
+	argon2MinIterations = 4
+	argon2MaxParallel   = 4
+)
+
+func (cp *EncryptParams) getHeaderFile() string {
+	if cp == nil {
+		return ""
+	}
+	return cp.HeaderFile
+}
+
+// getHeaderPath returns where the LUKS header of the device is read from, which is
+// the detached header file if it's set.
+func (cp *EncryptParams) getHeaderPath(devicePath string) string {
+	if cp.getHeaderFile() == "" {
+		return devicePath
+	}
+	return cp.getHeaderFile()
+}
+
+// getPBKDFMemoryEstimateKB returns the estimated memory cost in KiB of deriving the key with the
+// params. pbkdf2 costs no memory to speak of, while argon2 defaults to argon2DefaultMemoryKB.
+func (cp *EncryptParams) getPBKDFMemoryEstimateKB() int64 {
+	if cp == nil {
+		return argon2DefaultMemoryKB
+	}
+	if !isArgon2PBKDF(cp.GetPBKDF()) {
+		return 0
+	}
+	if memoryKB, err := strconv.ParseInt(cp.GetPBKDFMemoryKB(), 10, 64); err == nil && memoryKB > 0 {
+		return memoryKB
+	}
+	return argon2DefaultMemoryKB
+}
+
+// getHeaderOptions returns the cryptsetup flags of the detached header file if it's set.
+func getHeaderOptions(headerFile string) []string {
+	if headerFile == "" {
+		return nil
+	}
+	return []string{"--header", headerFile}
+}
+
+// allowedIntegrityAlgorithms are the authenticated integrity algorithms of dm-integrity accepted
+// by luksFormat. aead is for the AEAD ciphers carrying their own authentication tag.
+var allowedIntegrityAlgorithms = map[string]bool{
+	"hmac-sha256": true,
+	"hmac-sha512": true,
+	"poly1305":    true,
+	"aead":        true,
+}
+
+func isArgon2PBKDF(pbkdf string) bool {
+	return strings.HasPrefix(pbkdf, "argon2")
+}
+
+func (cp *EncryptParams) validate() error {
+	switch cp.GetLUKSVersion() {
+	case luksTypeLUKS1:
+		if isArgon2PBKDF(cp.GetPBKDF()) {
+			return fmt.Errorf("pbkdf %v is not supported by %v", cp.GetPBKDF(), luksTypeLUKS1)
+		}
+	case luksTypeLUKS2:
+	default:
+		return fmt.Errorf("invalid LUKS version %v, it should be %v or %v", cp.LUKSVersion, luksTypeLUKS1, luksTypeLUKS2)
+	}
+
+	for _, cost := range []struct {
+		name  string
+		value string
+		min   int
+		max   int
+	}{
+		{"pbkdf memory", cp.GetPBKDFMemoryKB(), argon2MinMemoryKB, argon2MaxMemoryKB},
+		{"pbkdf iterations", cp.GetPBKDFIterations(), argon2MinIterations, math.MaxInt32},
+		{"pbkdf parallel", cp.GetPBKDFParallel(), 1, argon2MaxParallel},
+	} {
+		if cost.value == "" {
+			continue
+		}
+		value, err := strconv.Atoi(cost.value)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid %v %v, it should be a positive integer", cost.name, cost.value)
+		}
+		if value < cost.min || value > cost.max {
+			return fmt.Errorf("invalid %v %v, it should be between %v and %v", cost.name, cost.value, cost.min, cost.max)
+		}
+		if !isArgon2PBKDF(cp.GetPBKDF()) {
+			return fmt.Errorf("%v is only supported by the argon2 PBKDFs, not %v", cost.name, cp.GetPBKDF())
+		}
+	}
+
+	if _, err := getPerformanceProfileFlags(cp.PerformanceProfile); err != nil {
+		return err
+	}
+
+	if cp.Integrity != "" {
+		if !allowedIntegrityAlgorithms[cp.Integrity] {
+			return fmt.Errorf("invalid integrity algorithm %v", cp.Integrity)
+		}
+		if cp.GetLUKSVersion() != luksTypeLUKS2 {
+			return fmt.Errorf("integrity %v requires %v", cp.Integrity, luksTypeLUKS2)
+		}
+	}
+
+	if err := validatePassphraseEncoding(cp.PassphraseEncoding); err != nil {
+		return err
+	}
+
+	if cp.KeySectorSize != "" {
+		if _, err := parseKeySectorSize(cp.KeySectorSize); err != nil {
+			return err
+		}
+		if cp.GetLUKSVersion() != luksTypeLUKS2 {
+			return fmt.Errorf("key sector size %v requires %v", cp.KeySectorSize, luksTypeLUKS2)
+		}
+	}
+
+	if cp.WipeFullDevice && !cp.WipeBeforeFormat {
+		return fmt.Errorf("wiping the full device requires wiping before format")
+	}
+
+	if cp.HeaderFile != "" && !path.IsAbs(cp.HeaderFile) {
+		return fmt.Errorf("invalid header file %v, it should be an absolute path", cp.HeaderFile)
+	}
+
+	if cp.VolumeUUID != "" {
+		if cp.GetLUKSVersion() != luksTypeLUKS2 {
+			return fmt.Errorf("tagging the LUKS header with the volume UUID requires %v", luksTypeLUKS2)
+		}
+		if _, err := uuid.Parse(cp.VolumeUUID); err != nil {
+			return fmt.Errorf("invalid volume UUID %v: %w", cp.VolumeUUID, err)
+		}
+	}
+	return nil
+}
+
+var (
+	mapperSaltLock sync.RWMutex
+	mapperSalt     string
+)
+
+// SetMapperSalt sets the cluster-scoped salt prefixed to the mapper names as `<salt>-<volume>`.
+// It prevents the mapper name collisions when multiple clusters share a node. An empty salt
+// restores the plain volume names.
+func SetMapperSalt(salt string) error {
+	if strings.ContainsAny(salt, "/ ") || salt == "." || salt == ".." {
+		return fmt.Errorf("invalid mapper salt %q", salt)
+	}
+	mapperSaltLock.Lock()
+	defer mapperSaltLock.Unlock()
+	mapperSalt = salt
+	return nil
+}
+
+// MapperName returns the device mapper name of the encrypted volume.
+func MapperName(volume string) string {
+	mapperSaltLock.RLock()
+	defer mapperSaltLock.RUnlock()
+	if mapperSalt == "" {
+		return volume
+	}
+	return mapperSalt + "-" + volume
+}
+
+// validateMapperName makes sure the mapper name of the volume, including the salt, fits the device
+// mapper name limit. Otherwise cryptsetup fails with a cryptic error at open time.
+func validateMapperName(volume string) error {
+	if err := validateVolumeName(volume); err != nil {
+		return err
+	}
+	mapper := MapperName(volume)
+	if len(mapper) > dmMaxNameLength {
+		return fmt.Errorf("mapper name %v of volume %v is %v characters long, exceeding the device mapper limit of %v characters",
+			mapper, volume, len(mapper), dmMaxNameLength)
+	}
+	return nil
+}
+
+// validateVolumeName refuses the volume names which would not stay a single entry of the mapper
+// directory once joined to it, e.g. "../sda" escaping it or "." resolving to the directory itself.
+func validateVolumeName(volume string) error {
+	switch {
+	case volume == "":
+		return fmt.Errorf("empty volume name")
+	case strings.ContainsRune(volume, '/'):
+		return fmt.Errorf("invalid volume name %q containing a path separator", volume)
+	case volume == "." || volume == "..":
+		return fmt.Errorf("invalid volume name %q", volume)
+	}
+	return nil
+}
+
+// VolumeMapperSafe returns the path for mapped encrypted device, or an error if the volume name
+// is not valid for a mapper.
+func VolumeMapperSafe(volume string) (string, error) {
+	if err := validateVolumeName(volume); err != nil {
+		return "", err
+	}
+	return path.Join(mapperFilePathPrefix, MapperName(volume)), nil
+}
+
+// VolumeMapper returns the path for mapped encrypted device. An invalid volume name is only warned
+// about and joined as is for compatibility, use VolumeMapperSafe to refuse it.
 func VolumeMapper(volume string) string {
-	return path.Join(mapperFilePathPrefix, volume)
+	mapperPath, err := VolumeMapperSafe(volume)
+	if err != nil {
+		logrus.WithError(err).Warnf("Invalid volume name for the mapper of volume %q", volume)
+		return path.Join(mapperFilePathPrefix, MapperName(volume))
+	}
+	return mapperPath
 }
 
 // EncryptVolume encrypts provided device with LUKS.
 func EncryptVolume(devicePath, passphrase string, cryptoParams *EncryptParams) error {
+	return EncryptVolumeContext(context.Background(), devicePath, passphrase, cryptoParams)
+}
+
+// EncryptVolumeContext is EncryptVolume killing cryptsetup once the context is cancelled,
+// in which case the returned error wraps the error of the context.
+func EncryptVolumeContext(ctx context.Context, devicePath, passphrase string, cryptoParams *EncryptParams) error {
+	if err := prepareEncryptVolume(ctx, devicePath, cryptoParams); err != nil {
+		return err
+	}
+	passphrase, err := DecodePassphrase(passphrase, cryptoParams.PassphraseEncoding)
+	if err != nil {
+		return err
+	}
+
 	logrus.Debugf("Encrypting device %s with LUKS", devicePath)
-	if _, err := luksFormat(devicePath, passphrase, cryptoParams); err != nil {
+	if _, err := luksFormat(ctx, devicePath, passphrase, cryptoParams); err != nil {
 		return fmt.Errorf("failed to encrypt device %s with LUKS: %w", devicePath, err)
 	}
 	return nil
 }
 
-// OpenVolume opens volume so that it can be used by the client.
-func OpenVolume(volume, devicePath, passphrase string) error {
-	if isOpen, _ := IsDeviceOpen(VolumeMapper(volume)); isOpen {
-		logrus.Debugf("device %s is already opened at %s", devicePath, VolumeMapper(volume))
+// prepareEncryptVolume validates the params and the device before the format, and wipes the
+// device if the params ask for it.
+func prepareEncryptVolume(ctx context.Context, devicePath string, cryptoParams *EncryptParams) error {
+	if err := cryptoParams.validate(); err != nil {
+		return err
+	}
+	if err := checkCryptSetupVersion(ctx, cryptoParams); err != nil {
+		return err
+	}
+	// Don't format a Longhorn device whose mapping can never be opened
+	if path.Dir(devicePath) == longhornDevicePathPrefix {
+		if err := validateMapperName(path.Base(devicePath)); err != nil {
+			return err
+		}
+	}
+
+	if err := checkDeviceSizeForLUKSHeader(devicePath, cryptoParams.GetLUKSVersion(), cryptoParams.HeaderFile != ""); err != nil {
+		return err
+	}
+	if err := checkSectorAlignment(devicePath, cryptoParams); err != nil {
+		return err
+	}
+
+	hasData, err := hasExistingData(devicePath)
+	if err != nil {
+		return err
+	}
+	if hasData {
+		if err := checkDestructiveOperation("encrypt existing data", devicePath, cryptoParams.Confirmation); err != nil {
+			return err
+		}
+	}
+
+	if cryptoParams.WipeBeforeFormat {
+		if err := wipeDevice(ctx, devicePath, cryptoParams.WipeFullDevice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDeviceSizeForLUKSHeader rejects the devices too small to hold the LUKS header plus
+// minimal data, which would otherwise fail the format confusingly. The header takes no space
+// on the device if it's detached.
+func checkDeviceSizeForLUKSHeader(devicePath, luksType string, detachedHeader bool) error {
+	headerSize := int64(luks2HeaderSize)
+	if luksType == luksTypeLUKS1 {
+		headerSize = luks1HeaderSize
+	}
+	if detachedHeader {
+		headerSize = 0
+	}
+
+	size, err := getDeviceSize(devicePath)
+	if err != nil {
+		return err
+	}
+	if size < headerSize+luksMinDataSize {
+		return fmt.Errorf("device %s too small for LUKS header: %v bytes, at least %v bytes required for %v",
+			devicePath, size, headerSize+luksMinDataSize, luksType)
+	}
+	return nil
+}
+
+// checkSectorAlignment checks the device size is a multiple of the key sector size of the params,
+// otherwise the tail of the device is not usable by the mapping. The misalignment is only warned
+// about unless the params ask for the strict alignment. Nothing is checked without the key sector
+// size.
+func checkSectorAlignment(devicePath string, cryptoParams *EncryptParams) error {
+	if cryptoParams == nil || cryptoParams.KeySectorSize == "" {
 		return nil
 	}
+	sectorSize, err := parseKeySectorSize(cryptoParams.KeySectorSize)
+	if err != nil {
+		return err
+	}
+
+	size, err := getDeviceSize(devicePath)
+	if err != nil {
+		return err
+	}
+	if tail := size % sectorSize; tail != 0 {
+		err := fmt.Errorf("size %v of device %s is not a multiple of the key sector size %v, the last %v bytes are unusable",
+			size, devicePath, sectorSize, tail)
+		if cryptoParams.StrictSectorAlignment {
+			return err
+		}
+		logrus.Warn(err)
+	}
+	return nil
+}
+
+func parseKeySectorSize(value string) (int64, error) {
+	sectorSize, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sectorSize < minKeySectorSize || sectorSize > maxKeySectorSize || sectorSize&(sectorSize-1) != 0 {
+		return 0, fmt.Errorf("invalid key sector size %v, it should be a power of two between %v and %v", value, minKeySectorSize, maxKeySectorSize)
+	}
+	return sectorSize, nil
+}
+
+// OpenVolume opens volume so that it can be used by the client. The key size is passed
+// to cryptsetup only if the params specify it, which is needed by non-standard setups.
+// An existing mapping of the volume is reused unless it's broken, see IsMappingHealthy,
+// in which case it's closed and the volume is opened again.
+func OpenVolume(volume, devicePath, passphrase string, cryptoParams *EncryptParams) error {
+	return OpenVolumeContext(context.Background(), volume, devicePath, passphrase, cryptoParams)
+}
+
+// OpenVolumeContext is OpenVolume killing cryptsetup once the context is cancelled, in which
+// case the returned error wraps the error of the context.
+func OpenVolumeContext(ctx context.Context, volume, devicePath, passphrase string, cryptoParams *EncryptParams) error {
+	if err := validateMapperName(volume); err != nil {
+		return err
+	}
+	if _, mapper, _ := DeviceEncryptionStatusWithHeader(VolumeMapper(volume), cryptoParams.getHeaderFile()); mapper != "" {
+		if isOpen, err := checkExistingMapping(ctx, volume); err != nil {
+			return err
+		} else if isOpen {
+			logrus.Debugf("device %s is already opened at %s", devicePath, VolumeMapper(volume))
+			return nil
+		}
+	}
+
+	if err := checkSectorAlignment(devicePath, cryptoParams); err != nil {
+		return err
+	}
+	options, err := getOpenOptions(devicePath, cryptoParams)
+	if err != nil {
+		return err
+	}
+	if cryptoParams != nil {
+		if passphrase, err = DecodePassphrase(passphrase, cryptoParams.PassphraseEncoding); err != nil {
+			return err
+		}
+	}
+	mappingUUID := ""
+	if cryptoParams != nil && cryptoParams.MappingUUID != "" {
+		if err := validateMappingUUID(cryptoParams.MappingUUID); err != nil {
+			return err
+		}
+		mappingUUID = cryptoParams.MappingUUID
+	}
+
+	if cryptoParams != nil && cryptoParams.VerifyPassphraseBeforeOpen {
+		valid, err := VerifyPassphrase(cryptoParams.getHeaderPath(devicePath), passphrase)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return fmt.Errorf("failed to open LUKS device %s: %w", devicePath, ErrInvalidPassphrase)
+		}
+	}
 
 	logrus.Debugf("Opening device %s with LUKS on %s", devicePath, volume)
-	_, err := luksOpen(volume, devicePath, passphrase)
+	_, err = luksOpen(ctx, MapperName(volume), devicePath, passphrase, cryptoParams.getPBKDFMemoryEstimateKB(), options...)
 	if err != nil {
 		logrus.Warnf("failed to open LUKS device %s: %s", devicePath, err)
+		return fmt.Errorf("failed to open LUKS device %s: %w", devicePath, err)
+	}
+
+	if mappingUUID != "" {
+		// The mapping is usable without the UUID, which is only for the traceability
+		if err := SetMappingUUID(volume, mappingUUID); err != nil {
+			logrus.Warnf("failed to set mapping UUID of LUKS device %s: %s", devicePath, err)
+		}
+	}
+	return EnsureMapperNode(volume)
+}
+
+// SetMappingUUID sets the device mapper UUID of the mapping of the volume, which cryptsetup
+// doesn't allow to customize. Device mapper only allows setting the UUID of a mapping once.
+func SetMappingUUID(volume, mappingUUID string) error {
+	if err := validateMappingUUID(mappingUUID); err != nil {
+		return err
+	}
+	if _, err := hostCommandRunner(context.Background(), "dmsetup", "rename", MapperName(volume), "--setuuid", mappingUUID); err != nil {
+		return fmt.Errorf("failed to set UUID %s of mapping %s: %w", mappingUUID, MapperName(volume), err)
+	}
+	return nil
+}
+
+func validateMappingUUID(mappingUUID string) error {
+	if _, err := uuid.Parse(mappingUUID); err != nil {
+		return fmt.Errorf("invalid mapping UUID %v: %w", mappingUUID, err)
+	}
+	return nil
+}
+
+// allowedOpenCiphers are the cipher specs accepted as the open time override for the legacy volumes.
+var allowedOpenCiphers = map[string]bool{
+	"aes-xts-plain64":      true,
+	"aes-xts-plain":        true,
+	"aes-cbc-essiv:sha256": true,
+	"aes-cbc-plain64":      true,
+	"aes-cbc-plain":        true,
+	"serpent-xts-plain64":  true,
+	"twofish-xts-plain64":  true,
+}
+
+// getOpenOptions returns the extra cryptsetup flags for the open, which are the detached header,
+// the key size override, the legacy cipher override, the integrity recovery flags and the flags
+// of the performance profile.
+func getOpenOptions(devicePath string, cryptoParams *EncryptParams) ([]string, error) {
+	options := getHeaderOptions(cryptoParams.getHeaderFile())
+	headerPath := cryptoParams.getHeaderPath(devicePath)
+	if err := checkOpenIntegrity(headerPath, cryptoParams); err != nil {
+		return nil, err
+	}
+	keySize := getOpenKeySize(cryptoParams)
+	if err := checkOpenKeySize(headerPath, keySize); err != nil {
+		return nil, err
+	}
+	if keySize != "" {
+		options = append(options, "--key-size", keySize)
+	}
+
+	if cryptoParams != nil && cryptoParams.OpenCipher != "" {
+		if !allowedOpenCiphers[cryptoParams.OpenCipher] {
+			return nil, fmt.Errorf("cipher %v is not allowed to be passed at open time", cryptoParams.OpenCipher)
+		}
+		logrus.Infof("Opening device %s with the legacy cipher override %v", devicePath, cryptoParams.OpenCipher)
+		options = append(options, "--cipher", cryptoParams.OpenCipher)
+	}
+
+	if cryptoParams != nil && cryptoParams.IntegrityRecoveryMode {
+		recoveryOptions, err := getIntegrityRecoveryOptions(headerPath)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, recoveryOptions...)
+	}
+
+	profile := ""
+	if cryptoParams != nil {
+		profile = cryptoParams.PerformanceProfile
+	}
+	flags, err := getPerformanceProfileFlags(profile)
+	if err != nil {
+		return nil, err
+	}
+	return append(options, flags...), nil
+}
+
+// checkOpenIntegrity refuses to open the device without the integrity protection the params ask for,
+// which would silently downgrade the protection of a device replaced on the untrusted storage.
+// No extra flag is needed to open an integrity protected device since LUKS2 records it in the header.
+func checkOpenIntegrity(devicePath string, cryptoParams *EncryptParams) error {
+	if cryptoParams == nil || cryptoParams.Integrity == "" {
+		return nil
+	}
+	isIntegrity, err := isIntegrityDevice(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to check integrity protection of device %s: %w", devicePath, err)
+	}
+	if !isIntegrity {
+		return fmt.Errorf("device %s has no integrity protection while integrity %v is required", devicePath, cryptoParams.Integrity)
+	}
+	return nil
+}
+
+// getIntegrityRecoveryOptions returns the flags opening the integrity protected device for the
+// data recovery. The mapping is read-only so the unverified data cannot be written back.
+func getIntegrityRecoveryOptions(devicePath string) ([]string, error) {
+	isIntegrity, err := isIntegrityDevice(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check integrity protection of device %s for recovery mode: %w", devicePath, err)
+	}
+	if !isIntegrity {
+		return nil, fmt.Errorf("integrity recovery mode only applies to integrity protected devices, device %s is not", devicePath)
+	}
+	logrus.Warnf("Opening device %s read-only in integrity recovery mode, the integrity of the data is NOT verified", devicePath)
+	return []string{"--integrity-recovery-mode", "--readonly"}, nil
+}
+
+// getOpenKeySize returns the key size explicitly specified in the params for the open. The
+// default key size isn't applied since LUKS reads the key size from the header.
+func getOpenKeySize(cryptoParams *EncryptParams) string {
+	if cryptoParams == nil {
+		return ""
+	}
+	return cryptoParams.KeySize
+}
+
+// checkOpenKeySize makes sure the key size override is consistent with the LUKS header.
+// The check is skipped if the header cannot be read, e.g. for a plain mode device.
+func checkOpenKeySize(devicePath, keySize string) error {
+	if keySize == "" {
+		return nil
+	}
+	info, err := GetLUKSDeviceInfo(devicePath)
+	if err != nil {
+		logrus.Debugf("Skipped checking key size %s against the header of device %s: %v", keySize, devicePath, err)
+		return nil
+	}
+	if info.KeySize != "" && info.KeySize != keySize {
+		return fmt.Errorf("key size %s is inconsistent with key size %s in the LUKS header of device %s", keySize, info.KeySize, devicePath)
+	}
+	return nil
+}
+
+// OpenVolumeWithMasterKey opens volume using a dumped LUKS master key instead of
+// a passphrase keyslot. This is meant for recovery when all the passphrases are
+// lost but the master key is still known.
+func OpenVolumeWithMasterKey(volume, devicePath, masterKeyFile string) error {
+	if err := validateMapperName(volume); err != nil {
+		return err
+	}
+	if isOpen, _ := IsDeviceOpen(VolumeMapper(volume)); isOpen {
+		if isOpen, err := checkExistingMapping(context.Background(), volume); err != nil {
+			return err
+		} else if isOpen {
+			logrus.Debugf("device %s is already opened at %s", devicePath, VolumeMapper(volume))
+			return nil
+		}
+	}
+
+	if err := validateMasterKeyFile(masterKeyFile); err != nil {
+		return err
+	}
+	if _, err := luksIsLuks(context.Background(), devicePath); err != nil {
+		return fmt.Errorf("device %s is not a valid LUKS device: %w", devicePath, err)
+	}
+
+	logrus.Debugf("Opening device %s with LUKS master key on %s", devicePath, volume)
+	if _, err := luksOpenWithMasterKey(context.Background(), MapperName(volume), devicePath, masterKeyFile); err != nil {
+		logrus.Warnf("failed to open LUKS device %s with master key: %s", devicePath, err)
+		return err
 	}
-	return err
+	return EnsureMapperNode(volume)
 }
 
-// CloseVolume closes encrypted volume so it can be detached.
+// validateMasterKeyFile makes sure the master key file on the host is a regular file holding a
+// key of a size supported by LUKS. Like validateKeyFile, it's checked on the host since that's
+// where cryptsetup reads it, and the key is compared against zeros there without reading it.
+func validateMasterKeyFile(masterKeyFile string) error {
+	if !filepath.IsAbs(masterKeyFile) {
+		return fmt.Errorf("master key file %v should be an absolute path", masterKeyFile)
+	}
+	stdout, err := hostCommandRunner(context.Background(), "stat", "-L", "-c", "%s %F", masterKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat master key file %s: %w", masterKeyFile, err)
+	}
+	fields := strings.SplitN(strings.TrimSpace(stdout), " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("failed to parse stat of master key file %s: %q", masterKeyFile, stdout)
+	}
+	if fields[1] != "regular file" {
+		return fmt.Errorf("master key file %s should be a non-empty regular file, it's a %s", masterKeyFile, fields[1])
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse size of master key file %s: %w", masterKeyFile, err)
+	}
+
+	switch size * 8 {
+	case 128, 256, 384, 512:
+	default:
+		return fmt.Errorf("master key file %s has invalid key size %d bits", masterKeyFile, size*8)
+	}
+
+	// cmp exits with 1 if the key differs from the zeros
+	_, err = hostCommandRunner(context.Background(), "cmp", "-s", "-n", fields[0], masterKeyFile, "/dev/zero")
+	if err == nil {
+		return fmt.Errorf("master key file %s contains an all-zero key", masterKeyFile)
+	}
+	if exitCode, ok := ExitCode(err); !ok || exitCode != 1 {
+		return fmt.Errorf("failed to check master key file %s: %w", masterKeyFile, err)
+	}
+	return nil
+}
+
+func zeroBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// RepairLUKSHeader tries to recover a damaged LUKS header of the device and
+// returns whether a repair was actually performed.
+//
+// WARNING: this is potentially destructive. cryptsetup rewrites the header
+// in place, so a wrong guess may make the data permanently inaccessible.
+// Back up the header before calling it. It refuses to run on an open device,
+// and requires the confirmation token while the safe mode is on.
+func RepairLUKSHeader(devicePath, confirmation string) (repaired bool, err error) {
+	if err := checkDestructiveOperation("repair LUKS header", devicePath, confirmation); err != nil {
+		return false, err
+	}
+
+	isHeld, err := isDeviceHeld(devicePath)
+	if err != nil {
+		return false, err
+	}
+	if isHeld {
+		return false, fmt.Errorf("cannot repair LUKS header of device %s since it is open", devicePath)
+	}
+
+	logrus.Warnf("Repairing LUKS header of device %s", devicePath)
+	stdout, err := luksRepair(context.Background(), devicePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to repair LUKS header of device %s: %w", devicePath, err)
+	}
+	return strings.Contains(stdout, "Repairing"), nil
+}
+
+// isDeviceHeld checks if the block device is held by another device, e.g. an
+// active dm-crypt mapping opened on top of it.
+func isDeviceHeld(devicePath string) (bool, error) {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve device %s: %w", devicePath, err)
+	}
+	holders, err := os.ReadDir(filepath.Join(sysBlockDir, filepath.Base(realPath), "holders"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to list holders of device %s: %w", devicePath, err)
+	}
+	return len(holders) > 0, nil
+}
+
+// GetLonghornVolumeFromHeader returns the Longhorn volume UUID stored in the LUKS2
+// header of the device at format time.
+func GetLonghornVolumeFromHeader(devicePath string) (string, error) {
+	dump, err := luksDump(context.Background(), devicePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to dump LUKS header of device %s: %w", devicePath, err)
+	}
+
+	kvs := parseCryptSetupKeyValues(dump)
+	if kvs["Version"] != "2" {
+		return "", fmt.Errorf("device %s is not a LUKS2 device, the volume UUID can only be stored in LUKS2 headers", devicePath)
+	}
+	if kvs["Subsystem"] != luksSubsystemLonghorn {
+		return "", fmt.Errorf("LUKS header of device %s is not tagged with a Longhorn volume UUID", devicePath)
+	}
+	return kvs["Label"], nil
+}
+
+// HasDetachedLUKSHeader checks if the detached LUKS header file has been formatted. The data
+// device of a volume with the detached header looks blank, so the header file is checked
+// instead to not format the volume again.
+func HasDetachedLUKSHeader(headerFile string) (bool, error) {
+	if _, err := luksIsLuks(context.Background(), headerFile); err != nil {
+		if code, ok := ExitCode(err); ok && (code == cryptSetupExitCodeNotLUKS || code == cryptSetupExitCodeNoDevice) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check detached LUKS header %s: %w", headerFile, err)
+	}
+	return true, nil
+}
+
+// CloseVolume closes encrypted volume so it can be detached. It's a no-op if the volume is not
+// open. A busy device is flushed and the close is retried with backoff, see SetCloseRetryPolicy.
 func CloseVolume(volume string) error {
-	logrus.Debugf("Closing LUKS device %s", volume)
-	_, err := luksClose(volume)
-	return err
+	return CloseVolumeContext(context.Background(), volume)
 }
 
-func ResizeEncryptoDevice(volume, passphrase string) error {
+// CloseVolumeContext is CloseVolume killing cryptsetup and giving up the retries once the
+// context is cancelled, in which case the error of the context is returned.
+func CloseVolumeContext(ctx context.Context, volume string) error {
 	if isOpen, err := IsDeviceOpen(VolumeMapper(volume)); err != nil {
 		return err
 	} else if !isOpen {
-		return fmt.Errorf("volume %v encrypto device is closed for resizing", volume)
+		logrus.Debugf("LUKS device %s is already closed", volume)
+		return nil
 	}
 
-	_, err := luksResize(volume, passphrase)
-	return err
+	logrus.Debugf("Closing LUKS device %s", volume)
+	return closeWithRetry(ctx, MapperName(volume))
+}
+
+// ResizeEncryptoDevice resizes the mapping of the volume to the size of the backing device.
+// The headerFile is the detached LUKS header of the volume if it has one. The resize fails if
+// the mapping size doesn't change while it doesn't cover the backing device yet, e.g. since the
+// backing device hasn't actually grown, or if the mapping is still smaller than the expectedSize
+// in bytes unless it's 0. A mapping already covering the backing device, e.g. on a retry, is fine.
+func ResizeEncryptoDevice(volume, passphrase, headerFile string, expectedSize int64) error {
+	return ResizeEncryptoDeviceContext(context.Background(), volume, passphrase, headerFile, expectedSize)
+}
+
+// ResizeEncryptoDeviceContext is ResizeEncryptoDevice killing cryptsetup once the context is
+// cancelled, in which case the error of the context is returned.
+func ResizeEncryptoDeviceContext(ctx context.Context, volume, passphrase, headerFile string, expectedSize int64) error {
+	if _, mapper, err := DeviceEncryptionStatusWithHeader(VolumeMapper(volume), headerFile); err != nil {
+		return err
+	} else if mapper == "" {
+		return fmt.Errorf("volume %v encrypto device %v is not active for resizing", volume, VolumeMapper(volume))
+	}
+
+	before, err := getMappingSize(ctx, volume, headerFile)
+	if err != nil {
+		return err
+	}
+	if _, err := luksResize(ctx, MapperName(volume), passphrase, getHeaderOptions(headerFile)...); err != nil {
+		return err
+	}
+	after, err := getMappingSize(ctx, volume, headerFile)
+	if err != nil {
+		return fmt.Errorf("failed to verify resize of volume %v encrypto device: %w", volume, err)
+	}
+
+	if after.mappedSize == before.mappedSize {
+		usableSize, ok := after.usableSize()
+		if !ok {
+			return fmt.Errorf("volume %v encrypto device with integrity %v did not change from size %v on resize, the backing device of size %v hasn't grown",
+				volume, after.integrity, after.mappedSize, after.backingSize)
+		}
+		if after.mappedSize != usableSize {
+			return fmt.Errorf("volume %v encrypto device did not change from size %v on resize, the backing device of size %v has the usable size %v after the data offset %v",
+				volume, after.mappedSize, after.backingSize, usableSize, after.offset)
+		}
+	}
+	if expectedSize > 0 && after.mappedSize < expectedSize {
+		return fmt.Errorf("volume %v encrypto device of size %v is smaller than the expected size %v after resize", volume, after.mappedSize, expectedSize)
+	}
+	if after.mappedSize == before.mappedSize {
+		logrus.Infof("Volume %v encrypto device of size %v already covers the backing device of size %v", volume, after.mappedSize, after.backingSize)
+		return nil
+	}
+	logrus.Infof("Resized volume %v encrypto device from %v to %v", volume, before.mappedSize, after.mappedSize)
+	return nil
 }
 
 // IsDeviceOpen determines if encrypted device is already open.
@@ -111,16 +1018,66 @@ func IsDeviceOpen(device string) (bool, error) {
 	return mappedFile != "", err
 }
 
+// NormalizeDevicePath cleans the device path, makes it absolute and resolves its symlinks, so
+// the paths of a mapping given by the callers in different forms can be recognized. The mapping
+// nodes under /dev/mapper are kept as they are, and a path resolved to a dm device is turned into
+// the node of its mapping under /dev/mapper. A missing device is only cleaned and made absolute.
+func NormalizeDevicePath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("empty device path")
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path of device %s: %w", path, err)
+	}
+	if filepath.Dir(absPath) == mapperFilePathPrefix {
+		return absPath, nil
+	}
+
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return absPath, nil
+		}
+		return "", fmt.Errorf("failed to resolve device %s: %w", path, err)
+	}
+	if !strings.HasPrefix(filepath.Base(realPath), "dm-") {
+		return realPath, nil
+	}
+	name, err := os.ReadFile(filepath.Join(sysBlockDir, filepath.Base(realPath), "dm", "name"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return realPath, nil
+		}
+		return "", fmt.Errorf("failed to get mapping name of device %s: %w", path, err)
+	}
+	return filepath.Join(mapperFilePathPrefix, strings.TrimSpace(string(name))), nil
+}
+
 // DeviceEncryptionStatus looks to identify if the passed device is a LUKS mapping
 // and if so what the device is and the mapper name as used by LUKS.
-// If not, just returns the original device and an empty string.
+// If not, just returns the original device and an empty string. The device path is
+// normalized by NormalizeDevicePath first, e.g. a symlink to the mapping is recognized.
 func DeviceEncryptionStatus(devicePath string) (mappedDevice, mapper string, err error) {
-	if !strings.HasPrefix(devicePath, mapperFilePathPrefix) {
+	return DeviceEncryptionStatusWithHeader(devicePath, "")
+}
+
+// DeviceEncryptionStatusWithHeader is DeviceEncryptionStatus of a mapping opened with the
+// detached LUKS header file, which is ignored if it's empty.
+func DeviceEncryptionStatusWithHeader(devicePath, headerFile string) (mappedDevice, mapper string, err error) {
+	normalizedPath, err := NormalizeDevicePath(devicePath)
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.HasPrefix(normalizedPath, mapperFilePathPrefix+"/") {
 		return devicePath, "", nil
 	}
-	volume := strings.TrimPrefix(devicePath, mapperFilePathPrefix+"/")
-	stdout, err := luksStatus(volume)
-	if err != nil {
+	mapper = strings.TrimPrefix(normalizedPath, mapperFilePathPrefix+"/")
+	stdout, err := luksStatus(context.Background(), mapper, getHeaderOptions(headerFile)...)
+	if err = wrapCryptSetupError(err, false); errors.Is(err, ErrDeviceBusy) {
+		// The mapping exists but cannot be inspected right now, it's not safe to take it as closed
+		return "", "", fmt.Errorf("failed to get status of device %s: %w", devicePath, err)
+	} else if err != nil {
 		logrus.Debugf("device %s is not an active LUKS device: %v", devicePath, err)
 		return devicePath, "", nil
 	}
@@ -139,7 +1096,7 @@ func DeviceEncryptionStatus(devicePath string) (mappedDevice, mapper string, err
 				devicePath, lines[i])
 		}
 		if strings.Compare(kv[0], "device") == 0 {
-			return strings.TrimSpace(kv[1]), volume, nil
+			return strings.TrimSpace(kv[1]), mapper, nil
 		}
 	}
 	// Identified as LUKS, but failed to identify a mapped device
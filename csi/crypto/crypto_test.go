@@ -0,0 +1,1228 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCryptSetup records every cryptsetup invocation and answers it with the
+// optional handler. Without a handler, every invocation succeeds with no output.
+// The version query is answered with version without being recorded, unless version is
+// cleared for the handler to answer it.
+// The other host commands see a blank device unless faked by newFakeHostCommand.
+type fakeCryptSetup struct {
+	lock      sync.Mutex
+	calls     [][]string
+	stdins    []string
+	stdinBufs [][]byte
+	handler   func(args []string) (string, error)
+	version   string
+}
+
+func newFakeCryptSetup(t *testing.T, handler func(args []string) (string, error)) *fakeCryptSetup {
+	f := &fakeCryptSetup{handler: handler, version: "cryptsetup 2.6.1 flags: UDEV BLKID KEYRING\n"}
+	oldRunner := cryptSetupRunner
+	cryptSetupRunner = f.run
+	t.Cleanup(func() {
+		cryptSetupRunner = oldRunner
+	})
+	newFakeHostCommand(t, blankDeviceHandler)
+	return f
+}
+
+// blankDeviceHandler fakes the host commands probing a blank 1GiB device, and a healthy mapping on it.
+func blankDeviceHandler(command string, args []string) (string, error) {
+	switch {
+	case command == "blockdev":
+		return "1073741824\n", nil
+	case command == "dmsetup" && args[0] == "status":
+		return "0 2097152 crypt\n", nil
+	case command == "dmsetup" && args[0] == "deps":
+		return " 1 dependencies\t: (sdb)\n", nil
+	}
+	return "", nil
+}
+
+func (f *fakeCryptSetup) run(ctx context.Context, stdin []byte, args ...string) (string, error) {
+	if len(args) > 0 && args[0] == "--version" && f.version != "" {
+		return f.version, nil
+	}
+	f.lock.Lock()
+	f.calls = append(f.calls, args)
+	f.stdins = append(f.stdins, string(stdin))
+	f.stdinBufs = append(f.stdinBufs, stdin)
+	f.lock.Unlock()
+	if f.handler == nil {
+		return "", nil
+	}
+	return f.handler(args)
+}
+
+// lastCall returns the last invocation whose arguments contain the given action.
+func (f *fakeCryptSetup) lastCall(action string) []string {
+	for i := len(f.calls) - 1; i >= 0; i-- {
+		for _, arg := range f.calls[i] {
+			if arg == action {
+				return f.calls[i]
+			}
+		}
+	}
+	return nil
+}
+
+func closedDeviceHandler(args []string) (string, error) {
+	if args[0] == "status" {
+		return "", fmt.Errorf("device %s not found", args[1])
+	}
+	return "", nil
+}
+
+const testMasterKeyFile = "/etc/longhorn/keys/master.key"
+
+// newFakeMasterKeyFile fakes the stat of the master key file on the host and its comparison
+// against the zeros, and a blank device otherwise.
+func newFakeMasterKeyFile(t *testing.T, stat string, zero bool) {
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		switch command {
+		case "stat":
+			if args[len(args)-1] != testMasterKeyFile {
+				return "", fmt.Errorf("unexpected stat %v", args)
+			}
+			return stat, nil
+		case "cmp":
+			if zero {
+				return "", nil
+			}
+			return "", &CommandError{Command: command, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		}
+		return blankDeviceHandler(command, args)
+	})
+}
+
+func TestOpenVolumeWithMasterKey(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	newFakeMasterKeyFile(t, "64 regular file\n", false)
+	if err := OpenVolumeWithMasterKey("vol", "/dev/longhorn/vol", testMasterKeyFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"luksOpen", "--master-key-file", testMasterKeyFile, "/dev/longhorn/vol", "vol"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+	if call := f.lastCall("isLuks"); call == nil {
+		t.Fatalf("expected the device format to be validated")
+	}
+}
+
+func TestOpenVolumeWithMasterKeyInvalidKeyFile(t *testing.T) {
+	for name, tc := range map[string]struct {
+		keyFile string
+		stat    string
+		zero    bool
+	}{
+		"short":         {keyFile: testMasterKeyFile, stat: "5 regular file"},
+		"zero":          {keyFile: testMasterKeyFile, stat: "32 regular file", zero: true},
+		"directory":     {keyFile: testMasterKeyFile, stat: "4096 directory"},
+		"relative path": {keyFile: "master.key", stat: "32 regular file"},
+	} {
+		f := newFakeCryptSetup(t, closedDeviceHandler)
+		newFakeMasterKeyFile(t, tc.stat, tc.zero)
+		if err := OpenVolumeWithMasterKey("vol", "/dev/longhorn/vol", tc.keyFile); err == nil {
+			t.Fatalf("expected an error for the %v master key file", name)
+		}
+		if call := f.lastCall("luksOpen"); call != nil {
+			t.Fatalf("unexpected luksOpen for the %v master key file: %v", name, call)
+		}
+	}
+
+	newFakeCryptSetup(t, closedDeviceHandler)
+	newFakeMasterKeyFile(t, "32 regular file", false)
+	if err := OpenVolumeWithMasterKey("..", "/dev/longhorn/vol", testMasterKeyFile); err == nil {
+		t.Fatalf("expected an error for the invalid volume name")
+	}
+}
+
+// newTestBlockDevice creates a fake device file and its sysfs entry, and marks it
+// held by a dm device when held is set.
+func newTestBlockDevice(t *testing.T, name string, held bool) string {
+	dir := t.TempDir()
+	oldSysBlockDir := sysBlockDir
+	sysBlockDir = filepath.Join(dir, "sys")
+	t.Cleanup(func() {
+		sysBlockDir = oldSysBlockDir
+	})
+
+	holdersDir := filepath.Join(sysBlockDir, name, "holders")
+	if err := os.MkdirAll(holdersDir, 0755); err != nil {
+		t.Fatalf("failed to create %v: %v", holdersDir, err)
+	}
+	if held {
+		if err := os.WriteFile(filepath.Join(holdersDir, "dm-0"), nil, 0644); err != nil {
+			t.Fatalf("failed to create holder: %v", err)
+		}
+	}
+
+	devicePath := filepath.Join(dir, name)
+	if err := os.WriteFile(devicePath, nil, 0600); err != nil {
+		t.Fatalf("failed to create %v: %v", devicePath, err)
+	}
+	return devicePath
+}
+
+func TestRepairLUKSHeader(t *testing.T) {
+	devicePath := newTestBlockDevice(t, "sdb", false)
+
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		return "Repairing keyslots.\n", nil
+	})
+	repaired, err := RepairLUKSHeader(devicePath, DestructiveOperationConfirmation)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !repaired {
+		t.Fatalf("expected the header to be repaired")
+	}
+	expected := []string{"-q", "-v", "repair", devicePath}
+	if call := f.lastCall("repair"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("repair args = %v, expected %v", call, expected)
+	}
+
+	newFakeCryptSetup(t, nil)
+	if repaired, err = RepairLUKSHeader(devicePath, DestructiveOperationConfirmation); err != nil || repaired {
+		t.Fatalf("expected nothing to repair, got repaired = %v, err = %v", repaired, err)
+	}
+}
+
+func TestRepairLUKSHeaderOpenDevice(t *testing.T) {
+	devicePath := newTestBlockDevice(t, "sdb", true)
+
+	f := newFakeCryptSetup(t, nil)
+	if _, err := RepairLUKSHeader(devicePath, DestructiveOperationConfirmation); err == nil {
+		t.Fatalf("expected an error when repairing an open device")
+	}
+	if len(f.calls) != 0 {
+		t.Fatalf("unexpected cryptsetup calls: %v", f.calls)
+	}
+}
+
+// newFakeLUKSHeader fakes a device whose header is written by luksFormat and read by luksDump.
+func newFakeLUKSHeader(t *testing.T, version string) *fakeCryptSetup {
+	label, subsystem := "(no label)", "(no subsystem)"
+	return newFakeCryptSetup(t, func(args []string) (string, error) {
+		for i, arg := range args {
+			switch arg {
+			case "--label":
+				label = args[i+1]
+			case "--subsystem":
+				subsystem = args[i+1]
+			}
+		}
+		if args[0] == "luksDump" {
+			return fmt.Sprintf("LUKS header information\nVersion:       \t%s\nEpoch:         \t3\nUUID:          \t%s\nLabel:         \t%s\nSubsystem:     \t%s\nFlags:       \t(no flags)\n",
+				version, "0b9f6f0a-6a8c-4d61-9d6b-7a2c2a1f3e4d", label, subsystem), nil
+		}
+		return "", nil
+	})
+}
+
+func TestVolumeUUIDHeaderRoundTrip(t *testing.T) {
+	volumeUUID := "f2d6c1b4-9e3a-4c7d-8b5f-1a2b3c4d5e6f"
+	newFakeLUKSHeader(t, "2")
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	params.VolumeUUID = volumeUUID
+	if err := EncryptVolume("/dev/sdb", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := GetLonghornVolumeFromHeader("/dev/sdb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result != volumeUUID {
+		t.Fatalf("volume UUID = %v, expected %v", result, volumeUUID)
+	}
+}
+
+func TestVolumeUUIDHeaderGuards(t *testing.T) {
+	newFakeLUKSHeader(t, "1")
+	if _, err := GetLonghornVolumeFromHeader("/dev/sdb"); err == nil {
+		t.Fatalf("expected an error reading the volume UUID from a LUKS1 header")
+	}
+
+	newFakeLUKSHeader(t, "2")
+	if _, err := GetLonghornVolumeFromHeader("/dev/sdb"); err == nil {
+		t.Fatalf("expected an error reading the volume UUID from an untagged header")
+	}
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	params.VolumeUUID = "not-a-uuid"
+	if err := EncryptVolume("/dev/sdb", "passphrase", params); err == nil {
+		t.Fatalf("expected an error for an invalid volume UUID")
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	if !IsSafeMode() {
+		t.Fatalf("expected the safe mode to be on by default")
+	}
+
+	f := newFakeCryptSetup(t, nil)
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		if command == "wipefs" {
+			return "ext4\n", nil
+		}
+		return blankDeviceHandler(command, args)
+	})
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	if err := EncryptVolume("/dev/sdb", "passphrase", params); err == nil {
+		t.Fatalf("expected encrypting existing data to be refused without confirmation")
+	}
+	if call := f.lastCall("luksFormat"); call != nil {
+		t.Fatalf("unexpected luksFormat: %v", call)
+	}
+
+	params.Confirmation = DestructiveOperationConfirmation
+	if err := EncryptVolume("/dev/sdb", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksFormat"); call == nil {
+		t.Fatalf("expected luksFormat with confirmation")
+	}
+
+	devicePath := newTestBlockDevice(t, "sdb", false)
+	if _, err := RepairLUKSHeader(devicePath, ""); err == nil {
+		t.Fatalf("expected repairing LUKS header to be refused without confirmation")
+	}
+
+	SetSafeMode(false)
+	defer SetSafeMode(true)
+	if _, err := RepairLUKSHeader(devicePath, ""); err != nil {
+		t.Fatalf("unexpected error with safe mode off: %v", err)
+	}
+}
+
+func TestMapperSalt(t *testing.T) {
+	if err := SetMapperSalt("cluster1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer SetMapperSalt("")
+
+	if mapper := VolumeMapper("vol"); mapper != "/dev/mapper/cluster1-vol" {
+		t.Fatalf("volume mapper = %v, expected /dev/mapper/cluster1-vol", mapper)
+	}
+
+	opened := false
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "luksOpen":
+			opened = true
+		case "status":
+			if !opened {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			return fmt.Sprintf("/dev/mapper/%s is active.\n  type:    LUKS2\n  device:  /dev/longhorn/vol\n", args[1]), nil
+		}
+		return "", nil
+	})
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", "cluster1-vol", "-d", "/dev/stdin"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	device, mapper, err := DeviceEncryptionStatus(VolumeMapper("vol"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device != "/dev/longhorn/vol" || mapper != "cluster1-vol" {
+		t.Fatalf("device = %v, mapper = %v, expected /dev/longhorn/vol and cluster1-vol", device, mapper)
+	}
+
+	if err := CloseVolume("vol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksClose"); !reflect.DeepEqual(call, []string{"luksClose", "cluster1-vol"}) {
+		t.Fatalf("luksClose args = %v, expected the salted mapper name", call)
+	}
+
+	if err := SetMapperSalt("bad/salt"); err == nil {
+		t.Fatalf("expected an error for an invalid salt")
+	}
+}
+
+func TestOpenVolumeKeySize(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status":
+			return "", fmt.Errorf("device %s not found", args[1])
+		case "luksDump":
+			if args[1] == "--dump-json-metadata" {
+				return "", fmt.Errorf("unsupported option")
+			}
+			return testLUKS2Dump, nil
+		}
+		return "", nil
+	})
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", MapperName("vol"), "-d", "/dev/stdin"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{KeySize: "256"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = append(expected, "--key-size", "256")
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{KeySize: "512"}); err == nil {
+		t.Fatalf("expected an error for the key size inconsistent with the header")
+	}
+}
+
+func TestOpenVolumeCipherOverride(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{OpenCipher: "aes-cbc-essiv:sha256"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", MapperName("vol"), "-d", "/dev/stdin", "--cipher", "aes-cbc-essiv:sha256"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{OpenCipher: "cipher_null-ecb"}); err == nil {
+		t.Fatalf("expected an error for the cipher not in the allow-list")
+	}
+}
+
+func TestOpenVolumeInvalidPassphrase(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksOpen" {
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: cryptSetupExitCodeNoPermission, Err: fmt.Errorf("exit status 2")}
+		}
+		return closedDeviceHandler(args)
+	})
+
+	err := OpenVolume("vol", "/dev/longhorn/vol", "wrong", &EncryptParams{})
+	if !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected ErrInvalidPassphrase", err)
+	}
+	if exitCode, ok := ExitCode(err); !ok || exitCode != cryptSetupExitCodeNoPermission {
+		t.Fatalf("expected the exit code to be kept in the error %v", err)
+	}
+
+	f.calls = nil
+	err = OpenVolume("vol", "/dev/longhorn/vol", "wrong", &EncryptParams{VerifyPassphraseBeforeOpen: true})
+	if !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected ErrInvalidPassphrase", err)
+	}
+	for _, call := range f.calls {
+		if call[0] == "luksOpen" && call[1] != "--test-passphrase" {
+			t.Fatalf("unexpected open after the passphrase verification failed: %v", call)
+		}
+	}
+
+	f = newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksOpen" && args[1] != "--test-passphrase" {
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 4, Err: fmt.Errorf("exit status 4")}
+		}
+		return closedDeviceHandler(args)
+	})
+	err = OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{VerifyPassphraseBeforeOpen: true})
+	if err == nil || errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected an error other than ErrInvalidPassphrase", err)
+	}
+	if call := f.lastCall("--test-passphrase"); call == nil {
+		t.Fatalf("expected the passphrase to be verified before the open")
+	}
+}
+
+func TestOpenVolumeIntegrityRecoveryMode(t *testing.T) {
+	integrityMetadata := strings.Replace(testLUKS2JSONMetadata, `"sector_size":4096}`,
+		`"sector_size":4096,"integrity":{"type":"hmac(sha256)","journal_encryption":"none","journal_integrity":"none"}}`, 1)
+	metadata := integrityMetadata
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksDump" && args[1] == "--dump-json-metadata" {
+			return metadata, nil
+		}
+		return closedDeviceHandler(args)
+	})
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{IntegrityRecoveryMode: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", MapperName("vol"), "-d", "/dev/stdin", "--integrity-recovery-mode", "--readonly"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	metadata = testLUKS2JSONMetadata
+	f.calls = nil
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{IntegrityRecoveryMode: true}); err == nil {
+		t.Fatalf("expected an error for the recovery mode on a device without integrity protection")
+	}
+	if call := f.lastCall("luksOpen"); call != nil {
+		t.Fatalf("unexpected luksOpen: %v", call)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	integrityMetadata := strings.Replace(testLUKS2JSONMetadata, `"sector_size":4096}`,
+		`"sector_size":4096,"integrity":{"type":"hmac(sha256)","journal_encryption":"none","journal_integrity":"none"}}`, 1)
+	metadata := integrityMetadata
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksDump" && args[1] == "--dump-json-metadata" {
+			return metadata, nil
+		}
+		return closedDeviceHandler(args)
+	})
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	params.Integrity = "hmac-sha256"
+	if err := EncryptVolume("/dev/sdb", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksFormat"); !strings.Contains(strings.Join(call, " "), "--type luks2 ") || !strings.Contains(strings.Join(call, " "), "--integrity hmac-sha256 ") {
+		t.Fatalf("luksFormat args = %v, expected LUKS2 with the integrity flag", call)
+	}
+
+	f.calls = nil
+	if err := EncryptVolume("/dev/sdb", "passphrase", NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksFormat"); strings.Contains(strings.Join(call, " "), "--integrity") {
+		t.Fatalf("unexpected integrity flag in luksFormat args %v", call)
+	}
+
+	for name, params := range map[string]*EncryptParams{
+		"luks1":                 {LUKSVersion: "luks1", Integrity: "hmac-sha256"},
+		"unsupported integrity": {Integrity: "crc32c"},
+	} {
+		f.calls = nil
+		if err := EncryptVolume("/dev/sdb", "passphrase", params); err == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+		if call := f.lastCall("luksFormat"); call != nil {
+			t.Fatalf("%v: unexpected luksFormat %v", name, call)
+		}
+	}
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", MapperName("vol"), "-d", "/dev/stdin"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	// The device without the integrity protection is refused rather than opened unprotected
+	metadata = testLUKS2JSONMetadata
+	f.calls = nil
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", params); err == nil {
+		t.Fatalf("expected an error for the device without integrity protection")
+	}
+	if call := f.lastCall("luksOpen"); call != nil {
+		t.Fatalf("unexpected luksOpen: %v", call)
+	}
+}
+
+func TestSetMappingUUID(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	var dmsetupCalls [][]string
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		if command == "dmsetup" {
+			dmsetupCalls = append(dmsetupCalls, args)
+		}
+		return "", nil
+	})
+
+	mappingUUID := "2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809"
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{MappingUUID: mappingUUID}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.lastCall("luksOpen") == nil {
+		t.Fatalf("expected the volume to be opened")
+	}
+	expected := [][]string{{"rename", MapperName("vol"), "--setuuid", mappingUUID}}
+	if !reflect.DeepEqual(dmsetupCalls, expected) {
+		t.Fatalf("dmsetup calls = %v, expected %v", dmsetupCalls, expected)
+	}
+
+	if err := SetMappingUUID("vol", "not-a-uuid"); err == nil {
+		t.Fatalf("expected an error for the invalid UUID")
+	}
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{MappingUUID: "not-a-uuid"}); err == nil {
+		t.Fatalf("expected an error for the invalid UUID before opening")
+	}
+	if len(dmsetupCalls) != 1 {
+		t.Fatalf("expected no dmsetup call for the invalid UUID, got %v", dmsetupCalls)
+	}
+}
+
+func TestMapperNameLength(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	if err := SetMapperSalt("cluster1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = SetMapperSalt("")
+	})
+
+	// The salted mapper name "cluster1-<volume>" hits the limit exactly
+	maxVolume := strings.Repeat("v", dmMaxNameLength-len("cluster1-"))
+	if err := OpenVolume(maxVolume, "/dev/longhorn/"+maxVolume, "passphrase", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	longVolume := maxVolume + "v"
+	if err := OpenVolume(longVolume, "/dev/longhorn/"+longVolume, "passphrase", nil); err == nil || !strings.Contains(err.Error(), "exceeding the device mapper limit") {
+		t.Fatalf("expected an error for the over-limit mapper name, got %v", err)
+	}
+	if err := EncryptVolume("/dev/longhorn/"+longVolume, "passphrase", NewEncryptParams("", "", "", "", "", "")); err == nil {
+		t.Fatalf("expected an error formatting the device of the over-limit mapper name")
+	}
+	for _, call := range f.calls {
+		for _, arg := range call {
+			if strings.Contains(arg, longVolume) {
+				t.Fatalf("unexpected cryptsetup call for the over-limit volume: %v", call)
+			}
+		}
+	}
+}
+
+func TestPassphraseBufferZeroed(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, call := range f.calls {
+		if call[0] != "luksOpen" {
+			continue
+		}
+		if f.stdins[i] != "passphrase" {
+			t.Fatalf("stdin = %q, expected the passphrase during the operation", f.stdins[i])
+		}
+		if !bytes.Equal(f.stdinBufs[i], make([]byte, len("passphrase"))) {
+			t.Fatalf("passphrase buffer is not zeroed after the operation: %q", f.stdinBufs[i])
+		}
+		return
+	}
+	t.Fatalf("luksOpen is not called")
+}
+
+func TestPBKDFParallel(t *testing.T) {
+	f := newFakeCryptSetup(t, nil)
+
+	for _, pbkdf := range []string{"", "argon2i", "argon2id"} {
+		params := NewEncryptParams("", "", "", "", pbkdf, "")
+		params.PBKDFParallel = "4"
+		if err := EncryptVolume("/dev/sdb", "passphrase", params); err != nil {
+			t.Fatalf("unexpected error for pbkdf %q: %v", pbkdf, err)
+		}
+		call := f.lastCall("luksFormat")
+		if !strings.Contains(strings.Join(call, " "), "--pbkdf-parallel 4 ") {
+			t.Fatalf("expected pbkdf parallel flag in luksFormat args %v", call)
+		}
+	}
+
+	if err := EncryptVolume("/dev/sdb", "passphrase", NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksFormat"); strings.Contains(strings.Join(call, " "), "--pbkdf-parallel") {
+		t.Fatalf("unexpected pbkdf parallel flag in luksFormat args %v", call)
+	}
+
+	for pbkdf, parallel := range map[string]string{"pbkdf2": "4", "argon2id": "0", "argon2i": "abc"} {
+		params := NewEncryptParams("", "", "", "", pbkdf, "")
+		params.PBKDFParallel = parallel
+		if err := EncryptVolume("/dev/sdb", "passphrase", params); err == nil {
+			t.Fatalf("expected an error for pbkdf %v with parallel %v", pbkdf, parallel)
+		}
+	}
+}
+
+func TestPBKDFCost(t *testing.T) {
+	f := newFakeCryptSetup(t, nil)
+
+	params := NewEncryptParams("", "", "", "", "argon2id", "")
+	params.PBKDFMemoryKB = "65536"
+	params.PBKDFIterations = "4"
+	if err := EncryptVolume("/dev/sdb", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	call := strings.Join(f.lastCall("luksFormat"), " ")
+	if !strings.Contains(call, "--pbkdf-memory 65536 --pbkdf-force-iterations 4 ") {
+		t.Fatalf("expected pbkdf cost flags in luksFormat args %v", call)
+	}
+
+	if err := EncryptVolume("/dev/sdb", "passphrase", NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	call = strings.Join(f.lastCall("luksFormat"), " ")
+	if strings.Contains(call, "--pbkdf-memory") || strings.Contains(call, "--pbkdf-force-iterations") {
+		t.Fatalf("unexpected pbkdf cost flags in luksFormat args %v", call)
+	}
+
+	testCases := map[string]struct {
+		pbkdf      string
+		memoryKB   string
+		iterations string
+	}{
+		"memory with pbkdf2":     {pbkdf: "pbkdf2", memoryKB: "65536"},
+		"iterations with pbkdf2": {pbkdf: "pbkdf2", iterations: "1000"},
+		"invalid memory":         {pbkdf: "argon2i", memoryKB: "64M"},
+		"too little memory":      {pbkdf: "argon2i", memoryKB: "16"},
+		"too much memory":        {pbkdf: "argon2i", memoryKB: "8388608"},
+		"too few iterations":     {pbkdf: "argon2id", iterations: "2"},
+		"negative iterations":    {pbkdf: "argon2id", iterations: "-4"},
+	}
+	for name, tc := range testCases {
+		params := NewEncryptParams("", "", "", "", tc.pbkdf, "")
+		params.PBKDFMemoryKB = tc.memoryKB
+		params.PBKDFIterations = tc.iterations
+		if err := EncryptVolume("/dev/sdb", "passphrase", params); err == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestResolvedEncryptParams(t *testing.T) {
+	for _, params := range []*EncryptParams{
+		NewEncryptParams("", "", "", "", "", ""),
+		NewEncryptParams("secret", "aes-cbc-essiv:sha256", "sha512", "512", "pbkdf2", ""),
+	} {
+		expected := ResolvedEncryptParams{
+			KeyCipher: params.GetKeyCipher(),
+			KeyHash:   params.GetKeyHash(),
+			KeySize:   params.GetKeySize(),
+			PBKDF:     params.GetPBKDF(),
+			LUKSType:  params.GetLUKSVersion(),
+		}
+		if resolved := params.Resolved(); resolved != expected {
+			t.Fatalf("resolved params = %+v, expected %+v", resolved, expected)
+		}
+	}
+}
+
+func TestDiffEncryptParams(t *testing.T) {
+	testCases := map[string]struct {
+		old      *EncryptParams
+		new      *EncryptParams
+		expected []string
+	}{
+		"no change": {
+			old:      NewEncryptParams("secret", "", "", "", "", ""),
+			new:      NewEncryptParams("secret", "", "", "", "", ""),
+			expected: []string{},
+		},
+		"default and explicit default": {
+			old:      NewEncryptParams("", "", "", "", "", ""),
+			new:      NewEncryptParams("", CryptoKeyDefaultCipher, CryptoKeyDefaultHash, CryptoKeyDefaultSize, CryptoDefaultPBKDF, CryptoDefaultLUKSVersion),
+			expected: []string{},
+		},
+		"cipher": {
+			old:      NewEncryptParams("", "aes-cbc-essiv:sha256", "", "", "", ""),
+			new:      NewEncryptParams("", "", "", "", "", ""),
+			expected: []string{"cipher: aes-cbc-essiv:sha256 -> aes-xts-plain64"},
+		},
+		"hash key size and pbkdf": {
+			old:      NewEncryptParams("", "", "", "", "", ""),
+			new:      NewEncryptParams("", "", "sha512", "512", "argon2id", ""),
+			expected: []string{"hash: sha256 -> sha512", "key size: 256 -> 512", "pbkdf: argon2i -> argon2id"},
+		},
+		"nil old params": {
+			old:      nil,
+			new:      NewEncryptParams("", "", "", "512", "", ""),
+			expected: []string{"key size: 256 -> 512"},
+		},
+	}
+
+	for name, tc := range testCases {
+		if changes := DiffEncryptParams(tc.old, tc.new); !reflect.DeepEqual(changes, tc.expected) {
+			t.Fatalf("%v: changes = %v, expected %v", name, changes, tc.expected)
+		}
+	}
+}
+
+func TestEncryptVolumeLUKSVersion(t *testing.T) {
+	f := newFakeCryptSetup(t, nil)
+
+	for luksVersion, expected := range map[string]struct {
+		luksType string
+		pbkdf    string
+	}{
+		"":      {luksTypeLUKS2, CryptoDefaultPBKDF},
+		"luks1": {luksTypeLUKS1, CryptoLUKS1PBKDF},
+		"luks2": {luksTypeLUKS2, CryptoDefaultPBKDF},
+	} {
+		if err := EncryptVolume("/dev/sdb", "passphrase", NewEncryptParams("", "", "", "", "", luksVersion)); err != nil {
+			t.Fatalf("LUKS version %q: unexpected error: %v", luksVersion, err)
+		}
+		call := f.lastCall("luksFormat")
+		if call == nil || call[2] != "--type" || call[3] != expected.luksType {
+			t.Fatalf("LUKS version %q: luksFormat args = %v, expected --type %v", luksVersion, call, expected.luksType)
+		}
+		if call[10] != "--pbkdf" || call[11] != expected.pbkdf {
+			t.Fatalf("LUKS version %q: luksFormat args = %v, expected --pbkdf %v", luksVersion, call, expected.pbkdf)
+		}
+	}
+
+	for _, params := range []*EncryptParams{
+		NewEncryptParams("", "", "", "", "", "luks3"),
+		NewEncryptParams("", "", "", "", "argon2id", "luks1"),
+	} {
+		f.calls = nil
+		if err := EncryptVolume("/dev/sdb", "passphrase", params); err == nil {
+			t.Fatalf("expected an error for LUKS version %v with pbkdf %v", params.LUKSVersion, params.PBKDF)
+		}
+		if call := f.lastCall("luksFormat"); call != nil {
+			t.Fatalf("unexpected luksFormat: %v", call)
+		}
+	}
+}
+
+func TestEncryptVolumeDeviceSize(t *testing.T) {
+	f := newFakeCryptSetup(t, nil)
+	deviceSize := "8388608"
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		if command == "blockdev" {
+			return deviceSize, nil
+		}
+		return "", nil
+	})
+
+	if err := EncryptVolume("/dev/sdb", "passphrase", NewEncryptParams("", "", "", "", "", "")); err == nil || !strings.Contains(err.Error(), "too small for LUKS header") {
+		t.Fatalf("expected an error for an undersized device, got %v", err)
+	}
+	if call := f.lastCall("luksFormat"); call != nil {
+		t.Fatalf("unexpected luksFormat: %v", call)
+	}
+
+	deviceSize = "16781312"
+	if err := EncryptVolume("/dev/sdb", "passphrase", NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error for an adequately-sized device: %v", err)
+	}
+	if call := f.lastCall("luksFormat"); call == nil {
+		t.Fatalf("expected luksFormat")
+	}
+}
+
+func TestSectorAlignment(t *testing.T) {
+	for name, tc := range map[string]struct {
+		deviceSize  int64
+		sectorSize  string
+		strict      bool
+		expectError bool
+	}{
+		"aligned": {
+			deviceSize: 1 << 30,
+			sectorSize: "4096",
+			strict:     true,
+		},
+		"misaligned": {
+			deviceSize: 1<<30 + 512,
+			sectorSize: "4096",
+		},
+		"misaligned strict": {
+			deviceSize:  1<<30 + 512,
+			sectorSize:  "4096",
+			strict:      true,
+			expectError: true,
+		},
+		"misaligned without sector size": {
+			deviceSize: 1<<30 + 512,
+			strict:     true,
+		},
+		"not a power of two": {
+			deviceSize:  1 << 30,
+			sectorSize:  "1000",
+			expectError: true,
+		},
+		"too large": {
+			deviceSize:  1 << 30,
+			sectorSize:  "8192",
+			expectError: true,
+		},
+	} {
+		f := newFakeCryptSetup(t, closedDeviceHandler)
+		newFakeHostCommand(t, func(command string, args []string) (string, error) {
+			if command == "blockdev" {
+				return fmt.Sprintf("%d\n", tc.deviceSize), nil
+			}
+			return blankDeviceHandler(command, args)
+		})
+		params := &EncryptParams{KeySectorSize: tc.sectorSize, StrictSectorAlignment: tc.strict}
+
+		formatErr := EncryptVolume("/dev/sdb", "passphrase", params)
+		openErr := OpenVolume("vol", "/dev/sdb", "passphrase", params)
+		if tc.expectError {
+			if formatErr == nil || openErr == nil {
+				t.Fatalf("%v: expected errors formatting and opening, got %v and %v", name, formatErr, openErr)
+			}
+			if call := f.lastCall("luksFormat"); call != nil {
+				t.Fatalf("%v: unexpected luksFormat: %v", name, call)
+			}
+			if call := f.lastCall("luksOpen"); call != nil {
+				t.Fatalf("%v: unexpected luksOpen: %v", name, call)
+			}
+			continue
+		}
+		if formatErr != nil || openErr != nil {
+			t.Fatalf("%v: unexpected errors formatting and opening: %v, %v", name, formatErr, openErr)
+		}
+
+		call := f.lastCall("luksFormat")
+		hasSectorSize := false
+		for i := range call {
+			if call[i] == "--sector-size" && i+1 < len(call) && call[i+1] == tc.sectorSize {
+				hasSectorSize = true
+			}
+		}
+		if hasSectorSize != (tc.sectorSize != "") {
+			t.Fatalf("%v: luksFormat args = %v, expected --sector-size only with the key sector size", name, call)
+		}
+	}
+
+	if err := EncryptVolume("/dev/sdb", "passphrase", &EncryptParams{LUKSVersion: luksTypeLUKS1, KeySectorSize: "4096"}); err == nil {
+		t.Fatalf("expected an error for the key sector size with %v", luksTypeLUKS1)
+	}
+}
+
+func TestDetachedHeader(t *testing.T) {
+	headerFile := "/var/lib/longhorn/luks-headers/vol.img"
+	opened, resized := false, false
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "luksOpen":
+			opened = true
+		case "resize":
+			resized = true
+		case "status":
+			if !opened {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			if resized {
+				return newTestResizedStatus(args[1], "/dev/longhorn/vol", 8192, ""), nil
+			}
+			return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/vol"), nil
+		}
+		return "", nil
+	})
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	params.HeaderFile = headerFile
+	if err := EncryptVolume("/dev/longhorn/vol", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, mapper, err := DeviceEncryptionStatusWithHeader(VolumeMapper("vol"), headerFile); err != nil || mapper != MapperName("vol") {
+		t.Fatalf("mapper = %v, err = %v, expected %v", mapper, err, MapperName("vol"))
+	}
+	if err := ResizeEncryptoDevice("vol", "passphrase", headerFile, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actions := map[string]bool{}
+	for _, call := range f.calls {
+		actions[call[0]] = true
+		if !strings.Contains(strings.Join(call, " "), "--header "+headerFile) {
+			t.Fatalf("cryptsetup args %v, expected the detached header %v", call, headerFile)
+		}
+	}
+	for _, action := range []string{"-q", "status", "luksOpen", "resize"} {
+		if !actions[action] {
+			t.Fatalf("cryptsetup calls = %v, expected %v", f.calls, action)
+		}
+	}
+
+	params.HeaderFile = "vol.img"
+	if err := EncryptVolume("/dev/longhorn/vol", "passphrase", params); err == nil {
+		t.Fatalf("expected an error for the relative header file")
+	}
+}
+
+func TestHasDetachedLUKSHeader(t *testing.T) {
+	testCases := map[string]struct {
+		err           error
+		expected      bool
+		expectedError bool
+	}{
+		"formatted":     {expected: true},
+		"not formatted": {err: &CommandError{Command: "cryptsetup", ExitCode: cryptSetupExitCodeNotLUKS, Err: fmt.Errorf("exit status 1")}},
+		"missing":       {err: &CommandError{Command: "cryptsetup", ExitCode: cryptSetupExitCodeNoDevice, Err: fmt.Errorf("exit status 4")}},
+		"failure":       {err: fmt.Errorf("failed to run cryptsetup"), expectedError: true},
+	}
+
+	for name, tc := range testCases {
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			if !reflect.DeepEqual(args, []string{"isLuks", "/var/lib/longhorn/luks-headers/vol.img"}) {
+				return "", fmt.Errorf("unexpected args %v", args)
+			}
+			return "", tc.err
+		})
+		formatted, err := HasDetachedLUKSHeader("/var/lib/longhorn/luks-headers/vol.img")
+		if tc.expectedError != (err != nil) {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if formatted != tc.expected {
+			t.Fatalf("%v: formatted = %v, expected %v", name, formatted, tc.expected)
+		}
+	}
+}
+
+func TestCryptoOperationsContextCancelled(t *testing.T) {
+	testCases := map[string]struct {
+		open      bool
+		operation func(ctx context.Context) error
+	}{
+		"encrypt": {
+			operation: func(ctx context.Context) error {
+				return EncryptVolumeContext(ctx, "/dev/longhorn/vol", "passphrase", NewEncryptParams("", "", "", "", "", ""))
+			},
+		},
+		"open": {
+			operation: func(ctx context.Context) error {
+				return OpenVolumeContext(ctx, "vol", "/dev/longhorn/vol", "passphrase", nil)
+			},
+		},
+		"close": {
+			open: true,
+			operation: func(ctx context.Context) error {
+				return CloseVolumeContext(ctx, "vol")
+			},
+		},
+		"resize": {
+			open: true,
+			operation: func(ctx context.Context) error {
+				return ResizeEncryptoDeviceContext(ctx, "vol", "passphrase", "", 0)
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		newFakeCryptSetup(t, nil)
+		// The fake cryptsetup hangs like on an unresponsive device until the context is done
+		cryptSetupRunner = func(ctx context.Context, stdin []byte, args ...string) (string, error) {
+			if args[0] == "status" {
+				if !tc.open {
+					return "", fmt.Errorf("device %s not found", args[1])
+				}
+				return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/vol"), nil
+			}
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := tc.operation(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%v: err = %v, expected %v", name, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestLUKSHelpersContextDeadline(t *testing.T) {
+	testCases := map[string]func(ctx context.Context) error{
+		"luksOpen": func(ctx context.Context) error {
+			_, err := luksOpen(ctx, "vol", "/dev/longhorn/vol", "passphrase", 0)
+			return err
+		},
+		"luksFormat": func(ctx context.Context) error {
+			_, err := luksFormat(ctx, "/dev/longhorn/vol", "passphrase", NewEncryptParams("", "", "", "", "", ""))
+			return err
+		},
+		"luksAddKey": func(ctx context.Context) error {
+			_, err := luksAddKey(ctx, "/dev/longhorn/vol", "passphrase", "new passphrase", -1)
+			return err
+		},
+		"luksStatus": func(ctx context.Context) error {
+			_, err := luksStatus(ctx, "vol")
+			return err
+		},
+		"luksDump": func(ctx context.Context) error {
+			_, err := luksDump(ctx, "/dev/longhorn/vol")
+			return err
+		},
+		"luksClose": func(ctx context.Context) error {
+			_, err := luksClose(ctx, "vol")
+			return err
+		},
+	}
+
+	for name, operation := range testCases {
+		newFakeCryptSetup(t, nil)
+		cryptSetupRunner = func(ctx context.Context, stdin []byte, args ...string) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := operation(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%v: err = %v, expected %v", name, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestRunCommandDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := runCommand(ctx, "sleep", nil, "60")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, expected %v", err, context.DeadlineExceeded)
+	}
+	// The process is killed on the deadline rather than waited for
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("runCommand returned after %v, expected the command to be killed on the deadline", elapsed)
+	}
+}
+
+func TestNormalizeDevicePath(t *testing.T) {
+	devicePath := newTestBlockDevice(t, "sdb", false)
+	dir, err := filepath.EvalSymlinks(filepath.Dir(devicePath))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	devicePath = filepath.Join(dir, "sdb")
+
+	// A symlink to a dm device is resolved to the node of its mapping
+	dmDevicePath := filepath.Join(dir, "dm-3")
+	if err := os.WriteFile(dmDevicePath, nil, 0600); err != nil {
+		t.Fatalf("failed to create %v: %v", dmDevicePath, err)
+	}
+	dmDir := filepath.Join(sysBlockDir, "dm-3", "dm")
+	if err := os.MkdirAll(dmDir, 0755); err != nil {
+		t.Fatalf("failed to create %v: %v", dmDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(dmDir, "name"), []byte("vol\n"), 0644); err != nil {
+		t.Fatalf("failed to create dm name: %v", err)
+	}
+	for link, target := range map[string]string{"sdb-link": devicePath, "vol-link": dmDevicePath} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatalf("failed to create symlink %v: %v", link, err)
+		}
+	}
+
+	oldWorkingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Chdir(oldWorkingDir)
+
+	testCases := map[string]struct {
+		path     string
+		expected string
+	}{
+		"mapper":                 {path: "/dev/mapper/vol", expected: "/dev/mapper/vol"},
+		"mapper trailing slash":  {path: "/dev/mapper/vol/", expected: "/dev/mapper/vol"},
+		"mapper double slash":    {path: "/dev/mapper//vol", expected: "/dev/mapper/vol"},
+		"relative":               {path: "sdb", expected: devicePath},
+		"relative parent":        {path: "../" + filepath.Base(dir) + "/./sdb", expected: devicePath},
+		"symlink":                {path: filepath.Join(dir, "sdb-link"), expected: devicePath},
+		"relative symlink":       {path: "sdb-link/", expected: devicePath},
+		"symlink to dm device":   {path: "vol-link", expected: "/dev/mapper/vol"},
+		"missing device":         {path: "/dev/longhorn/missing/../vol", expected: "/dev/longhorn/vol"},
+		"dm device without name": {path: "/dev/dm-999999", expected: "/dev/dm-999999"},
+	}
+	for name, tc := range testCases {
+		normalized, err := NormalizeDevicePath(tc.path)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if normalized != tc.expected {
+			t.Fatalf("%v: normalized = %v, expected %v", name, normalized, tc.expected)
+		}
+	}
+
+	if _, err := NormalizeDevicePath(""); err == nil {
+		t.Fatalf("expected an error for the empty path")
+	}
+
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "status" {
+			return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/vol"), nil
+		}
+		return "", nil
+	})
+	device, mapper, err := DeviceEncryptionStatus("vol-link")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device != "/dev/longhorn/vol" || mapper != "vol" {
+		t.Fatalf("device = %v, mapper = %v, expected the mapping vol of /dev/longhorn/vol", device, mapper)
+	}
+	if open, err := IsDeviceOpen("/dev/mapper/vol/"); err != nil || !open {
+		t.Fatalf("open = %v, err = %v, expected the mapping to be open", open, err)
+	}
+}
+
+func TestVolumeMapperSafe(t *testing.T) {
+	for volume, expected := range map[string]string{
+		"vol":       "/dev/mapper/vol",
+		"vol..1":    "/dev/mapper/vol..1",
+		"":          "",
+		".":         "",
+		"..":        "",
+		"../sda":    "",
+		"../../etc": "",
+		"vol/../..": "",
+		"/dev/sda":  "",
+	} {
+		mapperPath, err := VolumeMapperSafe(volume)
+		if expected == "" {
+			if err == nil {
+				t.Fatalf("VolumeMapperSafe(%q) = %v, expected an error", volume, mapperPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("VolumeMapperSafe(%q): unexpected error: %v", volume, err)
+		}
+		if mapperPath != expected {
+			t.Fatalf("VolumeMapperSafe(%q) = %v, expected %v", volume, mapperPath, expected)
+		}
+	}
+
+	// The compatible variant still returns the path, but the open refuses the name
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	if mapperPath := VolumeMapper("../sda"); mapperPath != "/dev/sda" {
+		t.Fatalf("VolumeMapper = %v, expected the unvalidated path", mapperPath)
+	}
+	if err := OpenVolume("../sda", "/dev/longhorn/vol", "passphrase", nil); err == nil {
+		t.Fatalf("expected an error opening the invalid volume name")
+	}
+	if call := f.lastCall("luksOpen"); call != nil {
+		t.Fatalf("unexpected luksOpen of the invalid volume name: %v", call)
+	}
+}
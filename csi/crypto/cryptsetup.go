@@ -0,0 +1,43 @@
+package crypto
+
+import (
+	"sync"
+)
+
+// defaultCryptSetupPath is looked up on the PATH of the host namespaces.
+const defaultCryptSetupPath = "cryptsetup"
+
+var (
+	cryptSetupConfigLock sync.RWMutex
+	cryptSetupPath       = defaultCryptSetupPath
+	cryptSetupGlobalArgs []string
+)
+
+// SetCryptsetupPath sets the cryptsetup binary run in the host namespaces for all the crypto
+// operations, e.g. a custom build in a non-standard location. An empty path resets it to the
+// cryptsetup on the PATH.
+func SetCryptsetupPath(path string) {
+	if path == "" {
+		path = defaultCryptSetupPath
+	}
+	cryptSetupConfigLock.Lock()
+	defer cryptSetupConfigLock.Unlock()
+	cryptSetupPath = path
+}
+
+// SetGlobalArgs sets the args prepended to every cryptsetup invocation, e.g. --debug while
+// troubleshooting. Note the args changing the output, like --debug or --verbose, may confuse
+// the helpers parsing the output. Nil or empty args clear them.
+func SetGlobalArgs(args []string) {
+	cryptSetupConfigLock.Lock()
+	defer cryptSetupConfigLock.Unlock()
+	cryptSetupGlobalArgs = append([]string{}, args...)
+}
+
+// getCryptSetupCommand returns the configured cryptsetup binary and the args with the global args
+// prepended.
+func getCryptSetupCommand(args []string) (string, []string) {
+	cryptSetupConfigLock.RLock()
+	defer cryptSetupConfigLock.RUnlock()
+	return cryptSetupPath, append(append([]string{}, cryptSetupGlobalArgs...), args...)
+}
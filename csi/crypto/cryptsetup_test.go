@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCryptSetupCommand(t *testing.T) {
+	defer SetCryptsetupPath("")
+	defer SetGlobalArgs(nil)
+
+	args := []string{"luksOpen", "/dev/sdb", "vol", "-d", "/dev/stdin"}
+	command, commandArgs := getCryptSetupCommand(args)
+	if command != "cryptsetup" || !reflect.DeepEqual(commandArgs, args) {
+		t.Fatalf("command = %v %v, expected cryptsetup on the PATH without global args", command, commandArgs)
+	}
+
+	globalArgs := []string{"--debug"}
+	SetCryptsetupPath("/opt/cryptsetup/sbin/cryptsetup")
+	SetGlobalArgs(globalArgs)
+	globalArgs[0] = "--verbose"
+	command, commandArgs = getCryptSetupCommand(args)
+	expectedArgs := []string{"--debug", "luksOpen", "/dev/sdb", "vol", "-d", "/dev/stdin"}
+	if command != "/opt/cryptsetup/sbin/cryptsetup" || !reflect.DeepEqual(commandArgs, expectedArgs) {
+		t.Fatalf("command = %v %v, expected /opt/cryptsetup/sbin/cryptsetup %v", command, commandArgs, expectedArgs)
+	}
+	if !reflect.DeepEqual(args, []string{"luksOpen", "/dev/sdb", "vol", "-d", "/dev/stdin"}) {
+		t.Fatalf("args = %v, expected them not to be modified", args)
+	}
+
+	// The priority wrappers run the configured cryptsetup
+	if err := SetCryptSetupPriority(10, 0, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer SetCryptSetupPriority(0, 0, 0)
+	command, wrappedArgs := getCryptSetupPriority().wrap(getCryptSetupCommand(args))
+	expectedArgs = append([]string{"-n", "10", "/opt/cryptsetup/sbin/cryptsetup"}, expectedArgs...)
+	if command != "nice" || !reflect.DeepEqual(wrappedArgs, expectedArgs) {
+		t.Fatalf("command = %v %v, expected nice %v", command, wrappedArgs, expectedArgs)
+	}
+
+	SetCryptsetupPath("")
+	SetGlobalArgs(nil)
+	command, commandArgs = getCryptSetupCommand(args)
+	if command != "cryptsetup" || !reflect.DeepEqual(commandArgs, args) {
+		t.Fatalf("command = %v %v, expected the defaults to be restored", command, commandArgs)
+	}
+}
@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUdevSettleRetries = 2
+	defaultUdevSettleTimeout = 10 * time.Second
+)
+
+// udevSettleRetryPolicy controls how long a missing device node of an existing mapping is waited
+// for, since udev may be slow on a busy node to create it after open.
+type udevSettleRetryPolicy struct {
+	retries int
+	timeout time.Duration
+}
+
+var (
+	udevSettlePolicyLock sync.RWMutex
+	udevSettlePolicy     = udevSettleRetryPolicy{retries: defaultUdevSettleRetries, timeout: defaultUdevSettleTimeout}
+)
+
+// SetUdevSettleRetryPolicy sets the number of the udevadm settle retries and the timeout of each
+// settle before a missing device node of an open mapping is created manually.
+func SetUdevSettleRetryPolicy(retries int, timeout time.Duration) error {
+	if retries < 0 {
+		return fmt.Errorf("invalid udev settle retries %v, it should not be negative", retries)
+	}
+	if timeout < time.Second {
+		return fmt.Errorf("invalid udev settle timeout %v, it should be at least 1s", timeout)
+	}
+	udevSettlePolicyLock.Lock()
+	defer udevSettlePolicyLock.Unlock()
+	udevSettlePolicy = udevSettleRetryPolicy{retries: retries, timeout: timeout}
+	return nil
+}
+
+func getUdevSettleRetryPolicy() udevSettleRetryPolicy {
+	udevSettlePolicyLock.RLock()
+	defer udevSettlePolicyLock.RUnlock()
+	return udevSettlePolicy
+}
+
+// EnsureMapperNode creates the device node of the mapping of the volume if it's missing, which
+// happens in the minimal environments without udev creating the nodes after open. A missing
+// mapping is a genuine open failure, while for an existing mapping udev is given the chance to
+// create the node first, see SetUdevSettleRetryPolicy.
+func EnsureMapperNode(volume string) error {
+	nodePath := VolumeMapper(volume)
+	exists, err := isBlockDeviceNodePresent(nodePath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	major, minor, err := getMappingDeviceNumber(MapperName(volume))
+	if err != nil {
+		return err
+	}
+	if exists, err = waitForUdevDeviceNode(nodePath); err != nil || exists {
+		return err
+	}
+	logrus.Infof("Creating missing device node %s with device number %s:%s", nodePath, major, minor)
+	if _, err := hostCommandRunner(context.Background(), "mknod", "-m", "0600", nodePath, "b", major, minor); err != nil {
+		return fmt.Errorf("failed to create device node %s: %w", nodePath, err)
+	}
+	return nil
+}
+
+// waitForUdevDeviceNode runs udevadm settle and checks the device node again until it's present
+// or the retries are exhausted. A failed settle is retried as well, since it times out while the
+// udev event queue is still busy.
+func waitForUdevDeviceNode(nodePath string) (bool, error) {
+	policy := getUdevSettleRetryPolicy()
+	timeout := strconv.Itoa(int(policy.timeout / time.Second))
+	for retry := 1; retry <= policy.retries; retry++ {
+		logrus.Infof("Waiting for udev to create device node %s, retry %v of %v", nodePath, retry, policy.retries)
+		if _, err := hostCommandRunner(context.Background(), "udevadm", "settle", "--timeout="+timeout); err != nil {
+			logrus.WithError(err).Warnf("Failed to wait for udev to settle for device node %s", nodePath)
+		}
+		exists, err := isBlockDeviceNodePresent(nodePath)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// isBlockDeviceNodePresent checks the block device node on the host. test exits with 1 if it's absent.
+func isBlockDeviceNodePresent(nodePath string) (bool, error) {
+	_, err := hostCommandRunner(context.Background(), "test", "-b", nodePath)
+	if err == nil {
+		return true, nil
+	}
+	if code, ok := ExitCode(err); ok && code == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check device node %s: %w", nodePath, err)
+}
+
+// getMappingDeviceNumber returns the major and minor numbers of the device mapper mapping.
+func getMappingDeviceNumber(mapper string) (major, minor string, err error) {
+	stdout, err := hostCommandRunner(context.Background(), "dmsetup", "info", "-c", "--noheadings", "-o", "major,minor", mapper)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get device number of mapping %s: %w", mapper, err)
+	}
+	numbers := strings.Split(strings.TrimSpace(stdout), ":")
+	if len(numbers) != 2 || numbers[0] == "" || numbers[1] == "" {
+		return "", "", fmt.Errorf("invalid device number %q of mapping %s", strings.TrimSpace(stdout), mapper)
+	}
+	return strings.TrimSpace(numbers[0]), strings.TrimSpace(numbers[1]), nil
+}
@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnsureMapperNode(t *testing.T) {
+	testCases := map[string]struct {
+		// missingChecks is the number of the device node checks failing before the node appears,
+		// -1 if it never appears.
+		missingChecks   int
+		expectedSettles int
+		expectedMknods  [][]string
+	}{
+		"node exists": {
+			missingChecks:   0,
+			expectedSettles: 0,
+			expectedMknods:  nil,
+		},
+		"node created by udev after settle": {
+			missingChecks:   1,
+			expectedSettles: 1,
+			expectedMknods:  nil,
+		},
+		"node created by udev after retried settle": {
+			missingChecks:   2,
+			expectedSettles: 2,
+			expectedMknods:  nil,
+		},
+		"node missing": {
+			missingChecks:   -1,
+			expectedSettles: defaultUdevSettleRetries,
+			expectedMknods:  [][]string{{"-m", "0600", VolumeMapper("vol"), "b", "253", "7"}},
+		},
+	}
+
+	for name, tc := range testCases {
+		var mknods [][]string
+		checks, settles := 0, 0
+		newFakeHostCommand(t, func(command string, args []string) (string, error) {
+			switch command {
+			case "test":
+				checks++
+				if tc.missingChecks >= 0 && checks > tc.missingChecks {
+					return "", nil
+				}
+				return "", &CommandError{Command: command, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+			case "dmsetup":
+				if args[len(args)-1] != MapperName("vol") {
+					return "", fmt.Errorf("unexpected args %v", args)
+				}
+				return "  253:7\n", nil
+			case "udevadm":
+				if !reflect.DeepEqual(args, []string{"settle", "--timeout=10"}) {
+					return "", fmt.Errorf("unexpected args %v", args)
+				}
+				settles++
+				return "", nil
+			case "mknod":
+				mknods = append(mknods, args)
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %v", command)
+		})
+
+		if err := EnsureMapperNode("vol"); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if settles != tc.expectedSettles {
+			t.Fatalf("%v: udevadm settle calls = %v, expected %v", name, settles, tc.expectedSettles)
+		}
+		if !reflect.DeepEqual(mknods, tc.expectedMknods) {
+			t.Fatalf("%v: mknod calls = %v, expected %v", name, mknods, tc.expectedMknods)
+		}
+	}
+}
+
+func TestEnsureMapperNodeMissingMapping(t *testing.T) {
+	var commands []string
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		commands = append(commands, command)
+		switch command {
+		case "test":
+			return "", &CommandError{Command: command, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		case "dmsetup":
+			return "", &CommandError{Command: command, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		}
+		return "", fmt.Errorf("unexpected command %v", command)
+	})
+
+	if err := EnsureMapperNode("vol"); err == nil {
+		t.Fatalf("expected error for missing mapping")
+	}
+	if expected := []string{"test", "dmsetup"}; !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("commands = %v, expected %v", commands, expected)
+	}
+}
+
+func TestSetUdevSettleRetryPolicy(t *testing.T) {
+	t.Cleanup(func() {
+		udevSettlePolicy = udevSettleRetryPolicy{retries: defaultUdevSettleRetries, timeout: defaultUdevSettleTimeout}
+	})
+
+	if err := SetUdevSettleRetryPolicy(-1, time.Second); err == nil {
+		t.Fatalf("expected error for negative retries")
+	}
+	if err := SetUdevSettleRetryPolicy(1, 500*time.Millisecond); err == nil {
+		t.Fatalf("expected error for sub-second timeout")
+	}
+	if err := SetUdevSettleRetryPolicy(0, 5*time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	settles := 0
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		switch command {
+		case "test":
+			return "", &CommandError{Command: command, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		case "dmsetup":
+			return "253:7", nil
+		case "udevadm":
+			settles++
+			return "", nil
+		case "mknod":
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %v", command)
+	})
+	if err := EnsureMapperNode("vol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if settles != 0 {
+		t.Fatalf("udevadm settle calls = %v, expected none with retries disabled", settles)
+	}
+}
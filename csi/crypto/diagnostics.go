@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// encryptionDiagnostics is the encryption state of a node collected for the support bundles.
+// It must never carry any passphrase or key material.
+type encryptionDiagnostics struct {
+	Mappings []mappingDiagnostics `json:"mappings"`
+	// Errors are the collection errors keyed by the mapper name
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type mappingDiagnostics struct {
+	Volume          string `json:"volume"`
+	Mapper          string `json:"mapper"`
+	Device          string `json:"device"`
+	LUKSVersion     string `json:"luksVersion"`
+	Cipher          string `json:"cipher"`
+	KeySize         string `json:"keySize"`
+	EnabledKeyslots []int  `json:"enabledKeyslots"`
+	DMState         string `json:"dmState"`
+}
+
+// CollectEncryptionDiagnostics returns the JSON snapshot of all the open crypt mappings of the
+// volumes on the node, including the LUKS version, the cipher, the keyslot usage and the
+// device mapper state. A mapping failing the collection is skipped and noted in the errors.
+func CollectEncryptionDiagnostics() ([]byte, error) {
+	mappers, err := listCryptMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	diagnostics := encryptionDiagnostics{
+		Mappings: []mappingDiagnostics{},
+		Errors:   map[string]string{},
+	}
+	for _, mapper := range mappers {
+		volume, ok := volumeFromMapperName(mapper)
+		if !ok {
+			// The mapping belongs to another cluster sharing the node
+			continue
+		}
+		mapping, err := collectMappingDiagnostics(volume, mapper)
+		if err != nil {
+			diagnostics.Errors[mapper] = err.Error()
+			continue
+		}
+		diagnostics.Mappings = append(diagnostics.Mappings, *mapping)
+	}
+
+	return json.Marshal(diagnostics)
+}
+
+func collectMappingDiagnostics(volume, mapper string) (*mappingDiagnostics, error) {
+	stdout, err := luksStatus(context.Background(), mapper)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status: %w", err)
+	}
+	devicePath := parseCryptSetupKeyValues(stdout)["device"]
+	if devicePath == "" {
+		return nil, fmt.Errorf("failed to get backing device")
+	}
+
+	info, err := GetLUKSDeviceInfo(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	keySlots, err := getEnabledKeyslots(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	dmState, err := getMappingState(mapper)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mappingDiagnostics{
+		Volume:          volume,
+		Mapper:          mapper,
+		Device:          devicePath,
+		LUKSVersion:     info.Version,
+		Cipher:          info.Cipher,
+		KeySize:         info.KeySize,
+		EnabledKeyslots: keySlots,
+		DMState:         dmState,
+	}, nil
+}
+
+// listCryptMappings returns the names of the device mapper crypt targets on the node.
+func listCryptMappings() ([]string, error) {
+	stdout, err := hostCommandRunner(context.Background(), "dmsetup", "ls", "--target", "crypt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list crypt mappings: %w", err)
+	}
+
+	mappers := []string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		// dmsetup prints "No devices found" if there is no mapping
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "(") {
+			continue
+		}
+		mappers = append(mappers, fields[0])
+	}
+	return mappers, nil
+}
+
+// getMappingState returns the device mapper state of the mapping, e.g. ACTIVE or SUSPENDED.
+func getMappingState(mapper string) (string, error) {
+	stdout, err := hostCommandRunner(context.Background(), "dmsetup", "info", mapper)
+	if err != nil {
+		return "", fmt.Errorf("failed to get device mapper info: %w", err)
+	}
+	state := parseCryptSetupKeyValues(stdout)["State"]
+	if state == "" {
+		return "", fmt.Errorf("failed to parse device mapper state")
+	}
+	return state, nil
+}
+
+// volumeFromMapperName returns the volume of the mapper name, which is false if the
+// mapper name doesn't have the mapper salt of this cluster.
+func volumeFromMapperName(mapper string) (string, bool) {
+	mapperSaltLock.RLock()
+	defer mapperSaltLock.RUnlock()
+	if mapperSalt == "" {
+		return mapper, true
+	}
+	volume := strings.TrimPrefix(mapper, mapperSalt+"-")
+	return volume, volume != mapper && volume != ""
+}
@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCollectEncryptionDiagnostics(t *testing.T) {
+	devices := map[string]string{
+		"vol-1": "/dev/longhorn/vol-1",
+		"vol-2": "/dev/longhorn/vol-2",
+	}
+	dumps := map[string]string{
+		"/dev/longhorn/vol-1": testLUKS1Dump,
+		"/dev/longhorn/vol-2": testLUKS2Dump,
+	}
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status":
+			device, ok := devices[args[1]]
+			if !ok {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			return fmt.Sprintf(testStatusTemplate, args[1], device), nil
+		case "luksDump":
+			if args[1] == "--dump-json-metadata" {
+				return "", fmt.Errorf("unsupported option")
+			}
+			return dumps[args[1]], nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		if command != "dmsetup" {
+			return "", fmt.Errorf("unexpected command %v", command)
+		}
+		switch args[0] {
+		case "ls":
+			return "vol-1\t(253:0)\nvol-2\t(253:1)\nvol-gone\t(253:2)\n", nil
+		case "info":
+			return fmt.Sprintf("Name:              %s\nState:             ACTIVE\nRead Ahead:        256\n", args[1]), nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	output, err := CollectEncryptionDiagnostics()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	diagnostics := struct {
+		Mappings []map[string]interface{} `json:"mappings"`
+		Errors   map[string]string        `json:"errors"`
+	}{}
+	if err := json.Unmarshal(output, &diagnostics); err != nil {
+		t.Fatalf("failed to unmarshal diagnostics %s: %v", output, err)
+	}
+
+	if len(diagnostics.Mappings) != 2 {
+		t.Fatalf("mappings = %v, expected 2 mappings", diagnostics.Mappings)
+	}
+	expectedKeys := []string{"cipher", "device", "dmState", "enabledKeyslots", "keySize", "luksVersion", "mapper", "volume"}
+	for _, mapping := range diagnostics.Mappings {
+		keys := []string{}
+		for key := range mapping {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Fatalf("mapping keys = %v, expected %v", keys, expectedKeys)
+		}
+		if mapping["dmState"] != "ACTIVE" {
+			t.Fatalf("dm state = %v, expected ACTIVE", mapping["dmState"])
+		}
+	}
+	if diagnostics.Mappings[0]["volume"] != "vol-1" || diagnostics.Mappings[0]["luksVersion"] != "1" ||
+		diagnostics.Mappings[1]["volume"] != "vol-2" || diagnostics.Mappings[1]["luksVersion"] != "2" {
+		t.Fatalf("unexpected mappings %v", diagnostics.Mappings)
+	}
+	if _, exist := diagnostics.Errors["vol-gone"]; !exist || len(diagnostics.Errors) != 1 {
+		t.Fatalf("errors = %v, expected the error of vol-gone only", diagnostics.Errors)
+	}
+	if strings.Contains(strings.ToLower(string(output)), "passphrase") {
+		t.Fatalf("diagnostics should not carry any key material: %s", output)
+	}
+}
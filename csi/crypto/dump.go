@@ -0,0 +1,201 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const luks1SectorSize = 512
+
+// LUKSDump is the structured luksDump output of a LUKS device, for debugging the keyslots and
+// the cipher configuration.
+type LUKSDump struct {
+	Version string
+	UUID    string
+	Cipher  string
+	Hash    string
+	// PayloadOffset is the offset of the data from the start of the device in bytes
+	PayloadOffset int64
+	Keyslots      []LUKSKeyslot
+}
+
+// LUKSKeyslot describes a passphrase keyslot and its key derivation parameters. The parameters
+// not applicable to the PBKDF are zero, e.g. the memory cost for pbkdf2. LUKS1 lists all the
+// keyslots including the disabled ones, while LUKS2 only lists the enabled ones.
+type LUKSKeyslot struct {
+	Index     int
+	Enabled   bool
+	PBKDF     string
+	AFStripes int
+	// Iterations is the iteration count of pbkdf2
+	Iterations int
+	// TimeCost, Memory in KiB and Threads are the costs of the argon2 PBKDFs
+	TimeCost int
+	Memory   int
+	Threads  int
+	// DigestID is the digest verifying the volume key unlocked by the keyslot. LUKS1 has the single
+	// digest 0.
+	DigestID int
+}
+
+// DumpDevice reads the LUKS header of the device into a LUKSDump. It's read-only and doesn't
+// require the passphrase.
+func DumpDevice(devicePath string) (*LUKSDump, error) {
+	stdout, err := luksDump(context.Background(), devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS header of device %s: %w", devicePath, err)
+	}
+	dump, err := parseLUKSDump(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS header of device %s: %w", devicePath, err)
+	}
+	return dump, nil
+}
+
+func parseLUKSDump(stdout string) (*LUKSDump, error) {
+	info, err := parseLUKSDeviceInfo(stdout)
+	if err != nil {
+		return nil, err
+	}
+	dump := &LUKSDump{
+		Version: info.Version,
+		UUID:    info.UUID,
+		Cipher:  info.Cipher,
+		Hash:    info.Hash,
+	}
+
+	kvs := parseCryptSetupKeyValues(stdout)
+	if info.Version == "1" {
+		sectors, err := strconv.ParseInt(kvs["Payload offset"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload offset %q", kvs["Payload offset"])
+		}
+		dump.PayloadOffset = sectors * luks1SectorSize
+		dump.Keyslots, err = parseLUKS1Keyslots(stdout)
+	} else {
+		// The first offset is the one of the data segment
+		if dump.PayloadOffset, err = parseBytes(kvs["offset"]); err != nil {
+			return nil, fmt.Errorf("invalid data segment offset: %w", err)
+		}
+		dump.Keyslots, err = parseLUKS2Keyslots(stdout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// parseLUKS1Keyslots parses the "Key Slot N: ENABLED/DISABLED" entries, each followed by
+// its tab indented properties if it's enabled.
+func parseLUKS1Keyslots(stdout string) ([]LUKSKeyslot, error) {
+	keySlots := []LUKSKeyslot{}
+	var current *LUKSKeyslot
+	for _, line := range strings.Split(stdout, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "Key Slot ") {
+			kv := strings.SplitN(strings.TrimPrefix(trimmed, "Key Slot "), ":", 2)
+			index, err := strconv.Atoi(kv[0])
+			if err != nil || len(kv) != 2 {
+				return nil, fmt.Errorf("invalid keyslot %q", trimmed)
+			}
+			keySlot := LUKSKeyslot{Index: index, Enabled: strings.TrimSpace(kv[1]) == "ENABLED"}
+			if keySlot.Enabled {
+				keySlot.PBKDF = "pbkdf2"
+			}
+			keySlots = append(keySlots, keySlot)
+			current = &keySlots[len(keySlots)-1]
+			continue
+		}
+		if current == nil || !strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if err := current.setParam(trimmed); err != nil {
+			return nil, err
+		}
+	}
+	return keySlots, nil
+}
+
+// parseLUKS2Keyslots parses the "Keyslots:" section, in which the keyslot headers are indented
+// with spaces and their properties are indented with tabs. The reencryption keyslots are skipped.
+func parseLUKS2Keyslots(stdout string) ([]LUKSKeyslot, error) {
+	keySlots := []LUKSKeyslot{}
+	var current *LUKSKeyslot
+	inKeyslots := false
+	for _, line := range strings.Split(stdout, "\n") {
+		if line == "Keyslots:" {
+			inKeyslots = true
+			continue
+		}
+		if !inKeyslots {
+			continue
+		}
+		if line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			// Reached the next section
+			break
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(line, "  ") {
+			kv := strings.SplitN(trimmed, ":", 2)
+			index, err := strconv.Atoi(kv[0])
+			if err != nil || len(kv) != 2 {
+				return nil, fmt.Errorf("invalid keyslot %q", trimmed)
+			}
+			current = nil
+			if strings.HasPrefix(strings.TrimSpace(kv[1]), "reencrypt") {
+				continue
+			}
+			keySlots = append(keySlots, LUKSKeyslot{Index: index, Enabled: true})
+			current = &keySlots[len(keySlots)-1]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if err := current.setParam(trimmed); err != nil {
+			return nil, err
+		}
+	}
+	return keySlots, nil
+}
+
+// setParam sets the key derivation parameter of the keyslot from the "key: value" line.
+// The other properties are ignored.
+func (k *LUKSKeyslot) setParam(line string) error {
+	kv := strings.SplitN(line, ":", 2)
+	if len(kv) != 2 {
+		return nil
+	}
+	key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+	var param *int
+	switch key {
+	case "PBKDF":
+		k.PBKDF = value
+		return nil
+	case "AF stripes":
+		param = &k.AFStripes
+	case "Iterations":
+		param = &k.Iterations
+	case "Time cost":
+		param = &k.TimeCost
+	case "Memory":
+		param = &k.Memory
+	case "Threads":
+		param = &k.Threads
+	case "Digest ID":
+		param = &k.DigestID
+	default:
+		return nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %v %q of keyslot %v", strings.ToLower(key), value, k.Index)
+	}
+	*param = n
+	return nil
+}
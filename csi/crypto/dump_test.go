@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLUKSDump(t *testing.T) {
+	dump, err := parseLUKSDump(testLUKS1Dump)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &LUKSDump{
+		Version:       "1",
+		UUID:          "6f4c9e1a-3b2d-4e8f-9a7c-1d2e3f4a5b6c",
+		Cipher:        "aes-xts-plain64",
+		Hash:          "sha256",
+		PayloadOffset: 4096 * 512,
+		Keyslots: []LUKSKeyslot{
+			{Index: 0, Enabled: true, PBKDF: "pbkdf2", AFStripes: 4000, Iterations: 1000},
+			{Index: 1},
+			{Index: 2, Enabled: true, PBKDF: "pbkdf2", AFStripes: 4000, Iterations: 1000},
+			{Index: 3}, {Index: 4}, {Index: 5}, {Index: 6}, {Index: 7},
+		},
+	}
+	if !reflect.DeepEqual(dump, expected) {
+		t.Fatalf("LUKS1 dump = %+v, expected %+v", dump, expected)
+	}
+
+	dump, err = parseLUKSDump(testLUKS2Dump)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = &LUKSDump{
+		Version:       "2",
+		UUID:          "2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809",
+		Cipher:        "aes-xts-plain64",
+		Hash:          "sha256",
+		PayloadOffset: 16777216,
+		Keyslots: []LUKSKeyslot{
+			{Index: 0, Enabled: true, PBKDF: "argon2i", AFStripes: 4000, TimeCost: 4, Memory: 1048576, Threads: 4},
+			{Index: 3, Enabled: true, PBKDF: "argon2i", AFStripes: 4000, TimeCost: 4, Memory: 1048576, Threads: 4},
+		},
+	}
+	if !reflect.DeepEqual(dump, expected) {
+		t.Fatalf("LUKS2 dump = %+v, expected %+v", dump, expected)
+	}
+
+	if _, err := parseLUKSDump(strings.Replace(testLUKS2Dump, "Threads:    4", "Threads:    four", 1)); err == nil {
+		t.Fatalf("expected an error for a malformed keyslot parameter")
+	}
+}
+
+func TestDumpDevice(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if reflect.DeepEqual(args, []string{"luksDump", "/dev/sdb"}) {
+			return testLUKS2Dump, nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	dump, err := DumpDevice("/dev/sdb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dump.Keyslots) != 2 {
+		t.Fatalf("keyslots = %+v, expected 2 keyslots", dump.Keyslots)
+	}
+	for i := range f.calls {
+		if f.stdins[i] != "" {
+			t.Fatalf("unexpected passphrase passed to %v", f.calls[i])
+		}
+	}
+}
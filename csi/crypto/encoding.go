@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// PassphraseEncodingRaw passes the passphrase to cryptsetup as is, which is the default.
+	PassphraseEncodingRaw = "raw"
+	// PassphraseEncodingHex and PassphraseEncodingBase64 decode the passphrase into the raw bytes
+	// before passing it to cryptsetup, e.g. for the binary key material returned by a KMS.
+	PassphraseEncodingHex    = "hex"
+	PassphraseEncodingBase64 = "base64"
+)
+
+// DecodePassphrase decodes the passphrase of the encoding into the raw bytes fed to cryptsetup.
+// An empty encoding is treated as PassphraseEncodingRaw. The surrounding whitespace of an encoded
+// passphrase is ignored. The decode errors never contain the passphrase.
+func DecodePassphrase(passphrase, encoding string) (string, error) {
+	if err := validatePassphraseEncoding(encoding); err != nil {
+		return "", err
+	}
+
+	var decoded []byte
+	var err error
+	switch encoding {
+	case "", PassphraseEncodingRaw:
+		return passphrase, nil
+	case PassphraseEncodingHex:
+		decoded, err = hex.DecodeString(strings.TrimSpace(passphrase))
+		if errors.Is(err, hex.ErrLength) {
+			return "", fmt.Errorf("failed to decode %v passphrase: odd length", encoding)
+		}
+	case PassphraseEncodingBase64:
+		decoded, err = base64.StdEncoding.DecodeString(strings.TrimSpace(passphrase))
+	}
+	defer zeroBytes(decoded)
+	if err != nil {
+		// The underlying error may quote the invalid character of the passphrase
+		return "", fmt.Errorf("failed to decode %v passphrase: invalid character", encoding)
+	}
+	if len(decoded) == 0 {
+		return "", fmt.Errorf("failed to decode %v passphrase: empty", encoding)
+	}
+	return string(decoded), nil
+}
+
+func validatePassphraseEncoding(encoding string) error {
+	switch encoding {
+	case "", PassphraseEncodingRaw, PassphraseEncodingHex, PassphraseEncodingBase64:
+		return nil
+	}
+	return fmt.Errorf("invalid passphrase encoding %v, it should be one of %v", encoding,
+		[]string{PassphraseEncodingRaw, PassphraseEncodingHex, PassphraseEncodingBase64})
+}
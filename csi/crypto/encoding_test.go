@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodePassphrase(t *testing.T) {
+	binaryKey := "\x00\x01\xfe\xff\n key"
+
+	testCases := map[string]struct {
+		passphrase    string
+		encoding      string
+		expected      string
+		expectedError string
+	}{
+		"default":        {passphrase: "passphrase", expected: "passphrase"},
+		"raw":            {passphrase: " passphrase\n", encoding: PassphraseEncodingRaw, expected: " passphrase\n"},
+		"hex":            {passphrase: "0001feff0a206b6579", encoding: PassphraseEncodingHex, expected: binaryKey},
+		"hex uppercase":  {passphrase: "0001FEFF0A206B6579\n", encoding: PassphraseEncodingHex, expected: binaryKey},
+		"base64":         {passphrase: "AAH+/woga2V5", encoding: PassphraseEncodingBase64, expected: binaryKey},
+		"invalid hex":    {passphrase: "secretzz", encoding: PassphraseEncodingHex, expectedError: "invalid character"},
+		"odd hex":        {passphrase: "abc", encoding: PassphraseEncodingHex, expectedError: "odd length"},
+		"invalid base64": {passphrase: "secret!!", encoding: PassphraseEncodingBase64, expectedError: "invalid character"},
+		"empty base64":   {passphrase: "\t\n", encoding: PassphraseEncodingBase64, expectedError: "empty"},
+		"invalid":        {passphrase: "secret", encoding: "base32", expectedError: "invalid passphrase encoding base32"},
+	}
+
+	for name, tc := range testCases {
+		decoded, err := DecodePassphrase(tc.passphrase, tc.encoding)
+		if tc.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("%v: err = %v, expected %q", name, err, tc.expectedError)
+			}
+			if strings.Contains(err.Error(), tc.passphrase) {
+				t.Fatalf("%v: err = %v, expected the passphrase not to be leaked", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if decoded != tc.expected {
+			t.Fatalf("%v: decoded = %q, expected %q", name, decoded, tc.expected)
+		}
+	}
+}
+
+func TestPassphraseEncoding(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	params.PassphraseEncoding = PassphraseEncodingHex
+	if err := EncryptVolume("/dev/longhorn/vol", "0001feff", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "0001feff", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, call := range f.calls {
+		if (call[0] == "luksOpen" || call[1] == "luksFormat") && f.stdins[i] != "\x00\x01\xfe\xff" {
+			t.Fatalf("cryptsetup %v got stdin %q, expected the decoded passphrase", call, f.stdins[i])
+		}
+	}
+
+	if err := EncryptVolume("/dev/longhorn/vol", "not hex", params); err == nil {
+		t.Fatalf("expected an error for the invalid hex passphrase")
+	}
+	params.PassphraseEncoding = "base32"
+	if err := EncryptVolume("/dev/longhorn/vol", "0001feff", params); err == nil {
+		t.Fatalf("expected an error for the invalid encoding")
+	}
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "0001feff", params); err == nil {
+		t.Fatalf("expected an error for the invalid encoding")
+	}
+}
@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// cryptSetupExitCodeNoPermission is returned by cryptsetup for a bad passphrase
+	cryptSetupExitCodeNoPermission = 2
+	// cryptSetupExitCodeBusy is returned by cryptsetup if the device is in use
+	cryptSetupExitCodeBusy = 5
+	// cryptSetupExitCodeNotLUKS is returned by cryptsetup isLuks and luksUUID if the device has no LUKS header
+	cryptSetupExitCodeNotLUKS = 1
+	// cryptSetupExitCodeNoDevice is returned by cryptsetup if the device or the file doesn't exist
+	cryptSetupExitCodeNoDevice = 4
+)
+
+// ErrInvalidPassphrase is wrapped in the error if the passphrase doesn't unlock the device.
+var ErrInvalidPassphrase = errors.New("invalid passphrase")
+
+// ErrDeviceNotLUKS is wrapped in the error if the device is not a LUKS container.
+var ErrDeviceNotLUKS = errors.New("not a LUKS device")
+
+// ErrNotLUKSDevice is the former name of ErrDeviceNotLUKS.
+//
+// Deprecated: use ErrDeviceNotLUKS.
+var ErrNotLUKSDevice = ErrDeviceNotLUKS
+
+// ErrDeviceBusy is wrapped in the error if the device or the mapping is still in use.
+var ErrDeviceBusy = errors.New("device busy")
+
+// ErrKeyslotsFull is wrapped in the error if no free keyslot is left for a new passphrase.
+var ErrKeyslotsFull = errors.New("all keyslots in use")
+
+// ErrHeaderHashMismatch is wrapped in the error if the LUKS header differs from the known-good one.
+var ErrHeaderHashMismatch = errors.New("LUKS header hash mismatch")
+
+// ErrUnexpectedOutputEncoding is wrapped in the error if the output of cryptsetup is not valid UTF-8.
+var ErrUnexpectedOutputEncoding = errors.New("unexpected output encoding")
+
+// CommandError is returned when cryptsetup or another host command fails.
+// It carries the exit code so that the callers can diagnose the failure.
+type CommandError struct {
+	Command  string
+	Args     []string
+	Output   string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("failed to run %v args: %v output: %v stderr: %v exit code: %v error: %v",
+		e.Command, e.Args, e.Output, strings.TrimSpace(e.Stderr), e.ExitCode, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// wrapCryptSetupError wraps the failure of cryptsetup into the matching error of the package, so the
+// callers can tell the failures apart via errors.Is. The exit code 2 only means a wrong passphrase
+// for the actions reading one. The CommandError stays accessible via errors.As.
+func wrapCryptSetupError(err error, readsPassphrase bool) error {
+	if err == nil {
+		return nil
+	}
+	code, ok := ExitCode(err)
+	switch {
+	case readsPassphrase && ok && code == cryptSetupExitCodeNoPermission:
+		return fmt.Errorf("%w: %w", ErrInvalidPassphrase, err)
+	case isDeviceBusy(err):
+		return fmt.Errorf("%w: %w", ErrDeviceBusy, err)
+	case strings.Contains(err.Error(), "is not a valid LUKS device"):
+		return fmt.Errorf("%w: %w", ErrDeviceNotLUKS, err)
+	case strings.Contains(err.Error(), "All key slots full"):
+		return fmt.Errorf("%w: %w", ErrKeyslotsFull, err)
+	}
+	return err
+}
+
+// ExitCode returns the exit code of the failed command wrapped in the error.
+// It returns false if the error is not caused by a command exiting with a code.
+func ExitCode(err error) (int, bool) {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode >= 0 {
+		return cmdErr.ExitCode, true
+	}
+	return 0, false
+}
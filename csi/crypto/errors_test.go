@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandExitCode(t *testing.T) {
+	_, err := runCommand(context.Background(), "sh", nil, "-c", "echo failure >&2; exit 4")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	exitCode, ok := ExitCode(err)
+	if !ok || exitCode != 4 {
+		t.Fatalf("exit code = %v, %v, expected 4", exitCode, ok)
+	}
+	if cmdErr := err.(*CommandError); cmdErr.Stderr != "failure\n" {
+		t.Fatalf("stderr = %q, expected the command stderr", cmdErr.Stderr)
+	}
+}
+
+func TestExitCodeFromFailedOperation(t *testing.T) {
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksDump" {
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 4, Err: fmt.Errorf("exit status 4")}
+		}
+		return "", nil
+	})
+
+	_, err := GetLonghornVolumeFromHeader("/dev/sdb")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if exitCode, ok := ExitCode(err); !ok || exitCode != 4 {
+		t.Fatalf("exit code = %v, %v, expected 4", exitCode, ok)
+	}
+
+	if _, ok := ExitCode(fmt.Errorf("not a command error")); ok {
+		t.Fatalf("expected no exit code for a generic error")
+	}
+}
+
+func TestRunCommandContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := runCommand(ctx, "sleep", nil, "10")
+	if err != context.Canceled {
+		t.Fatalf("err = %v, expected %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command ran for %v, expected it to be killed on cancel", elapsed)
+	}
+}
+
+func TestTypedCryptSetupErrors(t *testing.T) {
+	testCases := map[string]struct {
+		err       error
+		operation func() error
+		expected  error
+	}{
+		"open with invalid passphrase": {
+			err:       &CommandError{Command: "cryptsetup", ExitCode: 2, Stderr: "No key available with this passphrase.", Err: fmt.Errorf("exit status 2")},
+			operation: func() error { return OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil) },
+			expected:  ErrInvalidPassphrase,
+		},
+		"open not LUKS device": {
+			err:       &CommandError{Command: "cryptsetup", ExitCode: 1, Stderr: "Device /dev/longhorn/vol is not a valid LUKS device.", Err: fmt.Errorf("exit status 1")},
+			operation: func() error { return OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil) },
+			expected:  ErrDeviceNotLUKS,
+		},
+		"open busy device": {
+			err:       &CommandError{Command: "cryptsetup", ExitCode: 5, Stderr: "Device vol already exists.", Err: fmt.Errorf("exit status 5")},
+			operation: func() error { return OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil) },
+			expected:  ErrDeviceBusy,
+		},
+		"close busy device": {
+			err: newBusyError(MapperName("vol")),
+			operation: func() error {
+				_, err := luksClose(context.Background(), MapperName("vol"))
+				return err
+			},
+			expected: ErrDeviceBusy,
+		},
+		"resize with invalid passphrase": {
+			err: &CommandError{Command: "cryptsetup", ExitCode: 2, Err: fmt.Errorf("exit status 2")},
+			operation: func() error {
+				_, err := luksResize(context.Background(), MapperName("vol"), "passphrase")
+				return err
+			},
+			expected: ErrInvalidPassphrase,
+		},
+		"add key to full device": {
+			err: &CommandError{Command: "cryptsetup", ExitCode: 1, Stderr: "All key slots full.", Err: fmt.Errorf("exit status 1")},
+			operation: func() error {
+				_, err := luksAddKey(context.Background(), "/dev/sdb", "old", "new", 3)
+				return err
+			},
+			expected: ErrKeyslotsFull,
+		},
+		"status busy device": {
+			err: newBusyError(MapperName("vol")),
+			operation: func() error {
+				_, _, err := DeviceEncryptionStatus(VolumeMapper("vol"))
+				return err
+			},
+			expected: ErrDeviceBusy,
+		},
+	}
+
+	for name, tc := range testCases {
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			if args[0] == "status" && !strings.HasPrefix(name, "status") {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			return "", tc.err
+		})
+
+		err := tc.operation()
+		if !errors.Is(err, tc.expected) {
+			t.Fatalf("%v: err = %v, expected %v", name, err, tc.expected)
+		}
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) {
+			t.Fatalf("%v: err = %v, expected the command error to stay accessible", name, err)
+		}
+	}
+
+	// The exit code 2 of the status means no permission rather than a wrong passphrase
+	if err := wrapCryptSetupError(&CommandError{Command: "cryptsetup", ExitCode: 2, Err: fmt.Errorf("exit status 2")}, false); errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("unexpected invalid passphrase error %v", err)
+	}
+}
+
+func TestUnexpectedOutputEncoding(t *testing.T) {
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksDump" {
+			return "LUKS header information\nVersion:       \t2\nLabel:         \tvol\xff\xfe\n", nil
+		}
+		return "", nil
+	})
+
+	_, err := DumpDevice("/dev/longhorn/vol")
+	if !errors.Is(err, ErrUnexpectedOutputEncoding) {
+		t.Fatalf("err = %v, expected ErrUnexpectedOutputEncoding", err)
+	}
+	if !strings.Contains(err.Error(), "cryptsetup luksDump") || !strings.Contains(err.Error(), "at byte 61") {
+		t.Fatalf("err = %v, expected the action and the offset of the invalid byte", err)
+	}
+	if strings.Contains(err.Error(), "Label") {
+		t.Fatalf("err = %v, expected the output not to be leaked", err)
+	}
+
+	// The valid multi-byte characters are accepted
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		return "Label: 卷\n", nil
+	})
+	if stdout, err := runValidatedCryptSetup(context.Background(), nil, "luksDump", "/dev/longhorn/vol"); err != nil || stdout != "Label: 卷\n" {
+		t.Fatalf("stdout = %q, err = %v, expected the valid UTF-8 output", stdout, err)
+	}
+}
+
+func TestRunCommandLocale(t *testing.T) {
+	stdout, err := runCommand(context.Background(), "sh", nil, "-c", "echo $LC_ALL")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.TrimSpace(stdout) != "C" {
+		t.Fatalf("LC_ALL = %q, expected the C locale", stdout)
+	}
+}
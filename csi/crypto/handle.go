@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OpenHandle is the mapping of a volume opened by OpenVolumeScoped. The mapping is torn
+// down by Close, so the scoped operations can `defer handle.Close()`.
+type OpenHandle struct {
+	volume string
+	// owned is false if the mapping was already open, which is left to its owner to close
+	owned bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenVolumeScoped opens the volume for a scoped operation like a verification or a backup,
+// and returns the handle closing the mapping once the operation is done. If the volume is
+// already open, e.g. it's attached, the handle doesn't close the mapping.
+func OpenVolumeScoped(volume, devicePath, passphrase string) (*OpenHandle, error) {
+	wasOpen, _ := IsDeviceOpen(VolumeMapper(volume))
+	if err := OpenVolume(volume, devicePath, passphrase, nil); err != nil {
+		// Don't leak the mapping if the open failed after the activation
+		if isOpen, _ := IsDeviceOpen(VolumeMapper(volume)); isOpen && !wasOpen {
+			if closeErr := CloseVolume(volume); closeErr != nil {
+				logrus.Warnf("failed to close LUKS device %s after failed open: %v", volume, closeErr)
+			}
+		}
+		return nil, err
+	}
+	return &OpenHandle{volume: volume, owned: !wasOpen}, nil
+}
+
+// Path returns the path of the mapped device.
+func (h *OpenHandle) Path() string {
+	return VolumeMapper(h.volume)
+}
+
+// Close closes the mapping if it's opened by the handle. It's idempotent, the later calls
+// return the result of the first one.
+func (h *OpenHandle) Close() error {
+	h.closeOnce.Do(func() {
+		if !h.owned {
+			logrus.Debugf("Leaving LUKS device %s open since it's not opened by the handle", h.volume)
+			return
+		}
+		h.closeErr = CloseVolume(h.volume)
+	})
+	return h.closeErr
+}
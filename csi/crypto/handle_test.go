@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newFakeMappings(t *testing.T, open map[string]bool) *fakeCryptSetup {
+	return newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status":
+			if !open[args[1]] {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/"+args[1]), nil
+		case "luksOpen":
+			open[args[2]] = true
+			return "", nil
+		case "luksClose":
+			delete(open, args[1])
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+}
+
+func TestOpenVolumeScoped(t *testing.T) {
+	open := map[string]bool{}
+	f := newFakeMappings(t, open)
+
+	verify := func() error {
+		handle, err := OpenVolumeScoped("vol", "/dev/longhorn/vol", "passphrase")
+		if err != nil {
+			return err
+		}
+		defer handle.Close()
+
+		if !open[MapperName("vol")] {
+			t.Fatalf("expected the mapping to be open while in use")
+		}
+		if handle.Path() != VolumeMapper("vol") {
+			t.Fatalf("path = %v, expected %v", handle.Path(), VolumeMapper("vol"))
+		}
+		return fmt.Errorf("early return")
+	}
+	if err := verify(); err == nil {
+		t.Fatalf("expected the error of the early return")
+	}
+	if open[MapperName("vol")] {
+		t.Fatalf("expected the mapping to be closed by the deferred close")
+	}
+
+	handle, err := OpenVolumeScoped("vol", "/dev/longhorn/vol", "passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.calls = nil
+	for i := 0; i < 3; i++ {
+		if err := handle.Close(); err != nil {
+			t.Fatalf("unexpected error closing %v times: %v", i+1, err)
+		}
+	}
+	closes := 0
+	for _, call := range f.calls {
+		if call[0] == "luksClose" {
+			closes++
+		}
+	}
+	if closes != 1 {
+		t.Fatalf("mapping is closed %v times, expected once", closes)
+	}
+}
+
+func TestOpenVolumeScopedAlreadyOpen(t *testing.T) {
+	open := map[string]bool{MapperName("vol"): true}
+	f := newFakeMappings(t, open)
+
+	handle, err := OpenVolumeScoped("vol", "/dev/longhorn/vol", "passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := handle.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksClose"); call != nil || !open[MapperName("vol")] {
+		t.Fatalf("expected the mapping opened by others to be left open, luksClose %v", call)
+	}
+}
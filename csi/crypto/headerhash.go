@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GetHeaderHash returns the hex encoded SHA-256 of the LUKS header area of the device, which is
+// everything before the data, i.e. the binary header, the metadata and the keyslots. It changes
+// with any header modification including adding or removing a passphrase, so the hash has to be
+// recorded again after those. The device can be open.
+func GetHeaderHash(devicePath string) (string, error) {
+	dump, err := DumpDevice(devicePath)
+	if err != nil {
+		return "", err
+	}
+	if dump.PayloadOffset <= 0 {
+		return "", fmt.Errorf("cannot hash LUKS header of device %s without the header on the device", devicePath)
+	}
+
+	// The header is binary, read it as is and hash it here rather than relying on the host tools
+	stdout, err := hostCommandRunner(context.Background(), "dd", "if="+devicePath, "bs=1M", "count="+strconv.FormatInt(dump.PayloadOffset, 10),
+		"iflag=count_bytes", "status=none")
+	if err != nil {
+		return "", fmt.Errorf("failed to read LUKS header of device %s: %w", devicePath, err)
+	}
+	if int64(len(stdout)) != dump.PayloadOffset {
+		return "", fmt.Errorf("failed to read LUKS header of device %s: read %v bytes, expected %v", devicePath, len(stdout), dump.PayloadOffset)
+	}
+	sum := sha256.Sum256([]byte(stdout))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// OpenVolumeVerified opens the volume like OpenVolume with the default params, but only once the
+// hash of the LUKS header matches the expected one the caller recorded via GetHeaderHash in a
+// known-good state. It refuses to open a device whose header was substituted, e.g. with a header
+// having an extra keyslot of a passphrase known to the attacker. The header is verified right
+// before the open, but a header modified between the verification and the open is not detected.
+func OpenVolumeVerified(volume, devicePath, passphrase, expectedHeaderHash string) error {
+	if expectedHeaderHash == "" {
+		return fmt.Errorf("expected header hash is required to open device %s verified", devicePath)
+	}
+	headerHash, err := GetHeaderHash(devicePath)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(headerHash, expectedHeaderHash) {
+		return fmt.Errorf("refusing to open device %s with header hash %s, expected %s: %w",
+			devicePath, headerHash, expectedHeaderHash, ErrHeaderHashMismatch)
+	}
+	return OpenVolume(volume, devicePath, passphrase, nil)
+}
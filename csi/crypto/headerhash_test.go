@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newFakeHeader fakes a LUKS1 device whose header area of 2MiB is read by dd as the header.
+func newFakeHeader(t *testing.T, header string) *fakeCryptSetup {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksDump" {
+			return testLUKS1Dump, nil
+		}
+		return closedDeviceHandler(args)
+	})
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		if command == "dd" {
+			expected := []string{"if=/dev/longhorn/vol", "bs=1M", "count=2097152", "iflag=count_bytes", "status=none"}
+			if !reflect.DeepEqual(args, expected) {
+				t.Fatalf("dd args = %v, expected %v", args, expected)
+			}
+			return header, nil
+		}
+		return blankDeviceHandler(command, args)
+	})
+	return f
+}
+
+func TestOpenVolumeVerified(t *testing.T) {
+	header := strings.Repeat("L", 2<<20)
+	sum := sha256.Sum256([]byte(header))
+	headerHash := hex.EncodeToString(sum[:])
+
+	f := newFakeHeader(t, header)
+	hash, err := GetHeaderHash("/dev/longhorn/vol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hash != headerHash {
+		t.Fatalf("header hash = %v, expected %v", hash, headerHash)
+	}
+	if err := OpenVolumeVerified("vol", "/dev/longhorn/vol", "passphrase", strings.ToUpper(headerHash)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.lastCall("luksOpen") == nil {
+		t.Fatalf("expected luksOpen for the matching header")
+	}
+
+	substituted := "S" + header[1:]
+	f = newFakeHeader(t, substituted)
+	err = OpenVolumeVerified("vol", "/dev/longhorn/vol", "passphrase", headerHash)
+	if !errors.Is(err, ErrHeaderHashMismatch) {
+		t.Fatalf("expected ErrHeaderHashMismatch for the substituted header, got %v", err)
+	}
+	if f.lastCall("luksOpen") != nil {
+		t.Fatalf("unexpected luksOpen for the substituted header")
+	}
+
+	f = newFakeHeader(t, header[:1024])
+	if err := OpenVolumeVerified("vol", "/dev/longhorn/vol", "passphrase", headerHash); err == nil {
+		t.Fatalf("expected an error for the short read header")
+	}
+	if f.lastCall("luksOpen") != nil {
+		t.Fatalf("unexpected luksOpen for the short read header")
+	}
+
+	if err := OpenVolumeVerified("vol", "/dev/longhorn/vol", "passphrase", ""); err == nil {
+		t.Fatalf("expected an error without the expected header hash")
+	}
+}
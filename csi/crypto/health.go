@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dmsetupDepRegex matches a dependency of dmsetup deps, which is the device name if it can be
+// resolved, otherwise the device number like "(8, 16)".
+var dmsetupDepRegex = regexp.MustCompile(`\(([^)]*)\)`)
+
+// IsMappingHealthy checks the existing mapping of the volume is usable, which means it's still
+// a crypt target rather than replaced by the error target, and its backing device is present.
+// A mapping left behind by an ungraceful shutdown or detach may survive its backing device, and
+// all the IO to it fails. The error is returned if the mapping cannot be inspected.
+func IsMappingHealthy(volume string) (bool, error) {
+	mapper := MapperName(volume)
+	stdout, err := hostCommandRunner(context.Background(), "dmsetup", "status", mapper)
+	if err != nil {
+		return false, fmt.Errorf("failed to get device mapper status of mapping %s: %w", mapper, err)
+	}
+	// Each line is "<start> <length> <target> [<target status>]"
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			logrus.Warnf("Mapping %s has no table loaded: %q", mapper, stdout)
+			return false, nil
+		}
+		if fields[2] != "crypt" {
+			logrus.Warnf("Mapping %s has the %s target rather than crypt", mapper, fields[2])
+			return false, nil
+		}
+	}
+
+	stdout, err = hostCommandRunner(context.Background(), "dmsetup", "deps", "-o", "blkdevname", mapper)
+	if err != nil {
+		return false, fmt.Errorf("failed to get backing device of mapping %s: %w", mapper, err)
+	}
+	deps := dmsetupDepRegex.FindAllStringSubmatch(stdout, -1)
+	if len(deps) == 0 {
+		logrus.Warnf("Mapping %s has no backing device", mapper)
+		return false, nil
+	}
+	for _, dep := range deps {
+		name := dep[1]
+		// The device number is printed if the device node is gone
+		if strings.Contains(name, ",") {
+			logrus.Warnf("Backing device %s of mapping %s is gone", name, mapper)
+			return false, nil
+		}
+		if _, err := hostCommandRunner(context.Background(), "test", "-b", "/dev/"+name); err != nil {
+			logrus.Warnf("Backing device %s of mapping %s is gone: %v", name, mapper, err)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkExistingMapping returns whether the volume is already opened by a healthy mapping. The
+// broken mapping is closed so the volume can be opened again, while the mapping which cannot be
+// inspected is assumed to be healthy.
+func checkExistingMapping(ctx context.Context, volume string) (bool, error) {
+	healthy, err := IsMappingHealthy(volume)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to check health of the existing mapping of volume %s, assuming it's healthy", volume)
+		return true, nil
+	}
+	if healthy {
+		return true, nil
+	}
+
+	logrus.Warnf("Closing the broken mapping of volume %s to open it again", volume)
+	if err := closeWithRetry(ctx, MapperName(volume)); err != nil {
+		return false, fmt.Errorf("failed to close the broken mapping of volume %s: %w", volume, err)
+	}
+	return false, nil
+}
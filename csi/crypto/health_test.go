@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newFakeMapping fakes the device mapper status and dependencies of the mapping, whose
+// backing device nodes exist unless listed in missingDevices.
+func newFakeMapping(t *testing.T, status, deps string, missingDevices ...string) {
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		switch {
+		case command == "dmsetup" && args[0] == "status":
+			return status, nil
+		case command == "dmsetup" && args[0] == "deps":
+			return deps, nil
+		case command == "test":
+			for _, missing := range missingDevices {
+				if args[len(args)-1] == "/dev/"+missing {
+					return "", fmt.Errorf("exit status 1")
+				}
+			}
+		}
+		return blankDeviceHandler(command, args)
+	})
+}
+
+func TestIsMappingHealthy(t *testing.T) {
+	testCases := map[string]struct {
+		status          string
+		deps            string
+		missingDevices  []string
+		expectedHealthy bool
+	}{
+		"healthy": {
+			status:          "0 2097152 crypt\n",
+			deps:            " 1 dependencies\t: (sdb)\n",
+			expectedHealthy: true,
+		},
+		"error target": {
+			status: "0 2097152 error\n",
+			deps:   " 1 dependencies\t: (sdb)\n",
+		},
+		"no table": {
+			status: "\n",
+			deps:   " 1 dependencies\t: (sdb)\n",
+		},
+		"backing device number only": {
+			status: "0 2097152 crypt\n",
+			deps:   " 1 dependencies\t: (8, 16)\n",
+		},
+		"backing device node gone": {
+			status:         "0 2097152 crypt\n",
+			deps:           " 1 dependencies\t: (sdb)\n",
+			missingDevices: []string{"sdb"},
+		},
+		"no backing device": {
+			status: "0 2097152 crypt\n",
+			deps:   " 0 dependencies\t:\n",
+		},
+	}
+
+	for name, tc := range testCases {
+		newFakeMapping(t, tc.status, tc.deps, tc.missingDevices...)
+		healthy, err := IsMappingHealthy("vol")
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if healthy != tc.expectedHealthy {
+			t.Fatalf("%v: healthy = %v, expected %v", name, healthy, tc.expectedHealthy)
+		}
+	}
+}
+
+func TestOpenVolumeBrokenMapping(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "status" {
+			return fmt.Sprintf(testStatusTemplate, args[1], "/dev/longhorn/vol"), nil
+		}
+		return "", nil
+	})
+
+	newFakeMapping(t, "0 2097152 crypt\n", " 1 dependencies\t: (sdb)\n")
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksOpen"); call != nil {
+		t.Fatalf("unexpected luksOpen of the healthy mapping: %v", call)
+	}
+
+	newFakeMapping(t, "0 2097152 crypt\n", " 1 dependencies\t: (sdb)\n", "sdb")
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if call := f.lastCall("luksClose"); call == nil {
+		t.Fatalf("expected luksClose of the broken mapping")
+	}
+	if call := f.lastCall("luksOpen"); call == nil {
+		t.Fatalf("expected luksOpen after closing the broken mapping")
+	}
+}
@@ -0,0 +1,225 @@
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LUKSDeviceInfo is the encryption configuration read from the LUKS header.
+type LUKSDeviceInfo struct {
+	Version string
+	UUID    string
+	Cipher  string
+	Hash    string
+	KeySize string
+	PBKDF   string
+}
+
+// GetLUKSDeviceInfo reads the encryption configuration from the LUKS header of the device.
+// It doesn't require the passphrase. For LUKS2, the JSON metadata is preferred over the
+// text dump if cryptsetup supports it.
+func GetLUKSDeviceInfo(devicePath string) (*LUKSDeviceInfo, error) {
+	dump, err := luksDump(context.Background(), devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS header of device %s: %w", devicePath, err)
+	}
+	info, err := parseLUKSDeviceInfo(dump)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Version == "2" {
+		metadata, err := getLUKS2Metadata(devicePath)
+		if err != nil {
+			logrus.Debugf("Falling back to the text dump for LUKS2 device %s: %v", devicePath, err)
+			return info, nil
+		}
+		metadata.fillDeviceInfo(info)
+	}
+	return info, nil
+}
+
+// GetDeviceUUID returns the UUID of the LUKS header of the device, which is stable across the
+// opens unlike the mapper, so the device can be correlated with the PV. The error wraps
+// ErrDeviceNotLUKS if the device is not a LUKS container.
+func GetDeviceUUID(devicePath string) (string, error) {
+	stdout, err := luksUUID(context.Background(), devicePath)
+	if err != nil {
+		if exitCode, ok := ExitCode(err); ok && exitCode == cryptSetupExitCodeNotLUKS {
+			return "", fmt.Errorf("failed to get UUID of device %s: %w: %w", devicePath, ErrDeviceNotLUKS, err)
+		}
+		return "", fmt.Errorf("failed to get UUID of device %s: %w", devicePath, err)
+	}
+
+	uuid := strings.TrimSpace(stdout)
+	if uuid == "" {
+		return "", fmt.Errorf("empty UUID of LUKS device %s", devicePath)
+	}
+	return uuid, nil
+}
+
+// luks2Metadata is the LUKS2 JSON metadata dumped by cryptsetup.
+type luks2Metadata struct {
+	Keyslots map[string]luks2Keyslot `json:"keyslots"`
+	Segments map[string]luks2Segment `json:"segments"`
+	Digests  map[string]luks2Digest  `json:"digests"`
+}
+
+type luks2Keyslot struct {
+	Type    string `json:"type"`
+	KeySize int    `json:"key_size"`
+	KDF     struct {
+		Type   string `json:"type"`
+		Time   int    `json:"time,omitempty"`
+		Memory int    `json:"memory,omitempty"`
+		CPUs   int    `json:"cpus,omitempty"`
+	} `json:"kdf"`
+}
+
+type luks2Segment struct {
+	Type       string `json:"type"`
+	Offset     string `json:"offset"`
+	Size       string `json:"size"`
+	Encryption string `json:"encryption"`
+	SectorSize int    `json:"sector_size"`
+	// Integrity is only set for the authenticated encryption, i.e. the dm-integrity backed segments
+	Integrity *struct {
+		Type string `json:"type"`
+	} `json:"integrity,omitempty"`
+}
+
+type luks2Digest struct {
+	Type string `json:"type"`
+	Hash string `json:"hash"`
+}
+
+func getLUKS2Metadata(devicePath string) (*luks2Metadata, error) {
+	stdout, err := luksDumpJSON(context.Background(), devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS2 JSON metadata of device %s: %w", devicePath, err)
+	}
+	return parseLUKS2Metadata(stdout)
+}
+
+func parseLUKS2Metadata(stdout string) (*luks2Metadata, error) {
+	metadata := &luks2Metadata{}
+	if err := json.Unmarshal([]byte(stdout), metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS2 JSON metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// isIntegrityDevice returns true if any segment of the LUKS2 device is protected by dm-integrity.
+// Only LUKS2 supports the authenticated encryption, so it fails for the other devices.
+func isIntegrityDevice(devicePath string) (bool, error) {
+	metadata, err := getLUKS2Metadata(devicePath)
+	if err != nil {
+		return false, err
+	}
+	for _, segment := range metadata.Segments {
+		if segment.Integrity != nil && segment.Integrity.Type != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sortedIDs returns the numeric IDs of the JSON objects in order.
+func sortedIDs[T any](objects map[string]T) []int {
+	ids := []int{}
+	for id := range objects {
+		if i, err := strconv.Atoi(id); err == nil {
+			ids = append(ids, i)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// enabledKeyslots returns the passphrase keyslots, which excludes the re-encryption ones.
+func (m *luks2Metadata) enabledKeyslots() []int {
+	keySlots := []int{}
+	for _, id := range sortedIDs(m.Keyslots) {
+		if m.Keyslots[strconv.Itoa(id)].Type == "luks2" {
+			keySlots = append(keySlots, id)
+		}
+	}
+	return keySlots
+}
+
+func (m *luks2Metadata) fillDeviceInfo(info *LUKSDeviceInfo) {
+	if ids := sortedIDs(m.Segments); len(ids) > 0 {
+		info.Cipher = m.Segments[strconv.Itoa(ids[0])].Encryption
+	}
+	if ids := m.enabledKeyslots(); len(ids) > 0 {
+		keySlot := m.Keyslots[strconv.Itoa(ids[0])]
+		info.KeySize = strconv.Itoa(keySlot.KeySize * 8)
+		info.PBKDF = keySlot.KDF.Type
+	}
+	if ids := sortedIDs(m.Digests); len(ids) > 0 {
+		info.Hash = m.Digests[strconv.Itoa(ids[0])].Hash
+	}
+}
+
+func parseLUKSDeviceInfo(dump string) (*LUKSDeviceInfo, error) {
+	kvs := parseCryptSetupKeyValues(dump)
+	info := &LUKSDeviceInfo{
+		Version: kvs["Version"],
+		UUID:    kvs["UUID"],
+	}
+
+	switch info.Version {
+	case "1":
+		info.Cipher = kvs["Cipher name"] + "-" + kvs["Cipher mode"]
+		info.Hash = kvs["Hash spec"]
+		info.KeySize = kvs["MK bits"]
+		info.PBKDF = "pbkdf2"
+	case "2":
+		// The first occurrences are the data segment cipher, the keyslot
+		// key size and PBKDF, and the digest hash respectively
+		info.Cipher = kvs["cipher"]
+		info.Hash = kvs["Hash"]
+		info.KeySize = strings.TrimSuffix(kvs["Key"], " bits")
+		info.PBKDF = kvs["PBKDF"]
+	default:
+		return nil, fmt.Errorf("unknown LUKS version %q", info.Version)
+	}
+	return info, nil
+}
+
+// CheckReplicaEncryptionConsistency reports the LUKS version and cipher divergences across
+// the replica devices of a volume, e.g. after a partial re-encryption. The first device is
+// used as the reference.
+func CheckReplicaEncryptionConsistency(devicePaths []string) ([]string, error) {
+	divergences := []string{}
+	if len(devicePaths) == 0 {
+		return divergences, nil
+	}
+
+	var reference *LUKSDeviceInfo
+	for _, devicePath := range devicePaths {
+		info, err := GetLUKSDeviceInfo(devicePath)
+		if err != nil {
+			return nil, err
+		}
+		if reference == nil {
+			reference = info
+			continue
+		}
+		if info.Version != reference.Version {
+			divergences = append(divergences, fmt.Sprintf("%s: LUKS version %v differs from %v on %s",
+				devicePath, info.Version, reference.Version, devicePaths[0]))
+		}
+		if info.Cipher != reference.Cipher {
+			divergences = append(divergences, fmt.Sprintf("%s: cipher %v differs from %v on %s",
+				devicePath, info.Cipher, reference.Cipher, devicePaths[0]))
+		}
+	}
+	return divergences, nil
+}
@@ -0,0 +1,165 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseLUKSDeviceInfo(t *testing.T) {
+	info, err := parseLUKSDeviceInfo(testLUKS1Dump)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &LUKSDeviceInfo{Version: "1", UUID: "6f4c9e1a-3b2d-4e8f-9a7c-1d2e3f4a5b6c", Cipher: "aes-xts-plain64", Hash: "sha256", KeySize: "256", PBKDF: "pbkdf2"}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("LUKS1 info = %+v, expected %+v", info, expected)
+	}
+
+	info, err = parseLUKSDeviceInfo(testLUKS2Dump)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = &LUKSDeviceInfo{Version: "2", UUID: "2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809", Cipher: "aes-xts-plain64", Hash: "sha256", KeySize: "256", PBKDF: "argon2i"}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("LUKS2 info = %+v, expected %+v", info, expected)
+	}
+}
+
+func TestCheckReplicaEncryptionConsistency(t *testing.T) {
+	dumps := map[string]string{
+		"/dev/replica-1": testLUKS2Dump,
+		"/dev/replica-2": testLUKS2Dump,
+		"/dev/replica-3": testLUKS1Dump,
+	}
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if dump, ok := dumps[args[1]]; ok && args[0] == "luksDump" {
+			return dump, nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	divergences, err := CheckReplicaEncryptionConsistency([]string{"/dev/replica-1", "/dev/replica-2"})
+	if err != nil || len(divergences) != 0 {
+		t.Fatalf("divergences = %v, err = %v, expected consistent replicas", divergences, err)
+	}
+
+	divergences, err = CheckReplicaEncryptionConsistency([]string{"/dev/replica-1", "/dev/replica-2", "/dev/replica-3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"/dev/replica-3: LUKS version 1 differs from 2 on /dev/replica-1"}
+	if !reflect.DeepEqual(divergences, expected) {
+		t.Fatalf("divergences = %v, expected %v", divergences, expected)
+	}
+
+	if _, err := CheckReplicaEncryptionConsistency([]string{"/dev/replica-1", "/dev/missing"}); err == nil {
+		t.Fatalf("expected an error for a device failing to dump")
+	}
+}
+
+const testLUKS2JSONMetadata = `{
+  "keyslots":{
+    "0":{"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},
+      "area":{"type":"raw","offset":"32768","size":"258048","encryption":"aes-xts-plain64","key_size":64},
+      "kdf":{"type":"argon2id","time":4,"memory":1048576,"cpus":4,"salt":"c2FsdA=="}},
+    "2":{"type":"reencrypt","key_size":1,"af":{"type":"none"},"area":{"type":"checksum"},"kdf":{"type":"none"}},
+    "5":{"type":"luks2","key_size":64,"af":{"type":"luks1","stripes":4000,"hash":"sha256"},
+      "area":{"type":"raw","offset":"290816","size":"258048","encryption":"aes-xts-plain64","key_size":64},
+      "kdf":{"type":"argon2id","time":4,"memory":1048576,"cpus":4,"salt":"c2FsdA=="}}
+  },
+  "tokens":{},
+  "segments":{
+    "0":{"type":"crypt","offset":"16777216","size":"dynamic","iv_tweak":"0","encryption":"aes-xts-plain64","sector_size":4096}
+  },
+  "digests":{
+    "0":{"type":"pbkdf2","keyslots":["0","5"],"segments":["0"],"hash":"sha512","iterations":100000,"salt":"c2FsdA==","digest":"ZGlnZXN0"}
+  },
+  "config":{"json_size":"12288","keyslots_size":"16744448"}
+}`
+
+func TestGetLUKSDeviceInfoFromJSON(t *testing.T) {
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksDump" && args[1] == "--dump-json-metadata" {
+			return testLUKS2JSONMetadata, nil
+		}
+		return testLUKS2Dump, nil
+	})
+
+	info, err := GetLUKSDeviceInfo("/dev/sdb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &LUKSDeviceInfo{Version: "2", UUID: "2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809", Cipher: "aes-xts-plain64", Hash: "sha512", KeySize: "512", PBKDF: "argon2id"}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("info = %+v, expected %+v", info, expected)
+	}
+
+	keySlots, err := getEnabledKeyslots("/dev/sdb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keySlots, []int{0, 5}) {
+		t.Fatalf("keyslots = %v, expected [0 5]", keySlots)
+	}
+}
+
+func TestGetLUKSDeviceInfoFallbackToText(t *testing.T) {
+	for _, dump := range []string{testLUKS1Dump, testLUKS2Dump} {
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			if args[1] == "--dump-json-metadata" {
+				return "", &CommandError{ExitCode: 1, Err: fmt.Errorf("unsupported option")}
+			}
+			return dump, nil
+		})
+
+		info, err := GetLUKSDeviceInfo("/dev/sdb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected, _ := parseLUKSDeviceInfo(dump)
+		if !reflect.DeepEqual(info, expected) {
+			t.Fatalf("info = %+v, expected %+v", info, expected)
+		}
+
+		keySlots, err := getEnabledKeyslots("/dev/sdb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(keySlots, parseEnabledKeyslots(dump)) {
+			t.Fatalf("keyslots = %v, expected the text parsing result", keySlots)
+		}
+	}
+}
+
+func TestGetDeviceUUID(t *testing.T) {
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] != "luksUUID" {
+			return "", fmt.Errorf("unexpected args %v", args)
+		}
+		switch args[1] {
+		case "/dev/luks":
+			return "2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809\n", nil
+		case "/dev/plain":
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: cryptSetupExitCodeNotLUKS,
+				Stderr: "Device /dev/plain is not a valid LUKS device.", Err: fmt.Errorf("exit status 1")}
+		}
+		return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 4, Err: fmt.Errorf("exit status 4")}
+	})
+
+	uuid, err := GetDeviceUUID("/dev/luks")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if uuid != "2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809" {
+		t.Fatalf("UUID = %q, expected the trimmed UUID", uuid)
+	}
+
+	if _, err := GetDeviceUUID("/dev/plain"); !errors.Is(err, ErrDeviceNotLUKS) {
+		t.Fatalf("err = %v, expected ErrDeviceNotLUKS", err)
+	}
+	if _, err := GetDeviceUUID("/dev/missing"); err == nil || errors.Is(err, ErrDeviceNotLUKS) {
+		t.Fatalf("err = %v, expected an error other than ErrDeviceNotLUKS", err)
+	}
+}
@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EncryptVolumeWithKeyFile encrypts the device like EncryptVolume, but with the binary key file
+// rather than a passphrase, so the key never transits the environment or the stdin. The key file
+// is read by cryptsetup in the host namespaces, so keyFilePath is a path on the host. It must be
+// a non-empty regular file owned by root and readable only by root, i.e. no group or other
+// permission, which is validated before the format.
+func EncryptVolumeWithKeyFile(devicePath, keyFilePath string, params *EncryptParams) error {
+	if err := validateKeyFile(keyFilePath); err != nil {
+		return err
+	}
+	if err := prepareEncryptVolume(context.Background(), devicePath, params); err != nil {
+		return err
+	}
+
+	logrus.Debugf("Encrypting device %s with LUKS and key file %s", devicePath, keyFilePath)
+	if _, err := luksFormatWithKeyFile(context.Background(), devicePath, keyFilePath, params); err != nil {
+		return fmt.Errorf("failed to encrypt device %s with LUKS: %w", devicePath, err)
+	}
+	return nil
+}
+
+// OpenVolumeWithKeyFile opens the volume like OpenVolume with the default params, but with the
+// binary key file the device was encrypted with by EncryptVolumeWithKeyFile. The key file has
+// the same requirements as there.
+func OpenVolumeWithKeyFile(volume, devicePath, keyFilePath string) error {
+	if err := validateMapperName(volume); err != nil {
+		return err
+	}
+	if isOpen, _ := IsDeviceOpen(VolumeMapper(volume)); isOpen {
+		if isOpen, err := checkExistingMapping(context.Background(), volume); err != nil {
+			return err
+		} else if isOpen {
+			logrus.Debugf("device %s is already opened at %s", devicePath, VolumeMapper(volume))
+			return nil
+		}
+	}
+
+	if err := validateKeyFile(keyFilePath); err != nil {
+		return err
+	}
+	options, err := getOpenOptions(devicePath, nil)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("Opening device %s with LUKS and key file %s on %s", devicePath, keyFilePath, volume)
+	if _, err := luksOpenWithKeyFile(context.Background(), MapperName(volume), devicePath, keyFilePath, argon2DefaultMemoryKB, options...); err != nil {
+		logrus.Warnf("failed to open LUKS device %s with key file: %s", devicePath, err)
+		return fmt.Errorf("failed to open LUKS device %s: %w", devicePath, err)
+	}
+	return EnsureMapperNode(volume)
+}
+
+// validateKeyFile makes sure the key file on the host is a non-empty regular file which only root
+// can access. It's checked on the host via stat since that's where cryptsetup reads it.
+func validateKeyFile(keyFilePath string) error {
+	if !filepath.IsAbs(keyFilePath) {
+		return fmt.Errorf("key file %v should be an absolute path", keyFilePath)
+	}
+	stdout, err := hostCommandRunner(context.Background(), "stat", "-L", "-c", "%u %a %F", keyFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat key file %s: %w", keyFilePath, err)
+	}
+	fields := strings.SplitN(strings.TrimSpace(stdout), " ", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("failed to parse stat of key file %s: %q", keyFilePath, stdout)
+	}
+	if fields[2] != "regular file" {
+		return fmt.Errorf("key file %s should be a non-empty regular file, it's a %s", keyFilePath, fields[2])
+	}
+	if fields[0] != "0" {
+		return fmt.Errorf("key file %s should be owned by root, it's owned by uid %s", keyFilePath, fields[0])
+	}
+	mode, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return fmt.Errorf("failed to parse mode of key file %s: %w", keyFilePath, err)
+	}
+	if mode&0077 != 0 {
+		return fmt.Errorf("key file %s should only be accessible by root, it has mode %04o", keyFilePath, mode)
+	}
+	return nil
+}
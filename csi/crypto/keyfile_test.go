@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testKeyFile = "/etc/longhorn/keys/vol.key"
+
+// newFakeKeyFile fakes the stat of the key file on the host, and a blank device otherwise.
+func newFakeKeyFile(t *testing.T, stat string) {
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		if command == "stat" {
+			if args[len(args)-1] != testKeyFile {
+				return "", fmt.Errorf("unexpected stat %v", args)
+			}
+			return stat, nil
+		}
+		return blankDeviceHandler(command, args)
+	})
+}
+
+func TestKeyFile(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	newFakeKeyFile(t, "0 400 regular file\n")
+
+	if err := EncryptVolumeWithKeyFile("/dev/longhorn/vol", testKeyFile, NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	call := f.lastCall("luksFormat")
+	if !reflect.DeepEqual(call[len(call)-3:], []string{"/dev/longhorn/vol", "--key-file", testKeyFile}) {
+		t.Fatalf("luksFormat args = %v, expected the key file", call)
+	}
+
+	if err := OpenVolumeWithKeyFile("vol", "/dev/longhorn/vol", testKeyFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", MapperName("vol"), "--key-file", testKeyFile}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+	for i, stdin := range f.stdins {
+		if stdin != "" {
+			t.Fatalf("cryptsetup %v got stdin, expected the key file only", f.calls[i])
+		}
+	}
+}
+
+func TestPassphraseNotInArgs(t *testing.T) {
+	passphrase := "secret-passphrase"
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+
+	if err := EncryptVolume("/dev/longhorn/vol", passphrase, NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := OpenVolume("vol", "/dev/longhorn/vol", passphrase, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, call := range f.calls {
+		if strings.Contains(strings.Join(call, " "), passphrase) {
+			t.Fatalf("cryptsetup args %v contain the passphrase", call)
+		}
+		if (call[0] == "luksOpen" || call[1] == "luksFormat") && f.stdins[i] != passphrase {
+			t.Fatalf("cryptsetup %v got stdin %q, expected the passphrase", call, f.stdins[i])
+		}
+	}
+}
+
+func TestValidateKeyFile(t *testing.T) {
+	testCases := map[string]struct {
+		keyFile       string
+		stat          string
+		expectedError string
+	}{
+		"root only":      {keyFile: testKeyFile, stat: "0 600 regular file"},
+		"relative path":  {keyFile: "vol.key", expectedError: "absolute path"},
+		"group readable": {keyFile: testKeyFile, stat: "0 640 regular file", expectedError: "mode 0640"},
+		"world readable": {keyFile: testKeyFile, stat: "0 644 regular file", expectedError: "mode 0644"},
+		"non-root owner": {keyFile: testKeyFile, stat: "1000 600 regular file", expectedError: "owned by uid 1000"},
+		"empty":          {keyFile: testKeyFile, stat: "0 600 regular empty file", expectedError: "non-empty regular file"},
+		"directory":      {keyFile: testKeyFile, stat: "0 700 directory", expectedError: "non-empty regular file"},
+	}
+
+	for name, tc := range testCases {
+		newFakeKeyFile(t, tc.stat)
+		err := validateKeyFile(tc.keyFile)
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Fatalf("%v: unexpected error: %v", name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+			t.Fatalf("%v: err = %v, expected %q", name, err, tc.expectedError)
+		}
+	}
+
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+	newFakeKeyFile(t, "0 644 regular file")
+	if err := OpenVolumeWithKeyFile("vol", "/dev/longhorn/vol", testKeyFile); err == nil {
+		t.Fatalf("expected an error for the world readable key file")
+	}
+	if err := EncryptVolumeWithKeyFile("/dev/longhorn/vol", testKeyFile, NewEncryptParams("", "", "", "", "", "")); err == nil {
+		t.Fatalf("expected an error for the world readable key file")
+	}
+	if call := f.lastCall("luksOpen"); call != nil {
+		t.Fatalf("unexpected luksOpen: %v", call)
+	}
+	if call := f.lastCall("luksFormat"); call != nil {
+		t.Fatalf("unexpected luksFormat: %v", call)
+	}
+}
@@ -0,0 +1,548 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VerifyPassphrase returns whether the passphrase unlocks any keyslot of the device. The mapping
+// is not activated, so a wrong passphrase can be told apart from the other open failures.
+func VerifyPassphrase(devicePath, passphrase string) (bool, error) {
+	_, err := luksTestAnyPassphrase(context.Background(), devicePath, passphrase)
+	if err != nil {
+		if exitCode, ok := ExitCode(err); ok && exitCode == cryptSetupExitCodeNoPermission {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to test passphrase of device %s: %w", devicePath, err)
+	}
+	return true, nil
+}
+
+// VerifyRequest is a passphrase to verify against a device, see VerifyPassphrases.
+type VerifyRequest struct {
+	DevicePath string
+	Passphrase string
+}
+
+// VerifyResult is the result of a VerifyRequest. Err is set if the passphrase could not be tested,
+// e.g. the device is missing, in which case Valid is false.
+type VerifyResult struct {
+	DevicePath string
+	Valid      bool
+	Err        error
+}
+
+// VerifyPassphrases verifies the passphrases of the requests like VerifyPassphrase concurrently,
+// e.g. to confirm a rotated secret works for all the volumes before committing it. The key
+// derivations are still bounded by the concurrency and memory limits, see SetConcurrencyLimit.
+// The results are in the order of the requests.
+func VerifyPassphrases(reqs []VerifyRequest) []VerifyResult {
+	results := make([]VerifyResult, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func(i int, req VerifyRequest) {
+			defer wg.Done()
+			valid, err := VerifyPassphrase(req.DevicePath, req.Passphrase)
+			results[i] = VerifyResult{DevicePath: req.DevicePath, Valid: valid, Err: err}
+		}(i, req)
+	}
+	wg.Wait()
+	return results
+}
+
+// VerifyAllKeyslots tests the passphrase against each enabled keyslot of the
+// device individually and returns which of the keyslots it unlocks.
+func VerifyAllKeyslots(devicePath string, passphrase string) (map[int]bool, error) {
+	keySlots, err := getEnabledKeyslots(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[int]bool{}
+	for _, keySlot := range keySlots {
+		unlocks, err := testKeyslotPassphrase(devicePath, passphrase, keySlot)
+		if err != nil {
+			return nil, err
+		}
+		result[keySlot] = unlocks
+	}
+	return result, nil
+}
+
+// testKeyslotPassphrase returns whether the passphrase unlocks the keyslot of the device.
+func testKeyslotPassphrase(devicePath, passphrase string, keySlot int) (bool, error) {
+	_, err := luksTestPassphrase(context.Background(), devicePath, passphrase, keySlot)
+	if err == nil {
+		return true, nil
+	}
+	// Only a bad passphrase means the keyslot doesn't unlock, any other failure such as a timeout
+	// says nothing about the keyslot
+	if exitCode, ok := ExitCode(err); !ok || exitCode != cryptSetupExitCodeNoPermission {
+		return false, fmt.Errorf("failed to test passphrase against keyslot %v of device %s: %w", keySlot, devicePath, err)
+	}
+	logrus.Debugf("passphrase does not unlock keyslot %v of device %s: %v", keySlot, devicePath, err)
+	return false, nil
+}
+
+const (
+	luks1MaxKeyslots = 8
+	luks2MaxKeyslots = 32
+)
+
+// ReconcileKeyslots makes the passphrase keyslots of the device match the desired passphrases
+// indexed by the keyslot. The missing passphrases are added, the keyslots holding a different
+// passphrase are replaced and the extraneous keyslots are removed. The passphrases in verify are
+// the known passphrases of the current keyslots, used for the authorization if none of the desired
+// passphrases unlocks the device yet. A keyslot is only removed once another keyslot holding a
+// desired passphrase exists, so the device never becomes locked.
+func ReconcileKeyslots(devicePath string, desired map[int]string, verify map[int]string) (err error) {
+	if len(desired) == 0 {
+		return fmt.Errorf("refusing to remove all keyslots of device %s", devicePath)
+	}
+
+	maxKeyslots, version, err := getMaxKeyslots(devicePath)
+	if err != nil {
+		return err
+	}
+	for keySlot, passphrase := range desired {
+		if keySlot < 0 || keySlot >= maxKeyslots {
+			return fmt.Errorf("keyslot %v is out of the range of LUKS%v device %s", keySlot, version, devicePath)
+		}
+		if passphrase == "" {
+			return fmt.Errorf("invalid passphrase for keyslot %v of device %s", keySlot, devicePath)
+		}
+	}
+	// The LUKS2 keyslots may be fewer than the keyslot indexes, bounded by the keyslots area
+	_, capacity, err := UsedKeyslots(devicePath)
+	if err != nil {
+		return err
+	}
+	if len(desired) > capacity {
+		return fmt.Errorf("%v passphrases exceed the %v keyslots of LUKS%v device %s: %w", len(desired), capacity, version, devicePath, ErrKeyslotsFull)
+	}
+
+	enabled, err := getEnabledKeyslots(devicePath)
+	if err != nil {
+		return err
+	}
+	enabledSet := map[int]bool{}
+	kept, mismatched, extraneous := []int{}, []int{}, []int{}
+	for _, keySlot := range enabled {
+		enabledSet[keySlot] = true
+		passphrase, ok := desired[keySlot]
+		if !ok {
+			extraneous = append(extraneous, keySlot)
+			continue
+		}
+		unlocks, err := testKeyslotPassphrase(devicePath, passphrase, keySlot)
+		if err != nil {
+			return err
+		}
+		if unlocks {
+			kept = append(kept, keySlot)
+		} else {
+			mismatched = append(mismatched, keySlot)
+		}
+	}
+
+	// authorizer is the passphrase of a keyslot which is never removed, once one exists
+	authorizer := ""
+	if len(kept) > 0 {
+		authorizer = desired[kept[0]]
+	} else if authorizer, err = findAuthorizingPassphrase(devicePath, enabled, verify); err != nil {
+		return err
+	}
+
+	missing := []int{}
+	for keySlot := range desired {
+		if !enabledSet[keySlot] {
+			missing = append(missing, keySlot)
+		}
+	}
+	sort.Ints(missing)
+	for _, keySlot := range missing {
+		logrus.Infof("Adding passphrase to keyslot %v of device %s", keySlot, devicePath)
+		if _, err := luksAddKey(context.Background(), devicePath, authorizer, desired[keySlot], keySlot); err != nil {
+			return fmt.Errorf("failed to add passphrase to keyslot %v of device %s: %w", keySlot, devicePath, err)
+		}
+		kept = append(kept, keySlot)
+		authorizer = desired[kept[0]]
+	}
+
+	// All the desired keyslots hold a different passphrase, so a temporary keyslot keeps
+	// the device unlockable while they're rewritten.
+	if len(kept) == 0 && len(mismatched) > 0 {
+		tempKeySlot := -1
+		if len(enabled)+len(missing) < capacity {
+			tempKeySlot = findFreeKeyslot(maxKeyslots, enabledSet, desired)
+		}
+		if tempKeySlot < 0 {
+			return fmt.Errorf("no free keyslot left on device %s to replace keyslots %v: %w", devicePath, mismatched, ErrKeyslotsFull)
+		}
+		logrus.Infof("Adding temporary keyslot %v to device %s", tempKeySlot, devicePath)
+		if _, err := luksAddKey(context.Background(), devicePath, authorizer, desired[mismatched[0]], tempKeySlot); err != nil {
+			return fmt.Errorf("failed to add temporary keyslot %v to device %s: %w", tempKeySlot, devicePath, err)
+		}
+		authorizer = desired[mismatched[0]]
+		// luksKillSlot only accepts the passphrase of another keyslot, so the temporary keyslot
+		// is kept if a failure left it as the only one holding its passphrase
+		defer func() {
+			logrus.Infof("Removing temporary keyslot %v of device %s", tempKeySlot, devicePath)
+			if _, killErr := luksKillSlot(context.Background(), devicePath, authorizer, tempKeySlot); killErr != nil {
+				if err == nil {
+					err = fmt.Errorf("failed to remove temporary keyslot %v of device %s: %w", tempKeySlot, devicePath, killErr)
+					return
+				}
+				logrus.WithError(killErr).Warnf("Failed to remove temporary keyslot %v of device %s", tempKeySlot, devicePath)
+			}
+		}()
+	}
+
+	for _, keySlot := range mismatched {
+		logrus.Infof("Replacing passphrase of keyslot %v of device %s", keySlot, devicePath)
+		if _, err := luksKillSlot(context.Background(), devicePath, authorizer, keySlot); err != nil {
+			return fmt.Errorf("failed to remove keyslot %v of device %s: %w", keySlot, devicePath, err)
+		}
+		if _, err := luksAddKey(context.Background(), devicePath, authorizer, desired[keySlot], keySlot); err != nil {
+			return fmt.Errorf("failed to add passphrase to keyslot %v of device %s: %w", keySlot, devicePath, err)
+		}
+	}
+
+	for _, keySlot := range extraneous {
+		logrus.Infof("Removing extraneous keyslot %v of device %s", keySlot, devicePath)
+		if _, err := luksKillSlot(context.Background(), devicePath, authorizer, keySlot); err != nil {
+			return fmt.Errorf("failed to remove keyslot %v of device %s: %w", keySlot, devicePath, err)
+		}
+	}
+	return nil
+}
+
+// getMaxKeyslots returns the number of the keyslots of the device along with its LUKS version.
+func getMaxKeyslots(devicePath string) (int, string, error) {
+	info, err := GetLUKSDeviceInfo(devicePath)
+	if err != nil {
+		return 0, "", err
+	}
+	if info.Version == "2" {
+		return luks2MaxKeyslots, info.Version, nil
+	}
+	return luks1MaxKeyslots, info.Version, nil
+}
+
+// UsedKeyslots returns the number of the passphrase keyslots in use on the device along with the
+// number of the keyslots it can hold. LUKS1 has the fixed 8 keyslots, while the number of the LUKS2
+// keyslots is bounded by how many keyslot areas fit in the keyslots area of its header.
+func UsedKeyslots(devicePath string) (used int, total int, err error) {
+	stdout, err := luksDump(context.Background(), devicePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to dump LUKS header of device %s: %w", devicePath, err)
+	}
+	used, total, err = parseUsedKeyslots(stdout)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse keyslots of device %s: %w", devicePath, err)
+	}
+	return used, total, nil
+}
+
+func parseUsedKeyslots(stdout string) (used int, total int, err error) {
+	dump, err := parseLUKSDump(stdout)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, keySlot := range dump.Keyslots {
+		if keySlot.Enabled {
+			used++
+		}
+	}
+	if dump.Version == "1" {
+		return used, len(dump.Keyslots), nil
+	}
+
+	total = luks2MaxKeyslots
+	kvs := parseCryptSetupKeyValues(stdout)
+	if _, exist := kvs["Area length"]; !exist {
+		// Without any keyslot the size of a keyslot area is unknown
+		return used, total, nil
+	}
+	keyslotsArea, err := parseBytes(kvs["Keyslots area"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid keyslots area: %w", err)
+	}
+	areaLength, err := parseBytes(kvs["Area length"])
+	if err != nil || areaLength <= 0 {
+		return 0, 0, fmt.Errorf("invalid keyslot area length %q", kvs["Area length"])
+	}
+	if fit := int(keyslotsArea / areaLength); fit < total {
+		total = fit
+	}
+	if total < used {
+		total = used
+	}
+	return used, total, nil
+}
+
+// findAuthorizingPassphrase returns the first passphrase in verify unlocking its enabled keyslot.
+func findAuthorizingPassphrase(devicePath string, enabled []int, verify map[int]string) (string, error) {
+	for _, keySlot := range enabled {
+		passphrase, ok := verify[keySlot]
+		if !ok {
+			continue
+		}
+		unlocks, err := testKeyslotPassphrase(devicePath, passphrase, keySlot)
+		if err != nil {
+			return "", err
+		}
+		if unlocks {
+			return passphrase, nil
+		}
+	}
+	return "", fmt.Errorf("none of the provided passphrases unlocks device %s", devicePath)
+}
+
+// findFreeKeyslot returns the lowest keyslot neither enabled nor desired, or -1 if all are taken.
+func findFreeKeyslot(maxKeyslots int, enabled map[int]bool, desired map[int]string) int {
+	for keySlot := 0; keySlot < maxKeyslots; keySlot++ {
+		if _, ok := desired[keySlot]; !ok && !enabled[keySlot] {
+			return keySlot
+		}
+	}
+	return -1
+}
+
+// ValidateKeyslotConsistency checks that each keyslot is unlocked by its passphrase and returns
+// whether all the keyslots are bound to the same digest in the LUKS header. cryptsetup only
+// unlocks a keyslot whose volume key matches its digest, so the master key is never read.
+func ValidateKeyslotConsistency(devicePath string, passphrases map[int]string) (bool, error) {
+	if len(passphrases) == 0 {
+		return false, fmt.Errorf("no keyslot passphrase provided for device %s", devicePath)
+	}
+
+	dump, err := DumpDevice(devicePath)
+	if err != nil {
+		return false, err
+	}
+	digestIDs := map[int]int{}
+	for _, keySlot := range dump.Keyslots {
+		if keySlot.Enabled {
+			digestIDs[keySlot.Index] = keySlot.DigestID
+		}
+	}
+
+	keySlots := make([]int, 0, len(passphrases))
+	for keySlot := range passphrases {
+		keySlots = append(keySlots, keySlot)
+	}
+	sort.Ints(keySlots)
+
+	consistent := true
+	for _, keySlot := range keySlots {
+		digestID, ok := digestIDs[keySlot]
+		if !ok {
+			return false, fmt.Errorf("keyslot %v of device %s is not enabled", keySlot, devicePath)
+		}
+		unlocks, err := testKeyslotPassphrase(devicePath, passphrases[keySlot], keySlot)
+		if err != nil {
+			return false, err
+		}
+		if !unlocks {
+			return false, fmt.Errorf("failed to unlock keyslot %v of device %s: %w", keySlot, devicePath, ErrInvalidPassphrase)
+		}
+		if digestID != digestIDs[keySlots[0]] {
+			logrus.Warnf("Keyslot %v of device %s is bound to digest %v different from digest %v of keyslot %v",
+				keySlot, devicePath, digestID, digestIDs[keySlots[0]], keySlots[0])
+			consistent = false
+		}
+	}
+	return consistent, nil
+}
+
+// getEnabledKeyslots returns the sorted enabled passphrase keyslots of the device. The LUKS2 JSON
+// metadata is preferred, and the text dump is parsed for LUKS1 or cryptsetup not supporting JSON.
+func getEnabledKeyslots(devicePath string) ([]int, error) {
+	if metadata, err := getLUKS2Metadata(devicePath); err == nil {
+		return metadata.enabledKeyslots(), nil
+	}
+
+	dump, err := luksDump(context.Background(), devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS header of device %s: %w", devicePath, err)
+	}
+	return parseEnabledKeyslots(dump), nil
+}
+
+// parseEnabledKeyslots returns the sorted enabled keyslots from the luksDump output.
+// LUKS1 lists every slot as "Key Slot N: ENABLED/DISABLED", while LUKS2 only lists
+// the enabled slots as "N: <type>" under the "Keyslots:" section.
+func parseEnabledKeyslots(dump string) []int {
+	keySlots := []int{}
+	inLUKS2Keyslots := false
+	for _, line := range strings.Split(dump, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "Key Slot ") {
+			kv := strings.SplitN(strings.TrimPrefix(trimmed, "Key Slot "), ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[1]) != "ENABLED" {
+				continue
+			}
+			if keySlot, err := strconv.Atoi(kv[0]); err == nil {
+				keySlots = append(keySlots, keySlot)
+			}
+			continue
+		}
+
+		if line == "Keyslots:" {
+			inLUKS2Keyslots = true
+			continue
+		}
+		if !inLUKS2Keyslots {
+			continue
+		}
+		if line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			// Reached the next section
+			inLUKS2Keyslots = false
+			continue
+		}
+		// Keyslot headers are indented with spaces, while their properties are indented with tabs
+		if !strings.HasPrefix(line, "  ") {
+			continue
+		}
+		kv := strings.SplitN(trimmed, ":", 2)
+		if len(kv) != 2 || strings.HasPrefix(strings.TrimSpace(kv[1]), "reencrypt") {
+			continue
+		}
+		if keySlot, err := strconv.Atoi(kv[0]); err == nil {
+			keySlots = append(keySlots, keySlot)
+		}
+	}
+	sort.Ints(keySlots)
+	return keySlots
+}
+
+// AddPassphrase adds the new passphrase to the lowest free keyslot of the device, authorized by
+// the old passphrase.
+func AddPassphrase(devicePath, oldPassphrase, newPassphrase string) error {
+	_, err := addPassphrase(devicePath, oldPassphrase, newPassphrase)
+	return err
+}
+
+// addPassphrase adds the new passphrase and returns the keyslot holding it.
+func addPassphrase(devicePath, oldPassphrase, newPassphrase string) (int, error) {
+	if oldPassphrase == "" || newPassphrase == "" {
+		return -1, fmt.Errorf("invalid passphrase for device %s", devicePath)
+	}
+
+	maxKeyslots, version, err := getMaxKeyslots(devicePath)
+	if err != nil {
+		return -1, err
+	}
+	enabled, err := getEnabledKeyslots(devicePath)
+	if err != nil {
+		return -1, err
+	}
+	enabledSet := map[int]bool{}
+	for _, keySlot := range enabled {
+		enabledSet[keySlot] = true
+	}
+	keySlot := findFreeKeyslot(maxKeyslots, enabledSet, nil)
+	if keySlot < 0 {
+		return -1, fmt.Errorf("all %v keyslots of LUKS%v device %s are in use, remove a passphrase first: %w", maxKeyslots, version, devicePath, ErrKeyslotsFull)
+	}
+
+	logrus.Infof("Adding passphrase to keyslot %v of device %s", keySlot, devicePath)
+	if _, err := luksAddKey(context.Background(), devicePath, oldPassphrase, newPassphrase, keySlot); err != nil {
+		return -1, fmt.Errorf("failed to add passphrase to keyslot %v of device %s: %w", keySlot, devicePath, err)
+	}
+	return keySlot, nil
+}
+
+// RemovePassphrase removes the keyslots unlocked by the passphrase from the device. It refuses to
+// remove the passphrase if no other keyslot would be left to unlock the device.
+func RemovePassphrase(devicePath, passphrase string) error {
+	unlocked, err := VerifyAllKeyslots(devicePath, passphrase)
+	if err != nil {
+		return err
+	}
+	removals := 0
+	for _, unlocks := range unlocked {
+		if unlocks {
+			removals++
+		}
+	}
+	if removals == 0 {
+		return fmt.Errorf("failed to remove passphrase from device %s: %w", devicePath, ErrInvalidPassphrase)
+	}
+	if removals == len(unlocked) {
+		return fmt.Errorf("refusing to remove the passphrase of all keyslots of device %s", devicePath)
+	}
+
+	// luksRemoveKey wipes the first keyslot unlocked by the passphrase only
+	for i := 0; i < removals; i++ {
+		if _, err := luksRemoveKey(context.Background(), devicePath, passphrase); err != nil {
+			return fmt.Errorf("failed to remove passphrase from device %s: %w", devicePath, err)
+		}
+	}
+	return nil
+}
+
+// RotatePassphrase replaces the old passphrase of the device with the new one without
+// re-encrypting the data. The new passphrase is added and verified before the old one is
+// removed, and the added keyslot is rolled back if the verification fails. Both passphrases unlock
+// the device in the meantime, see ChangePassphrase for the change without such a window.
+func RotatePassphrase(devicePath, oldPassphrase, newPassphrase string) error {
+	if oldPassphrase == newPassphrase {
+		return fmt.Errorf("new passphrase of device %s is the same as the old one", devicePath)
+	}
+
+	used, total, err := UsedKeyslots(devicePath)
+	if err != nil {
+		return err
+	}
+	if used >= total {
+		return fmt.Errorf("cannot rotate passphrase of device %s with all %v keyslots in use, remove a passphrase first: %w", devicePath, total, ErrKeyslotsFull)
+	}
+
+	keySlot, err := addPassphrase(devicePath, oldPassphrase, newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	unlocks, err := testKeyslotPassphrase(devicePath, newPassphrase, keySlot)
+	if err != nil || !unlocks {
+		if err == nil {
+			err = fmt.Errorf("new passphrase does not unlock keyslot %v", keySlot)
+		}
+		logrus.Warnf("Rolling back keyslot %v of device %s since the new passphrase cannot be verified: %v", keySlot, devicePath, err)
+		if _, killErr := luksKillSlot(context.Background(), devicePath, oldPassphrase, keySlot); killErr != nil {
+			return fmt.Errorf("failed to roll back keyslot %v of device %s after %v: %w", keySlot, devicePath, err, killErr)
+		}
+		return fmt.Errorf("failed to verify new passphrase of device %s: %w", devicePath, err)
+	}
+
+	return RemovePassphrase(devicePath, oldPassphrase)
+}
+
+// ChangePassphrase replaces the old passphrase of the device with the new one in a single
+// cryptsetup luksChangeKey, so unlike RotatePassphrase there is no window in which both
+// passphrases unlock the device, and no free keyslot is needed. On the other hand the new
+// passphrase is not verified before the old one is gone, and with LUKS1 and no free keyslot the
+// keyslot is overwritten in place, so a crash in the middle may lose it. ErrInvalidPassphrase is
+// returned if the old passphrase unlocks no keyslot.
+func ChangePassphrase(devicePath, oldPassphrase, newPassphrase string) error {
+	if oldPassphrase == "" || newPassphrase == "" {
+		return fmt.Errorf("invalid passphrase for device %s", devicePath)
+	}
+	if oldPassphrase == newPassphrase {
+		return fmt.Errorf("new passphrase of device %s is the same as the old one", devicePath)
+	}
+	if _, err := luksChangeKey(context.Background(), devicePath, oldPassphrase, newPassphrase); err != nil {
+		return fmt.Errorf("failed to change passphrase of device %s: %w", devicePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,769 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testLUKS1Dump = `LUKS header information for /dev/sdb
+
+Version:       	1
+Cipher name:   	aes
+Cipher mode:   	xts-plain64
+Hash spec:     	sha256
+Payload offset:	4096
+MK bits:       	256
+UUID:          	6f4c9e1a-3b2d-4e8f-9a7c-1d2e3f4a5b6c
+
+Key Slot 0: ENABLED
+	Iterations:         	1000
+	Salt:               	00 01 02 03
+	Key material offset:	8
+	AF stripes:            	4000
+Key Slot 1: DISABLED
+Key Slot 2: ENABLED
+	Iterations:         	1000
+	Salt:               	00 01 02 03
+	Key material offset:	520
+	AF stripes:            	4000
+Key Slot 3: DISABLED
+Key Slot 4: DISABLED
+Key Slot 5: DISABLED
+Key Slot 6: DISABLED
+Key Slot 7: DISABLED
+`
+
+const testLUKS2Dump = `LUKS header information
+Version:       	2
+Epoch:         	5
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	2a3b4c5d-6e7f-4081-92a3-b4c5d6e7f809
+Label:         	(no label)
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: (whole device)
+	cipher: aes-xts-plain64
+	sector: 512 [bytes]
+
+Keyslots:
+  0: luks2
+	Key:        256 bits
+	Priority:   normal
+	Cipher:     aes-xts-plain64
+	Cipher key: 256 bits
+	PBKDF:      argon2i
+	Time cost:  4
+	Memory:     1048576
+	Threads:    4
+	AF stripes: 4000
+	AF hash:    sha256
+	Area offset:32768 [bytes]
+	Area length:258048 [bytes]
+	Digest ID:  0
+  3: luks2
+	Key:        256 bits
+	Priority:   normal
+	Cipher:     aes-xts-plain64
+	Cipher key: 256 bits
+	PBKDF:      argon2i
+	Time cost:  4
+	Memory:     1048576
+	Threads:    4
+	AF stripes: 4000
+	AF hash:    sha256
+	Area offset:290816 [bytes]
+	Area length:258048 [bytes]
+	Digest ID:  0
+Tokens:
+Digests:
+  0: pbkdf2
+	Hash:       sha256
+	Iterations: 100000
+`
+
+func TestParseEnabledKeyslots(t *testing.T) {
+	if keySlots := parseEnabledKeyslots(testLUKS1Dump); !reflect.DeepEqual(keySlots, []int{0, 2}) {
+		t.Fatalf("LUKS1 keyslots = %v, expected [0 2]", keySlots)
+	}
+	if keySlots := parseEnabledKeyslots(testLUKS2Dump); !reflect.DeepEqual(keySlots, []int{0, 3}) {
+		t.Fatalf("LUKS2 keyslots = %v, expected [0 3]", keySlots)
+	}
+}
+
+func TestParseUsedKeyslots(t *testing.T) {
+	noKeyslots := strings.SplitN(testLUKS2Dump, "Keyslots:\n", 2)[0] + "Keyslots:\nTokens:\n"
+
+	testCases := map[string]struct {
+		dump          string
+		expectedUsed  int
+		expectedTotal int
+	}{
+		"LUKS1":                 {dump: testLUKS1Dump, expectedUsed: 2, expectedTotal: 8},
+		"LUKS2":                 {dump: testLUKS2Dump, expectedUsed: 2, expectedTotal: 32},
+		"LUKS2 small area":      {dump: strings.Replace(testLUKS2Dump, "16744448", "1032192", 1), expectedUsed: 2, expectedTotal: 4},
+		"LUKS2 without keyslot": {dump: noKeyslots, expectedUsed: 0, expectedTotal: 32},
+	}
+
+	for name, tc := range testCases {
+		used, total, err := parseUsedKeyslots(tc.dump)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if used != tc.expectedUsed || total != tc.expectedTotal {
+			t.Fatalf("%v: used %v of %v keyslots, expected %v of %v", name, used, total, tc.expectedUsed, tc.expectedTotal)
+		}
+	}
+}
+
+func TestVerifyPassphrase(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "luksOpen" && args[1] == "--test-passphrase" {
+			switch args[2] {
+			case "/dev/sdb":
+				return "", nil
+			case "/dev/sdc":
+				return "", &CommandError{ExitCode: cryptSetupExitCodeNoPermission, Err: fmt.Errorf("no key available with this passphrase")}
+			}
+			return "", &CommandError{ExitCode: 4, Err: fmt.Errorf("device %s does not exist", args[2])}
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+	var hostCalls [][]string
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		hostCalls = append(hostCalls, append([]string{command}, args...))
+		return "", nil
+	})
+
+	valid, err := VerifyPassphrase("/dev/sdb", "passphrase")
+	if err != nil || !valid {
+		t.Fatalf("valid = %v, err = %v, expected the passphrase to be valid", valid, err)
+	}
+	// Only the passphrase is tested, no mapping is activated
+	expected := []string{"luksOpen", "--test-passphrase", "/dev/sdb", "-d", "/dev/stdin"}
+	if !reflect.DeepEqual(f.calls, [][]string{expected}) {
+		t.Fatalf("cryptsetup calls = %v, expected only %v", f.calls, expected)
+	}
+	if f.stdins[0] != "passphrase" {
+		t.Fatalf("passphrase is not passed via stdin")
+	}
+	if len(hostCalls) != 0 {
+		t.Fatalf("unexpected host commands %v", hostCalls)
+	}
+
+	if valid, err := VerifyPassphrase("/dev/sdc", "wrong"); err != nil || valid {
+		t.Fatalf("valid = %v, err = %v, expected the passphrase to be invalid", valid, err)
+	}
+	if _, err := VerifyPassphrase("/dev/missing", "passphrase"); err == nil {
+		t.Fatalf("expected an error for a missing device")
+	}
+}
+
+func TestVerifyAllKeyslots(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "luksDump":
+			return testLUKS2Dump, nil
+		case "luksOpen":
+			// The passphrase only unlocks keyslot 3
+			if args[3] == "3" {
+				return "", nil
+			}
+			return "", &CommandError{ExitCode: 2, Err: fmt.Errorf("no key available with this passphrase")}
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	result, err := VerifyAllKeyslots("/dev/sdb", "passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[int]bool{0: false, 3: true}; !reflect.DeepEqual(result, expected) {
+		t.Fatalf("result = %v, expected %v", result, expected)
+	}
+
+	expected := []string{"luksOpen", "--test-passphrase", "--key-slot", "3", "/dev/sdb", "-d", "/dev/stdin"}
+	if call := f.lastCall("--test-passphrase"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+	for i, call := range f.calls {
+		if call[0] == "luksOpen" && f.stdins[i] != "passphrase" {
+			t.Fatalf("passphrase is not passed via stdin for %v", call)
+		}
+	}
+}
+
+func TestVerifyAllKeyslotsFailure(t *testing.T) {
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "luksDump":
+			return testLUKS2Dump, nil
+		case "luksOpen":
+			// Not a CommandError, e.g. cryptsetup failed to start
+			return "", fmt.Errorf("signal: killed")
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	if result, err := VerifyAllKeyslots("/dev/sdb", "passphrase"); err == nil {
+		t.Fatalf("result = %v, expected an error", result)
+	}
+	if err := RemovePassphrase("/dev/sdb", "passphrase"); err == nil || errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected the failure instead of an invalid passphrase", err)
+	}
+}
+
+func TestValidateKeyslotConsistency(t *testing.T) {
+	testCases := map[string]struct {
+		dump               string
+		passphrases        map[int]string
+		expectedConsistent bool
+	}{
+		"consistent LUKS2": {
+			dump:               testLUKS2Dump,
+			passphrases:        map[int]string{0: "passphrase-0", 3: "passphrase-3"},
+			expectedConsistent: true,
+		},
+		"inconsistent LUKS2": {
+			dump:               strings.Replace(testLUKS2Dump, "Area offset:290816 [bytes]\n\tArea length:258048 [bytes]\n\tDigest ID:  0", "Area offset:290816 [bytes]\n\tArea length:258048 [bytes]\n\tDigest ID:  1", 1),
+			passphrases:        map[int]string{0: "passphrase-0", 3: "passphrase-3"},
+			expectedConsistent: false,
+		},
+		"LUKS1": {
+			dump:               testLUKS1Dump,
+			passphrases:        map[int]string{0: "passphrase-0", 2: "passphrase-2"},
+			expectedConsistent: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		var f *fakeCryptSetup
+		f = newFakeCryptSetup(t, func(args []string) (string, error) {
+			switch {
+			case args[0] == "luksDump" && len(args) == 2:
+				return tc.dump, nil
+			case args[0] == "luksOpen" && args[1] == "--test-passphrase":
+				if f.stdins[len(f.stdins)-1] != "passphrase-"+args[3] {
+					return "", &CommandError{ExitCode: 2, Err: fmt.Errorf("no key available with this passphrase")}
+				}
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected args %v", args)
+		})
+
+		consistent, err := ValidateKeyslotConsistency("/dev/sdb", tc.passphrases)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if consistent != tc.expectedConsistent {
+			t.Fatalf("%v: consistent = %v, expected %v", name, consistent, tc.expectedConsistent)
+		}
+		for _, call := range f.calls {
+			for _, arg := range call {
+				if arg == "--dump-master-key" || arg == "--dump-volume-key" {
+					t.Fatalf("%v: unexpected master key dump %v", name, call)
+				}
+			}
+		}
+
+		if _, err := ValidateKeyslotConsistency("/dev/sdb", map[int]string{0: "wrong"}); !errors.Is(err, ErrInvalidPassphrase) {
+			t.Fatalf("%v: err = %v, expected ErrInvalidPassphrase", name, err)
+		}
+		if _, err := ValidateKeyslotConsistency("/dev/sdb", map[int]string{5: "passphrase-5"}); err == nil {
+			t.Fatalf("%v: expected an error for the disabled keyslot", name)
+		}
+	}
+
+	if _, err := ValidateKeyslotConsistency("/dev/sdb", nil); err == nil {
+		t.Fatalf("expected an error without passphrases")
+	}
+}
+
+// fakeKeyslotDevice fakes the keyslots of a LUKS1 device, holding the passphrase of each enabled keyslot.
+type fakeKeyslotDevice struct {
+	keySlots map[int]string
+	// brokenKeySlots fail the passphrase test even for the right passphrase
+	brokenKeySlots map[int]bool
+	// failedAddKeySlots fail luksAddKey
+	failedAddKeySlots map[int]bool
+	// luks2KeyslotsArea fakes a LUKS2 device instead, with the keyslots area of the size
+	luks2KeyslotsArea int
+}
+
+// luks2Dump returns the dump of the LUKS2 device with the 258048 bytes keyslot areas.
+func (d *fakeKeyslotDevice) luks2Dump() string {
+	header := strings.SplitN(testLUKS2Dump, "Keyslots:\n", 2)[0]
+	header = strings.Replace(header, "16744448", strconv.Itoa(d.luks2KeyslotsArea), 1)
+	dump := header + "Keyslots:\n"
+	for keySlot := 0; keySlot < luks2MaxKeyslots; keySlot++ {
+		if _, ok := d.keySlots[keySlot]; ok {
+			dump += fmt.Sprintf("  %v: luks2\n\tKey:        256 bits\n\tArea length:258048 [bytes]\n\tDigest ID:  0\n", keySlot)
+		}
+	}
+	return dump + "Tokens:\nDigests:\n  0: pbkdf2\n"
+}
+
+func (d *fakeKeyslotDevice) unlocks(passphrase string, except int) bool {
+	for keySlot, p := range d.keySlots {
+		if keySlot != except && p == passphrase {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fakeKeyslotDevice) handle(args []string, stdin string) (string, error) {
+	noKey := &CommandError{Command: "cryptsetup", Args: args, ExitCode: 2, Err: fmt.Errorf("no key available with this passphrase")}
+	switch args[0] {
+	case "luksDump":
+		if args[1] == "--dump-json-metadata" {
+			return "", fmt.Errorf("unsupported option")
+		}
+		if d.luks2KeyslotsArea > 0 {
+			return d.luks2Dump(), nil
+		}
+		dump := strings.SplitN(testLUKS1Dump, "\nKey Slot 0", 2)[0] + "\n"
+		for keySlot := 0; keySlot < luks1MaxKeyslots; keySlot++ {
+			if _, ok := d.keySlots[keySlot]; ok {
+				dump += fmt.Sprintf("Key Slot %v: ENABLED\n", keySlot)
+			} else {
+				dump += fmt.Sprintf("Key Slot %v: DISABLED\n", keySlot)
+			}
+		}
+		return dump, nil
+	case "luksOpen":
+		if args[2] != "--key-slot" {
+			if !d.unlocks(stdin, -1) {
+				return "", noKey
+			}
+			return "", nil
+		}
+		keySlot, _ := strconv.Atoi(args[3])
+		if p, ok := d.keySlots[keySlot]; !ok || p != stdin || d.brokenKeySlots[keySlot] {
+			return "", noKey
+		}
+		return "", nil
+	case "luksAddKey":
+		keySlot, _ := strconv.Atoi(args[2])
+		existing, passphrase := splitKeyFiles(args, stdin)
+		if !d.unlocks(existing, -1) {
+			return "", noKey
+		}
+		if _, ok := d.keySlots[keySlot]; ok {
+			return "", fmt.Errorf("key slot %v is full", keySlot)
+		}
+		if d.failedAddKeySlots[keySlot] {
+			return "", fmt.Errorf("failed to add key slot %v", keySlot)
+		}
+		d.keySlots[keySlot] = passphrase
+		return "", nil
+	case "luksChangeKey":
+		existing, passphrase := splitKeyFiles(args, stdin)
+		for keySlot := 0; keySlot < luks2MaxKeyslots; keySlot++ {
+			if p, ok := d.keySlots[keySlot]; ok && p == existing {
+				d.keySlots[keySlot] = passphrase
+				return "", nil
+			}
+		}
+		return "", noKey
+	case "luksRemoveKey":
+		for keySlot := 0; keySlot < luks2MaxKeyslots; keySlot++ {
+			if p, ok := d.keySlots[keySlot]; ok && p == stdin {
+				delete(d.keySlots, keySlot)
+				return "", nil
+			}
+		}
+		return "", noKey
+	case "luksKillSlot":
+		keySlot, _ := strconv.Atoi(args[2])
+		if !d.unlocks(stdin, keySlot) {
+			return "", noKey
+		}
+		delete(d.keySlots, keySlot)
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected args %v", args)
+}
+
+// splitKeyFiles splits stdin into the existing and the new key files by their sizes in the args.
+func splitKeyFiles(args []string, stdin string) (existing, passphrase string) {
+	size := -1
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--keyfile-size" {
+			size, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	if size < 0 || size > len(stdin) {
+		return stdin, ""
+	}
+	return stdin[:size], stdin[size:]
+}
+
+func newFakeKeyslotDevice(t *testing.T, keySlots map[int]string) *fakeKeyslotDevice {
+	d := &fakeKeyslotDevice{keySlots: keySlots}
+	var f *fakeCryptSetup
+	f = newFakeCryptSetup(t, func(args []string) (string, error) {
+		return d.handle(args, f.stdins[len(f.stdins)-1])
+	})
+	return d
+}
+
+func TestVerifyPassphrases(t *testing.T) {
+	oldLimit := GetConcurrencyLimit()
+	defer SetConcurrencyLimit(oldLimit)
+	if err := SetConcurrencyLimit(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	passphrases := map[string]string{}
+	reqs := []VerifyRequest{}
+	expected := []VerifyResult{}
+	for i := 0; i < 20; i++ {
+		devicePath := fmt.Sprintf("/dev/longhorn/vol-%d", i)
+		passphrases[devicePath] = fmt.Sprintf("key-%d", i)
+		req := VerifyRequest{DevicePath: devicePath, Passphrase: passphrases[devicePath]}
+		if i%3 == 0 {
+			req.Passphrase = "wrong"
+		}
+		reqs = append(reqs, req)
+		expected = append(expected, VerifyResult{DevicePath: devicePath, Valid: i%3 != 0})
+	}
+	reqs = append(reqs, VerifyRequest{DevicePath: "/dev/longhorn/missing", Passphrase: "key"})
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	oldRunner := cryptSetupRunner
+	cryptSetupRunner = func(ctx context.Context, stdin []byte, args ...string) (string, error) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			running--
+			lock.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		devicePath := args[2]
+		passphrase, ok := passphrases[devicePath]
+		switch {
+		case !ok:
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 4, Err: fmt.Errorf("device %s does not exist", devicePath)}
+		case passphrase != string(stdin):
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 2, Err: fmt.Errorf("no key available with this passphrase")}
+		}
+		return "", nil
+	}
+	t.Cleanup(func() {
+		cryptSetupRunner = oldRunner
+	})
+
+	results := VerifyPassphrases(reqs)
+	if len(results) != len(reqs) {
+		t.Fatalf("results = %v, expected %v results", results, len(reqs))
+	}
+	missing := results[len(results)-1]
+	if missing.DevicePath != "/dev/longhorn/missing" || missing.Valid || missing.Err == nil {
+		t.Fatalf("result = %+v, expected an error for the missing device", missing)
+	}
+	if !reflect.DeepEqual(results[:len(results)-1], expected) {
+		t.Fatalf("results = %+v, expected %+v", results[:len(results)-1], expected)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("max running = %v, expected the concurrency limit of 2 to be respected", maxRunning)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	// The passphrase is replaced in the same keyslot, even with all the keyslots in use
+	full := map[int]string{}
+	for keySlot := 0; keySlot < luks1MaxKeyslots; keySlot++ {
+		full[keySlot] = fmt.Sprintf("key-%v", keySlot)
+	}
+	d := newFakeKeyslotDevice(t, full)
+	if err := ChangePassphrase("/dev/sdb", "key-3", "new"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := d.keySlots[3]; p != "new" || len(d.keySlots) != luks1MaxKeyslots {
+		t.Fatalf("keyslots = %v, expected keyslot 3 to hold the new passphrase", d.keySlots)
+	}
+
+	if err := ChangePassphrase("/dev/sdb", "key-3", "other"); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected ErrInvalidPassphrase for the wrong old passphrase", err)
+	}
+	if err := ChangePassphrase("/dev/sdb", "new", "new"); err == nil {
+		t.Fatalf("expected an error changing to the same passphrase")
+	}
+
+	for _, passphrases := range [][2]string{{"new", ""}, {"", "next"}} {
+		if err := ChangePassphrase("/dev/sdb", passphrases[0], passphrases[1]); err == nil {
+			t.Fatalf("expected an error changing passphrase %q to %q", passphrases[0], passphrases[1])
+		}
+	}
+	if p := d.keySlots[3]; p != "new" {
+		t.Fatalf("keyslot 3 = %q, expected the invalid passphrases not to change it", p)
+	}
+
+	// A decoded binary passphrase may contain a newline, which is passed as is
+	for _, passphrases := range [][2]string{{"new", "next\nline"}, {"next\nline", "\x00\n"}} {
+		if err := ChangePassphrase("/dev/sdb", passphrases[0], passphrases[1]); err != nil {
+			t.Fatalf("unexpected error changing passphrase %q to %q: %v", passphrases[0], passphrases[1], err)
+		}
+		if p := d.keySlots[3]; p != passphrases[1] {
+			t.Fatalf("keyslot 3 = %q, expected %q", p, passphrases[1])
+		}
+	}
+}
+
+func TestReconcileKeyslots(t *testing.T) {
+	testCases := map[string]struct {
+		keySlots map[int]string
+		desired  map[int]string
+		verify   map[int]string
+	}{
+		"add": {
+			keySlots: map[int]string{0: "key-0"},
+			desired:  map[int]string{0: "key-0", 1: "key-1", 5: "key-5"},
+		},
+		"remove": {
+			keySlots: map[int]string{0: "key-0", 1: "key-1", 2: "key-2"},
+			desired:  map[int]string{1: "key-1"},
+		},
+		"replace": {
+			keySlots: map[int]string{0: "key-0", 1: "old-1"},
+			desired:  map[int]string{0: "key-0", 1: "new-1"},
+		},
+		"rotate the last keyslot": {
+			keySlots: map[int]string{0: "old-0"},
+			desired:  map[int]string{0: "new-0"},
+			verify:   map[int]string{0: "old-0"},
+		},
+		"move to other keyslots": {
+			keySlots: map[int]string{0: "old-0", 1: "old-1"},
+			desired:  map[int]string{2: "new-2"},
+			verify:   map[int]string{1: "old-1"},
+		},
+		"unchanged": {
+			keySlots: map[int]string{0: "key-0", 3: "key-3"},
+			desired:  map[int]string{0: "key-0", 3: "key-3"},
+		},
+		"binary passphrase": {
+			keySlots: map[int]string{0: "old\n0"},
+			desired:  map[int]string{0: "new\x00\n0", 1: "key\n1"},
+			verify:   map[int]string{0: "old\n0"},
+		},
+	}
+
+	for name, tc := range testCases {
+		d := newFakeKeyslotDevice(t, tc.keySlots)
+		if err := ReconcileKeyslots("/dev/sdb", tc.desired, tc.verify); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(d.keySlots, tc.desired) {
+			t.Fatalf("%v: keyslots = %v, expected %v", name, d.keySlots, tc.desired)
+		}
+	}
+}
+
+func TestReconcileKeyslotsFailure(t *testing.T) {
+	full := map[int]string{}
+	for keySlot := 0; keySlot < luks1MaxKeyslots; keySlot++ {
+		full[keySlot] = fmt.Sprintf("old-%v", keySlot)
+	}
+	testCases := map[string]struct {
+		keySlots map[int]string
+		desired  map[int]string
+		verify   map[int]string
+	}{
+		"free keyslots exhausted": {
+			keySlots: full,
+			desired:  map[int]string{0: "new-0", 1: "new-1", 2: "new-2", 3: "new-3", 4: "new-4", 5: "new-5", 6: "new-6", 7: "new-7"},
+			verify:   map[int]string{0: "old-0"},
+		},
+		"no desired keyslot": {
+			keySlots: map[int]string{0: "key-0"},
+			desired:  map[int]string{},
+			verify:   map[int]string{0: "key-0"},
+		},
+		"no authorization": {
+			keySlots: map[int]string{0: "key-0"},
+			desired:  map[int]string{0: "new-0"},
+			verify:   map[int]string{0: "wrong"},
+		},
+		"keyslot out of range": {
+			keySlots: map[int]string{0: "key-0"},
+			desired:  map[int]string{0: "key-0", 8: "key-8"},
+		},
+		"empty passphrase": {
+			keySlots: map[int]string{0: "key-0"},
+			desired:  map[int]string{0: "key-0", 1: ""},
+		},
+	}
+
+	for name, tc := range testCases {
+		original := map[int]string{}
+		for keySlot, passphrase := range tc.keySlots {
+			original[keySlot] = passphrase
+		}
+		d := newFakeKeyslotDevice(t, tc.keySlots)
+		if err := ReconcileKeyslots("/dev/sdb", tc.desired, tc.verify); err == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+		if !reflect.DeepEqual(d.keySlots, original) {
+			t.Fatalf("%v: keyslots = %v, expected unchanged %v", name, d.keySlots, original)
+		}
+	}
+}
+
+func TestReconcileKeyslotsTemporaryKeyslot(t *testing.T) {
+	// The temporary keyslot is removed even if replacing a keyslot fails
+	d := newFakeKeyslotDevice(t, map[int]string{0: "old-0", 1: "old-1"})
+	d.failedAddKeySlots = map[int]bool{1: true}
+	if err := ReconcileKeyslots("/dev/sdb", map[int]string{0: "new-0", 1: "new-1"}, map[int]string{0: "old-0"}); err == nil {
+		t.Fatalf("expected an error for the failed keyslot")
+	}
+	if expected := map[int]string{0: "new-0"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+
+	// but kept if it's the only keyslot left holding its passphrase
+	d = newFakeKeyslotDevice(t, map[int]string{0: "old-0", 1: "old-1"})
+	d.failedAddKeySlots = map[int]bool{0: true}
+	if err := ReconcileKeyslots("/dev/sdb", map[int]string{0: "new-0", 1: "new-1"}, map[int]string{0: "old-0"}); err == nil {
+		t.Fatalf("expected an error for the failed keyslot")
+	}
+	if expected := map[int]string{1: "old-1", 2: "new-0"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+}
+
+func TestReconcileKeyslotsLUKS2Capacity(t *testing.T) {
+	desired := map[int]string{0: "new-0", 1: "new-1"}
+	verify := map[int]string{0: "old-0"}
+
+	// Only 2 keyslot areas fit, so there is no room for the temporary keyslot
+	d := newFakeKeyslotDevice(t, map[int]string{0: "old-0", 1: "old-1"})
+	d.luks2KeyslotsArea = 2 * 258048
+	if err := ReconcileKeyslots("/dev/sdb", desired, verify); !errors.Is(err, ErrKeyslotsFull) {
+		t.Fatalf("err = %v, expected ErrKeyslotsFull", err)
+	}
+	if expected := map[int]string{0: "old-0", 1: "old-1"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected unchanged %v", d.keySlots, expected)
+	}
+	if err := ReconcileKeyslots("/dev/sdb", map[int]string{0: "old-0", 1: "old-1", 5: "key-5"}, nil); !errors.Is(err, ErrKeyslotsFull) {
+		t.Fatalf("err = %v, expected ErrKeyslotsFull for more passphrases than keyslots", err)
+	}
+
+	d.luks2KeyslotsArea = 3 * 258048
+	if err := ReconcileKeyslots("/dev/sdb", desired, verify); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(d.keySlots, desired) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, desired)
+	}
+}
+
+func TestAddPassphrase(t *testing.T) {
+	d := newFakeKeyslotDevice(t, map[int]string{0: "key-0", 2: "key-2"})
+	if err := AddPassphrase("/dev/sdb", "key-2", "key-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[int]string{0: "key-0", 1: "key-1", 2: "key-2"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+
+	if err := AddPassphrase("/dev/sdb", "wrong", "key-3"); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected ErrInvalidPassphrase", err)
+	}
+
+	// a decoded binary passphrase may contain a newline or a NUL byte
+	binary := string([]byte{0x0a, 0x00, 0xff, 0x0a})
+	if err := AddPassphrase("/dev/sdb", "key-1", binary); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := AddPassphrase("/dev/sdb", binary, "key-4"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[int]string{0: "key-0", 1: "key-1", 2: "key-2", 3: binary, 4: "key-4"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+
+	full := map[int]string{}
+	for keySlot := 0; keySlot < luks1MaxKeyslots; keySlot++ {
+		full[keySlot] = fmt.Sprintf("key-%v", keySlot)
+	}
+	newFakeKeyslotDevice(t, full)
+	err := AddPassphrase("/dev/sdb", "key-0", "key-8")
+	if err == nil || !strings.Contains(err.Error(), "all 8 keyslots") {
+		t.Fatalf("err = %v, expected an error for the full keyslots", err)
+	}
+}
+
+func TestRemovePassphrase(t *testing.T) {
+	d := newFakeKeyslotDevice(t, map[int]string{0: "key-0", 1: "shared", 3: "shared"})
+	if err := RemovePassphrase("/dev/sdb", "shared"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[int]string{0: "key-0"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+
+	if err := RemovePassphrase("/dev/sdb", "key-0"); err == nil {
+		t.Fatalf("expected an error removing the passphrase of the last keyslot")
+	}
+	if err := RemovePassphrase("/dev/sdb", "wrong"); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("err = %v, expected ErrInvalidPassphrase", err)
+	}
+	if expected := map[int]string{0: "key-0"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+}
+
+func TestRotatePassphrase(t *testing.T) {
+	d := newFakeKeyslotDevice(t, map[int]string{0: "old", 1: "other"})
+	if err := RotatePassphrase("/dev/sdb", "old", "new"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[int]string{1: "other", 2: "new"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected %v", d.keySlots, expected)
+	}
+
+	// The new keyslot fails the verification, so it's rolled back with the old passphrase kept
+	d = newFakeKeyslotDevice(t, map[int]string{0: "old"})
+	d.brokenKeySlots = map[int]bool{1: true}
+	if err := RotatePassphrase("/dev/sdb", "old", "new"); err == nil {
+		t.Fatalf("expected an error for the new passphrase failing the verification")
+	}
+	if expected := map[int]string{0: "old"}; !reflect.DeepEqual(d.keySlots, expected) {
+		t.Fatalf("keyslots = %v, expected the rollback to %v", d.keySlots, expected)
+	}
+
+	if err := RotatePassphrase("/dev/sdb", "old", "old"); err == nil {
+		t.Fatalf("expected an error rotating to the same passphrase")
+	}
+
+	// All the keyslots are in use, so the rotation fails before adding the new passphrase
+	full := map[int]string{}
+	for keySlot := 0; keySlot < luks1MaxKeyslots; keySlot++ {
+		full[keySlot] = fmt.Sprintf("key-%v", keySlot)
+	}
+	newFakeKeyslotDevice(t, full)
+	err := RotatePassphrase("/dev/sdb", "key-0", "new")
+	if !errors.Is(err, ErrKeyslotsFull) || !strings.Contains(err.Error(), "cannot rotate") {
+		t.Fatalf("err = %v, expected ErrKeyslotsFull before adding the new passphrase", err)
+	}
+}
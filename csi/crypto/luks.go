@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	iscsiutil "github.com/longhorn/go-iscsi-helper/util"
 )
@@ -15,57 +17,316 @@ import (
 const hostProcPath = "/proc" // we use hostPID for the csi plugin
 const luksTimeout = time.Minute
 
-func luksOpen(volume, devicePath, passphrase string) (stdout string, err error) {
-	return cryptSetupWithPassphrase(passphrase,
-		"luksOpen", devicePath, volume, "-d", "/dev/stdin")
+func luksOpen(ctx context.Context, mapper, devicePath, passphrase string, memoryKB int64, options ...string) (stdout string, err error) {
+	args := append([]string{"luksOpen", devicePath, mapper, "-d", "/dev/stdin"}, options...)
+	stdout, err = cryptSetupWithPassphraseCost(ctx, memoryKB, passphrase, args...)
+	return stdout, wrapCryptSetupError(err, true)
 }
 
-func luksClose(volume string) (stdout string, err error) {
-	return cryptSetup("luksClose", volume)
+// luksOpenWithKeyFile opens the device with the key file, which is read by cryptsetup as is.
+func luksOpenWithKeyFile(ctx context.Context, mapper, devicePath, keyFile string, memoryKB int64, options ...string) (stdout string, err error) {
+	args := append([]string{"luksOpen", devicePath, mapper, "--key-file", keyFile}, options...)
+	stdout, err = cryptSetupWithKeyFile(ctx, memoryKB, args...)
+	return stdout, wrapCryptSetupError(err, true)
 }
 
-func luksFormat(devicePath, passphrase string, cryptoParams *EncryptParams) (stdout string, err error) {
-	return cryptSetupWithPassphrase(passphrase,
-		"-q", "luksFormat", "--type", "luks2", "--cipher", cryptoParams.GetKeyCipher(), "--hash", cryptoParams.GetKeyHash(), "--key-size", cryptoParams.GetKeySize(), "--pbkdf", cryptoParams.GetPBKDF(),
-		devicePath, "-d", "/dev/stdin")
+func luksTestPassphrase(ctx context.Context, devicePath, passphrase string, keySlot int) (stdout string, err error) {
+	return cryptSetupWithPassphraseContext(ctx, passphrase,
+		"luksOpen", "--test-passphrase", "--key-slot", strconv.Itoa(keySlot), devicePath, "-d", "/dev/stdin")
 }
 
-func luksResize(volume, passphrase string) (stdout string, err error) {
-	return cryptSetupWithPassphrase(passphrase,
-		"resize", volume)
+// luksTestAnyPassphrase checks the passphrase against all the keyslots without activating the mapping.
+func luksTestAnyPassphrase(ctx context.Context, devicePath, passphrase string) (stdout string, err error) {
+	return cryptSetupWithPassphraseContext(ctx, passphrase,
+		"luksOpen", "--test-passphrase", devicePath, "-d", "/dev/stdin")
 }
 
-func luksStatus(volume string) (stdout string, err error) {
-	return cryptSetup("status", volume)
+// luksAddKey adds the new passphrase to the free keyslot, authorized by the existing passphrase.
+// Both are read from stdin as raw key files, the existing one first, bounded by their sizes so
+// that a decoded binary passphrase may contain any byte including a newline.
+func luksAddKey(ctx context.Context, devicePath, existingPassphrase, newPassphrase string, keySlot int) (stdout string, err error) {
+	// a key file size of 0 means reading until EOF
+	if existingPassphrase == "" || newPassphrase == "" {
+		return "", fmt.Errorf("empty passphrase for device %s", devicePath)
+	}
+	stdout, err = cryptSetupWithPassphraseContext(ctx, existingPassphrase+newPassphrase,
+		"luksAddKey", "--key-slot", strconv.Itoa(keySlot), devicePath, "/dev/stdin",
+		"-d", "/dev/stdin", "--keyfile-size", strconv.Itoa(len(existingPassphrase)),
+		"--new-keyfile-size", strconv.Itoa(len(newPassphrase)))
+	return stdout, wrapCryptSetupError(err, true)
+}
+
+// luksChangeKey replaces the passphrase of the first keyslot unlocked by the old passphrase with the
+// new one. Both are read from stdin as raw key files like in luksAddKey.
+func luksChangeKey(ctx context.Context, devicePath, oldPassphrase, newPassphrase string) (stdout string, err error) {
+	if oldPassphrase == "" || newPassphrase == "" {
+		return "", fmt.Errorf("empty passphrase for device %s", devicePath)
+	}
+	stdout, err = cryptSetupWithPassphraseContext(ctx, oldPassphrase+newPassphrase,
+		"luksChangeKey", devicePath, "/dev/stdin",
+		"-d", "/dev/stdin", "--keyfile-size", strconv.Itoa(len(oldPassphrase)),
+		"--new-keyfile-size", strconv.Itoa(len(newPassphrase)))
+	return stdout, wrapCryptSetupError(err, true)
+}
+
+// luksRemoveKey wipes the first keyslot unlocked by the passphrase.
+func luksRemoveKey(ctx context.Context, devicePath, passphrase string) (stdout string, err error) {
+	return cryptSetupWithPassphraseContext(ctx, passphrase,
+		"luksRemoveKey", devicePath, "-d", "/dev/stdin")
+}
+
+// luksKillSlot wipes the keyslot, authorized by the passphrase of another keyslot.
+func luksKillSlot(ctx context.Context, devicePath, passphrase string, keySlot int) (stdout string, err error) {
+	return cryptSetupWithPassphraseContext(ctx, passphrase,
+		"luksKillSlot", devicePath, strconv.Itoa(keySlot), "-d", "/dev/stdin")
+}
+
+func luksClose(ctx context.Context, mapper string) (stdout string, err error) {
+	stdout, err = cryptSetupContext(ctx, "luksClose", mapper)
+	return stdout, wrapCryptSetupError(err, false)
+}
+
+func luksCloseDeferred(ctx context.Context, mapper string) (stdout string, err error) {
+	stdout, err = cryptSetupContext(ctx, "close", "--deferred", mapper)
+	return stdout, wrapCryptSetupError(err, false)
+}
+
+func luksFormat(ctx context.Context, devicePath, passphrase string, cryptoParams *EncryptParams) (stdout string, err error) {
+	args := append(getLUKSFormatArgs(cryptoParams), devicePath, "-d", "/dev/stdin")
+	return cryptSetupWithPassphraseCost(ctx, cryptoParams.getPBKDFMemoryEstimateKB(), passphrase, args...)
+}
+
+func luksFormatWithKeyFile(ctx context.Context, devicePath, keyFile string, cryptoParams *EncryptParams) (stdout string, err error) {
+	args := append(getLUKSFormatArgs(cryptoParams), devicePath, "--key-file", keyFile)
+	return cryptSetupWithKeyFile(ctx, cryptoParams.getPBKDFMemoryEstimateKB(), args...)
+}
+
+// getLUKSFormatArgs returns the luksFormat arguments of the params except the device and the key.
+func getLUKSFormatArgs(cryptoParams *EncryptParams) []string {
+	resolved := cryptoParams.Resolved()
+	args := []string{"-q", "luksFormat", "--type", resolved.LUKSType, "--cipher", resolved.KeyCipher, "--hash", resolved.KeyHash, "--key-size", resolved.KeySize, "--pbkdf", resolved.PBKDF}
+	if memory := cryptoParams.GetPBKDFMemoryKB(); memory != "" {
+		args = append(args, "--pbkdf-memory", memory)
+	}
+	if iterations := cryptoParams.GetPBKDFIterations(); iterations != "" {
+		args = append(args, "--pbkdf-force-iterations", iterations)
+	}
+	if parallel := cryptoParams.GetPBKDFParallel(); parallel != "" {
+		args = append(args, "--pbkdf-parallel", parallel)
+	}
+	if cryptoParams.Integrity != "" {
+		args = append(args, "--integrity", cryptoParams.Integrity)
+	}
+	if cryptoParams.KeySectorSize != "" {
+		args = append(args, "--sector-size", cryptoParams.KeySectorSize)
+	}
+	if cryptoParams.VolumeUUID != "" {
+		args = append(args, "--subsystem", luksSubsystemLonghorn, "--label", cryptoParams.VolumeUUID)
+	}
+	return append(args, getHeaderOptions(cryptoParams.HeaderFile)...)
+}
+
+func luksResize(ctx context.Context, mapper, passphrase string, options ...string) (stdout string, err error) {
+	args := append([]string{"resize", mapper}, options...)
+	stdout, err = cryptSetupWithPassphraseContext(ctx, passphrase, args...)
+	return stdout, wrapCryptSetupError(err, true)
+}
+
+func luksStatus(ctx context.Context, mapper string, options ...string) (stdout string, err error) {
+	args := append([]string{"status", mapper}, options...)
+	return cryptSetupContext(ctx, args...)
+}
+
+func luksOpenWithMasterKey(ctx context.Context, mapper, devicePath, masterKeyFile string) (stdout string, err error) {
+	return cryptSetupContext(ctx, "luksOpen", "--master-key-file", masterKeyFile, devicePath, mapper)
+}
+
+// plainOpen opens the device in the plain dm-crypt mode. The passphrase is read from stdin
+// without -d, so cryptsetup hashes it with the hash like an interactive passphrase, while
+// a key file would be used as the raw key.
+func plainOpen(ctx context.Context, mapper, devicePath, passphrase, cipher, hash, keySize string) (stdout string, err error) {
+	return cryptSetupWithPassphraseContext(ctx, passphrase,
+		"plainOpen", "--cipher", cipher, "--hash", hash, "--key-size", keySize, devicePath, mapper)
+}
+
+func luksRepair(ctx context.Context, devicePath string) (stdout string, err error) {
+	return cryptSetupContext(ctx, "-q", "-v", "repair", devicePath)
+}
+
+func luksDump(ctx context.Context, devicePath string) (stdout string, err error) {
+	return cryptSetupContext(ctx, "luksDump", devicePath)
+}
+
+func luksDumpJSON(ctx context.Context, devicePath string) (stdout string, err error) {
+	return cryptSetupContext(ctx, "luksDump", "--dump-json-metadata", devicePath)
+}
+
+func luksUUID(ctx context.Context, devicePath string) (stdout string, err error) {
+	return cryptSetupContext(ctx, "luksUUID", devicePath)
+}
+
+func luksIsLuks(ctx context.Context, devicePath string) (stdout string, err error) {
+	return cryptSetupContext(ctx, "isLuks", devicePath)
 }
 
 func cryptSetup(args ...string) (stdout string, err error) {
-	return cryptSetupWithPassphrase("", args...)
+	return cryptSetupContext(context.Background(), args...)
+}
+
+func cryptSetupContext(ctx context.Context, args ...string) (stdout string, err error) {
+	return runValidatedCryptSetup(ctx, nil, args...)
+}
+
+// cryptSetupWithPassphrase feeds the passphrase to cryptsetup via stdin. The passphrase
+// is copied into a buffer which is zeroed once cryptsetup completes, since Go strings
+// cannot be wiped. The concurrency is throttled as deriving the key is expensive.
+func cryptSetupWithPassphrase(passphrase string, args ...string) (stdout string, err error) {
+	return cryptSetupWithPassphraseContext(context.Background(), passphrase, args...)
+}
+
+func cryptSetupWithPassphraseContext(ctx context.Context, passphrase string, args ...string) (stdout string, err error) {
+	return cryptSetupWithPassphraseCost(ctx, argon2DefaultMemoryKB, passphrase, args...)
+}
+
+// cryptSetupWithPassphraseCost is cryptSetupWithPassphraseContext with the estimated memory cost
+// in KiB of the key derivation, which is accounted by the throttle.
+func cryptSetupWithPassphraseCost(ctx context.Context, memoryKB int64, passphrase string, args ...string) (stdout string, err error) {
+	if err := cryptoThrottle.acquire(ctx, memoryKB); err != nil {
+		return "", err
+	}
+	defer cryptoThrottle.release(memoryKB)
+
+	stdin := []byte(passphrase)
+	defer zeroBytes(stdin)
+	return runValidatedCryptSetup(ctx, stdin, args...)
+}
+
+// cryptSetupWithKeyFile runs cryptsetup deriving the key from a key file passed in the args, which
+// is throttled like cryptSetupWithPassphraseCost.
+func cryptSetupWithKeyFile(ctx context.Context, memoryKB int64, args ...string) (stdout string, err error) {
+	if err := cryptoThrottle.acquire(ctx, memoryKB); err != nil {
+		return "", err
+	}
+	defer cryptoThrottle.release(memoryKB)
+
+	return runValidatedCryptSetup(ctx, nil, args...)
 }
 
-// cryptSetupWithPassphrase runs cryptsetup via nsenter inside of the host namespaces
+// runValidatedCryptSetup runs cryptsetup via cryptSetupRunner, and refuses the output which is not
+// valid UTF-8, e.g. in a corrupt environment, rather than feeding it to the line-based parsers.
+// The output itself is left out of the error since it may hold the key material.
+func runValidatedCryptSetup(ctx context.Context, stdin []byte, args ...string) (stdout string, err error) {
+	stdout, err = cryptSetupRunner(ctx, stdin, args...)
+	if err != nil || utf8.ValidString(stdout) {
+		return stdout, err
+	}
+	offset := 0
+	for offset < len(stdout) {
+		r, size := utf8.DecodeRuneInString(stdout[offset:])
+		if r == utf8.RuneError && size <= 1 {
+			break
+		}
+		offset += size
+	}
+	action := ""
+	if len(args) > 0 {
+		action = args[0]
+	}
+	return "", fmt.Errorf("output of cryptsetup %v is invalid UTF-8 at byte %v of %v: %w", action, offset, len(stdout), ErrUnexpectedOutputEncoding)
+}
+
+// cryptSetupRunner is the function actually executing cryptsetup. It can be
+// replaced in tests to verify the assembled arguments without a host binary.
+// cryptsetup is killed once the context is cancelled.
+var cryptSetupRunner = runCryptSetup
+
+// runCryptSetup runs cryptsetup via nsenter inside of the host namespaces
 // cryptsetup returns 0 on success and a non-zero value on error.
 // 1 wrong parameters, 2 no permission (bad passphrase),
 // 3 out of memory, 4 wrong device specified,
 // 5 device already exists or device is busy.
-func cryptSetupWithPassphrase(passphrase string, args ...string) (stdout string, err error) {
+// cryptsetup is wrapped with nice and ionice if a lower priority is configured.
+// The cryptsetup binary and the global args are configurable, see SetCryptsetupPath.
+func runCryptSetup(ctx context.Context, stdin []byte, args ...string) (stdout string, err error) {
+	cryptSetupCommand, cryptSetupArgs := getCryptSetupCommand(args)
+	command, wrappedArgs := getCryptSetupPriority().wrap(cryptSetupCommand, cryptSetupArgs)
+	stdout, err = runHostCommand(ctx, command, stdin, wrappedArgs...)
+	if cmdErr, ok := err.(*CommandError); ok {
+		// Report cryptsetup rather than the priority wrappers
+		cmdErr.Command = cryptSetupCommand
+		cmdErr.Args = cryptSetupArgs
+	}
+	return stdout, err
+}
+
+// hostCommandRunner executes the helper commands other than cryptsetup, e.g. blockdev.
+// It can be replaced in tests as well.
+var hostCommandRunner = func(ctx context.Context, command string, args ...string) (stdout string, err error) {
+	return runHostCommand(ctx, command, nil, args...)
+}
+
+func runHostCommand(ctx context.Context, command string, stdin []byte, args ...string) (stdout string, err error) {
 	// NOTE: cryptsetup needs to be run in the host IPC/MNT
 	// if you only use MNT the binary will not return but still do the appropriate action.
 	ns := iscsiutil.GetHostNamespacePath(hostProcPath)
-	nsArgs := prepareCommandArgs(ns, "cryptsetup", args)
-	ctx, cancel := context.WithTimeout(context.TODO(), luksTimeout)
+	nsArgs := prepareCommandArgs(ns, command, args)
+	stdout, err = runCommand(ctx, "nsenter", stdin, nsArgs...)
+	if cmdErr, ok := err.(*CommandError); ok {
+		// Report the command run inside of the host namespaces rather than nsenter
+		cmdErr.Command = command
+		cmdErr.Args = args
+	}
+	return stdout, err
+}
+
+// noLUKSTimeoutKey marks the context of a long-running command, e.g. a re-encryption, which must
+// not be killed by the luksTimeout.
+type noLUKSTimeoutKey struct{}
+
+// withoutLUKSTimeout returns the context whose commands are only bounded by the context itself.
+func withoutLUKSTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noLUKSTimeoutKey{}, true)
+}
+
+// runCommand runs the command with the luksTimeout unless the context is marked by
+// withoutLUKSTimeout. The command is killed once the context is cancelled, and the error of the
+// context is returned then.
+func runCommand(ctx context.Context, command string, stdin []byte, args ...string) (stdout string, err error) {
+	var timeoutCtx context.Context
+	var cancel context.CancelFunc
+	if ctx.Value(noLUKSTimeoutKey{}) == nil {
+		timeoutCtx, cancel = context.WithTimeout(ctx, luksTimeout)
+	} else {
+		timeoutCtx, cancel = context.WithCancel(ctx)
+	}
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "nsenter", nsArgs...)
+	cmd := exec.CommandContext(timeoutCtx, command, args...)
+	// The output is parsed, so it must not be localized
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
 
-	var stdoutBuf bytes.Buffer
+	var stdoutBuf, stderrBuf bytes.Buffer
 	cmd.Stdout = &stdoutBuf
-	if len(passphrase) > 0 {
-		cmd.Stdin = strings.NewReader(passphrase)
+	cmd.Stderr = &stderrBuf
+	if len(stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(stdin)
 	}
 
-	output := string(stdoutBuf.Bytes())
 	if err := cmd.Run(); err != nil {
-		return output, fmt.Errorf("failed to run cryptsetup args: %v output: %v error: %v", args, output, err)
+		if ctx.Err() != nil {
+			return stdoutBuf.String(), ctx.Err()
+		}
+		exitCode := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+		return stdoutBuf.String(), &CommandError{
+			Command:  command,
+			Args:     args,
+			Output:   stdoutBuf.String(),
+			Stderr:   stderrBuf.String(),
+			ExitCode: exitCode,
+			Err:      err,
+		}
 	}
 
 	return stdoutBuf.String(), nil
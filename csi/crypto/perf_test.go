@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetPerformanceProfileFlags(t *testing.T) {
+	testCases := map[string]struct {
+		profile       string
+		expectedFlags []string
+		expectedError bool
+	}{
+		"empty": {
+			profile:       "",
+			expectedFlags: []string{},
+		},
+		"default": {
+			profile:       PerformanceProfileDefault,
+			expectedFlags: []string{},
+		},
+		"low latency": {
+			profile:       PerformanceProfileLowLatency,
+			expectedFlags: []string{"--perf-no_read_workqueue", "--perf-no_write_workqueue"},
+		},
+		"throughput": {
+			profile:       PerformanceProfileThroughput,
+			expectedFlags: []string{"--perf-submit_from_crypt_cpus"},
+		},
+		"invalid": {
+			profile:       "fastest",
+			expectedError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		flags, err := getPerformanceProfileFlags(tc.profile)
+		if tc.expectedError {
+			if err == nil {
+				t.Fatalf("%v: expected an error", name)
+			}
+			if err := (&EncryptParams{PerformanceProfile: tc.profile}).validate(); err == nil {
+				t.Fatalf("%v: expected a validation error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(flags, tc.expectedFlags) {
+			t.Fatalf("%v: flags = %v, expected %v", name, flags, tc.expectedFlags)
+		}
+	}
+}
+
+func TestOpenVolumePerformanceProfile(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{PerformanceProfile: PerformanceProfileLowLatency}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"luksOpen", "/dev/longhorn/vol", MapperName("vol"), "-d", "/dev/stdin", "--perf-no_read_workqueue", "--perf-no_write_workqueue"}
+	if call := f.lastCall("luksOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("luksOpen args = %v, expected %v", call, expected)
+	}
+
+	if err := OpenVolume("vol", "/dev/longhorn/vol", "passphrase", &EncryptParams{PerformanceProfile: "fastest"}); err == nil {
+		t.Fatalf("expected an error for the invalid performance profile")
+	}
+}
@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OpenPlainVolume opens the legacy plain mode dm-crypt device of the volume. A plain device has
+// no header, so nothing is stored about how it was encrypted: the cipher, the hash and the key
+// size have to be passed explicitly and exactly as they were at the first open, and there is no
+// keyslot to verify the passphrase against. A wrong passphrase or parameter still opens the
+// device, but the mapping reads garbage and writing to it destroys the data, so the mapping has
+// to be checked before use, e.g. by probing for the expected filesystem. There is no passphrase
+// rotation either, since the key is derived from the passphrase directly. The defaults of the
+// params are never applied for the same reason.
+func OpenPlainVolume(volume, devicePath, passphrase string, params *EncryptParams) error {
+	if err := validateMapperName(volume); err != nil {
+		return err
+	}
+	if params == nil || params.KeyCipher == "" || params.KeyHash == "" || params.KeySize == "" {
+		return fmt.Errorf("cipher, hash and key size are required to open plain device %s since it has no header", devicePath)
+	}
+	if isOpen, _ := IsDeviceOpen(VolumeMapper(volume)); isOpen {
+		logrus.Debugf("device %s is already opened at %s", devicePath, VolumeMapper(volume))
+		return nil
+	}
+
+	// Opening a LUKS device in the plain mode maps the header as the data
+	if _, err := luksIsLuks(context.Background(), devicePath); err == nil {
+		return fmt.Errorf("device %s has a LUKS header, it must not be opened in the plain mode", devicePath)
+	}
+
+	logrus.Warnf("Opening device %s in the plain mode on %s, the passphrase and the params cannot be verified without a header", devicePath, volume)
+	if _, err := plainOpen(context.Background(), MapperName(volume), devicePath, passphrase, params.KeyCipher, params.KeyHash, params.KeySize); err != nil {
+		return fmt.Errorf("failed to open plain device %s: %w", devicePath, err)
+	}
+	return EnsureMapperNode(volume)
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestOpenPlainVolume(t *testing.T) {
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status", "isLuks":
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		}
+		return "", nil
+	})
+
+	params := NewEncryptParams("", "aes-cbc-essiv:sha256", "ripemd160", "256", "", "")
+	if err := OpenPlainVolume("vol", "/dev/longhorn/vol", "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"plainOpen", "--cipher", "aes-cbc-essiv:sha256", "--hash", "ripemd160", "--key-size", "256", "/dev/longhorn/vol", MapperName("vol")}
+	if call := f.lastCall("plainOpen"); !reflect.DeepEqual(call, expected) {
+		t.Fatalf("plainOpen args = %v, expected %v", call, expected)
+	}
+	if stdin := f.stdins[len(f.stdins)-1]; stdin != "passphrase" {
+		t.Fatalf("stdin = %q, expected the passphrase", stdin)
+	}
+
+	for name, params := range map[string]*EncryptParams{
+		"nil params":       nil,
+		"missing cipher":   NewEncryptParams("", "", "ripemd160", "256", "", ""),
+		"missing hash":     NewEncryptParams("", "aes-cbc-essiv:sha256", "", "256", "", ""),
+		"missing key size": NewEncryptParams("", "aes-cbc-essiv:sha256", "ripemd160", "", "", ""),
+	} {
+		f.calls = nil
+		if err := OpenPlainVolume("vol", "/dev/longhorn/vol", "passphrase", params); err == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+		if call := f.lastCall("plainOpen"); call != nil {
+			t.Fatalf("%v: unexpected plainOpen %v", name, call)
+		}
+	}
+}
+
+func TestOpenPlainVolumeLUKSDevice(t *testing.T) {
+	f := newFakeCryptSetup(t, closedDeviceHandler)
+
+	params := NewEncryptParams("", "aes-cbc-essiv:sha256", "ripemd160", "256", "", "")
+	if err := OpenPlainVolume("vol", "/dev/longhorn/vol", "passphrase", params); err == nil {
+		t.Fatalf("expected an error for the LUKS device")
+	}
+	if call := f.lastCall("plainOpen"); call != nil {
+		t.Fatalf("unexpected plainOpen %v", call)
+	}
+}
@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	// ioniceClassNone keeps the IO scheduling class of cryptsetup unchanged
+	ioniceClassNone       = 0
+	ioniceClassBestEffort = 2
+	ioniceClassIdle       = 3
+
+	maxNiceness        = 19
+	maxIoniceBestLevel = 7
+)
+
+// cryptSetupPriority is the CPU and IO scheduling priority cryptsetup runs with.
+// The zero value is the normal priority.
+type cryptSetupPriority struct {
+	niceness    int
+	ioniceClass int
+	ioniceLevel int
+}
+
+var (
+	cryptSetupPriorityLock    sync.RWMutex
+	currentCryptSetupPriority cryptSetupPriority
+)
+
+// SetCryptSetupPriority deprioritizes cryptsetup, so the key derivations of a bulk volume open
+// don't starve the other processes on the node. The niceness is 0 to 19, and the ionice class
+// is 0 for unchanged, 2 for best-effort with the level 0 to 7, or 3 for idle. The realtime class
+// and the negative niceness are rejected since they would boost cryptsetup instead.
+func SetCryptSetupPriority(niceness, ioniceClass, ioniceLevel int) error {
+	if niceness < 0 || niceness > maxNiceness {
+		return fmt.Errorf("invalid niceness %v, it should be between 0 and %v", niceness, maxNiceness)
+	}
+	switch ioniceClass {
+	case ioniceClassNone, ioniceClassIdle:
+		ioniceLevel = 0
+	case ioniceClassBestEffort:
+		if ioniceLevel < 0 || ioniceLevel > maxIoniceBestLevel {
+			return fmt.Errorf("invalid best-effort ionice level %v, it should be between 0 and %v", ioniceLevel, maxIoniceBestLevel)
+		}
+	default:
+		return fmt.Errorf("unsupported ionice class %v", ioniceClass)
+	}
+
+	cryptSetupPriorityLock.Lock()
+	defer cryptSetupPriorityLock.Unlock()
+	currentCryptSetupPriority = cryptSetupPriority{niceness: niceness, ioniceClass: ioniceClass, ioniceLevel: ioniceLevel}
+	return nil
+}
+
+func getCryptSetupPriority() cryptSetupPriority {
+	cryptSetupPriorityLock.RLock()
+	defer cryptSetupPriorityLock.RUnlock()
+	return currentCryptSetupPriority
+}
+
+// wrap prefixes the command with nice and ionice as configured. The command is returned
+// unchanged for the normal priority.
+func (p cryptSetupPriority) wrap(command string, args []string) (string, []string) {
+	prefix := []string{}
+	if p.niceness > 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(p.niceness))
+	}
+	if p.ioniceClass != ioniceClassNone {
+		prefix = append(prefix, "ionice", "-c", strconv.Itoa(p.ioniceClass))
+		if p.ioniceClass == ioniceClassBestEffort {
+			prefix = append(prefix, "-n", strconv.Itoa(p.ioniceLevel))
+		}
+	}
+	if len(prefix) == 0 {
+		return command, args
+	}
+	return prefix[0], append(append(prefix[1:], command), args...)
+}
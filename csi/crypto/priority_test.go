@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCryptSetupPriority(t *testing.T) {
+	defer SetCryptSetupPriority(0, 0, 0)
+
+	args := []string{"luksOpen", "/dev/sdb", "vol", "-d", "/dev/stdin"}
+	command, wrappedArgs := getCryptSetupPriority().wrap("cryptsetup", args)
+	if command != "cryptsetup" || !reflect.DeepEqual(wrappedArgs, args) {
+		t.Fatalf("command = %v %v, expected cryptsetup to run unwrapped by default", command, wrappedArgs)
+	}
+
+	testCases := map[string]struct {
+		niceness, ioniceClass, ioniceLevel int
+		expectedCommand                    string
+		expectedArgs                       []string
+	}{
+		"nice":                 {10, 0, 0, "nice", []string{"-n", "10", "cryptsetup"}},
+		"best-effort ionice":   {0, 2, 7, "ionice", []string{"-c", "2", "-n", "7", "cryptsetup"}},
+		"nice and idle ionice": {19, 3, 4, "nice", []string{"-n", "19", "ionice", "-c", "3", "cryptsetup"}},
+	}
+	for name, tc := range testCases {
+		if err := SetCryptSetupPriority(tc.niceness, tc.ioniceClass, tc.ioniceLevel); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		command, wrappedArgs := getCryptSetupPriority().wrap("cryptsetup", args)
+		expectedArgs := append(tc.expectedArgs, args...)
+		if command != tc.expectedCommand || !reflect.DeepEqual(wrappedArgs, expectedArgs) {
+			t.Fatalf("%v: command = %v %v, expected %v %v", name, command, wrappedArgs, tc.expectedCommand, expectedArgs)
+		}
+	}
+
+	for _, invalid := range [][3]int{{-5, 0, 0}, {20, 0, 0}, {0, 1, 0}, {0, 2, 8}} {
+		if err := SetCryptSetupPriority(invalid[0], invalid[1], invalid[2]); err == nil {
+			t.Fatalf("expected an error for niceness %v ionice class %v level %v", invalid[0], invalid[1], invalid[2])
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	reencryptRequirement = "online-reencrypt"
+	sectorSize           = 512
+)
+
+// reencryptProgressInterval is the interval of polling the LUKS header for the progress of a
+// running re-encryption. It can be shortened in tests.
+var reencryptProgressInterval = 10 * time.Second
+
+// ReencryptVolume re-encrypts the LUKS2 device with the cipher and the key size of the new params.
+// See ReencryptVolumeContext.
+func ReencryptVolume(devicePath, passphrase string, newParams *EncryptParams) error {
+	return ReencryptVolumeContext(context.Background(), devicePath, passphrase, newParams, nil)
+}
+
+// ReencryptVolumeContext re-encrypts the LUKS2 device in place with a new volume key and the cipher
+// and the key size of the new params. The device can stay open and in use meanwhile. A pending
+// re-encryption, e.g. interrupted by a crash or a cancellation, is resumed rather than started
+// over, so the call can be simply repeated until it succeeds. A device already using the cipher and
+// the key size without a pending re-encryption is left alone.
+// The progress, if not nil, is called periodically with the percentage of the data re-encrypted.
+// cryptsetup is killed once the context is cancelled, and the returned error wraps the error of the
+// context then. It's not bounded by the usual cryptsetup timeout since it may take hours.
+func ReencryptVolumeContext(ctx context.Context, devicePath, passphrase string, newParams *EncryptParams, progress func(percent float64)) error {
+	if newParams == nil {
+		return fmt.Errorf("missing encryption params to re-encrypt device %s", devicePath)
+	}
+	if err := newParams.validate(); err != nil {
+		return err
+	}
+	if newParams.GetLUKSVersion() != luksTypeLUKS2 {
+		return fmt.Errorf("re-encryption requires %v rather than %v", luksTypeLUKS2, newParams.GetLUKSVersion())
+	}
+	// The online re-encryption was introduced in cryptsetup 2.2
+	if err := requireCryptSetupVersion(ctx, 2, 2); err != nil {
+		return fmt.Errorf("cannot re-encrypt device %s: %w", devicePath, err)
+	}
+	passphrase, err := DecodePassphrase(passphrase, newParams.PassphraseEncoding)
+	if err != nil {
+		return err
+	}
+
+	headerPath := devicePath
+	if newParams.HeaderFile != "" {
+		headerPath = newParams.HeaderFile
+	}
+	dump, err := luksDump(ctx, headerPath)
+	if err != nil {
+		return fmt.Errorf("failed to dump LUKS header of device %s: %w", devicePath, err)
+	}
+	info, err := parseLUKSDeviceInfo(dump)
+	if err != nil {
+		return fmt.Errorf("failed to parse LUKS header of device %s: %w", devicePath, err)
+	}
+	if info.Version != "2" {
+		return fmt.Errorf("device %s is LUKS version %v, re-encryption requires %v", devicePath, info.Version, luksTypeLUKS2)
+	}
+
+	resolved := newParams.Resolved()
+	args := []string{"reencrypt", devicePath, "-d", "/dev/stdin"}
+	switch {
+	case strings.Contains(parseCryptSetupKeyValues(dump)["Requirements"], reencryptRequirement):
+		// The first data segment is the area already re-encrypted with the target cipher. Without
+		// the new key args cryptsetup resumes the pending re-encryption.
+		if info.Cipher != resolved.KeyCipher {
+			return fmt.Errorf("device %s has a pending re-encryption to cipher %v rather than %v", devicePath, info.Cipher, resolved.KeyCipher)
+		}
+		logrus.Infof("Resuming re-encryption of device %s to cipher %v", devicePath, info.Cipher)
+	case info.Cipher == resolved.KeyCipher && info.KeySize == resolved.KeySize:
+		logrus.Infof("Device %s already uses cipher %v with key size %v", devicePath, info.Cipher, info.KeySize)
+		return nil
+	default:
+		logrus.Infof("Re-encrypting device %s from cipher %v to %v", devicePath, info.Cipher, resolved.KeyCipher)
+		args = append(args, "--cipher", resolved.KeyCipher, "--key-size", resolved.KeySize,
+			"--hash", resolved.KeyHash, "--pbkdf", resolved.PBKDF)
+	}
+	args = append(args, getHeaderOptions(newParams.HeaderFile)...)
+
+	// The crypto throttle is not taken, since it would be held for the whole re-encryption
+	done := make(chan error, 1)
+	go func() {
+		stdin := []byte(passphrase)
+		defer zeroBytes(stdin)
+		_, err := runValidatedCryptSetup(withoutLUKSTimeout(ctx), stdin, args...)
+		done <- err
+	}()
+
+	ticker := time.NewTicker(reencryptProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("failed to re-encrypt device %s: %w", devicePath, wrapCryptSetupError(err, true))
+			}
+			if progress != nil {
+				progress(100)
+			}
+			return nil
+		case <-ticker.C:
+			if progress == nil {
+				continue
+			}
+			percent, err := getReencryptionProgress(ctx, devicePath, headerPath)
+			if err != nil {
+				logrus.WithError(err).Debugf("Failed to get re-encryption progress of device %s", devicePath)
+				continue
+			}
+			progress(percent)
+		}
+	}
+}
+
+// getReencryptionProgress reads the progress of the running re-encryption of the device from its
+// LUKS header. The data size is the device size minus the offset of the data.
+func getReencryptionProgress(ctx context.Context, devicePath, headerPath string) (float64, error) {
+	dump, err := luksDump(ctx, headerPath)
+	if err != nil {
+		return 0, err
+	}
+	kvs := parseCryptSetupKeyValues(dump)
+	if !strings.Contains(kvs["Requirements"], reencryptRequirement) {
+		return 0, fmt.Errorf("no pending re-encryption")
+	}
+	// The first offset is the one of the first data segment
+	offset, err := parseBytes(kvs["offset"])
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse data offset: %w", err)
+	}
+	deviceSize, err := getDeviceSize(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	return parseReencryptionProgress(dump, deviceSize-offset)
+}
+
+// ListPendingReencryptions returns the volumes with an in-progress LUKS2
+// re-encryption along with the percentage of the data already re-encrypted.
+// Volumes which are not open or have no pending re-encryption are skipped.
+func ListPendingReencryptions(volumes []string) (map[string]float64, error) {
+	pending := map[string]float64{}
+	for _, volume := range volumes {
+		stdout, err := luksStatus(context.Background(), MapperName(volume))
+		if err != nil {
+			// The volume is not open, there is no online re-encryption
+			continue
+		}
+		status := parseCryptSetupKeyValues(stdout)
+		devicePath := status["device"]
+		if devicePath == "" {
+			continue
+		}
+
+		dump, err := luksDump(context.Background(), devicePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump LUKS header of volume %s: %w", volume, err)
+		}
+		if !strings.Contains(parseCryptSetupKeyValues(dump)["Requirements"], reencryptRequirement) {
+			continue
+		}
+
+		dataSize, err := parseSectors(status["size"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse size of volume %s: %w", volume, err)
+		}
+		percent, err := parseReencryptionProgress(dump, dataSize*sectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse re-encryption progress of volume %s: %w", volume, err)
+		}
+		pending[volume] = percent
+	}
+	return pending, nil
+}
+
+// parseReencryptionProgress computes the progress of a forward re-encryption.
+// During the re-encryption the first data segment covers the area already
+// encrypted with the new key, so the progress is its length over the data size.
+func parseReencryptionProgress(dump string, dataSize int64) (float64, error) {
+	if dataSize <= 0 {
+		return 0, fmt.Errorf("invalid data size %v", dataSize)
+	}
+
+	inDataSegments := false
+	inFirstSegment := false
+	for _, line := range strings.Split(dump, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Data segments:"):
+			inDataSegments = true
+			continue
+		case inDataSegments && line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t"):
+			// Reached the next section
+			inDataSegments = false
+		}
+		if !inDataSegments {
+			continue
+		}
+
+		if strings.HasSuffix(trimmed, ": crypt") || strings.HasSuffix(trimmed, ": linear") {
+			inFirstSegment = strings.HasPrefix(trimmed, "0:")
+			continue
+		}
+		if !inFirstSegment || !strings.HasPrefix(trimmed, "length:") {
+			continue
+		}
+
+		length, err := parseBytes(strings.TrimSpace(strings.TrimPrefix(trimmed, "length:")))
+		if err != nil {
+			return 0, err
+		}
+		percent := float64(length) * 100 / float64(dataSize)
+		if percent > 100 {
+			percent = 100
+		}
+		return percent, nil
+	}
+	return 0, fmt.Errorf("re-encrypted segment not found")
+}
+
+// parseCryptSetupKeyValues parses the "key: value" lines of the cryptsetup
+// output. Only the first occurrence of each key is kept.
+func parseCryptSetupKeyValues(stdout string) map[string]string {
+	kvs := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		if _, exist := kvs[key]; !exist {
+			kvs[key] = strings.TrimSpace(kv[1])
+		}
+	}
+	return kvs
+}
+
+// parseBytes parses a value like "1048576 [bytes]".
+func parseBytes(value string) (int64, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 || fields[1] != "[bytes]" {
+		return 0, fmt.Errorf("invalid bytes value %q", value)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+// parseSectors parses a value like "2048 sectors".
+func parseSectors(value string) (int64, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 || fields[1] != "sectors" {
+		return 0, fmt.Errorf("invalid sectors value %q", value)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
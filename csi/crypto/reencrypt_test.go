@@ -0,0 +1,221 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testStatusTemplate = `/dev/mapper/%s is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  device:  %s
+  sector size:  512
+  offset:  32768 sectors
+  size:    4096 sectors
+  mode:    read/write
+`
+
+const testReencryptingDump = `LUKS header information
+Version:       	2
+Epoch:         	9
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	5bd1a8b4-7c8f-4a23-9b8e-1bd4f0d9b1f2
+Label:         	(no label)
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+Requirements:	online-reencrypt-v2
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: 524288 [bytes]
+	cipher: aes-xts-plain64
+	sector: 512 [bytes]
+
+  1: crypt
+	offset: 17301504 [bytes]
+	length: (whole device)
+	cipher: aes-cbc-essiv:sha256
+	sector: 512 [bytes]
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+`
+
+const testCleanDump = `LUKS header information
+Version:       	2
+Epoch:         	3
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	0f3a5c61-2b4e-4f4e-8d0b-9a3c2f1e7d6a
+Label:         	(no label)
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: (whole device)
+	cipher: aes-xts-plain64
+	sector: 512 [bytes]
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+`
+
+func TestListPendingReencryptions(t *testing.T) {
+	devices := map[string]string{
+		"reencrypting": "/dev/sdb",
+		"clean":        "/dev/sdc",
+	}
+	dumps := map[string]string{
+		"/dev/sdb": testReencryptingDump,
+		"/dev/sdc": testCleanDump,
+	}
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "status":
+			device, ok := devices[args[1]]
+			if !ok {
+				return "", fmt.Errorf("device %s not found", args[1])
+			}
+			return fmt.Sprintf(testStatusTemplate, args[1], device), nil
+		case "luksDump":
+			return dumps[args[1]], nil
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	pending, err := ListPendingReencryptions([]string{"reencrypting", "clean", "closed"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("pending = %v, expected only the re-encrypting volume", pending)
+	}
+	// 524288 bytes of 4096 sectors * 512 bytes
+	if percent := pending["reencrypting"]; percent != 25 {
+		t.Fatalf("percent = %v, expected 25", percent)
+	}
+}
+
+func TestReencryptVolume(t *testing.T) {
+	defer func(interval time.Duration) { reencryptProgressInterval = interval }(reencryptProgressInterval)
+	reencryptProgressInterval = time.Millisecond
+
+	// The device size puts 524288 bytes of the re-encrypting dump at 25% after the 16MiB offset
+	deviceSize := int64(16777216 + 2097152)
+
+	for name, tc := range map[string]struct {
+		dump         string
+		params       *EncryptParams
+		expectedArgs []string
+		expectError  bool
+	}{
+		"fresh": {
+			dump:   testCleanDump,
+			params: &EncryptParams{KeyCipher: "serpent-xts-plain64", KeySize: "512"},
+			expectedArgs: []string{"reencrypt", "/dev/sdb", "-d", "/dev/stdin", "--cipher", "serpent-xts-plain64",
+				"--key-size", "512", "--hash", CryptoKeyDefaultHash, "--pbkdf", CryptoDefaultPBKDF},
+		},
+		"resume": {
+			dump:         testReencryptingDump,
+			params:       &EncryptParams{KeyCipher: "aes-xts-plain64", KeySize: "512"},
+			expectedArgs: []string{"reencrypt", "/dev/sdb", "-d", "/dev/stdin"},
+		},
+		"already done": {
+			dump:   testCleanDump,
+			params: &EncryptParams{KeyCipher: "aes-xts-plain64", KeySize: "512"},
+		},
+		"pending to another cipher": {
+			dump:        testReencryptingDump,
+			params:      &EncryptParams{KeyCipher: "serpent-xts-plain64", KeySize: "512"},
+			expectError: true,
+		},
+		"luks1": {
+			dump:        testLUKS1Dump,
+			params:      &EncryptParams{KeyCipher: "serpent-xts-plain64", KeySize: "512"},
+			expectError: true,
+		},
+		"luks1 params": {
+			dump:        testCleanDump,
+			params:      &EncryptParams{LUKSVersion: luksTypeLUKS1, PBKDF: "pbkdf2"},
+			expectError: true,
+		},
+	} {
+		started := make(chan struct{})
+		polled := make(chan struct{})
+		f := newFakeCryptSetup(t, func(args []string) (string, error) {
+			switch args[0] {
+			case "luksDump":
+				select {
+				case <-started:
+					return testReencryptingDump, nil
+				default:
+					return tc.dump, nil
+				}
+			case "reencrypt":
+				close(started)
+				// Keep running until the progress has been reported once
+				select {
+				case <-polled:
+				case <-time.After(10 * time.Second):
+					return "", fmt.Errorf("progress not reported")
+				}
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected args %v", args)
+		})
+		newFakeHostCommand(t, func(command string, args []string) (string, error) {
+			return fmt.Sprintf("%d\n", deviceSize), nil
+		})
+
+		percents := []float64{}
+		err := ReencryptVolumeContext(context.Background(), "/dev/sdb", "secret", tc.params, func(percent float64) {
+			if len(percents) == 0 {
+				close(polled)
+			}
+			percents = append(percents, percent)
+		})
+		if tc.expectError {
+			if err == nil {
+				t.Fatalf("%v: expected an error", name)
+			}
+			if call := f.lastCall("reencrypt"); call != nil {
+				t.Fatalf("%v: reencrypt = %v, expected it not to run", name, call)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+
+		call := f.lastCall("reencrypt")
+		if tc.expectedArgs == nil {
+			if call != nil {
+				t.Fatalf("%v: reencrypt = %v, expected it not to run", name, call)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(call, tc.expectedArgs) {
+			t.Fatalf("%v: reencrypt = %v, expected %v", name, call, tc.expectedArgs)
+		}
+		for i, args := range f.calls {
+			if args[0] == "reencrypt" && f.stdins[i] != "secret" {
+				t.Fatalf("%v: stdin = %q, expected the passphrase", name, f.stdins[i])
+			}
+		}
+		// The fake re-encrypting dump doesn't advance, so the progress stays at 25% until the end
+		if len(percents) < 2 || percents[0] != 25 || percents[len(percents)-1] != 100 {
+			t.Fatalf("%v: percents = %v, expected 25 then 100", name, percents)
+		}
+	}
+}
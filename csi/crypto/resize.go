@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FilesystemResizeRequired compares the size of the mapped device of the volume
+// with the size of the filesystem on it, and returns whether the filesystem needs
+// to be expanded along with the new filesystem size in bytes.
+func FilesystemResizeRequired(volume string) (bool, int64, error) {
+	mappedDevice := VolumeMapper(volume)
+
+	deviceSize, err := getDeviceSize(mappedDevice)
+	if err != nil {
+		return false, 0, err
+	}
+
+	fsSize, fsBlockSize, err := getFilesystemSize(mappedDevice)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// The filesystem cannot grow into a gap smaller than one of its blocks
+	return deviceSize-fsSize >= fsBlockSize, deviceSize, nil
+}
+
+// CheckSizeConsistency compares the size of the mapped device of the volume with the size of
+// its backing device. The mapping should cover the backing device minus the LUKS header, so
+// any other discrepancy means a resize is pending for the mapping. The mapping with the
+// integrity protection is always reported consistent, since the room taken by the integrity
+// tags cannot be computed from the mapping status.
+func CheckSizeConsistency(volume string) (consistent bool, backingSize, mappedSize int64, err error) {
+	size, err := getMappingSize(context.Background(), volume, "")
+	if err != nil {
+		return false, 0, 0, err
+	}
+	usableSize, ok := size.usableSize()
+	if !ok {
+		logrus.Debugf("Cannot compute the usable size of volume %v with integrity %v, assuming its mapping is consistent", volume, size.integrity)
+		return true, size.backingSize, size.mappedSize, nil
+	}
+	return usableSize == size.mappedSize, size.backingSize, size.mappedSize, nil
+}
+
+// mappingSize is the size of the mapping of a volume along with the size of its backing device.
+type mappingSize struct {
+	backingSize int64
+	// offset is the offset of the data on the backing device in bytes
+	offset     int64
+	mappedSize int64
+	// integrity is the integrity algorithm if the mapping has the dm-integrity protection
+	integrity string
+}
+
+// usableSize is the size of the backing device available to the mapping after the data offset.
+// It returns false for the mapping with the integrity protection, whose tags and journal take
+// extra room on the backing device laid out by dm-integrity, so the usable size is unknown.
+func (s *mappingSize) usableSize() (int64, bool) {
+	if s.integrity != "" {
+		return 0, false
+	}
+	return s.backingSize - s.offset, true
+}
+
+func getMappingSize(ctx context.Context, volume, headerFile string) (*mappingSize, error) {
+	stdout, err := luksStatus(ctx, MapperName(volume), getHeaderOptions(headerFile)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of volume %s: %w", volume, err)
+	}
+	status := parseCryptSetupKeyValues(stdout)
+	devicePath := status["device"]
+	if devicePath == "" {
+		return nil, fmt.Errorf("failed to get backing device of volume %s", volume)
+	}
+
+	offset, err := parseSectors(status["offset"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse data offset of volume %s: %w", volume, err)
+	}
+	mappedSectors, err := parseSectors(status["size"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse size of volume %s: %w", volume, err)
+	}
+
+	backingSize, err := getDeviceSize(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mappingSize{
+		backingSize: backingSize,
+		offset:      offset * sectorSize,
+		mappedSize:  mappedSectors * sectorSize,
+		integrity:   status["integrity"],
+	}, nil
+}
+
+// getDeviceSize returns the size of the block device in bytes.
+func getDeviceSize(devicePath string) (int64, error) {
+	stdout, err := hostCommandRunner(context.Background(), "blockdev", "--getsize64", devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of device %s: %w", devicePath, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(stdout), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size of device %s: %w", devicePath, err)
+	}
+	return size, nil
+}
+
+// getFilesystemSize probes the filesystem on the device and returns its size and block size in bytes.
+func getFilesystemSize(devicePath string) (size, blockSize int64, err error) {
+	stdout, err := hostCommandRunner(context.Background(), "blkid", "-p", "-s", "TYPE", "-o", "value", devicePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to probe filesystem type of device %s: %w", devicePath, err)
+	}
+
+	fsType := strings.TrimSpace(stdout)
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return getExtFilesystemSize(devicePath)
+	case "xfs":
+		return getXFSFilesystemSize(devicePath)
+	case "":
+		return 0, 0, fmt.Errorf("no filesystem found on device %s", devicePath)
+	default:
+		return 0, 0, fmt.Errorf("unsupported filesystem %v on device %s", fsType, devicePath)
+	}
+}
+
+func getExtFilesystemSize(devicePath string) (size, blockSize int64, err error) {
+	stdout, err := hostCommandRunner(context.Background(), "dumpe2fs", "-h", devicePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to dump ext filesystem of device %s: %w", devicePath, err)
+	}
+
+	kvs := parseCryptSetupKeyValues(stdout)
+	blockCount, err := strconv.ParseInt(kvs["Block count"], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse block count of device %s: %w", devicePath, err)
+	}
+	blockSize, err = strconv.ParseInt(kvs["Block size"], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse block size of device %s: %w", devicePath, err)
+	}
+	return blockCount * blockSize, blockSize, nil
+}
+
+func getXFSFilesystemSize(devicePath string) (size, blockSize int64, err error) {
+	stdout, err := hostCommandRunner(context.Background(), "xfs_db", "-r", "-c", "sb 0", "-c", "p blocksize dblocks", devicePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to dump xfs filesystem of device %s: %w", devicePath, err)
+	}
+
+	kvs := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			kvs[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	blockCount, err := strconv.ParseInt(kvs["dblocks"], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse block count of device %s: %w", devicePath, err)
+	}
+	blockSize, err = strconv.ParseInt(kvs["blocksize"], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse block size of device %s: %w", devicePath, err)
+	}
+	return blockCount * blockSize, blockSize, nil
+}
@@ -0,0 +1,211 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newFakeHostCommand(t *testing.T, handler func(command string, args []string) (string, error)) {
+	oldRunner := hostCommandRunner
+	hostCommandRunner = func(ctx context.Context, command string, args ...string) (string, error) {
+		return handler(command, args)
+	}
+	t.Cleanup(func() {
+		hostCommandRunner = oldRunner
+	})
+}
+
+func newFakeFilesystem(t *testing.T, fsType string, deviceSize, blockCount int64) {
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		switch command {
+		case "blockdev":
+			return fmt.Sprintf("%d\n", deviceSize), nil
+		case "blkid":
+			return fsType + "\n", nil
+		case "dumpe2fs":
+			return fmt.Sprintf("Filesystem volume name:   <none>\nBlock count:              %d\nBlock size:               4096\n", blockCount), nil
+		case "xfs_db":
+			return fmt.Sprintf("blocksize = 4096\ndblocks = %d\n", blockCount), nil
+		}
+		return "", fmt.Errorf("unexpected command %v", command)
+	})
+}
+
+func TestFilesystemResizeRequired(t *testing.T) {
+	testCases := map[string]struct {
+		fsType           string
+		deviceSize       int64
+		blockCount       int64
+		expectedRequired bool
+	}{
+		"ext4 matching":     {"ext4", 4096 * 1024, 1024, false},
+		"ext4 mismatched":   {"ext4", 4096 * 2048, 1024, true},
+		"xfs matching":      {"xfs", 4096 * 1024, 1024, false},
+		"xfs mismatched":    {"xfs", 4096 * 2048, 1024, true},
+		"partial block gap": {"ext4", 4096*1024 + 512, 1024, false},
+	}
+
+	for name, tc := range testCases {
+		newFakeFilesystem(t, tc.fsType, tc.deviceSize, tc.blockCount)
+		required, size, err := FilesystemResizeRequired("vol")
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if required != tc.expectedRequired {
+			t.Fatalf("%v: required = %v, expected %v", name, required, tc.expectedRequired)
+		}
+		if size != tc.deviceSize {
+			t.Fatalf("%v: size = %v, expected %v", name, size, tc.deviceSize)
+		}
+	}
+}
+
+func TestFilesystemResizeRequiredUnsupportedFilesystem(t *testing.T) {
+	newFakeFilesystem(t, "btrfs", 4096, 1)
+	if _, _, err := FilesystemResizeRequired("vol"); err == nil {
+		t.Fatalf("expected an error for unsupported filesystem")
+	}
+}
+
+func TestCheckSizeConsistency(t *testing.T) {
+	// The test status has a 32768 sectors header offset and a 4096 sectors mapping
+	headerSize := int64(32768 * 512)
+	mappedSize := int64(4096 * 512)
+
+	testCases := map[string]struct {
+		backingSize        int64
+		integrity          string
+		expectedConsistent bool
+	}{
+		"consistent": {
+			backingSize:        headerSize + mappedSize,
+			expectedConsistent: true,
+		},
+		"backing device grown": {
+			backingSize:        headerSize + 2*mappedSize,
+			expectedConsistent: false,
+		},
+		"backing device shrunk": {
+			backingSize:        headerSize + mappedSize/2,
+			expectedConsistent: false,
+		},
+		"integrity": {
+			// The integrity tags take the room beyond the mapping
+			backingSize:        headerSize + 2*mappedSize,
+			integrity:          "hmac(sha256)",
+			expectedConsistent: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			if args[0] == "status" {
+				return newTestResizedStatus(args[1], "/dev/longhorn/vol", 4096, tc.integrity), nil
+			}
+			return "", fmt.Errorf("unexpected args %v", args)
+		})
+		newFakeHostCommand(t, func(command string, args []string) (string, error) {
+			if command == "blockdev" && args[len(args)-1] == "/dev/longhorn/vol" {
+				return fmt.Sprintf("%d\n", tc.backingSize), nil
+			}
+			return "", fmt.Errorf("unexpected command %v %v", command, args)
+		})
+
+		consistent, backingSize, mapped, err := CheckSizeConsistency("vol")
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if consistent != tc.expectedConsistent || backingSize != tc.backingSize || mapped != mappedSize {
+			t.Fatalf("%v: consistent = %v, backing size = %v, mapped size = %v, expected %v, %v and %v",
+				name, consistent, backingSize, mapped, tc.expectedConsistent, tc.backingSize, mappedSize)
+		}
+	}
+}
+
+// newTestResizedStatus returns the status of the mapping of the size in sectors, with the
+// integrity protection if integrity is set.
+func newTestResizedStatus(mapper, device string, sectors int64, integrity string) string {
+	status := strings.Replace(fmt.Sprintf(testStatusTemplate, mapper, device), "size:    4096 sectors", fmt.Sprintf("size:    %d sectors", sectors), 1)
+	if integrity != "" {
+		status += fmt.Sprintf("  integrity: %s\n", integrity)
+	}
+	return status
+}
+
+func TestResizeEncryptoDevice(t *testing.T) {
+	// The test status has a 32768 sectors header offset and a 4096 sectors mapping
+	testCases := map[string]struct {
+		resizedSectors int64
+		integrity      string
+		backingSize    int64
+		expectedSize   int64
+		expectedError  string
+	}{
+		"grown": {
+			resizedSectors: 8192,
+			expectedSize:   8192 * 512,
+		},
+		"no-op": {
+			resizedSectors: 4096,
+			expectedError:  "did not change from size 2097152 on resize",
+		},
+		"already covering the backing device": {
+			resizedSectors: 4096,
+			backingSize:    (32768 + 4096) * 512,
+			expectedSize:   4096 * 512,
+		},
+		"no-op with integrity": {
+			resizedSectors: 4096,
+			integrity:      "hmac(sha256)",
+			expectedError:  "with integrity hmac(sha256) did not change",
+		},
+		"smaller than expected": {
+			resizedSectors: 8192,
+			expectedSize:   16384 * 512,
+			expectedError:  "smaller than the expected size",
+		},
+	}
+
+	for name, tc := range testCases {
+		resized := false
+		newFakeCryptSetup(t, func(args []string) (string, error) {
+			switch args[0] {
+			case "status":
+				if resized {
+					return newTestResizedStatus(args[1], "/dev/longhorn/vol", tc.resizedSectors, tc.integrity), nil
+				}
+				return newTestResizedStatus(args[1], "/dev/longhorn/vol", 4096, tc.integrity), nil
+			case "resize":
+				resized = true
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected args %v", args)
+		})
+		if tc.backingSize != 0 {
+			newFakeHostCommand(t, func(command string, args []string) (string, error) {
+				if command == "blockdev" {
+					return fmt.Sprintf("%d\n", tc.backingSize), nil
+				}
+				return blankDeviceHandler(command, args)
+			})
+		}
+
+		err := ResizeEncryptoDevice("vol", "passphrase", "", tc.expectedSize)
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Fatalf("%v: unexpected error: %v", name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+			t.Fatalf("%v: err = %v, expected %q", name, err, tc.expectedError)
+		}
+	}
+
+	newFakeCryptSetup(t, closedDeviceHandler)
+	if err := ResizeEncryptoDevice("vol", "passphrase", "", 0); err == nil || !strings.Contains(err.Error(), "is not active") {
+		t.Fatalf("expected an error for the closed device, got %v", err)
+	}
+}
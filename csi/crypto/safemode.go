@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// DestructiveOperationConfirmation is the confirmation token the callers have to
+// pass explicitly to run destructive operations while the safe mode is on.
+const DestructiveOperationConfirmation = "confirm-destroy-data"
+
+// safeModeDisabled is inverted so that the safe mode is on by default.
+var safeModeDisabled atomic.Bool
+
+// SetSafeMode turns the safe mode on or off. While it is on, the destructive
+// operations, e.g. formatting a device holding data or repairing a LUKS header,
+// are refused unless the confirmation token is provided. It is a defense in depth
+// against reconcile bugs on production nodes.
+func SetSafeMode(enabled bool) {
+	safeModeDisabled.Store(!enabled)
+}
+
+// IsSafeMode returns whether the safe mode is on.
+func IsSafeMode() bool {
+	return !safeModeDisabled.Load()
+}
+
+func checkDestructiveOperation(operation, devicePath, confirmation string) error {
+	if !IsSafeMode() || confirmation == DestructiveOperationConfirmation {
+		return nil
+	}
+	return fmt.Errorf("refused to %v on device %s in safe mode without the confirmation token", operation, devicePath)
+}
+
+// hasExistingData checks if there is any filesystem, partition table or LUKS
+// signature on the device.
+func hasExistingData(devicePath string) (bool, error) {
+	stdout, err := hostCommandRunner(context.Background(), "wipefs", "--noheadings", "--output", "TYPE", devicePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to probe signatures of device %s: %w", devicePath, err)
+	}
+	return strings.TrimSpace(stdout) != "", nil
+}
@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minSecureKeySize is the smallest volume key size in bits which isn't considered weak.
+	// Note that XTS splits the key in half, so 256 bits for XTS is AES-128.
+	minSecureKeySize = 256
+)
+
+// weakCipherParts are the components of the cipher spec which make the encryption weak,
+// mapped to the reason.
+var weakCipherParts = map[string]string{
+	"ecb":         "ECB mode leaks the plaintext patterns",
+	"cipher_null": "null cipher doesn't encrypt the data",
+	"plain":       "32-bit plain IV wraps around on devices larger than 2TiB",
+	"des":         "DES is broken",
+	"des3":        "3DES has a 64-bit block size",
+	"blowfish":    "Blowfish has a 64-bit block size",
+}
+
+// weakHashes are the digest hashes which are not collision resistant.
+var weakHashes = map[string]bool{
+	"md5":       true,
+	"sha1":      true,
+	"ripemd160": true,
+}
+
+// SecurityWarnings returns the reasons why the encryption configuration of the device is
+// considered weak. It returns an empty slice if nothing is wrong.
+func SecurityWarnings(info *LUKSDeviceInfo) []string {
+	warnings := []string{}
+	if info == nil {
+		return warnings
+	}
+
+	for _, part := range strings.FieldsFunc(strings.ToLower(info.Cipher), func(r rune) bool { return r == '-' || r == ':' }) {
+		if reason, ok := weakCipherParts[part]; ok {
+			warnings = append(warnings, fmt.Sprintf("cipher %v: %v", info.Cipher, reason))
+		}
+	}
+	if weakHashes[strings.ToLower(info.Hash)] {
+		warnings = append(warnings, fmt.Sprintf("hash %v is not collision resistant", info.Hash))
+	}
+	if keySize, err := strconv.Atoi(info.KeySize); err == nil && keySize < minSecureKeySize {
+		warnings = append(warnings, fmt.Sprintf("key size %v bits is smaller than %v bits", keySize, minSecureKeySize))
+	}
+	if info.Version == "2" && strings.EqualFold(info.PBKDF, "pbkdf2") {
+		warnings = append(warnings, "PBKDF pbkdf2 is not memory hard, argon2id is preferred on LUKS2")
+	}
+	return warnings
+}
+
+// FindWeaklyEncryptedVolumes inspects the LUKS header of each device and returns the devices
+// encrypted with weak parameters along with the reasons, so they can be scheduled for
+// re-encryption. The devices without a LUKS header are skipped.
+func FindWeaklyEncryptedVolumes(devicePaths []string) (map[string]string, error) {
+	weak := map[string]string{}
+	for _, devicePath := range devicePaths {
+		if _, err := luksIsLuks(context.Background(), devicePath); err != nil {
+			if code, ok := ExitCode(err); ok && code == cryptSetupExitCodeNotLUKS {
+				logrus.Debugf("Skipping device %s without LUKS header", devicePath)
+				continue
+			}
+			return nil, fmt.Errorf("failed to check LUKS header of device %s: %w", devicePath, err)
+		}
+
+		info, err := GetLUKSDeviceInfo(devicePath)
+		if err != nil {
+			return nil, err
+		}
+		if warnings := SecurityWarnings(info); len(warnings) > 0 {
+			weak[devicePath] = strings.Join(warnings, "; ")
+		}
+	}
+	return weak, nil
+}
@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSecurityWarnings(t *testing.T) {
+	tests := map[string]struct {
+		info     *LUKSDeviceInfo
+		expected int
+	}{
+		"strong LUKS2":     {&LUKSDeviceInfo{Version: "2", Cipher: "aes-xts-plain64", Hash: "sha256", KeySize: "512", PBKDF: "argon2id"}, 0},
+		"LUKS1 pbkdf2":     {&LUKSDeviceInfo{Version: "1", Cipher: "aes-xts-plain64", Hash: "sha256", KeySize: "256", PBKDF: "pbkdf2"}, 0},
+		"LUKS2 pbkdf2":     {&LUKSDeviceInfo{Version: "2", Cipher: "aes-xts-plain64", Hash: "sha256", KeySize: "256", PBKDF: "pbkdf2"}, 1},
+		"ECB":              {&LUKSDeviceInfo{Version: "1", Cipher: "aes-ecb", Hash: "sha256", KeySize: "256", PBKDF: "pbkdf2"}, 1},
+		"null cipher":      {&LUKSDeviceInfo{Version: "2", Cipher: "cipher_null-ecb", Hash: "sha256", KeySize: "256", PBKDF: "argon2id"}, 2},
+		"plain IV":         {&LUKSDeviceInfo{Version: "1", Cipher: "aes-cbc-plain", Hash: "sha256", KeySize: "256", PBKDF: "pbkdf2"}, 1},
+		"essiv":            {&LUKSDeviceInfo{Version: "1", Cipher: "aes-cbc-essiv:sha256", Hash: "sha256", KeySize: "256", PBKDF: "pbkdf2"}, 0},
+		"SHA1 small key":   {&LUKSDeviceInfo{Version: "1", Cipher: "aes-xts-plain64", Hash: "sha1", KeySize: "128", PBKDF: "pbkdf2"}, 2},
+		"unknown key size": {&LUKSDeviceInfo{Version: "2", Cipher: "aes-xts-plain64", Hash: "sha256", PBKDF: "argon2id"}, 0},
+		"nil":              {nil, 0},
+	}
+	for name, test := range tests {
+		if warnings := SecurityWarnings(test.info); len(warnings) != test.expected {
+			t.Fatalf("%v: got warnings %v, expected %v", name, warnings, test.expected)
+		}
+	}
+}
+
+func TestFindWeaklyEncryptedVolumes(t *testing.T) {
+	weakLUKS1Dump := strings.NewReplacer("xts-plain64", "cbc-plain", "sha256", "sha1").Replace(testLUKS1Dump)
+	dumps := map[string]string{
+		"/dev/strong": testLUKS2Dump,
+		"/dev/legacy": testLUKS1Dump,
+		"/dev/weak":   weakLUKS1Dump,
+	}
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		switch args[0] {
+		case "isLuks":
+			if _, ok := dumps[args[1]]; ok {
+				return "", nil
+			}
+			return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: cryptSetupExitCodeNotLUKS, Err: fmt.Errorf("exit status 1")}
+		case "luksDump":
+			if dump, ok := dumps[args[1]]; ok {
+				return dump, nil
+			}
+		}
+		return "", fmt.Errorf("unexpected args %v", args)
+	})
+
+	weak, err := FindWeaklyEncryptedVolumes([]string{"/dev/strong", "/dev/plain", "/dev/legacy", "/dev/weak"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := weak["/dev/weak"]; !ok || len(weak) != 1 {
+		t.Fatalf("weak devices = %v, expected [/dev/weak]", weak)
+	}
+	if !strings.Contains(weak["/dev/weak"], "aes-cbc-plain") || !strings.Contains(weak["/dev/weak"], "sha1") {
+		t.Fatalf("unexpected reason %q", weak["/dev/weak"])
+	}
+
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		return "", &CommandError{Command: "cryptsetup", Args: args, ExitCode: 4, Err: fmt.Errorf("exit status 4")}
+	})
+	if _, err := FindWeaklyEncryptedVolumes([]string{"/dev/strong"}); err == nil {
+		t.Fatalf("expected error when the LUKS header cannot be checked")
+	}
+}
@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// argon2DefaultMemoryKB is the max argon2 memory cost cryptsetup benchmarks for by default, which
+// is the estimate of the operations whose memory cost is not configured.
+const argon2DefaultMemoryKB = 1024 * 1024
+
+// throttle limits the number of concurrent cryptsetup operations deriving keys
+// from passphrases, since the PBKDF, e.g. argon2, is CPU and memory intensive.
+// Besides the count, the total estimated memory cost of the operations in flight
+// is capped if memoryLimitKB is set. An operation is always admitted if nothing
+// else is in flight, so a single operation above the cap still runs alone.
+// The limits can be adjusted at runtime and are honored by the next admissions.
+type throttle struct {
+	lock             sync.Mutex
+	cond             *sync.Cond
+	limit            int
+	inFlight         int
+	memoryLimitKB    int64
+	inFlightMemoryKB int64
+}
+
+func newThrottle(limit int) *throttle {
+	t := &throttle{limit: limit}
+	t.cond = sync.NewCond(&t.lock)
+	return t
+}
+
+// acquire waits for the admission of an operation of the memory cost in KiB. It gives up and
+// returns the error of the context once the context is cancelled while waiting.
+func (t *throttle) acquire(ctx context.Context, memoryKB int64) error {
+	if done := ctx.Done(); done != nil {
+		// The cond cannot wait on the context, so wake up the waiters to check it
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				t.lock.Lock()
+				t.cond.Broadcast()
+				t.lock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for t.inFlight >= t.limit || t.exceedsMemoryLimit(memoryKB) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.cond.Wait()
+	}
+	t.inFlight++
+	t.inFlightMemoryKB += memoryKB
+	return nil
+}
+
+func (t *throttle) exceedsMemoryLimit(memoryKB int64) bool {
+	return t.memoryLimitKB > 0 && t.inFlight > 0 && t.inFlightMemoryKB+memoryKB > t.memoryLimitKB
+}
+
+func (t *throttle) release(memoryKB int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inFlight--
+	t.inFlightMemoryKB -= memoryKB
+	t.cond.Broadcast()
+}
+
+func (t *throttle) setLimit(limit int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.limit = limit
+	t.cond.Broadcast()
+}
+
+func (t *throttle) getLimit() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.limit
+}
+
+func (t *throttle) setMemoryLimit(memoryLimitKB int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.memoryLimitKB = memoryLimitKB
+	t.cond.Broadcast()
+}
+
+func (t *throttle) getMemoryLimit() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.memoryLimitKB
+}
+
+var cryptoThrottle = newThrottle(runtime.NumCPU())
+
+// SetConcurrencyLimit adjusts the max number of concurrent passphrase based crypto
+// operations on the node, e.g. to reduce it under node pressure. The default is the
+// number of CPUs. Operations already running are not affected.
+func SetConcurrencyLimit(limit int) error {
+	if limit <= 0 {
+		return fmt.Errorf("invalid concurrency limit %v, it should be a positive integer", limit)
+	}
+	cryptoThrottle.setLimit(limit)
+	return nil
+}
+
+// GetConcurrencyLimit returns the max number of concurrent passphrase based crypto operations.
+func GetConcurrencyLimit() int {
+	return cryptoThrottle.getLimit()
+}
+
+// SetMemoryLimit caps the total estimated PBKDF memory cost in KiB of the concurrent passphrase
+// based crypto operations on the node, so fewer argon2 operations run at the same time the higher
+// their memory cost is. The cost of an operation is estimated from EncryptParams.PBKDFMemoryKB,
+// or argon2DefaultMemoryKB if it's not known. 0 disables the cap, which is the default.
+func SetMemoryLimit(memoryLimitKB int64) error {
+	if memoryLimitKB < 0 {
+		return fmt.Errorf("invalid memory limit %v, it should not be negative", memoryLimitKB)
+	}
+	cryptoThrottle.setMemoryLimit(memoryLimitKB)
+	return nil
+}
+
+// GetMemoryLimit returns the cap of the total estimated PBKDF memory cost in KiB, 0 if disabled.
+func GetMemoryLimit() int64 {
+	return cryptoThrottle.getMemoryLimit()
+}
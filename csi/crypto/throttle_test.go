@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runConcurrentOpens opens the volumes concurrently with the params and returns
+// the max number of luksOpen running at the same time.
+func runConcurrentOpens(t *testing.T, count int, params *EncryptParams) int {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "status" {
+			return "", fmt.Errorf("device %s not found", args[1])
+		}
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return "", nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := OpenVolume(fmt.Sprintf("vol-%d", i), fmt.Sprintf("/dev/longhorn/vol-%d", i), "passphrase", params); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return maxRunning
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	oldLimit := GetConcurrencyLimit()
+	defer SetConcurrencyLimit(oldLimit)
+
+	if err := SetConcurrencyLimit(0); err == nil {
+		t.Fatalf("expected an error for a non-positive limit")
+	}
+
+	if err := SetConcurrencyLimit(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if limit := GetConcurrencyLimit(); limit != 1 {
+		t.Fatalf("limit = %v, expected 1", limit)
+	}
+	if maxRunning := runConcurrentOpens(t, 4, nil); maxRunning != 1 {
+		t.Fatalf("max running = %v, expected 1", maxRunning)
+	}
+
+	if err := SetConcurrencyLimit(3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxRunning := runConcurrentOpens(t, 6, nil); maxRunning > 3 || maxRunning < 2 {
+		t.Fatalf("max running = %v, expected at most 3 concurrent opens", maxRunning)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	oldLimit := GetConcurrencyLimit()
+	defer SetConcurrencyLimit(oldLimit)
+	oldMemoryLimit := GetMemoryLimit()
+	defer SetMemoryLimit(oldMemoryLimit)
+
+	if err := SetMemoryLimit(-1); err == nil {
+		t.Fatalf("expected an error for a negative memory limit")
+	}
+
+	if err := SetConcurrencyLimit(4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := SetMemoryLimit(2 * 1024 * 1024); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if limit := GetMemoryLimit(); limit != 2*1024*1024 {
+		t.Fatalf("memory limit = %v, expected %v", limit, 2*1024*1024)
+	}
+
+	highMemoryParams := &EncryptParams{PBKDF: "argon2id", PBKDFMemoryKB: "1048576"}
+	if maxRunning := runConcurrentOpens(t, 6, highMemoryParams); maxRunning != 2 {
+		t.Fatalf("max running = %v, expected 2 concurrent opens of 1GiB each", maxRunning)
+	}
+
+	// An open above the memory limit still runs alone
+	oversizedParams := &EncryptParams{PBKDF: "argon2id", PBKDFMemoryKB: "4194304"}
+	if maxRunning := runConcurrentOpens(t, 3, oversizedParams); maxRunning != 1 {
+		t.Fatalf("max running = %v, expected 1 concurrent open above the memory limit", maxRunning)
+	}
+
+	lowMemoryParams := &EncryptParams{PBKDF: "argon2id", PBKDFMemoryKB: "65536"}
+	if maxRunning := runConcurrentOpens(t, 6, lowMemoryParams); maxRunning > 4 || maxRunning < 3 {
+		t.Fatalf("max running = %v, expected the concurrency limit to apply to cheap opens", maxRunning)
+	}
+
+	pbkdf2Params := &EncryptParams{PBKDF: "pbkdf2"}
+	if maxRunning := runConcurrentOpens(t, 6, pbkdf2Params); maxRunning > 4 || maxRunning < 3 {
+		t.Fatalf("max running = %v, expected pbkdf2 opens not to be limited by memory", maxRunning)
+	}
+}
+
+func TestThrottleCancelled(t *testing.T) {
+	oldLimit := GetConcurrencyLimit()
+	defer SetConcurrencyLimit(oldLimit)
+	if err := SetConcurrencyLimit(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f := newFakeCryptSetup(t, func(args []string) (string, error) {
+		if args[0] == "status" {
+			return "", fmt.Errorf("device %s not found", args[1])
+		}
+		return "", nil
+	})
+
+	// Fill up the throttle, so the open waits for the admission
+	if err := cryptoThrottle.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cryptoThrottle.release(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- OpenVolumeContext(ctx, "vol", "/dev/longhorn/vol", "passphrase", nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, expected the error of the cancelled context", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("open is still waiting for the throttle after the context is cancelled")
+	}
+	if call := f.lastCall("luksOpen"); call != nil {
+		t.Fatalf("luksOpen = %v, expected it not to run", call)
+	}
+	if err := cryptoThrottle.acquire(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, expected the error of the cancelled context", err)
+	}
+}
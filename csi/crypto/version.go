@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cryptSetupVersionRegexp matches the first line of `cryptsetup --version`, e.g. "cryptsetup 2.6.1"
+// or "cryptsetup 2.7.0 flags: UDEV BLKID ...". The patch version is missing in some old builds.
+var cryptSetupVersionRegexp = regexp.MustCompile(`^cryptsetup (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// ErrCryptSetupTooOld is wrapped in the error if cryptsetup is older than a feature requires.
+var ErrCryptSetupTooOld = errors.New("cryptsetup too old")
+
+// Version returns the version of the configured cryptsetup, see SetCryptsetupPath.
+func Version() (major, minor, patch int, err error) {
+	return getCryptSetupVersion(context.Background())
+}
+
+func getCryptSetupVersion(ctx context.Context) (major, minor, patch int, err error) {
+	stdout, err := cryptSetupContext(ctx, "--version")
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to get cryptsetup version: %w", err)
+	}
+	return parseCryptSetupVersion(stdout)
+}
+
+func parseCryptSetupVersion(stdout string) (major, minor, patch int, err error) {
+	matches := cryptSetupVersionRegexp.FindStringSubmatch(stdout)
+	if matches == nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse cryptsetup version from %q", stdout)
+	}
+	major, _ = strconv.Atoi(matches[1])
+	minor, _ = strconv.Atoi(matches[2])
+	if matches[3] != "" {
+		patch, _ = strconv.Atoi(matches[3])
+	}
+	return major, minor, patch, nil
+}
+
+// RequireVersion returns an error wrapping ErrCryptSetupTooOld if the configured cryptsetup is older
+// than minMajor.minMinor.
+func RequireVersion(minMajor, minMinor int) error {
+	return requireCryptSetupVersion(context.Background(), minMajor, minMinor)
+}
+
+func requireCryptSetupVersion(ctx context.Context, minMajor, minMinor int) error {
+	major, minor, patch, err := getCryptSetupVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if major < minMajor || (major == minMajor && minor < minMinor) {
+		return fmt.Errorf("cryptsetup %v.%v.%v is older than the required version %v.%v: %w", major, minor, patch, minMajor, minMinor, ErrCryptSetupTooOld)
+	}
+	return nil
+}
+
+// getRequiredCryptSetupVersion returns the minimum cryptsetup version the format with the params
+// requires, along with the feature requiring it. No version is required for a plain LUKS1 format.
+func (cp *EncryptParams) getRequiredCryptSetupVersion() (major, minor int, feature string) {
+	switch {
+	case cp.Integrity != "":
+		return 2, 0, "integrity " + cp.Integrity
+	case cp.GetLUKSVersion() == luksTypeLUKS2 && cp.HeaderFile != "":
+		return 2, 0, "detached " + luksTypeLUKS2 + " header"
+	case cp.GetLUKSVersion() == luksTypeLUKS2:
+		return 2, 0, luksTypeLUKS2
+	case cp.HeaderFile != "":
+		// The detached header was introduced in cryptsetup 1.4
+		return 1, 4, "detached " + luksTypeLUKS1 + " header"
+	}
+	return 0, 0, ""
+}
+
+// checkCryptSetupVersion refuses the format with the params if cryptsetup is known to be too old
+// for them, rather than leaving it to a confusing cryptsetup error. If the version cannot be
+// determined, e.g. for a custom build, it's left to cryptsetup.
+func checkCryptSetupVersion(ctx context.Context, cp *EncryptParams) error {
+	major, minor, feature := cp.getRequiredCryptSetupVersion()
+	if feature == "" {
+		return nil
+	}
+	err := requireCryptSetupVersion(ctx, major, minor)
+	if errors.Is(err, ErrCryptSetupTooOld) {
+		return fmt.Errorf("%v is not supported: %w", feature, err)
+	}
+	if err != nil {
+		logrus.Warnf("Failed to check cryptsetup supports %v, leaving it to cryptsetup: %v", feature, err)
+	}
+	return nil
+}
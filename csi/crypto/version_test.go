@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseCryptSetupVersion(t *testing.T) {
+	testCases := map[string]struct {
+		stdout        string
+		expected      [3]int
+		expectedError bool
+	}{
+		"version":           {stdout: "cryptsetup 2.4.3\n", expected: [3]int{2, 4, 3}},
+		"with flags":        {stdout: "cryptsetup 2.7.0 flags: UDEV BLKID KEYRING FIPS KERNEL_CAPI PWQUALITY\n", expected: [3]int{2, 7, 0}},
+		"release candidate": {stdout: "cryptsetup 2.0.0-rc1\n", expected: [3]int{2, 0, 0}},
+		"no patch":          {stdout: "cryptsetup 1.7\n", expected: [3]int{1, 7, 0}},
+		"unexpected":        {stdout: "cryptsetup version unknown\n", expectedError: true},
+		"empty":             {stdout: "", expectedError: true},
+	}
+
+	for name, tc := range testCases {
+		major, minor, patch, err := parseCryptSetupVersion(tc.stdout)
+		if tc.expectedError {
+			if err == nil {
+				t.Fatalf("%v: expected an error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if version := [3]int{major, minor, patch}; version != tc.expected {
+			t.Fatalf("%v: version = %v, expected %v", name, version, tc.expected)
+		}
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	f := newFakeCryptSetup(t, nil)
+	f.version = "cryptsetup 2.3.7\n"
+
+	for _, required := range [][2]int{{1, 4}, {2, 0}, {2, 3}} {
+		if err := RequireVersion(required[0], required[1]); err != nil {
+			t.Fatalf("required %v: unexpected error: %v", required, err)
+		}
+	}
+	for _, required := range [][2]int{{2, 4}, {3, 0}} {
+		if err := RequireVersion(required[0], required[1]); !errors.Is(err, ErrCryptSetupTooOld) {
+			t.Fatalf("required %v: err = %v, expected ErrCryptSetupTooOld", required, err)
+		}
+	}
+
+	f.version = ""
+	f.handler = func(args []string) (string, error) {
+		return "", fmt.Errorf("exec: cryptsetup: not found")
+	}
+	if err := RequireVersion(2, 0); err == nil || errors.Is(err, ErrCryptSetupTooOld) {
+		t.Fatalf("err = %v, expected the failure to get the version", err)
+	}
+}
+
+func TestEncryptVolumeVersionGuard(t *testing.T) {
+	testCases := map[string]struct {
+		version       string
+		params        func(params *EncryptParams)
+		expectedError bool
+	}{
+		"LUKS2 on cryptsetup 1": {
+			version:       "cryptsetup 1.7.5\n",
+			expectedError: true,
+		},
+		"integrity on cryptsetup 1": {
+			version: "cryptsetup 1.7.5\n",
+			params: func(params *EncryptParams) {
+				params.Integrity = "hmac-sha256"
+			},
+			expectedError: true,
+		},
+		"LUKS1 on cryptsetup 1": {
+			version: "cryptsetup 1.7.5\n",
+			params: func(params *EncryptParams) {
+				params.LUKSVersion = luksTypeLUKS1
+			},
+		},
+		"detached LUKS1 header on cryptsetup 1.7": {
+			version: "cryptsetup 1.7.5\n",
+			params: func(params *EncryptParams) {
+				params.LUKSVersion = luksTypeLUKS1
+				params.HeaderFile = "/var/lib/longhorn/luks-headers/vol.img"
+			},
+		},
+		"detached LUKS1 header on cryptsetup 1.3": {
+			version: "cryptsetup 1.3.1\n",
+			params: func(params *EncryptParams) {
+				params.LUKSVersion = luksTypeLUKS1
+				params.HeaderFile = "/var/lib/longhorn/luks-headers/vol.img"
+			},
+			expectedError: true,
+		},
+		"integrity on cryptsetup 2": {
+			version: "cryptsetup 2.6.1\n",
+			params: func(params *EncryptParams) {
+				params.Integrity = "hmac-sha256"
+			},
+		},
+		"unknown version": {
+			version: "cryptsetup (vendor build)\n",
+		},
+	}
+
+	for name, tc := range testCases {
+		f := newFakeCryptSetup(t, nil)
+		f.version = tc.version
+		params := NewEncryptParams("", "", "", "", "", "")
+		if tc.params != nil {
+			tc.params(params)
+		}
+
+		err := EncryptVolume("/dev/longhorn/vol", "passphrase", params)
+		if tc.expectedError {
+			if !errors.Is(err, ErrCryptSetupTooOld) {
+				t.Fatalf("%v: err = %v, expected ErrCryptSetupTooOld", name, err)
+			}
+			if call := f.lastCall("luksFormat"); call != nil {
+				t.Fatalf("%v: unexpected luksFormat on the too old cryptsetup: %v", name, call)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if call := f.lastCall("luksFormat"); call == nil {
+			t.Fatalf("%v: expected luksFormat", name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// wipeChunkSize is the size zeroed by a single dd run of the full wipe, so that each run finishes
+// well within the command timeout even on a slow device.
+const wipeChunkSize = 1 << 30
+
+// WipeDevice zeroes the header region of the device, or the whole device if full is set, so the
+// stale plaintext blocks of the previous user are not recoverable. The header region covers the
+// LUKS2 header and the usual filesystem superblocks. A mounted or otherwise held device is refused.
+// The data on the device is destroyed, so the confirmation token is required in safe mode.
+func WipeDevice(devicePath string, full bool, confirmation string) error {
+	if err := checkDestructiveOperation("wipe", devicePath, confirmation); err != nil {
+		return err
+	}
+	return wipeDevice(context.Background(), devicePath, full)
+}
+
+// wipeDevice stops wiping once the context is cancelled, leaving the device partially wiped.
+func wipeDevice(ctx context.Context, devicePath string, full bool) error {
+	if err := checkDeviceNotInUse(devicePath); err != nil {
+		return err
+	}
+
+	size, err := getDeviceSize(devicePath)
+	if err != nil {
+		return err
+	}
+	wipeSize := size
+	if !full && wipeSize > luks2HeaderSize {
+		wipeSize = luks2HeaderSize
+	}
+
+	logrus.Infof("Wiping %v bytes of device %s", wipeSize, devicePath)
+	for offset := int64(0); offset < wipeSize; offset += wipeChunkSize {
+		count := wipeSize - offset
+		if count > wipeChunkSize {
+			count = wipeChunkSize
+		}
+		if _, err := hostCommandRunner(ctx, "dd", "if=/dev/zero", "of="+devicePath, "bs=1M",
+			"count="+strconv.FormatInt(count, 10), "seek="+strconv.FormatInt(offset, 10),
+			"iflag=count_bytes", "oflag=seek_bytes,direct", "conv=fsync"); err != nil {
+			return fmt.Errorf("failed to wipe device %s at offset %v: %w", devicePath, offset, err)
+		}
+	}
+	return nil
+}
+
+// checkDeviceNotInUse refuses the device if it's mounted or held by another device, e.g. an open
+// dm-crypt mapping. findmnt exits with 1 if the device is not mounted.
+func checkDeviceNotInUse(devicePath string) error {
+	if _, err := hostCommandRunner(context.Background(), "findmnt", "--noheadings", "--source", devicePath); err == nil {
+		return fmt.Errorf("device %s is mounted", devicePath)
+	} else if code, ok := ExitCode(err); !ok || code != 1 {
+		return fmt.Errorf("failed to check mounts of device %s: %w", devicePath, err)
+	}
+
+	isHeld, err := isDeviceHeld(devicePath)
+	if err != nil {
+		return err
+	}
+	if isHeld {
+		return fmt.Errorf("device %s is in use by another device", devicePath)
+	}
+	return nil
+}
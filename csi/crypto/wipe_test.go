@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// newFakeWipeHost fakes the host commands of a device of the size, recording the dd runs.
+func newFakeWipeHost(t *testing.T, size string, mounted bool) *[][]string {
+	var dds [][]string
+	newFakeHostCommand(t, func(command string, args []string) (string, error) {
+		switch command {
+		case "findmnt":
+			if mounted {
+				return "/var/lib/kubelet", nil
+			}
+			return "", &CommandError{Command: command, Args: args, ExitCode: 1, Err: fmt.Errorf("exit status 1")}
+		case "blockdev":
+			return size + "\n", nil
+		case "dd":
+			dds = append(dds, args)
+		}
+		return "", nil
+	})
+	return &dds
+}
+
+func TestWipeDevice(t *testing.T) {
+	devicePath := newTestBlockDevice(t, "sdb", false)
+
+	testCases := map[string]struct {
+		size        string
+		full        bool
+		expectedDDs [][]string
+	}{
+		"header region": {
+			size: "3221225472",
+			expectedDDs: [][]string{
+				{"if=/dev/zero", "of=" + devicePath, "bs=1M", "count=16777216", "seek=0", "iflag=count_bytes", "oflag=seek_bytes,direct", "conv=fsync"},
+			},
+		},
+		"header region of small device": {
+			size: "1048576",
+			expectedDDs: [][]string{
+				{"if=/dev/zero", "of=" + devicePath, "bs=1M", "count=1048576", "seek=0", "iflag=count_bytes", "oflag=seek_bytes,direct", "conv=fsync"},
+			},
+		},
+		"full device": {
+			size: "2684354560",
+			full: true,
+			expectedDDs: [][]string{
+				{"if=/dev/zero", "of=" + devicePath, "bs=1M", "count=1073741824", "seek=0", "iflag=count_bytes", "oflag=seek_bytes,direct", "conv=fsync"},
+				{"if=/dev/zero", "of=" + devicePath, "bs=1M", "count=1073741824", "seek=1073741824", "iflag=count_bytes", "oflag=seek_bytes,direct", "conv=fsync"},
+				{"if=/dev/zero", "of=" + devicePath, "bs=1M", "count=536870912", "seek=2147483648", "iflag=count_bytes", "oflag=seek_bytes,direct", "conv=fsync"},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		dds := newFakeWipeHost(t, tc.size, false)
+		if err := WipeDevice(devicePath, tc.full, DestructiveOperationConfirmation); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(*dds, tc.expectedDDs) {
+			t.Fatalf("%v: dd calls = %v, expected %v", name, *dds, tc.expectedDDs)
+		}
+	}
+}
+
+func TestWipeDeviceInUse(t *testing.T) {
+	mountedDevice := newTestBlockDevice(t, "sdb", false)
+	dds := newFakeWipeHost(t, "3221225472", true)
+	if err := WipeDevice(mountedDevice, false, DestructiveOperationConfirmation); err == nil {
+		t.Fatalf("expected an error for the mounted device")
+	}
+
+	heldDevice := newTestBlockDevice(t, "sdc", true)
+	if err := WipeDevice(heldDevice, false, DestructiveOperationConfirmation); err == nil {
+		t.Fatalf("expected an error for the held device")
+	}
+
+	dds = newFakeWipeHost(t, "3221225472", false)
+	if err := WipeDevice(mountedDevice, false, ""); err == nil {
+		t.Fatalf("expected an error without the confirmation in safe mode")
+	}
+	if len(*dds) != 0 {
+		t.Fatalf("unexpected dd calls %v", *dds)
+	}
+}
+
+func TestEncryptVolumeWipeBeforeFormat(t *testing.T) {
+	devicePath := newTestBlockDevice(t, "sdb", false)
+	f := newFakeCryptSetup(t, nil)
+
+	dds := newFakeWipeHost(t, "1073741824", false)
+	if err := EncryptVolume(devicePath, "passphrase", NewEncryptParams("", "", "", "", "", "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*dds) != 0 {
+		t.Fatalf("unexpected dd calls %v without wiping enabled", *dds)
+	}
+
+	params := NewEncryptParams("", "", "", "", "", "")
+	params.WipeBeforeFormat = true
+	f.calls = nil
+	if err := EncryptVolume(devicePath, "passphrase", params); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*dds) != 1 || f.lastCall("luksFormat") == nil {
+		t.Fatalf("dd calls = %v, cryptsetup calls = %v, expected the wipe and the format", *dds, f.calls)
+	}
+
+	params = NewEncryptParams("", "", "", "", "", "")
+	params.WipeFullDevice = true
+	if err := EncryptVolume(devicePath, "passphrase", params); err == nil {
+		t.Fatalf("expected an error for the full wipe without wiping before format")
+	}
+}
@@ -35,6 +35,33 @@ const (
 	CryptoKeyHash     = "CRYPTO_KEY_HASH"
 	CryptoKeySize     = "CRYPTO_KEY_SIZE"
 	CryptoPBKDF       = "CRYPTO_PBKDF"
+	// CryptoLUKSVersion is the LUKS format version of the new encrypted volumes, luks1 or luks2
+	CryptoLUKSVersion = "CRYPTO_LUKS_VERSION"
+	// CryptoPBKDFParallel is the number of the parallel threads of the argon2 PBKDFs
+	CryptoPBKDFParallel = "CRYPTO_PBKDF_PARALLEL"
+	// CryptoPBKDFMemory is the memory cost in KiB of the argon2 PBKDFs
+	CryptoPBKDFMemory = "CRYPTO_PBKDF_MEMORY"
+	// CryptoPBKDFIterations is the iteration cost of the argon2 PBKDFs
+	CryptoPBKDFIterations = "CRYPTO_PBKDF_ITERATIONS"
+	// CryptoOpenCipher is the cipher spec passed at open time for the legacy volumes only
+	CryptoOpenCipher = "CRYPTO_OPEN_CIPHER"
+	// CryptoIntegrityRecoveryMode opens the integrity protected volume read-only for the data recovery if "true"
+	CryptoIntegrityRecoveryMode = "CRYPTO_INTEGRITY_RECOVERY_MODE"
+	// CryptoIntegrity is the dm-integrity algorithm of the new encrypted volumes, e.g. hmac-sha256
+	CryptoIntegrity = "CRYPTO_INTEGRITY"
+	// CryptoHeaderFile is the path of the detached LUKS header file of the volume on the host
+	CryptoHeaderFile = "CRYPTO_HEADER_FILE"
+	// CryptoWipeBeforeFormat wipes the header region of a new encrypted volume before the format if
+	// "true", and the full volume if "full"
+	CryptoWipeBeforeFormat = "CRYPTO_WIPE_BEFORE_FORMAT"
+	// CryptoPassphraseEncoding is the encoding of CryptoKeyValue, raw, hex or base64, see crypto.PassphraseEncodingRaw
+	CryptoPassphraseEncoding = "CRYPTO_PASSPHRASE_ENCODING"
+	// CryptoPerfProfile is the performance profile of the crypto device, see crypto.PerformanceProfileDefault
+	CryptoPerfProfile = "CRYPTO_PERF_PROFILE"
+	// CryptoKeySectorSize is the encryption sector size in bytes of the new encrypted volumes, e.g. 4096
+	CryptoKeySectorSize = "CRYPTO_KEY_SECTOR_SIZE"
+	// CryptoStrictSectorAlignment refuses the volume whose size is not a multiple of CryptoKeySectorSize if "true"
+	CryptoStrictSectorAlignment = "CRYPTO_STRICT_SECTOR_ALIGNMENT"
 
 	defaultFsType = "ext4"
 )
@@ -416,7 +443,31 @@ func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 			return nil, status.Errorf(codes.InvalidArgument, "unsupported disk encryption format %v", diskFormat)
 		}
 
-		cryptoParams := crypto.NewEncryptParams(keyProvider, secrets[CryptoKeyCipher], secrets[CryptoKeyHash], secrets[CryptoKeySize], secrets[CryptoPBKDF])
+		cryptoParams := crypto.NewEncryptParams(keyProvider, secrets[CryptoKeyCipher], secrets[CryptoKeyHash], secrets[CryptoKeySize], secrets[CryptoPBKDF], secrets[CryptoLUKSVersion])
+		cryptoParams.PBKDFParallel = secrets[CryptoPBKDFParallel]
+		cryptoParams.PBKDFMemoryKB = secrets[CryptoPBKDFMemory]
+		cryptoParams.PBKDFIterations = secrets[CryptoPBKDFIterations]
+		cryptoParams.OpenCipher = secrets[CryptoOpenCipher]
+		cryptoParams.HeaderFile = secrets[CryptoHeaderFile]
+		cryptoParams.Integrity = secrets[CryptoIntegrity]
+		cryptoParams.WipeBeforeFormat = secrets[CryptoWipeBeforeFormat] == "true" || secrets[CryptoWipeBeforeFormat] == "full"
+		cryptoParams.WipeFullDevice = secrets[CryptoWipeBeforeFormat] == "full"
+		cryptoParams.PerformanceProfile = secrets[CryptoPerfProfile]
+		cryptoParams.PassphraseEncoding = secrets[CryptoPassphraseEncoding]
+		cryptoParams.IntegrityRecoveryMode = secrets[CryptoIntegrityRecoveryMode] == "true"
+		cryptoParams.KeySectorSize = secrets[CryptoKeySectorSize]
+		cryptoParams.StrictSectorAlignment = secrets[CryptoStrictSectorAlignment] == "true"
+
+		// the data device with a detached header looks blank, so check the header file instead
+		if diskFormat == "" && cryptoParams.HeaderFile != "" {
+			formatted, err := crypto.HasDetachedLUKSHeader(cryptoParams.HeaderFile)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if formatted {
+				diskFormat = "crypto_LUKS"
+			}
+		}
 
 		// initial setup of longhorn device for crypto
 		if diskFormat == "" {
@@ -428,8 +479,11 @@ func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		cryptoDevice := crypto.VolumeMapper(volumeID)
 		logrus.Debugf("volume %s requires crypto device %s", volumeID, cryptoDevice)
 
-		if err := crypto.OpenVolume(volumeID, devicePath, passphrase); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		if err := crypto.OpenVolume(volumeID, devicePath, passphrase, cryptoParams); err != nil {
+			if errors.Is(err, crypto.ErrInvalidPassphrase) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid passphrase for encrypted volume %v: %v", volumeID, err)
+			}
+			return nil, status.Error(getCryptoErrorCode(err, codes.Internal), err.Error())
 		}
 
 		// update the device path to point to the new crypto device
@@ -495,7 +549,7 @@ func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		} else if isOpen {
 			logrus.Debugf("NodeUnstagehVolume: volume %s has active crypto device %s", volumeID, cryptoDevice)
 			if err := crypto.CloseVolume(volumeID); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
+				return nil, status.Error(getCryptoErrorCode(err, codes.Internal), err.Error())
 			}
 			logrus.Infof("NodeUnstageVolume: volume %s closed active crypto device %s", volumeID, cryptoDevice)
 		}
@@ -649,9 +703,21 @@ func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 			return "", status.Errorf(codes.InvalidArgument, "missing passphrase for encrypted volume %v", volumeID)
 		}
 
-		// blindly resize the encrypto device
-		if err := crypto.ResizeEncryptoDevice(volumeID, passphrase); err != nil {
-			return "", status.Errorf(codes.InvalidArgument, "failed to resize crypto device %v for volume %v node expansion", devicePath, volumeID)
+		// only resize the encrypto device if the mapping doesn't cover the backing device yet,
+		// resize it anyway if the sizes cannot be checked
+		consistent, backingSize, mappedSize, err := crypto.CheckSizeConsistency(volumeID)
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to check size consistency of crypto device %v for volume %v", devicePath, volumeID)
+		} else if consistent {
+			logrus.Debugf("Crypto device %v of size %v is consistent with backing size %v for volume %v", devicePath, mappedSize, backingSize, volumeID)
+			return devicePath, nil
+		}
+		passphrase, err = crypto.DecodePassphrase(passphrase, secrets[CryptoPassphraseEncoding])
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "failed to decode passphrase for encrypted volume %v: %v", volumeID, err)
+		}
+		if err := crypto.ResizeEncryptoDevice(volumeID, passphrase, secrets[CryptoHeaderFile], 0); err != nil {
+			return "", status.Errorf(getCryptoErrorCode(err, codes.InvalidArgument), "failed to resize crypto device %v for volume %v node expansion: %v", devicePath, volumeID, err)
 		}
 
 		return devicePath, nil
@@ -688,6 +754,22 @@ func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 	}, nil
 }
 
+// getCryptoErrorCode maps the typed errors of the crypto package to the gRPC code, so the retryable
+// failures can be told apart without matching the error text. The fallback code is used otherwise.
+func getCryptoErrorCode(err error, fallback codes.Code) codes.Code {
+	switch {
+	case errors.Is(err, crypto.ErrInvalidPassphrase):
+		return codes.InvalidArgument
+	case errors.Is(err, crypto.ErrDeviceBusy):
+		return codes.Unavailable
+	case errors.Is(err, crypto.ErrDeviceNotLUKS):
+		return codes.FailedPrecondition
+	case errors.Is(err, crypto.ErrKeyslotsFull):
+		return codes.ResourceExhausted
+	}
+	return fallback
+}
+
 func getNodeServiceCapabilities(cs []csi.NodeServiceCapability_RPC_Type) []*csi.NodeServiceCapability {
 	var nscs []*csi.NodeServiceCapability
 
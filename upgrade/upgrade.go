@@ -3,6 +3,7 @@ package upgrade
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -44,7 +45,10 @@ const (
 	LeaseLockName = "longhorn-manager-upgrade-lock"
 )
 
-func Upgrade(kubeconfigPath, currentNodeID string) error {
+// Upgrade upgrades the Longhorn CRs. A positive budget limits the wall-clock time of the resource upgrade.
+// The human-readable progress of the upgrade paths supporting it is streamed to out if set, otherwise
+// it's logged via logrus.
+func Upgrade(kubeconfigPath, currentNodeID string, budget time.Duration, out io.Writer) error {
 	namespace := os.Getenv(types.EnvPodNamespace)
 	if namespace == "" {
 		logrus.Warnf("Cannot detect pod namespace, environment variable %v is missing, "+
@@ -80,14 +84,14 @@ func Upgrade(kubeconfigPath, currentNodeID string) error {
 		return err
 	}
 
-	if err := upgrade(currentNodeID, namespace, config, lhClient, kubeClient); err != nil {
+	if err := upgrade(currentNodeID, namespace, config, lhClient, kubeClient, budget, out); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func upgrade(currentNodeID, namespace string, config *restclient.Config, lhClient *lhclientset.Clientset, kubeClient *clientset.Clientset) error {
+func upgrade(currentNodeID, namespace string, config *restclient.Config, lhClient *lhclientset.Clientset, kubeClient *clientset.Clientset, budget time.Duration, out io.Writer) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	var err error
 	defer cancel()
@@ -134,7 +138,7 @@ func upgrade(currentNodeID, namespace string, config *restclient.Config, lhClien
 				if err = doAPIVersionUpgrade(namespace, config, lhClient); err != nil {
 					return
 				}
-				if err = doResourceUpgrade(namespace, lhClient, kubeClient); err != nil {
+				if err = doResourceUpgrade(namespace, lhClient, kubeClient, budget, out); err != nil {
 					return
 				}
 			},
@@ -229,7 +233,15 @@ func upgradeLocalNode() (err error) {
 	return nil
 }
 
-func doResourceUpgrade(namespace string, lhClient *lhclientset.Clientset, kubeClient *clientset.Clientset) (err error) {
+// resourceUpgradeStep is a single upgrade path walked through when the Longhorn
+// version before the upgrade is older than toVersion.
+type resourceUpgradeStep struct {
+	path      string
+	toVersion string
+	upgrade   func() error
+}
+
+func doResourceUpgrade(namespace string, lhClient *lhclientset.Clientset, kubeClient *clientset.Clientset, budget time.Duration, out io.Writer) (err error) {
 	defer func() {
 		err = errors.Wrap(err, "upgrade resources failed")
 	}()
@@ -240,77 +252,127 @@ func doResourceUpgrade(namespace string, lhClient *lhclientset.Clientset, kubeCl
 	}
 
 	resourceMaps := map[string]interface{}{}
-
-	if semver.Compare(lhVersionBeforeUpgrade, "v0.8.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v0.7.0 to v0.8.0")
-		if err := v070to080.UpgradeResources(namespace, lhClient, resourceMaps); err != nil {
-			return err
-		}
+	steps := newResourceUpgradeSteps(namespace, lhClient, kubeClient, resourceMaps, out)
+	if err := runResourceUpgradeSteps(lhVersionBeforeUpgrade, steps, budget); err != nil {
+		return err
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.0.1") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.0.0 to v1.0.1")
-		if err := v100to101.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
-			return err
-		}
+
+	if err := upgradeutil.UpdateResources(namespace, lhClient, resourceMaps); err != nil {
+		return err
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.1.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.0.2 to v1.1.0")
-		if err := v102to110.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
-			return err
-		}
+	// Make sure none of the migrations is silently dropped before the version is bumped
+	if err := upgradeutil.CheckResourcesFlushed(namespace, lhClient, resourceMaps); err != nil {
+		return errors.Wrap(err, "upgraded resources are not fully persisted")
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.1.1") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.1.0 to v1.1.1")
-		if err := v110to111.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
-			return err
-		}
+
+	return upgradeutil.CreateOrUpdateLonghornVersionSetting(namespace, lhClient)
+}
+
+// newResourceUpgradeSteps returns all the upgrade paths in the order they are walked through.
+func newResourceUpgradeSteps(namespace string, lhClient *lhclientset.Clientset, kubeClient *clientset.Clientset, resourceMaps map[string]interface{}, out io.Writer) []resourceUpgradeStep {
+	return []resourceUpgradeStep{
+		{"v0.7.0 to v0.8.0", "v0.8.0", func() error {
+			return v070to080.UpgradeResources(namespace, lhClient, resourceMaps)
+		}},
+		{"v1.0.0 to v1.0.1", "v1.0.1", func() error {
+			return v100to101.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
+		{"v1.0.2 to v1.1.0", "v1.1.0", func() error {
+			return v102to110.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
+		{"v1.1.0 to v1.1.1", "v1.1.1", func() error {
+			return v110to111.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
+		{"v1.1.0 to v1.2.0", "v1.2.0", func() error {
+			return v110to120.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
+		{"v1.1.1 to v1.2.0", "v1.2.0", func() error {
+			return v111to120.UpgradeResources(namespace, lhClient, resourceMaps)
+		}},
+		{"v1.2.0 to v1.2.1", "v1.2.1", func() error {
+			return v120to121.UpgradeResources(namespace, lhClient, resourceMaps)
+		}},
+		{"v1.2.2 to v1.2.3", "v1.2.3", func() error {
+			return v122to123.UpgradeResources(namespace, lhClient, resourceMaps, false, out)
+		}},
+		{"v1.2.x to v1.3.0", "v1.3.0", func() error {
+			return v12xto130.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
+		{"v1.3.x to v1.4.0", "v1.4.0", func() error {
+			return v13xto140.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
+		{"v1.4.x to v1.5.0", "v1.5.0", func() error {
+			return v14xto150.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps)
+		}},
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.2.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.1.0 to v1.2.0")
-		if err := v110to120.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
-			return err
-		}
+}
+
+// resourceUpgradeStepDescriptions describes the steps of the upgrade paths, keyed by the path.
+var resourceUpgradeStepDescriptions = map[string]func() []upgradeutil.StepDescription{
+	"v1.2.2 to v1.2.3": v122to123.DescribeSteps,
+}
+
+// DescribeUpgradeSteps returns the steps of the upgrade paths walked through when upgrading from the
+// Longhorn version from to the version to, in the order they run, so the upgrade can be introspected
+// before running it. Nothing is modified. A path without the step descriptions is described as a
+// whole.
+func DescribeUpgradeSteps(from, to string) ([]upgradeutil.StepDescription, error) {
+	if !semver.IsValid(from) || !semver.IsValid(to) {
+		return nil, fmt.Errorf("invalid upgrade from %v to %v, both should be valid versions", from, to)
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.2.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.1.1 to v1.2.0")
-		if err := v111to120.UpgradeResources(namespace, lhClient, resourceMaps); err != nil {
-			return err
-		}
+	if semver.Compare(from, to) >= 0 {
+		return nil, fmt.Errorf("invalid upgrade from %v to %v, the source version should be older", from, to)
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.2.1") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.2.0 to v1.2.1")
-		if err := v120to121.UpgradeResources(namespace, lhClient, resourceMaps); err != nil {
-			return err
+
+	descriptions := []upgradeutil.StepDescription{}
+	for _, step := range newResourceUpgradeSteps("", nil, nil, nil, nil) {
+		if semver.Compare(from, step.toVersion) >= 0 || semver.Compare(step.toVersion, to) > 0 {
+			continue
 		}
-	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.2.3") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.2.2 to v1.2.3")
-		if err := v122to123.UpgradeResources(namespace, lhClient, resourceMaps); err != nil {
-			return err
+		describe, ok := resourceUpgradeStepDescriptions[step.path]
+		if !ok {
+			descriptions = append(descriptions, upgradeutil.StepDescription{
+				Path:        step.path,
+				Name:        step.path,
+				Description: fmt.Sprintf("upgrades the resources to %v, no step description is available", step.toVersion),
+			})
+			continue
 		}
-	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.3.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.2.x to v1.3.0")
-		if err := v12xto130.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
-			return err
+		for _, description := range describe() {
+			description.Path = step.path
+			descriptions = append(descriptions, description)
 		}
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.4.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.3.x to v1.4.0")
-		if err := v13xto140.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
-			return err
+	return descriptions, nil
+}
+
+// runResourceUpgradeSteps walks through the upgrade paths required by the version before the upgrade.
+// If budget is positive, it's checked between the steps, and once the elapsed time exceeds it the
+// remaining steps are skipped. A running step is not interrupted. The caller doesn't persist the cached
+// changes of the finished steps then, but a step writing to the API server directly has already done so,
+// and the upgrade can be retried later.
+func runResourceUpgradeSteps(lhVersionBeforeUpgrade string, steps []resourceUpgradeStep, budget time.Duration) error {
+	var requiredSteps []resourceUpgradeStep
+	for _, step := range steps {
+		if semver.Compare(lhVersionBeforeUpgrade, step.toVersion) < 0 {
+			requiredSteps = append(requiredSteps, step)
 		}
 	}
-	if semver.Compare(lhVersionBeforeUpgrade, "v1.5.0") < 0 {
-		logrus.Debugf("Walking through the upgrade path v1.4.x to v1.5.0")
-		if err := v14xto150.UpgradeResources(namespace, lhClient, kubeClient, resourceMaps); err != nil {
+
+	start := time.Now()
+	for i, step := range requiredSteps {
+		logrus.Debugf("Walking through the upgrade path %v", step.path)
+		if err := step.upgrade(); err != nil {
 			return err
 		}
-	}
 
-	if err := upgradeutil.UpdateResources(namespace, lhClient, resourceMaps); err != nil {
-		return err
+		elapsed := time.Since(start)
+		logrus.Infof("Finished upgrade path %v, %v/%v upgrade steps done in %v", step.path, i+1, len(requiredSteps), elapsed)
+		if budget > 0 && elapsed > budget {
+			return fmt.Errorf("upgrade budget %v exceeded after step %v, %v/%v upgrade steps done in %v",
+				budget, step.path, i+1, len(requiredSteps), elapsed)
+		}
 	}
 
-	return upgradeutil.CreateOrUpdateLonghornVersionSetting(namespace, lhClient)
+	return nil
 }
@@ -0,0 +1,108 @@
+package upgrade
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	upgradeutil "github.com/longhorn/longhorn-manager/upgrade/util"
+)
+
+func TestRunResourceUpgradeStepsBudgetExceeded(t *testing.T) {
+	var executed []string
+	newStep := func(path, toVersion string, duration time.Duration) resourceUpgradeStep {
+		return resourceUpgradeStep{path, toVersion, func() error {
+			time.Sleep(duration)
+			executed = append(executed, path)
+			return nil
+		}}
+	}
+	steps := []resourceUpgradeStep{
+		newStep("v1.1.0 to v1.2.0", "v1.2.0", 0),
+		newStep("v1.2.0 to v1.2.1", "v1.2.1", 0),
+		newStep("v1.2.2 to v1.2.3", "v1.2.3", 100*time.Millisecond),
+		newStep("v1.2.x to v1.3.0", "v1.3.0", 0),
+	}
+
+	err := runResourceUpgradeSteps("v1.2.0", steps, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected the upgrade budget to be exceeded")
+	}
+	if !strings.Contains(err.Error(), "upgrade budget 50ms exceeded after step v1.2.2 to v1.2.3, 2/3 upgrade steps done") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"v1.2.0 to v1.2.1", "v1.2.2 to v1.2.3"}
+	if strings.Join(executed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("executed = %v, expected = %v", executed, expected)
+	}
+}
+
+func TestRunResourceUpgradeStepsNoBudget(t *testing.T) {
+	count := 0
+	steps := []resourceUpgradeStep{
+		{"v1.2.2 to v1.2.3", "v1.2.3", func() error {
+			time.Sleep(10 * time.Millisecond)
+			count++
+			return nil
+		}},
+		{"v1.2.x to v1.3.0", "v1.3.0", func() error {
+			count++
+			return nil
+		}},
+	}
+
+	if err := runResourceUpgradeSteps("v1.2.2", steps, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("count = %v, expected = 2", count)
+	}
+}
+
+func TestDescribeUpgradeSteps(t *testing.T) {
+	descriptions, err := DescribeUpgradeSteps("v1.2.2", "v1.2.3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := []string{}
+	for _, d := range descriptions {
+		if d.Path != "v1.2.2 to v1.2.3" || d.Description == "" {
+			t.Fatalf("unexpected step description %+v", d)
+		}
+		names = append(names, d.Name)
+	}
+	expected := []string{"backfillBackupVolumeLabels", "upgradeBackups", "checkAndRemoveEngineBackupStatus", "checkAndUpdateEngineActiveState"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("steps = %v, expected %v", names, expected)
+	}
+	for i, keyword := range []string{"mutates backups", "mutates backups", "clears engine backup status", "activates engines"} {
+		if !strings.Contains(descriptions[i].Description, keyword) {
+			t.Fatalf("description of step %v = %q, expected to contain %q", descriptions[i].Name, descriptions[i].Description, keyword)
+		}
+	}
+
+	descriptions, err = DescribeUpgradeSteps("v1.2.0", "v1.3.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	paths := []string{}
+	for _, d := range descriptions {
+		if len(paths) == 0 || paths[len(paths)-1] != d.Path {
+			paths = append(paths, d.Path)
+		}
+	}
+	expectedPaths := []string{"v1.2.0 to v1.2.1", "v1.2.2 to v1.2.3", "v1.2.x to v1.3.0"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Fatalf("paths = %v, expected %v", paths, expectedPaths)
+	}
+	if expected := (upgradeutil.StepDescription{Path: "v1.2.x to v1.3.0", Name: "v1.2.x to v1.3.0", Description: "upgrades the resources to v1.3.0, no step description is available"}); descriptions[len(descriptions)-1] != expected {
+		t.Fatalf("last step = %+v, expected %+v", descriptions[len(descriptions)-1], expected)
+	}
+
+	for _, versions := range [][2]string{{"v1.2.3", "v1.2.2"}, {"1.2.2", "v1.2.3"}} {
+		if _, err := DescribeUpgradeSteps(versions[0], versions[1]); err == nil {
+			t.Fatalf("expected an error for the upgrade from %v to %v", versions[0], versions[1])
+		}
+	}
+}
@@ -2,10 +2,15 @@ package util
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
 	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/jinzhu/copier"
 	"github.com/pkg/errors"
@@ -16,6 +21,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
 
 	"github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
 	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
@@ -24,28 +31,44 @@ import (
 	"github.com/longhorn/longhorn-manager/types"
 )
 
+// StepDescription describes what an upgrade step does, so the upgrade can be introspected by tooling.
+type StepDescription struct {
+	// Path is the upgrade path of the step, e.g. "v1.2.2 to v1.2.3"
+	Path        string
+	Name        string
+	Description string
+}
+
 type ProgressMonitor struct {
 	description                 string
 	targetValue                 int
 	currentValue                int
 	currentProgressInPercentage float64
 	mutex                       *sync.RWMutex
+
+	// overall aggregates the progress of all the steps. It's nil for a standalone monitor.
+	overall *OverallProgressMonitor
 }
 
 func NewProgressMonitor(description string, currentValue, targetValue int) *ProgressMonitor {
+	return newProgressMonitor(description, currentValue, targetValue, nil)
+}
+
+func newProgressMonitor(description string, currentValue, targetValue int, overall *OverallProgressMonitor) *ProgressMonitor {
 	pm := &ProgressMonitor{
 		description:                 description,
 		targetValue:                 targetValue,
 		currentValue:                currentValue,
 		currentProgressInPercentage: math.Floor(float64(currentValue*100) / float64(targetValue)),
 		mutex:                       &sync.RWMutex{},
+		overall:                     overall,
 	}
 	pm.logCurrentProgress()
 	return pm
 }
 
 func (pm *ProgressMonitor) logCurrentProgress() {
-	logrus.Infof("%v: current progress %v%% (%v/%v)", pm.description, pm.currentProgressInPercentage, pm.currentValue, pm.targetValue)
+	pm.overall.printf("%v: current progress %v%% (%v/%v)", pm.description, pm.currentProgressInPercentage, pm.currentValue, pm.targetValue)
 }
 
 func (pm *ProgressMonitor) Inc() int {
@@ -59,6 +82,7 @@ func (pm *ProgressMonitor) Inc() int {
 	if pm.currentProgressInPercentage != oldProgressInPercentage {
 		pm.logCurrentProgress()
 	}
+	pm.overall.add(1)
 	return pm.currentValue
 }
 
@@ -68,11 +92,13 @@ func (pm *ProgressMonitor) SetCurrentValue(newValue int) {
 
 	oldProgressInPercentage := pm.currentProgressInPercentage
 
+	delta := newValue - pm.currentValue
 	pm.currentValue = newValue
 	pm.currentProgressInPercentage = math.Floor(float64(pm.currentValue*100) / float64(pm.targetValue))
 	if pm.currentProgressInPercentage != oldProgressInPercentage {
 		pm.logCurrentProgress()
 	}
+	pm.overall.add(delta)
 }
 
 func (pm *ProgressMonitor) GetCurrentProgress() (int, int, float64) {
@@ -81,6 +107,94 @@ func (pm *ProgressMonitor) GetCurrentProgress() (int, int, float64) {
 	return pm.currentValue, pm.targetValue, pm.currentProgressInPercentage
 }
 
+// OverallProgressMonitor aggregates the progress of multiple upgrade steps, so the operators get a
+// single percentage of the whole upgrade. Each step is weighted by its number of items, and the
+// total is pre-counted before running the steps.
+type OverallProgressMonitor struct {
+	description                 string
+	targetValue                 int
+	currentValue                int
+	currentProgressInPercentage float64
+	mutex                       *sync.RWMutex
+
+	// out receives the human-readable progress of the overall and the step monitors instead of
+	// logrus if set
+	out io.Writer
+}
+
+func NewOverallProgressMonitor(description string, targetValue int) *OverallProgressMonitor {
+	return NewOverallProgressMonitorWithOutput(description, targetValue, nil)
+}
+
+// NewOverallProgressMonitorWithOutput creates the overall monitor streaming the progress lines to out.
+// The progress is logged via logrus if out is nil.
+func NewOverallProgressMonitorWithOutput(description string, targetValue int, out io.Writer) *OverallProgressMonitor {
+	opm := &OverallProgressMonitor{
+		description: description,
+		targetValue: targetValue,
+		mutex:       &sync.RWMutex{},
+		out:         out,
+	}
+	opm.currentProgressInPercentage = opm.getProgressInPercentage()
+	opm.logCurrentProgress()
+	return opm
+}
+
+// NewProgressMonitor creates the monitor of a step reporting to the overall progress.
+// A standalone monitor is returned if opm is nil.
+func (opm *OverallProgressMonitor) NewProgressMonitor(description string, currentValue, targetValue int) *ProgressMonitor {
+	pm := newProgressMonitor(description, currentValue, targetValue, opm)
+	opm.add(currentValue)
+	return pm
+}
+
+// Printf streams a human-readable line to the output of the monitor, or logs it if there is no output.
+func (opm *OverallProgressMonitor) Printf(format string, args ...interface{}) {
+	opm.printf(format, args...)
+}
+
+func (opm *OverallProgressMonitor) printf(format string, args ...interface{}) {
+	if opm == nil || opm.out == nil {
+		logrus.Infof(format, args...)
+		return
+	}
+	fmt.Fprintf(opm.out, format+"\n", args...)
+}
+
+func (opm *OverallProgressMonitor) getProgressInPercentage() float64 {
+	if opm.targetValue == 0 {
+		return 100
+	}
+	return math.Floor(float64(opm.currentValue*100) / float64(opm.targetValue))
+}
+
+func (opm *OverallProgressMonitor) logCurrentProgress() {
+	opm.printf("%v: %v%% of upgrade complete (%v/%v)", opm.description, opm.currentProgressInPercentage, opm.currentValue, opm.targetValue)
+}
+
+func (opm *OverallProgressMonitor) add(delta int) {
+	if opm == nil || delta == 0 {
+		return
+	}
+
+	opm.mutex.Lock()
+	defer opm.mutex.Unlock()
+
+	oldProgressInPercentage := opm.currentProgressInPercentage
+
+	opm.currentValue += delta
+	opm.currentProgressInPercentage = opm.getProgressInPercentage()
+	if opm.currentProgressInPercentage != oldProgressInPercentage {
+		opm.logCurrentProgress()
+	}
+}
+
+func (opm *OverallProgressMonitor) GetCurrentProgress() (int, int, float64) {
+	opm.mutex.RLock()
+	defer opm.mutex.RUnlock()
+	return opm.currentValue, opm.targetValue, opm.currentProgressInPercentage
+}
+
 func ListShareManagerPods(namespace string, kubeClient *clientset.Clientset) ([]v1.Pod, error) {
 	smPodsList, err := kubeClient.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
 		LabelSelector: labels.Set(types.GetShareManagerComponentLabel()).String(),
@@ -550,10 +664,80 @@ func CreateAndUpdateBackingImageInProvidedCache(namespace string, lhClient *lhcl
 	return obj, nil
 }
 
+const (
+	// largeUpdateWriteEstimate is the estimated number of writes above which UpdateResources
+	// warns that the upgrade may be throttled by the API server
+	largeUpdateWriteEstimate = 10000
+)
+
+var (
+	updateRateLimiterLock sync.RWMutex
+	updateRateLimiter     flowcontrol.RateLimiter
+)
+
+// SetUpdateRateLimit limits the writes of UpdateResources to the API server to qps with the
+// burst, on top of the rate limiting of the client. A non-positive qps removes the limit.
+// Note that the client already backs off on the 429 responses per the Retry-After header.
+func SetUpdateRateLimit(qps float32, burst int) {
+	updateRateLimiterLock.Lock()
+	defer updateRateLimiterLock.Unlock()
+
+	if updateRateLimiter != nil {
+		updateRateLimiter.Stop()
+		updateRateLimiter = nil
+	}
+	if qps > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		updateRateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	}
+}
+
+// waitForUpdateRateLimit blocks until the next write is allowed by the update rate limit, if any.
+func waitForUpdateRateLimit() {
+	updateRateLimiterLock.RLock()
+	defer updateRateLimiterLock.RUnlock()
+
+	if updateRateLimiter != nil {
+		updateRateLimiter.Accept()
+	}
+}
+
+// EstimateUpdateWrites returns the upper bound of the number of writes UpdateResources issues
+// for the cached resources, which is a status update and a spec update for each resource.
+func EstimateUpdateWrites(resourceMaps map[string]interface{}) int {
+	writes := 0
+	for _, resourceMap := range resourceMaps {
+		if v := reflect.ValueOf(resourceMap); v.Kind() == reflect.Map {
+			writes += 2 * v.Len()
+		}
+	}
+	return writes
+}
+
+// warnLargeUpdateWriteEstimate warns the operator if the estimated writes may get the upgrade throttled.
+func warnLargeUpdateWriteEstimate(writes int) {
+	if writes <= largeUpdateWriteEstimate {
+		return
+	}
+
+	updateRateLimiterLock.RLock()
+	defer updateRateLimiterLock.RUnlock()
+	if updateRateLimiter != nil && updateRateLimiter.QPS() > 0 {
+		logrus.Warnf("Upgrade may issue up to %v writes to the API server, taking at least %v at the update rate limit of %v QPS",
+			writes, time.Duration(float64(writes)/float64(updateRateLimiter.QPS())*float64(time.Second)).Round(time.Second), updateRateLimiter.QPS())
+		return
+	}
+	logrus.Warnf("Upgrade may issue up to %v writes to the API server and get throttled, consider setting an update rate limit", writes)
+}
+
 // UpdateResources persists all the resources in provided cached `resourceMap`. This method is not thread-safe.
 func UpdateResources(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) error {
 	var err error
 
+	warnLargeUpdateWriteEstimate(EstimateUpdateWrites(resourceMaps))
+
 	for resourceKind, resourceMap := range resourceMaps {
 		switch resourceKind {
 		case types.LonghornKindNode:
@@ -590,6 +774,306 @@ func UpdateResources(namespace string, lhClient *lhclientset.Clientset, resource
 	return nil
 }
 
+// CheckResourcesFlushed lists the cached kinds of resources from the API server again, and errors
+// if any change in the cache is not persisted, e.g. the write is dropped on a conflict.
+func CheckResourcesFlushed(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) error {
+	var err error
+
+	persisted := map[string]interface{}{}
+	for resourceKind := range resourceMaps {
+		switch resourceKind {
+		case types.LonghornKindNode:
+			_, err = ListAndUpdateNodesInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindVolume:
+			_, err = ListAndUpdateVolumesInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindEngine:
+			_, err = ListAndUpdateEnginesInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindReplica:
+			_, err = ListAndUpdateReplicasInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindBackup:
+			_, err = ListAndUpdateBackupsInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindEngineImage:
+			_, err = ListAndUpdateEngineImagesInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindInstanceManager:
+			_, err = ListAndUpdateInstanceManagersInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindShareManager:
+			_, err = ListAndUpdateShareManagersInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindBackingImage:
+			_, err = ListAndUpdateBackingImagesInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindRecurringJob:
+			_, err = ListAndUpdateRecurringJobsInProvidedCache(namespace, lhClient, persisted)
+		case types.LonghornKindSetting:
+			_, err = ListAndUpdateSettingsInProvidedCache(namespace, lhClient, persisted)
+		default:
+			return fmt.Errorf("resource kind %v is not able to be checked", resourceKind)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if pending := PendingResourceChanges(resourceMaps, persisted); len(pending) > 0 {
+		return fmt.Errorf("%v cached resource changes are not persisted: %v", len(pending), pending)
+	}
+	return nil
+}
+
+// PendingResourceChanges returns the cached resources, as `<kind>/<name>`, which differ from or are
+// missing in the persisted resources. The metadata managed by the API server is not compared.
+func PendingResourceChanges(cached, persisted map[string]interface{}) []string {
+	pending := []string{}
+	for resourceKind, resourceMap := range cached {
+		cachedMap := reflect.ValueOf(resourceMap)
+		if cachedMap.Kind() != reflect.Map {
+			continue
+		}
+		persistedMap := reflect.ValueOf(persisted[resourceKind])
+
+		iter := cachedMap.MapRange()
+		for iter.Next() {
+			var persistedObj reflect.Value
+			if persistedMap.Kind() == reflect.Map {
+				persistedObj = persistedMap.MapIndex(iter.Key())
+			}
+			if !persistedObj.IsValid() || !isResourcePersisted(iter.Value(), persistedObj) {
+				pending = append(pending, fmt.Sprintf("%v/%v", resourceKind, iter.Key()))
+			}
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// isResourcePersisted compares the cached and the persisted pointers to the resources. The type
+// meta and the object meta other than the labels, annotations, finalizers and owner references
+// are skipped, since the resource versions of the cached resources are not kept up to date.
+func isResourcePersisted(cached, persisted reflect.Value) bool {
+	if cached.IsNil() || persisted.IsNil() {
+		return cached.IsNil() == persisted.IsNil()
+	}
+
+	cachedMeta, cachedOK := cached.Interface().(metav1.Object)
+	persistedMeta, persistedOK := persisted.Interface().(metav1.Object)
+	if !cachedOK || !persistedOK {
+		return reflect.DeepEqual(cached.Interface(), persisted.Interface())
+	}
+	if !reflect.DeepEqual(cachedMeta.GetLabels(), persistedMeta.GetLabels()) ||
+		!reflect.DeepEqual(cachedMeta.GetAnnotations(), persistedMeta.GetAnnotations()) ||
+		!reflect.DeepEqual(cachedMeta.GetFinalizers(), persistedMeta.GetFinalizers()) ||
+		!reflect.DeepEqual(cachedMeta.GetOwnerReferences(), persistedMeta.GetOwnerReferences()) {
+		return false
+	}
+
+	cachedStruct, persistedStruct := cached.Elem(), persisted.Elem()
+	for i := 0; i < cachedStruct.NumField(); i++ {
+		switch cachedStruct.Type().Field(i).Name {
+		case "TypeMeta", "ObjectMeta":
+			continue
+		}
+		if !reflect.DeepEqual(cachedStruct.Field(i).Interface(), persistedStruct.Field(i).Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+// CopyResourceMaps deep copies the cached resources, so the upgrade can run on the copy without
+// touching the cache, e.g. in a dry run.
+func CopyResourceMaps(resourceMaps map[string]interface{}) map[string]interface{} {
+	copied := map[string]interface{}{}
+	for resourceKind, resourceMap := range resourceMaps {
+		m := reflect.ValueOf(resourceMap)
+		if m.Kind() != reflect.Map {
+			copied[resourceKind] = resourceMap
+			continue
+		}
+		copiedMap := reflect.MakeMapWithSize(m.Type(), m.Len())
+		iter := m.MapRange()
+		for iter.Next() {
+			value := iter.Value()
+			if deepCopy := value.MethodByName("DeepCopy"); deepCopy.IsValid() && !value.IsNil() {
+				value = deepCopy.Call(nil)[0]
+			}
+			copiedMap.SetMapIndex(iter.Key(), value)
+		}
+		copied[resourceKind] = copiedMap.Interface()
+	}
+	return copied
+}
+
+// ErrDryRunWrite is returned for the writes refused by the clientset of NewDryRunClientset.
+var ErrDryRunWrite = errors.New("write refused in dry run")
+
+// NewDryRunClientset returns a clientset sharing the connection of lhClient, which refuses all
+// but the read requests with ErrDryRunWrite, so a dry run persists nothing even if a step calls
+// the client directly. Only the v1beta2 API is served. A nil lhClient is returned as is.
+func NewDryRunClientset(lhClient *lhclientset.Clientset) (*lhclientset.Clientset, error) {
+	if lhClient == nil {
+		return nil, nil
+	}
+	restClient, ok := lhClient.LonghornV1beta2().RESTClient().(*rest.RESTClient)
+	if !ok {
+		return nil, fmt.Errorf("unexpected REST client %T", lhClient.LonghornV1beta2().RESTClient())
+	}
+
+	httpClient := http.Client{}
+	if restClient.Client != nil {
+		httpClient = *restClient.Client
+	}
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = readOnlyRoundTripper{next: next}
+
+	readOnly := *restClient
+	readOnly.Client = &httpClient
+	return lhclientset.New(&readOnly), nil
+}
+
+type readOnlyRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt readOnlyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, errors.Wrapf(ErrDryRunWrite, "%v %v", req.Method, req.URL.Path)
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// ResourceFieldChange is a change of a field of a cached resource. The values are in JSON, and
+// the missing value is empty.
+type ResourceFieldChange struct {
+	Kind  string
+	Name  string
+	Field string
+	Old   string
+	New   string
+}
+
+func (c ResourceFieldChange) String() string {
+	return fmt.Sprintf("%v/%v %v: %v -> %v", c.Kind, c.Name, c.Field, valueOrNone(c.Old), valueOrNone(c.New))
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
+
+// DiffResources returns the field changes from the resources before to the ones after, sorted by
+// the kind, the name and the field, so the changes of the runs can be diffed. The fields are the
+// JSON paths, e.g. "status.backupStatus". Like PendingResourceChanges, the object meta other than
+// the labels, annotations, finalizers and owner references is not compared.
+func DiffResources(before, after map[string]interface{}) ([]ResourceFieldChange, error) {
+	changes := []ResourceFieldChange{}
+	for resourceKind, resourceMap := range after {
+		afterMap := reflect.ValueOf(resourceMap)
+		if afterMap.Kind() != reflect.Map {
+			continue
+		}
+		beforeMap := reflect.ValueOf(before[resourceKind])
+
+		iter := afterMap.MapRange()
+		for iter.Next() {
+			var beforeObj interface{}
+			if beforeMap.Kind() == reflect.Map {
+				if obj := beforeMap.MapIndex(iter.Key()); obj.IsValid() {
+					beforeObj = obj.Interface()
+				}
+			}
+			beforeFields, err := flattenResourceFields(beforeObj)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to flatten %v/%v", resourceKind, iter.Key())
+			}
+			afterFields, err := flattenResourceFields(iter.Value().Interface())
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to flatten %v/%v", resourceKind, iter.Key())
+			}
+
+			for field, newValue := range afterFields {
+				if oldValue := beforeFields[field]; oldValue != newValue {
+					changes = append(changes, ResourceFieldChange{resourceKind, fmt.Sprint(iter.Key()), field, oldValue, newValue})
+				}
+			}
+			for field, oldValue := range beforeFields {
+				if _, exist := afterFields[field]; !exist {
+					changes = append(changes, ResourceFieldChange{resourceKind, fmt.Sprint(iter.Key()), field, oldValue, ""})
+				}
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind < changes[j].Kind
+		}
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+// flattenResourceFields returns the leaf fields of the resource in JSON keyed by the JSON paths.
+// The lists are the leaves as a whole.
+func flattenResourceFields(obj interface{}) (map[string]string, error) {
+	fields := map[string]string{}
+	if obj == nil || (reflect.ValueOf(obj).Kind() == reflect.Ptr && reflect.ValueOf(obj).IsNil()) {
+		return fields, nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	root := map[string]interface{}{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	delete(root, "kind")
+	delete(root, "apiVersion")
+	if metadata, ok := root["metadata"].(map[string]interface{}); ok {
+		kept := map[string]interface{}{}
+		for _, key := range []string{"labels", "annotations", "finalizers", "ownerReferences"} {
+			if value, exist := metadata[key]; exist {
+				kept[key] = value
+			}
+		}
+		root["metadata"] = kept
+	}
+
+	var flatten func(prefix string, value interface{}) error
+	flatten = func(prefix string, value interface{}) error {
+		if m, ok := value.(map[string]interface{}); ok {
+			for key, v := range m {
+				field := key
+				if prefix != "" {
+					field = prefix + "." + key
+				}
+				if err := flatten(field, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		fields[prefix] = string(data)
+		return nil
+	}
+	if err := flatten("", root); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
 func updateNodes(namespace string, lhClient *lhclientset.Clientset, nodes map[string]*longhorn.Node) error {
 	existingNodeList, err := lhClient.LonghornV1beta2().Nodes(namespace).List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
@@ -603,13 +1087,21 @@ func updateNodes(namespace string, lhClient *lhclientset.Clientset, nodes map[st
 		}
 
 		if !reflect.DeepEqual(existingNode.Status, node.Status) {
-			if _, err = lhClient.LonghornV1beta2().Nodes(namespace).UpdateStatus(context.TODO(), node, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().Nodes(namespace).UpdateStatus(context.TODO(), node, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingNode.ResourceVersion = updated.ResourceVersion
+				node.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingNode.Spec, node.Spec) ||
 			!reflect.DeepEqual(existingNode.ObjectMeta, node.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().Nodes(namespace).Update(context.TODO(), node, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -632,13 +1124,21 @@ func updateVolumes(namespace string, lhClient *lhclientset.Clientset, volumes ma
 		}
 
 		if !reflect.DeepEqual(existingVolume.Status, volume.Status) {
-			if _, err = lhClient.LonghornV1beta2().Volumes(namespace).UpdateStatus(context.TODO(), volume, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().Volumes(namespace).UpdateStatus(context.TODO(), volume, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingVolume.ResourceVersion = updated.ResourceVersion
+				volume.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingVolume.Spec, volume.Spec) ||
 			!reflect.DeepEqual(existingVolume.ObjectMeta, volume.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().Volumes(namespace).Update(context.TODO(), volume, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -661,13 +1161,21 @@ func updateReplicas(namespace string, lhClient *lhclientset.Clientset, replicas
 		}
 
 		if !reflect.DeepEqual(existingReplica.Status, replica.Status) {
-			if _, err = lhClient.LonghornV1beta2().Replicas(namespace).UpdateStatus(context.TODO(), replica, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().Replicas(namespace).UpdateStatus(context.TODO(), replica, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingReplica.ResourceVersion = updated.ResourceVersion
+				replica.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingReplica.Spec, replica.Spec) ||
 			!reflect.DeepEqual(existingReplica.ObjectMeta, replica.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().Replicas(namespace).Update(context.TODO(), replica, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -690,13 +1198,21 @@ func updateEngines(namespace string, lhClient *lhclientset.Clientset, engines ma
 		}
 
 		if !reflect.DeepEqual(existingEngine.Status, engine.Status) {
-			if _, err = lhClient.LonghornV1beta2().Engines(namespace).UpdateStatus(context.TODO(), engine, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().Engines(namespace).UpdateStatus(context.TODO(), engine, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingEngine.ResourceVersion = updated.ResourceVersion
+				engine.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingEngine.Spec, engine.Spec) ||
 			!reflect.DeepEqual(existingEngine.ObjectMeta, engine.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().Engines(namespace).Update(context.TODO(), engine, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -719,13 +1235,21 @@ func updateBackups(namespace string, lhClient *lhclientset.Clientset, backups ma
 		}
 
 		if !reflect.DeepEqual(existingBackup.Status, backup.Status) {
-			if _, err = lhClient.LonghornV1beta2().Backups(namespace).UpdateStatus(context.TODO(), backup, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().Backups(namespace).UpdateStatus(context.TODO(), backup, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingBackup.ResourceVersion = updated.ResourceVersion
+				backup.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingBackup.Spec, backup.Spec) ||
 			!reflect.DeepEqual(existingBackup.ObjectMeta, backup.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().Backups(namespace).Update(context.TODO(), backup, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -748,13 +1272,21 @@ func updateEngineImages(namespace string, lhClient *lhclientset.Clientset, engin
 		}
 
 		if !reflect.DeepEqual(existingEngineImage.Status, engineImage.Status) {
-			if _, err = lhClient.LonghornV1beta2().EngineImages(namespace).UpdateStatus(context.TODO(), engineImage, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().EngineImages(namespace).UpdateStatus(context.TODO(), engineImage, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingEngineImage.ResourceVersion = updated.ResourceVersion
+				engineImage.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingEngineImage.Spec, engineImage.Spec) ||
 			!reflect.DeepEqual(existingEngineImage.ObjectMeta, engineImage.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().EngineImages(namespace).Update(context.TODO(), engineImage, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -777,13 +1309,21 @@ func updateInstanceManagers(namespace string, lhClient *lhclientset.Clientset, i
 		}
 
 		if !reflect.DeepEqual(existingInstanceManager.Status, instanceManager.Status) {
-			if _, err = lhClient.LonghornV1beta2().InstanceManagers(namespace).UpdateStatus(context.TODO(), instanceManager, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().InstanceManagers(namespace).UpdateStatus(context.TODO(), instanceManager, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingInstanceManager.ResourceVersion = updated.ResourceVersion
+				instanceManager.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingInstanceManager.Spec, instanceManager.Spec) ||
 			!reflect.DeepEqual(existingInstanceManager.ObjectMeta, instanceManager.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().InstanceManagers(namespace).Update(context.TODO(), instanceManager, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -806,13 +1346,21 @@ func updateShareManagers(namespace string, lhClient *lhclientset.Clientset, shar
 		}
 
 		if !reflect.DeepEqual(existingShareManager.Status, shareManager.Status) {
-			if _, err = lhClient.LonghornV1beta2().ShareManagers(namespace).UpdateStatus(context.TODO(), shareManager, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().ShareManagers(namespace).UpdateStatus(context.TODO(), shareManager, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingShareManager.ResourceVersion = updated.ResourceVersion
+				shareManager.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingShareManager.Spec, shareManager.Spec) ||
 			!reflect.DeepEqual(existingShareManager.ObjectMeta, shareManager.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().ShareManagers(namespace).Update(context.TODO(), shareManager, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -835,13 +1383,21 @@ func updateBackingImages(namespace string, lhClient *lhclientset.Clientset, back
 		}
 
 		if !reflect.DeepEqual(existingBackingImage.Status, backingImage.Status) {
-			if _, err = lhClient.LonghornV1beta2().BackingImages(namespace).UpdateStatus(context.TODO(), backingImage, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().BackingImages(namespace).UpdateStatus(context.TODO(), backingImage, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingBackingImage.ResourceVersion = updated.ResourceVersion
+				backingImage.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingBackingImage.Spec, backingImage.Spec) ||
 			!reflect.DeepEqual(existingBackingImage.ObjectMeta, backingImage.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().BackingImages(namespace).Update(context.TODO(), backingImage, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -864,13 +1420,21 @@ func updateRecurringJobs(namespace string, lhClient *lhclientset.Clientset, recu
 		}
 
 		if !reflect.DeepEqual(existingRecurringJob.Status, recurringJob.Status) {
-			if _, err = lhClient.LonghornV1beta2().RecurringJobs(namespace).UpdateStatus(context.TODO(), recurringJob, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
+			waitForUpdateRateLimit()
+			updated, err := lhClient.LonghornV1beta2().RecurringJobs(namespace).UpdateStatus(context.TODO(), recurringJob, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
+			if err == nil {
+				// The following update would conflict with the stale resource version
+				existingRecurringJob.ResourceVersion = updated.ResourceVersion
+				recurringJob.ResourceVersion = updated.ResourceVersion
+			}
 		}
 
 		if !reflect.DeepEqual(existingRecurringJob.Spec, recurringJob.Spec) ||
 			!reflect.DeepEqual(existingRecurringJob.ObjectMeta, recurringJob.ObjectMeta) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().RecurringJobs(namespace).Update(context.TODO(), recurringJob, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -893,6 +1457,7 @@ func updateSettings(namespace string, lhClient *lhclientset.Clientset, settings
 		}
 
 		if !reflect.DeepEqual(existingSetting.Value, setting.Value) {
+			waitForUpdateRateLimit()
 			if _, err = lhClient.LonghornV1beta2().Settings(namespace).Update(context.TODO(), setting, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(errors.Cause(err)) {
 				return err
 			}
@@ -1,8 +1,22 @@
 package util
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"sync"
 	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+	lhclientset "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned"
+	"github.com/longhorn/longhorn-manager/types"
 )
 
 func TestProgressMonitorInc(t *testing.T) {
@@ -46,3 +60,228 @@ func TestProgressMonitorInc(t *testing.T) {
 		t.Fatalf(`targetValue = %v, expectedTargetValue = %v`, targetValue, expectedTargetValue)
 	}
 }
+
+func TestOverallProgressMonitor(t *testing.T) {
+	opm := NewOverallProgressMonitor("Test OPM", 10)
+	backupPM := opm.NewProgressMonitor("Test backups", 0, 2)
+	enginePM := opm.NewProgressMonitor("Test engines", 0, 8)
+
+	backupPM.Inc()
+	backupPM.Inc()
+	if currentValue, _, percentage := opm.GetCurrentProgress(); currentValue != 2 || percentage != 20.0 {
+		t.Fatalf(`currentValue = %v, percentage = %v, expected 2 and 20`, currentValue, percentage)
+	}
+
+	enginePM.SetCurrentValue(3)
+	if currentValue, _, percentage := opm.GetCurrentProgress(); currentValue != 5 || percentage != 50.0 {
+		t.Fatalf(`currentValue = %v, percentage = %v, expected 5 and 50`, currentValue, percentage)
+	}
+
+	enginePM.SetCurrentValue(8)
+	currentValue, targetValue, percentage := opm.GetCurrentProgress()
+	if currentValue != 10 || targetValue != 10 || percentage != 100.0 {
+		t.Fatalf(`currentValue = %v, targetValue = %v, percentage = %v, expected 10, 10 and 100`, currentValue, targetValue, percentage)
+	}
+
+	// A standalone monitor doesn't require the overall progress
+	var nilOPM *OverallProgressMonitor
+	nilOPM.NewProgressMonitor("Test standalone", 0, 1).Inc()
+}
+
+func newTestEngine(name, labelVolumeName, specVolumeName string) *longhorn.Engine {
+	e := &longhorn.Engine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{},
+		},
+	}
+	if labelVolumeName != "" {
+		e.Labels[types.LonghornLabelVolume] = labelVolumeName
+	}
+	e.Spec.VolumeName = specVolumeName
+	return e
+}
+
+func TestEstimateUpdateWrites(t *testing.T) {
+	resourceMaps := map[string]interface{}{
+		types.LonghornKindVolume: map[string]*longhorn.Volume{"vol-1": {}, "vol-2": {}},
+		types.LonghornKindEngine: map[string]*longhorn.Engine{"vol-1-e-0": {}, "vol-2-e-0": {}, "vol-2-e-1": {}},
+		types.LonghornKindBackup: map[string]*longhorn.Backup{},
+	}
+	if writes := EstimateUpdateWrites(resourceMaps); writes != 10 {
+		t.Fatalf("writes = %v, expected 10", writes)
+	}
+	if writes := EstimateUpdateWrites(nil); writes != 0 {
+		t.Fatalf("writes = %v, expected 0 for no resources", writes)
+	}
+}
+
+// countingRateLimiter counts the writes waiting for the rate limit without blocking.
+type countingRateLimiter struct {
+	flowcontrol.RateLimiter
+	accepted int
+}
+
+func (l *countingRateLimiter) Accept() {
+	l.accepted++
+}
+
+func (l *countingRateLimiter) Stop() {}
+
+func TestUpdateRateLimit(t *testing.T) {
+	defer SetUpdateRateLimit(0, 0)
+
+	limiter := &countingRateLimiter{}
+	updateRateLimiter = limiter
+	for i := 0; i < 3; i++ {
+		waitForUpdateRateLimit()
+	}
+	if limiter.accepted != 3 {
+		t.Fatalf("accepted = %v, expected every write to wait for the rate limit", limiter.accepted)
+	}
+
+	SetUpdateRateLimit(10, 2)
+	if updateRateLimiter == nil || updateRateLimiter.QPS() != 10 {
+		t.Fatalf("expected the update rate limit of 10 QPS to be set")
+	}
+	SetUpdateRateLimit(0, 0)
+	if updateRateLimiter != nil {
+		t.Fatalf("expected the update rate limit to be removed")
+	}
+	// Without a rate limit the writes are not blocked
+	waitForUpdateRateLimit()
+}
+
+func TestPendingResourceChanges(t *testing.T) {
+	newBackup := func(resourceVersion string) *longhorn.Backup {
+		return &longhorn.Backup{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup-1", ResourceVersion: resourceVersion, Labels: map[string]string{types.LonghornLabelBackupVolume: "vol"}},
+			Status:     longhorn.BackupStatus{State: longhorn.BackupStateCompleted},
+		}
+	}
+	persisted := map[string]interface{}{
+		types.LonghornKindBackup:  map[string]*longhorn.Backup{"backup-1": newBackup("2")},
+		types.LonghornKindSetting: map[string]*longhorn.Setting{"setting-1": {ObjectMeta: metav1.ObjectMeta{Name: "setting-1"}, Value: "true"}},
+	}
+
+	// The stale resource version of the cache doesn't make the change pending
+	cached := map[string]interface{}{
+		types.LonghornKindBackup:  map[string]*longhorn.Backup{"backup-1": newBackup("1")},
+		types.LonghornKindSetting: map[string]*longhorn.Setting{"setting-1": {ObjectMeta: metav1.ObjectMeta{Name: "setting-1"}, Value: "true"}},
+	}
+	if pending := PendingResourceChanges(cached, persisted); len(pending) != 0 {
+		t.Fatalf("pending = %v, expected the flushed changes not to be pending", pending)
+	}
+
+	// Simulate the changes not flushed to the API server
+	unflushedBackup := newBackup("1")
+	unflushedBackup.Status.SnapshotName = "snap-1"
+	unlabeledBackup := newBackup("1")
+	unlabeledBackup.Labels = nil
+	cached = map[string]interface{}{
+		types.LonghornKindBackup: map[string]*longhorn.Backup{
+			"backup-1": unflushedBackup,
+			"backup-2": newBackup("1"),
+		},
+		types.LonghornKindSetting: map[string]*longhorn.Setting{"setting-1": {ObjectMeta: metav1.ObjectMeta{Name: "setting-1"}, Value: "false"}},
+	}
+	expected := []string{types.LonghornKindBackup + "/backup-1", types.LonghornKindBackup + "/backup-2", types.LonghornKindSetting + "/setting-1"}
+	if pending := PendingResourceChanges(cached, persisted); !reflect.DeepEqual(pending, expected) {
+		t.Fatalf("pending = %v, expected %v", pending, expected)
+	}
+
+	cached = map[string]interface{}{
+		types.LonghornKindBackup: map[string]*longhorn.Backup{"backup-1": unlabeledBackup},
+	}
+	if pending := PendingResourceChanges(cached, persisted); len(pending) != 1 {
+		t.Fatalf("pending = %v, expected the label change to be pending", pending)
+	}
+}
+
+func TestDiffResources(t *testing.T) {
+	engine := newTestEngine("vol-e-0", "vol", "vol")
+	engine.Status.BackupStatus = map[string]*longhorn.EngineBackupStatus{"backup-1": {Progress: 100}}
+	before := map[string]interface{}{
+		types.LonghornKindEngine: map[string]*longhorn.Engine{engine.Name: engine},
+		types.LonghornKindBackup: map[string]*longhorn.Backup{},
+	}
+
+	after := CopyResourceMaps(before)
+	upgraded := after[types.LonghornKindEngine].(map[string]*longhorn.Engine)[engine.Name]
+	if upgraded == engine {
+		t.Fatalf("expected the engine to be deep copied")
+	}
+	upgraded.Spec.Active = true
+	upgraded.Status.BackupStatus = map[string]*longhorn.EngineBackupStatus{}
+	upgraded.ResourceVersion = "2"
+	after[types.LonghornKindBackup].(map[string]*longhorn.Backup)["backup-1"] = &longhorn.Backup{
+		ObjectMeta: metav1.ObjectMeta{Name: "backup-1", Labels: map[string]string{types.LonghornLabelBackupVolume: "vol"}},
+	}
+
+	changes, err := DiffResources(before, after)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		types.LonghornKindBackup + "/backup-1 metadata.labels." + types.LonghornLabelBackupVolume + `: <none> -> "vol"`,
+		types.LonghornKindEngine + "/vol-e-0 spec.active: false -> true",
+		types.LonghornKindEngine + "/vol-e-0 status.backupStatus.backup-1.progress: 100 -> <none>",
+		types.LonghornKindEngine + `/vol-e-0 status.backupStatus.backup-1.replicaAddress: "" -> <none>`,
+		types.LonghornKindEngine + `/vol-e-0 status.backupStatus.backup-1.snapshotName: "" -> <none>`,
+		types.LonghornKindEngine + `/vol-e-0 status.backupStatus.backup-1.state: "" -> <none>`,
+	}
+	actual := []string{}
+	for _, change := range changes {
+		// The other fields of the backup are new as well
+		if change.Kind == types.LonghornKindBackup && change.Field != "metadata.labels."+types.LonghornLabelBackupVolume {
+			continue
+		}
+		actual = append(actual, change.String())
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("changes = %v, expected %v", actual, expected)
+	}
+	if engine.Spec.Active || len(engine.Status.BackupStatus) != 1 {
+		t.Fatalf("expected the original engine to be untouched, got %+v", engine)
+	}
+}
+
+func TestNewDryRunClientset(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"metadata":{"name":"setting"},"value":"true"}`)
+	}))
+	defer server.Close()
+	lhClient, err := lhclientset.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	dryRunClient, err := NewDryRunClientset(lhClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	setting, err := dryRunClient.LonghornV1beta2().Settings("longhorn-system").Get(context.TODO(), "setting", metav1.GetOptions{})
+	if err != nil || setting.Value != "true" {
+		t.Fatalf("setting = %v, err = %v, expected the read to be served", setting, err)
+	}
+	if _, err := dryRunClient.LonghornV1beta2().Settings("longhorn-system").Update(context.TODO(), setting, metav1.UpdateOptions{}); !errors.Is(err, ErrDryRunWrite) {
+		t.Fatalf("err = %v, expected ErrDryRunWrite", err)
+	}
+	if err := dryRunClient.LonghornV1beta2().Settings("longhorn-system").Delete(context.TODO(), "setting", metav1.DeleteOptions{}); !errors.Is(err, ErrDryRunWrite) {
+		t.Fatalf("err = %v, expected ErrDryRunWrite", err)
+	}
+	if !reflect.DeepEqual(requests, []string{http.MethodGet}) {
+		t.Fatalf("requests = %v, expected only the read to reach the server", requests)
+	}
+
+	// The original client still writes
+	if _, err := lhClient.LonghornV1beta2().Settings("longhorn-system").Update(context.TODO(), setting, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client, err := NewDryRunClientset(nil); client != nil || err != nil {
+		t.Fatalf("client = %v, err = %v, expected nil for the nil client", client, err)
+	}
+}
@@ -0,0 +1,233 @@
+package v122to123
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	lhclientset "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned"
+)
+
+// defaultFailureManifestPath is on the host path of the Longhorn data, so the manifest survives
+// the restart of the manager pod.
+const defaultFailureManifestPath = "/var/lib/longhorn/upgrade/v1.2.2-to-v1.2.3-failures.json"
+
+var (
+	failureManifestPathLock sync.RWMutex
+	failureManifestPath     = defaultFailureManifestPath
+)
+
+// SetFailureManifestPath sets where UpgradeResources writes the failure manifest. An empty path
+// restores the default.
+func SetFailureManifestPath(path string) {
+	failureManifestPathLock.Lock()
+	defer failureManifestPathLock.Unlock()
+
+	if path == "" {
+		path = defaultFailureManifestPath
+	}
+	failureManifestPath = path
+}
+
+func getFailureManifestPath() string {
+	failureManifestPathLock.RLock()
+	defer failureManifestPathLock.RUnlock()
+	return failureManifestPath
+}
+
+// FailureManifest records the names of the resources each upgrade step failed on, keyed by the
+// step name. The names are the backups for upgradeBackups, the engines for
+// checkAndRemoveEngineBackupStatus and the volumes for checkAndUpdateEngineActiveState.
+type FailureManifest map[string][]string
+
+func (m FailureManifest) add(step string, names ...string) {
+	for _, name := range names {
+		i := sort.SearchStrings(m[step], name)
+		if i < len(m[step]) && m[step][i] == name {
+			continue
+		}
+		m[step] = append(m[step], "")
+		copy(m[step][i+1:], m[step][i:])
+		m[step][i] = name
+	}
+}
+
+// collect records the resources of the *resourceFailuresError, so the upgrade can carry on with
+// the others. Any other error is returned as it is.
+func (m FailureManifest) collect(err error) error {
+	var failed *resourceFailuresError
+	if !errors.As(err, &failed) {
+		return err
+	}
+	logrus.Errorf(upgradeLogPrefix+"%v, will carry on and record them for the retry", failed)
+	for name := range failed.errs {
+		m.add(failed.step, name)
+	}
+	return nil
+}
+
+// Count returns the number of the failures of all the steps.
+func (m FailureManifest) Count() int {
+	count := 0
+	for _, names := range m {
+		count += len(names)
+	}
+	return count
+}
+
+// resourceFailuresError is returned by an upgrade step failing on some of the resources, while the
+// other resources are upgraded.
+type resourceFailuresError struct {
+	step string
+	// errs is the error of each failed resource keyed by the resource name
+	errs map[string]error
+}
+
+func newResourceFailuresError(step string) *resourceFailuresError {
+	return &resourceFailuresError{step: step, errs: map[string]error{}}
+}
+
+func (e *resourceFailuresError) add(name string, err error) {
+	e.errs[name] = err
+}
+
+func (e *resourceFailuresError) Error() string {
+	names := make([]string, 0, len(e.errs))
+	for name := range e.errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, e.errs[name].Error())
+	}
+	return fmt.Sprintf("%v failed on %v resources: %v", e.step, len(names), strings.Join(messages, "; "))
+}
+
+// upgradeScope limits an upgrade step to the named resources, e.g. the ones failed in a prior upgrade.
+// A nil scope covers all the resources.
+type upgradeScope map[string]bool
+
+func newUpgradeScope(names []string) upgradeScope {
+	scope := upgradeScope{}
+	for _, name := range names {
+		scope[name] = true
+	}
+	return scope
+}
+
+func (s upgradeScope) includes(name string) bool {
+	return s == nil || s[name]
+}
+
+// WriteFailureManifest writes the failure manifest to the path as JSON.
+func WriteFailureManifest(path string, manifest FailureManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize the failure manifest")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create the directory of failure manifest %v", path)
+	}
+	// Replace the manifest atomically, so a crash never leaves a truncated one behind
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write failure manifest %v", path)
+	}
+	return errors.Wrapf(os.Rename(tmpPath, path), "failed to write failure manifest %v", path)
+}
+
+// ReadFailureManifest reads the failure manifest written by WriteFailureManifest.
+func ReadFailureManifest(path string) (FailureManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read failure manifest %v", path)
+	}
+	manifest := FailureManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse failure manifest %v", path)
+	}
+	for step, names := range manifest {
+		sort.Strings(names)
+		manifest[step] = names
+	}
+	return manifest, nil
+}
+
+// recordFailures writes the failures to the manifest, or removes the stale manifest of a prior
+// upgrade if nothing failed.
+func recordFailures(path string, failures FailureManifest) error {
+	if failures.Count() > 0 {
+		logrus.Warnf(upgradeLogPrefix+"recording %v failed resources to %v for the retry", failures.Count(), path)
+		return WriteFailureManifest(path, failures)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove stale failure manifest %v", path)
+	}
+	return nil
+}
+
+// RetryFailed re-processes only the resources in the failure manifest at the path written by a prior
+// UpgradeResources, and persists them, without re-scanning the whole cluster. The manifest is updated
+// with the resources still failing, or removed if none is. It returns the remaining failures.
+func RetryFailed(namespace string, lhClient *lhclientset.Clientset, path string) (remaining FailureManifest, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"retry failed resources failed")
+	}()
+
+	manifest, err := ReadFailureManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceMaps := map[string]interface{}{}
+	if remaining, err = retryFailedInProvidedCache(namespace, lhClient, resourceMaps, manifest); err != nil {
+		return nil, err
+	}
+	if err := persistResources(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+	if err := recordFailures(path, remaining); err != nil {
+		return nil, err
+	}
+	if remaining.Count() > 0 {
+		return remaining, fmt.Errorf("%v resources still failed: %v", remaining.Count(), remaining)
+	}
+	return remaining, nil
+}
+
+// retryFailedInProvidedCache runs the upgrade steps on the resources in the manifest only, in the order
+// of the upgrade. The engine backup status is still kept for the backups failing again.
+func retryFailedInProvidedCache(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, manifest FailureManifest) (FailureManifest, error) {
+	remaining := FailureManifest{}
+	if names := manifest["upgradeBackups"]; len(names) > 0 {
+		migrated, err := migrateBackupsInProvidedCache(namespace, lhClient, resourceMaps, backupMigrationOptions{scope: newUpgradeScope(names)})
+		if err := remaining.collect(err); err != nil {
+			return nil, err
+		}
+		logrus.Infof(upgradeLogPrefix+"retried the migration of backups %v, migrated %v", names, migrated)
+	}
+	if names := manifest["checkAndRemoveEngineBackupStatus"]; len(names) > 0 {
+		removed, err := checkAndRemoveEngineBackupStatus(namespace, lhClient, resourceMaps, remaining["upgradeBackups"], newUpgradeScope(names), nil)
+		if err := remaining.collect(err); err != nil {
+			return nil, err
+		}
+		logrus.Infof(upgradeLogPrefix+"retried the backup status removal of engines %v, removed %v", names, removed)
+	}
+	if names := manifest["checkAndUpdateEngineActiveState"]; len(names) > 0 {
+		activated, err := checkAndUpdateEngineActiveState(namespace, lhClient, resourceMaps, newUpgradeScope(names), nil)
+		if err := remaining.collect(err); err != nil {
+			return nil, err
+		}
+		logrus.Infof(upgradeLogPrefix+"retried the engine activation of volumes %v, activated %v", names, activated)
+	}
+	return remaining, nil
+}
@@ -0,0 +1,108 @@
+package v122to123
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+)
+
+func TestUpgradeResourcesFailureManifest(t *testing.T) {
+	good := newTestBackup("backup-good", "vol")
+	bad := newTestBackup("backup-bad", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[good.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	engine.Status.BackupStatus[bad.Name] = nil
+	other := newTestBackup("backup-other", "vol2")
+	otherEngine := newTestEngine("vol2-e-0", "vol2", "node-1")
+	otherEngine.Status.BackupStatus[other.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{good, bad, other}, []*longhorn.Engine{engine, otherEngine},
+		[]*longhorn.Volume{newTestVolume("vol", "node-1"), newTestVolume("vol2", "node-1")})
+	result, err := UpgradeResourcesWithResult(testNamespace, nil, resourceMaps, nil)
+	if err == nil {
+		t.Fatalf("expected an error for the failed backup")
+	}
+	expected := FailureManifest{
+		"upgradeBackups":                   {"backup-bad"},
+		"checkAndRemoveEngineBackupStatus": {"vol-e-0"},
+	}
+	if result == nil || !reflect.DeepEqual(result.Failed, expected) {
+		t.Fatalf("result = %+v, expected failures %v", result, expected)
+	}
+	// The other resources are upgraded, while the engine backup status is kept for the retry
+	if good.Status.State == "" || other.Status.State == "" {
+		t.Fatalf("expected the other backups to be migrated")
+	}
+	if len(engine.Status.BackupStatus) != 2 || otherEngine.Status.BackupStatus != nil {
+		t.Fatalf("engine backup status = %v and %v, expected only the one with the failed backup kept", engine.Status.BackupStatus, otherEngine.Status.BackupStatus)
+	}
+
+	path := filepath.Join(t.TempDir(), "upgrade", "failures.json")
+	if err := recordFailures(path, result.Failed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manifest, err := ReadFailureManifest(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Fatalf("manifest = %v, expected %v", manifest, expected)
+	}
+
+	// Nothing failed, so the stale manifest is removed
+	if err := recordFailures(path, FailureManifest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the manifest to be removed, got %v", err)
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	bad := newTestBackup("backup-bad", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[bad.Name] = nil
+	other := newTestBackup("backup-other", "vol2")
+	otherEngine := newTestEngine("vol2-e-0", "vol2", "node-1")
+	otherEngine.Status.BackupStatus[other.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{bad, other}, []*longhorn.Engine{engine, otherEngine},
+		[]*longhorn.Volume{newTestVolume("vol", "node-1"), newTestVolume("vol2", "node-1")})
+
+	manifest := FailureManifest{
+		"upgradeBackups":                   {"backup-bad"},
+		"checkAndRemoveEngineBackupStatus": {"vol-e-0"},
+	}
+
+	// The backup still fails, so the engine backup status is still kept
+	remaining, err := retryFailedInProvidedCache(testNamespace, nil, resourceMaps, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(remaining, manifest) {
+		t.Fatalf("remaining = %v, expected %v", remaining, manifest)
+	}
+	if _, exist := engine.Status.BackupStatus[bad.Name]; !exist {
+		t.Fatalf("expected the engine backup status of the failed backup to be kept")
+	}
+
+	// Once the engine backup status is fixed, the retry succeeds
+	engine.Status.BackupStatus[bad.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	remaining, err = retryFailedInProvidedCache(testNamespace, nil, resourceMaps, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if remaining.Count() != 0 {
+		t.Fatalf("remaining = %v, expected none", remaining)
+	}
+	if bad.Status.State == "" || engine.Status.BackupStatus != nil {
+		t.Fatalf("expected backup-bad to be migrated and the backup status of engine vol-e-0 to be removed")
+	}
+
+	// Only the resources in the manifest are retried
+	if other.Status.State != "" || otherEngine.Status.BackupStatus == nil {
+		t.Fatalf("expected the resources not in the manifest to be left untouched")
+	}
+}
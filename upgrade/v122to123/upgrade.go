@@ -1,88 +1,899 @@
 package v122to123
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/mod/semver"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/longhorn/longhorn-manager/engineapi"
 	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
 	lhclientset "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned"
 	"github.com/longhorn/longhorn-manager/types"
 	upgradeutil "github.com/longhorn/longhorn-manager/upgrade/util"
+	"github.com/longhorn/longhorn-manager/util"
 )
 
 const (
 	upgradeLogPrefix = "upgrade from v1.2.2 to v1.2.3: "
+
+	sourceVersion = "v1.2.2"
+	targetVersion = "v1.2.3"
 )
 
-func UpgradeResources(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) (err error) {
-	if err := upgradeBackups(namespace, lhClient, resourceMaps); err != nil {
+// UpgradeResources upgrades the resources in the cache, which the upgrade dispatcher persists along
+// with the other upgrade paths and then verifies. If the upgrade fails on some of the resources only,
+// the failed ones are written to the failure manifest, see SetFailureManifestPath, so they can be
+// retried by RetryFailed without re-scanning the whole cluster. With dryRun nothing is modified, and
+// the intended changes are logged instead, see DryRunUpgradeResources. The human-readable progress is
+// streamed to out if set, otherwise it's logged via logrus.
+func UpgradeResources(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, dryRun bool, out io.Writer) (err error) {
+	if dryRun {
+		_, err := DryRunUpgradeResources(namespace, lhClient, resourceMaps, out)
 		return err
 	}
-	if err := upgradeEngines(namespace, lhClient, resourceMaps); err != nil {
+
+	result, err := UpgradeResourcesWithResult(namespace, lhClient, resourceMaps, out)
+	if result == nil {
 		return err
 	}
+
+	if recordErr := recordFailures(getFailureManifestPath(), result.Failed); recordErr != nil {
+		if err != nil {
+			return errors.Wrapf(err, "%v", recordErr)
+		}
+		return recordErr
+	}
+	return err
+}
+
+// DryRunUpgradeResources runs the upgrade on a copy of the cached resources, and returns the field
+// changes it would make, sorted so they can be diffed across the runs. The cache is left untouched
+// besides loading the resources the upgrade works on, and nothing is persisted, since the client
+// refuses all the writes, see upgradeutil.NewDryRunClientset. The changes are streamed to out if
+// set, otherwise they're logged via logrus. The changes made before the upgrade fails on some of
+// the resources are still returned along with the error.
+func DryRunUpgradeResources(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, out io.Writer) ([]upgradeutil.ResourceFieldChange, error) {
+	lhClient, err := upgradeutil.NewDryRunClientset(lhClient)
+	if err != nil {
+		return nil, errors.Wrap(err, upgradeLogPrefix+"failed to create the client for the dry run")
+	}
+
+	// Load the resources into the cache before copying it, otherwise the ones listed by the upgrade
+	// would be missing from the resources to compare with
+	if _, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+	if _, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+	if _, err := upgradeutil.ListAndUpdateVolumesInProvidedCache(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+	if _, err := upgradeutil.ListAndUpdateSettingsInProvidedCache(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+
+	upgraded := upgradeutil.CopyResourceMaps(resourceMaps)
+	result, upgradeErr := UpgradeResourcesWithResult(namespace, lhClient, upgraded, out)
+	if result == nil {
+		return nil, upgradeErr
+	}
+
+	changes, err := upgradeutil.DiffResources(resourceMaps, upgraded)
+	if err != nil {
+		return nil, errors.Wrap(err, upgradeLogPrefix+"failed to diff the upgraded resources")
+	}
+	printf := logrus.Infof
+	if out != nil {
+		printf = func(format string, args ...interface{}) {
+			fmt.Fprintf(out, format+"\n", args...)
+		}
+	}
+	for _, change := range changes {
+		printf(upgradeLogPrefix+"dry run: %v", change)
+	}
+	printf(upgradeLogPrefix+"dry run: %v field changes, nothing is persisted", len(changes))
+	return changes, upgradeErr
+}
+
+// persistResources persists the resources in the cache, and makes sure none of the writes is
+// silently dropped.
+func persistResources(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) error {
+	if err := upgradeutil.UpdateResources(namespace, lhClient, resourceMaps); err != nil {
+		return errors.Wrap(err, upgradeLogPrefix+"failed to persist the upgraded resources")
+	}
+	if err := upgradeutil.CheckResourcesFlushed(namespace, lhClient, resourceMaps); err != nil {
+		return errors.Wrap(err, upgradeLogPrefix+"upgraded resources are not fully persisted")
+	}
+	return nil
+}
+
+// DescribeSteps returns the steps of the upgrade in the order they run. The step names are the
+// ones the modified resources are recorded with.
+func DescribeSteps() []upgradeutil.StepDescription {
+	return []upgradeutil.StepDescription{
+		{Name: "backfillBackupVolumeLabels", Description: "mutates backups: sets the missing volume label derived from the backup status, the backup URL and the engines"},
+		{Name: "upgradeBackups", Description: "mutates backups: copies the backup status of the engines to the backups"},
+		{Name: "checkAndRemoveEngineBackupStatus", Description: "clears engine backup status: the migrated backup status is removed from the engines"},
+		{Name: "checkAndUpdateEngineActiveState", Description: "activates engines: sets the current engine of each volume without an active engine active"},
+	}
+}
+
+// ModifiedResources records the names of the resources actually modified by each upgrade step,
+// keyed by the step name. A step modifying nothing is not recorded, so re-running an idempotent
+// upgrade reports nothing.
+type ModifiedResources map[string][]string
+
+func (m ModifiedResources) add(step string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	m[step] = append(m[step], names...)
+	sort.Strings(m[step])
+}
+
+func (m ModifiedResources) merge(other ModifiedResources) {
+	for step, names := range other {
+		m.add(step, names)
+	}
+}
+
+// Count returns the number of the modifications of all the steps.
+func (m ModifiedResources) Count() int {
+	count := 0
+	for _, names := range m {
+		count += len(names)
+	}
+	return count
+}
+
+// EngineActiveChange records the change of the Spec.Active flag of an engine made by the upgrade.
+type EngineActiveChange struct {
+	EngineName string
+	VolumeName string
+	OldActive  bool
+	NewActive  bool
+}
+
+func (c EngineActiveChange) String() string {
+	return fmt.Sprintf("%v (volume %v): %v -> %v", c.EngineName, c.VolumeName, c.OldActive, c.NewActive)
+}
+
+// UpgradeResult is the structured result of the upgrade for the audit.
+type UpgradeResult struct {
+	// Modified is the resources modified by each step
+	Modified ModifiedResources
+	// EngineActiveChanges is the engines whose active flag is flipped, sorted by the engine name,
+	// so the operator can confirm the active engine of each volume is as intended
+	EngineActiveChanges []EngineActiveChange
+	// Failed is the resources each step failed on, which are left as they are
+	Failed FailureManifest
+	// StepDurations is the wall-clock time each executed step took, to find the bottleneck of a
+	// large upgrade
+	StepDurations StepDurations
+}
+
+// timeNow is the clock the step durations are measured with. It can be replaced in tests.
+var timeNow = time.Now
+
+// StepDurations records the wall-clock time each upgrade step took, keyed by the step name.
+type StepDurations map[string]time.Duration
+
+// track starts timing the step, and returns the function recording the time elapsed once the
+// step is done.
+func (d StepDurations) track(step string) func() {
+	start := timeNow()
+	return func() {
+		d[step] += timeNow().Sub(start)
+	}
+}
+
+// UpgradeResourcesWithReport upgrades the resources in the cache like UpgradeResources, and returns
+// the resources modified by each step, so the idempotency of the upgrade can be checked. The
+// human-readable progress is streamed to out if set, otherwise it's logged via logrus.
+func UpgradeResourcesWithReport(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, out io.Writer) (ModifiedResources, error) {
+	result, err := UpgradeResourcesWithResult(namespace, lhClient, resourceMaps, out)
+	if err != nil {
+		return nil, err
+	}
+	return result.Modified, nil
+}
+
+// UpgradeResourcesWithResult is UpgradeResourcesWithReport, and additionally returns the changes of
+// the engine active flags in the result. A step failing on some of the resources carries on with the
+// others, and the failed resources are returned in the result along with the error.
+func UpgradeResourcesWithResult(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, out io.Writer) (*UpgradeResult, error) {
+	// The previous upgrade paths may or may not have cached the resources
+	if err := validateResourceMaps(resourceMaps, false); err != nil {
+		return nil, errors.Wrap(err, upgradeLogPrefix+"invalid resource cache before upgrade")
+	}
+	if err := checkSourceVersion(namespace, lhClient, resourceMaps); err != nil {
+		return nil, errors.Wrap(err, upgradeLogPrefix+"unexpected source version")
+	}
+	overall, err := newOverallProgressMonitor(namespace, lhClient, resourceMaps, out)
+	if err != nil {
+		return nil, errors.Wrap(err, upgradeLogPrefix+"failed to count the resources to upgrade")
+	}
+
+	modified := ModifiedResources{}
+	failures := FailureManifest{}
+	durations := StepDurations{}
+	done := durations.track("backfillBackupVolumeLabels")
+	labeled, err := backfillBackupVolumeLabels(namespace, lhClient, resourceMaps)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	modified.add("backfillBackupVolumeLabels", labeled)
+	done = durations.track("upgradeBackups")
+	migrated, err := upgradeBackups(namespace, lhClient, resourceMaps, "", overall)
+	done()
+	if err := failures.collect(err); err != nil {
+		return nil, err
+	}
+	modified.add("upgradeBackups", migrated)
+	engineModified, activeChanges, err := upgradeEngines(namespace, lhClient, resourceMaps, failures, durations, overall)
+	if err != nil {
+		return nil, err
+	}
+	modified.merge(engineModified)
+
+	if err := ValidateResourceMaps(resourceMaps); err != nil {
+		return nil, errors.Wrap(err, upgradeLogPrefix+"invalid resource cache after upgrade")
+	}
+	for _, change := range activeChanges {
+		overall.Printf(upgradeLogPrefix+"changed the active flag of engine %v", change)
+	}
+	overall.Printf(upgradeLogPrefix+"modified %v resources", modified.Count())
+	for _, step := range DescribeSteps() {
+		if duration, exist := durations[step.Name]; exist {
+			overall.Printf(upgradeLogPrefix+"step %v took %v", step.Name, duration)
+		}
+	}
+	result := &UpgradeResult{
+		Modified:            modified,
+		EngineActiveChanges: activeChanges,
+		Failed:              failures,
+		StepDurations:       durations,
+	}
+	if failures.Count() > 0 {
+		return result, fmt.Errorf(upgradeLogPrefix+"failed to upgrade %v resources: %v", failures.Count(), failures)
+	}
+	return result, nil
+}
+
+// checkSourceVersion refuses to run the upgrade if the current Longhorn version recorded in the setting
+// is already the target version or newer, which means the migration would run twice. An older version
+// is only warned about, since the preceding upgrade paths are expected to have run in the same pass.
+func checkSourceVersion(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) error {
+	setting, err := upgradeutil.GetSettingFromProvidedCache(namespace, lhClient, resourceMaps, string(types.SettingNameCurrentLonghornVersion))
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		logrus.Warnf(upgradeLogPrefix+"cannot find the current Longhorn version, assuming the source version is %v", sourceVersion)
+		return nil
+	}
+	return validateSourceVersion(setting.Value)
+}
+
+func validateSourceVersion(currentVersion string) error {
+	if currentVersion == "" {
+		logrus.Warnf(upgradeLogPrefix+"the current Longhorn version is empty, assuming the source version is %v", sourceVersion)
+		return nil
+	}
+	if !semver.IsValid(currentVersion) {
+		// The upgrade dispatcher treats such a version, e.g. of a custom build, as older than all the
+		// upgrade paths, so the migration runs as before
+		logrus.Warnf(upgradeLogPrefix+"the current Longhorn version %v is not a valid semantic version, "+
+			"running the migration without checking whether it has already been done", currentVersion)
+		return nil
+	}
+	if semver.Compare(currentVersion, targetVersion) >= 0 {
+		return fmt.Errorf("current Longhorn version %v is not older than the target version %v, refusing to run the migration again", currentVersion, targetVersion)
+	}
+	if semver.Compare(currentVersion, sourceVersion) < 0 {
+		logrus.Warnf(upgradeLogPrefix+"current Longhorn version %v is older than the source version %v, the preceding upgrade paths are expected to have run", currentVersion, sourceVersion)
+	}
+	return nil
+}
+
+// newOverallProgressMonitor pre-counts the items handled by all the upgrade steps, which are the backups,
+// the engines and the volumes having engines, so the overall progress can be logged.
+func newOverallProgressMonitor(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, out io.Writer) (*upgradeutil.OverallProgressMonitor, error) {
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
+	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
+	total := len(backupMap) + len(engineMap) + len(groupEnginesByVolume(engineMap))
+	return upgradeutil.NewOverallProgressMonitorWithOutput(upgradeLogPrefix+"upgradeResources", total, out), nil
+}
+
+// ValidateResourceMaps checks the backups, engines and volumes used by this upgrade path are cached
+// in the resource maps with the expected types, and that none of the cached resources is nil.
+func ValidateResourceMaps(resourceMaps map[string]interface{}) error {
+	return validateResourceMaps(resourceMaps, true)
+}
+
+func validateResourceMaps(resourceMaps map[string]interface{}, requireAll bool) error {
+	if resourceMaps == nil {
+		return fmt.Errorf("resource maps is nil")
+	}
+
+	expectedTypes := []struct {
+		kind string
+		typ  reflect.Type
+	}{
+		{types.LonghornKindBackup, reflect.TypeOf(map[string]*longhorn.Backup{})},
+		{types.LonghornKindEngine, reflect.TypeOf(map[string]*longhorn.Engine{})},
+		{types.LonghornKindVolume, reflect.TypeOf(map[string]*longhorn.Volume{})},
+	}
+	for _, expected := range expectedTypes {
+		v, exist := resourceMaps[expected.kind]
+		if !exist {
+			if requireAll {
+				return fmt.Errorf("%v is not cached in resource maps", expected.kind)
+			}
+			continue
+		}
+		if reflect.TypeOf(v) != expected.typ {
+			return fmt.Errorf("%v is cached in resource maps with unexpected type %T", expected.kind, v)
+		}
+		iter := reflect.ValueOf(v).MapRange()
+		for iter.Next() {
+			if iter.Value().IsNil() {
+				return fmt.Errorf("%v %v is nil in resource maps", expected.kind, iter.Key())
+			}
+		}
+	}
 	return nil
 }
 
-func upgradeBackups(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) (err error) {
+// upgradeBackups copies the backup status from the engine CRs to the backup CRs. The backups are handled
+// in the name order, and the ones not after startAfter are skipped if it is set, so that an interrupted
+// upgrade can be resumed.
+func upgradeBackups(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, startAfter string, overall *upgradeutil.OverallProgressMonitor) (migrated []string, err error) {
 	defer func() {
 		err = errors.Wrapf(err, upgradeLogPrefix+"upgrade backups failed")
 	}()
 
-	// Copy backupStatus from engine CRs to backup CRs
+	migrated, err = migrateBackupsInProvidedCache(namespace, lhClient, resourceMaps, backupMigrationOptions{startAfter: startAfter, overall: overall})
+	if validateErr := validateMigratedBackupURLSchemes(namespace, lhClient, resourceMaps, migrated); validateErr != nil {
+		logrus.WithError(validateErr).Warnf(upgradeLogPrefix + "failed to validate the URL schemes of the migrated backups")
+	}
+	return migrated, err
+}
+
+// validateMigratedBackupURLSchemes logs the migrated backups whose URL scheme doesn't match the type of
+// the configured backup target, see ValidateBackupURLSchemes. Nothing is validated without a backup target.
+func validateMigratedBackupURLSchemes(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, migrated []string) error {
+	if len(migrated) == 0 {
+		return nil
+	}
+	setting, err := upgradeutil.GetSettingFromProvidedCache(namespace, lhClient, resourceMaps, string(types.SettingNameBackupTarget))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if setting.Value == "" {
+		return nil
+	}
+	backupTargetType, err := util.CheckBackupType(setting.Value)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse backup target %v", setting.Value)
+	}
+
 	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
 	if err != nil {
 		return err
 	}
+	backups := map[string]*longhorn.Backup{}
+	for _, name := range migrated {
+		backups[name] = backupMap[name]
+	}
+	if mismatched := ValidateBackupURLSchemes(backups, backupTargetType); len(mismatched) > 0 {
+		logrus.Warnf(upgradeLogPrefix+"%v migrated backups don't match the %v backup target and may be stale or belong to another backup target: %v",
+			len(mismatched), backupTargetType, mismatched)
+	}
+	return nil
+}
 
+// backfillBackupVolumeLabels sets the missing backup volume label of the old backups, otherwise they
+// are skipped by the backup migration. The label is only set if the volume name derived from
+// the backup status, the backup URL and the engine backup status is the same.
+func backfillBackupVolumeLabels(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) (labeled []string, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"backfill backup volume labels failed")
+	}()
+
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
 	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	labeled = []string{}
+	for _, backup := range backupMap {
+		if _, exist := backup.Labels[types.LonghornLabelBackupVolume]; exist {
+			continue
+		}
+		volumeName := deriveBackupVolumeName(backup, engineMap)
+		if volumeName == "" {
+			continue
+		}
+		if backup.Labels == nil {
+			backup.Labels = map[string]string{}
+		}
+		backup.Labels[types.LonghornLabelBackupVolume] = volumeName
+		labeled = append(labeled, backup.Name)
+		logrus.Infof("Backfilled the missing volume label of backup %v with volume %v", backup.Name, volumeName)
+	}
+	sort.Strings(labeled)
+	return labeled, nil
+}
+
+// deriveBackupVolumeName returns the volume name of the backup if all the available sources agree on it.
+func deriveBackupVolumeName(backup *longhorn.Backup, engineMap map[string]*longhorn.Engine) string {
+	candidates := map[string]struct{}{}
+	if backup.Status.VolumeName != "" {
+		candidates[backup.Status.VolumeName] = struct{}{}
+	}
+	if backup.Status.URL != "" {
+		if u, err := url.Parse(backup.Status.URL); err == nil && u.Query().Get("volume") != "" {
+			candidates[u.Query().Get("volume")] = struct{}{}
+		}
 	}
-	volumeNameToEngines := make(map[string][]*longhorn.Engine)
 	for _, e := range engineMap {
-		volumeNameToEngines[e.Labels[types.LonghornLabelVolume]] = append(volumeNameToEngines[e.Labels[types.LonghornLabelVolume]], e)
+		if _, exist := e.Status.BackupStatus[backup.Name]; !exist {
+			continue
+		}
+		volumeName := e.Spec.VolumeName
+		if volumeName == "" {
+			volumeName = e.Labels[types.LonghornLabelVolume]
+		}
+		if volumeName != "" {
+			candidates[volumeName] = struct{}{}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		logrus.Warnf("Failed to derive the volume of backup %v without the volume label", backup.Name)
+		return ""
+	case 1:
+		for volumeName := range candidates {
+			return volumeName
+		}
+	}
+	logrus.Warnf("Cannot backfill the volume label of backup %v since it's ambiguous among volumes %v", backup.Name, candidates)
+	return ""
+}
+
+// MigrateVolumeBackups copies the backup status from the engine CRs to the backup CRs of a single volume
+// and persists them, so that a volume can be fixed without a full upgrade pass.
+// It returns the number of the updated backups.
+func MigrateVolumeBackups(namespace string, lhClient *lhclientset.Clientset, volumeName string) (migrated int, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"migrate backups of volume %v failed", volumeName)
+	}()
+
+	if volumeName == "" {
+		return 0, fmt.Errorf("volume name is required")
+	}
+
+	resourceMaps := map[string]interface{}{}
+	migratedBackups, err := migrateBackupsInProvidedCache(namespace, lhClient, resourceMaps, backupMigrationOptions{volumeName: volumeName})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := upgradeutil.UpdateResources(namespace, lhClient, resourceMaps); err != nil {
+		return 0, err
+	}
+	return len(migratedBackups), nil
+}
+
+// BackupMigrationFilter selects a subset of the backups to migrate, so the backups of a backup
+// target or a group of volumes can be remediated without a full upgrade pass. A backup has to
+// match all the set fields.
+type BackupMigrationFilter struct {
+	// LabelSelector is matched against the labels of the backup CRs, e.g. "backup-volume=vol1"
+	LabelSelector string
+	// VolumeNamePrefix is matched against the volume name of the backups
+	VolumeNamePrefix string
+}
+
+// MigrateFilteredBackups copies the backup status from the engine CRs to the backup CRs matching the
+// filter and persists them. It returns the sorted names of the updated backups.
+func MigrateFilteredBackups(namespace string, lhClient *lhclientset.Clientset, filter BackupMigrationFilter) (migrated []string, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"migrate filtered backups failed")
+	}()
+
+	opts := backupMigrationOptions{volumeNamePrefix: filter.VolumeNamePrefix}
+	if filter.LabelSelector != "" {
+		if opts.selector, err = labels.Parse(filter.LabelSelector); err != nil {
+			return nil, errors.Wrapf(err, "invalid label selector %v", filter.LabelSelector)
+		}
+	}
+	if opts.selector == nil && opts.volumeNamePrefix == "" {
+		return nil, fmt.Errorf("label selector or volume name prefix is required")
+	}
+
+	resourceMaps := map[string]interface{}{}
+	if migrated, err = migrateBackupsInProvidedCache(namespace, lhClient, resourceMaps, opts); err != nil {
+		return nil, err
+	}
+	if err := upgradeutil.UpdateResources(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// FindInconsistentBackupStatuses returns the sorted names of the completed backups whose URL is empty
+// or whose progress is not 100, which indicates an inconsistent copy of the engine backup status.
+// The backups are returned for the operator to review, and nothing is modified.
+func FindInconsistentBackupStatuses(namespace string, lhClient *lhclientset.Clientset) (inconsistent []string, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"find inconsistent backup statuses failed")
+	}()
+
+	return findInconsistentBackupStatusesInProvidedCache(namespace, lhClient, map[string]interface{}{}, false)
+}
+
+// EstimateBackupStatusCleanupSavings returns the approximate number of bytes the engine CRs shrink by
+// once the upgrade clears their backup status, so the etcd relief can be quantified beforehand.
+// Nothing is modified.
+func EstimateBackupStatusCleanupSavings(namespace string, lhClient *lhclientset.Clientset) (savings int64, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"estimate backup status cleanup savings failed")
+	}()
+
+	return estimateBackupStatusCleanupSavingsInProvidedCache(namespace, lhClient, map[string]interface{}{})
+}
+
+func estimateBackupStatusCleanupSavingsInProvidedCache(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) (int64, error) {
+	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return 0, err
+	}
+
+	// The cleared backup status is serialized as null
+	clearedSize := int64(len("null"))
+	savings := int64(0)
+	for _, engine := range engineMap {
+		if len(engine.Status.BackupStatus) == 0 {
+			continue
+		}
+		data, err := json.Marshal(engine.Status.BackupStatus)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to serialize backup status of engine %v", engine.Name)
+		}
+		savings += int64(len(data)) - clearedSize
+	}
+	return savings, nil
+}
+
+// RepairInconsistentBackupStatuses re-derives the missing URL and progress of the inconsistent backups
+// from the engine backup status of their volumes, and persists them. It returns the sorted names of
+// the repaired backups.
+func RepairInconsistentBackupStatuses(namespace string, lhClient *lhclientset.Clientset) (repaired []string, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"repair inconsistent backup statuses failed")
+	}()
+
+	resourceMaps := map[string]interface{}{}
+	repaired, err = findInconsistentBackupStatusesInProvidedCache(namespace, lhClient, resourceMaps, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := upgradeutil.UpdateResources(namespace, lhClient, resourceMaps); err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
+
+// AssertAllBackupsHaveState returns the sorted names of the backups whose state is still empty,
+// which didn't inherit the engine backup status in the migration. An empty result is the go for
+// the operator.
+func AssertAllBackupsHaveState(namespace string, lhClient *lhclientset.Clientset) (stateless []string, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"assert all backups have state failed")
+	}()
+
+	return findBackupsWithoutStateInProvidedCache(namespace, lhClient, map[string]interface{}{})
+}
+
+func findBackupsWithoutStateInProvidedCache(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) ([]string, error) {
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list all existing Longhorn backups")
+	}
+
+	stateless := []string{}
+	for name, backup := range backupMap {
+		if backup.Status.State == "" {
+			stateless = append(stateless, name)
+		}
+	}
+	sort.Strings(stateless)
+	if len(stateless) > 0 {
+		logrus.Warnf(upgradeLogPrefix+"%v backups have no state after the migration: %v", len(stateless), stateless)
 	}
+	return stateless, nil
+}
+
+// AssertNoOrphanedBackups returns the sorted names of the backups whose labeled volume has neither a volume
+// CR nor an engine, so they have lost the correlation to their volume. An empty result confirms the
+// migration didn't orphan any backup.
+func AssertNoOrphanedBackups(namespace string, lhClient *lhclientset.Clientset) (orphaned []string, err error) {
+	defer func() {
+		err = errors.Wrapf(err, upgradeLogPrefix+"assert no orphaned backups failed")
+	}()
 
+	return findOrphanedBackupsInProvidedCache(namespace, lhClient, map[string]interface{}{})
+}
+
+func findOrphanedBackupsInProvidedCache(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) ([]string, error) {
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list all existing Longhorn backups")
+	}
+	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list all existing Longhorn engines")
+	}
 	volumeMap, err := upgradeutil.ListAndUpdateVolumesInProvidedCache(namespace, lhClient, resourceMaps)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "failed to list all existing Longhorn volumes")
 	}
 
-	progressMonitor := upgradeutil.NewProgressMonitor("upgradeBackups", 0, len(backupMap))
-	// Loop all the backup CRs
-	for _, backup := range backupMap {
-		progressMonitor.Inc()
-		// Get volume name from label
-		volumeName, exist := backup.Labels[types.LonghornLabelBackupVolume]
+	engineVolumes := map[string]bool{}
+	for _, e := range engineMap {
+		engineVolumes[e.Spec.VolumeName] = true
+		engineVolumes[e.Labels[types.LonghornLabelVolume]] = true
+	}
+
+	orphaned := []string{}
+	for name, backup := range backupMap {
+		volumeName := backup.Labels[types.LonghornLabelBackupVolume]
+		if volumeName == "" {
+			continue
+		}
+		if _, exist := volumeMap[volumeName]; exist || engineVolumes[volumeName] {
+			continue
+		}
+		orphaned = append(orphaned, name)
+	}
+	sort.Strings(orphaned)
+	if len(orphaned) > 0 {
+		logrus.Warnf(upgradeLogPrefix+"%v backups are orphaned from their volumes after the migration: %v", len(orphaned), orphaned)
+	}
+	return orphaned, nil
+}
+
+func isBackupStatusInconsistent(backup *longhorn.Backup) bool {
+	return backup.Status.State == longhorn.BackupStateCompleted && (backup.Status.URL == "" || backup.Status.Progress < 100)
+}
+
+// findInconsistentBackupStatusesInProvidedCache returns the inconsistent backups in the cache. If repair is
+// set, it re-derives the missing fields from the engines and only returns the repaired backups instead.
+func findInconsistentBackupStatusesInProvidedCache(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, repair bool) ([]string, error) {
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
+
+	var engineMap map[string]*longhorn.Engine
+	var volumeMap map[string]*longhorn.Volume
+	volumeNameToEngines := map[string][]*longhorn.Engine{}
+	if repair {
+		if engineMap, err = upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps); err != nil {
+			return nil, err
+		}
+		volumeNameToEngines = groupEnginesByVolume(engineMap)
+		if volumeMap, err = upgradeutil.ListAndUpdateVolumesInProvidedCache(namespace, lhClient, resourceMaps); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []string{}
+	for name, backup := range backupMap {
+		if !isBackupStatusInconsistent(backup) {
+			continue
+		}
+		if !repair {
+			logrus.Warnf("Backup %v is completed but has URL %q and progress %v, please review it", name, backup.Status.URL, backup.Status.Progress)
+			result = append(result, name)
+			continue
+		}
+
+		volumeName, exist := getBackupVolumeName(backup, engineMap)
 		if !exist {
 			continue
 		}
+		engine := getBackupEngine(volumeNameToEngines[volumeName], volumeMap[volumeName])
+		if engine == nil {
+			continue
+		}
+		backupStatus, exist := engine.Status.BackupStatus[name]
+		if !exist || backupStatus == nil {
+			continue
+		}
+		if backup.Status.URL == "" {
+			backup.Status.URL = backupStatus.BackupURL
+		}
+		if backup.Status.Progress < 100 && backupStatus.Progress == 100 {
+			backup.Status.Progress = backupStatus.Progress
+		}
+		if isBackupStatusInconsistent(backup) {
+			logrus.Warnf("Failed to repair the inconsistent status of backup %v from engine %v", name, engine.Name)
+			continue
+		}
+		logrus.Infof("Repaired the inconsistent status of backup %v from engine %v", name, engine.Name)
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
 
-		engines := volumeNameToEngines[volumeName]
+var (
+	backupMigrationWorkersLock sync.RWMutex
+	backupMigrationWorkers     = runtime.NumCPU()
+)
 
-		// No engine CR found
-		var engine *longhorn.Engine
-		switch len(engines) {
-		case 0:
-			continue
-		case 1:
-			engine = engines[0]
-		default:
-			v, ok := volumeMap[volumeName]
-			if !ok {
-				continue
-			}
+// SetBackupMigrationWorkers sets the number of the volumes whose backups are migrated concurrently. A
+// non-positive number restores the default, which is the number of CPUs.
+func SetBackupMigrationWorkers(workers int) {
+	backupMigrationWorkersLock.Lock()
+	defer backupMigrationWorkersLock.Unlock()
 
-			for _, e := range engines {
-				if e.Spec.NodeID == v.Status.CurrentNodeID &&
-					e.Spec.DesireState == longhorn.InstanceStateRunning &&
-					e.Status.CurrentState == longhorn.InstanceStateRunning {
-					engine = e
-					break
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	backupMigrationWorkers = workers
+}
+
+func getBackupMigrationWorkers() int {
+	backupMigrationWorkersLock.RLock()
+	defer backupMigrationWorkersLock.RUnlock()
+	return backupMigrationWorkers
+}
+
+// backupMigrationOptions selects the backups to migrate.
+type backupMigrationOptions struct {
+	// volumeName limits the migration to the backups of the volume if set
+	volumeName string
+	// volumeNamePrefix limits the migration to the backups of the volumes with the prefix if set
+	volumeNamePrefix string
+	// selector limits the migration to the backups with the matching labels if set
+	selector labels.Selector
+	// startAfter skips the backups whose names are not lexicographically after it if set
+	startAfter string
+	// scope limits the migration to the backups in it if set
+	scope upgradeScope
+	// overall aggregates the migration progress into the whole upgrade progress if set
+	overall *upgradeutil.OverallProgressMonitor
+}
+
+// migrateBackupsInProvidedCache copies the backup status from the engine CRs to the backup CRs in the provided cache.
+// The volumes are handled concurrently by the workers, see SetBackupMigrationWorkers. It returns the sorted names of
+// the updated backups. A backup failed to migrate doesn't stop the others, and the failed backups are returned in a
+// *resourceFailuresError.
+func migrateBackupsInProvidedCache(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, opts backupMigrationOptions) ([]string, error) {
+	// Copy backupStatus from engine CRs to backup CRs
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
+
+	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
+	warnMislabeledEngines(engineMap)
+	volumeNameToEngines := groupEnginesByVolume(engineMap)
+
+	volumeMap, err := upgradeutil.ListAndUpdateVolumesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
+	}
+	warnMissingBackupMigrationSource(len(backupMap), len(engineMap), len(volumeMap))
+
+	backupNames := make([]string, 0, len(backupMap))
+	for name := range backupMap {
+		backupNames = append(backupNames, name)
+	}
+	sort.Strings(backupNames)
+
+	progressMonitor := opts.overall.NewProgressMonitor("upgradeBackups", 0, len(backupMap))
+	// Group the backups by the volume, so the volumes are migrated concurrently while each backup
+	// is only touched by the worker of its volume
+	volumeBackups := map[string][]*longhorn.Backup{}
+	for _, backupName := range backupNames {
+		backup := backupMap[backupName]
+		backupVolumeName, exist := getBackupVolumeName(backup, engineMap)
+		switch {
+		case opts.startAfter != "" && backupName <= opts.startAfter,
+			!opts.scope.includes(backupName),
+			opts.selector != nil && !opts.selector.Matches(labels.Set(backup.Labels)),
+			!exist,
+			opts.volumeName != "" && backupVolumeName != opts.volumeName,
+			!strings.HasPrefix(backupVolumeName, opts.volumeNamePrefix):
+			progressMonitor.Inc()
+			continue
+		}
+		volumeBackups[backupVolumeName] = append(volumeBackups[backupVolumeName], backup)
+	}
+
+	volumeNames := make(chan string, len(volumeBackups))
+	for volumeName := range volumeBackups {
+		volumeNames <- volumeName
+	}
+	close(volumeNames)
+
+	var lock sync.Mutex
+	migrated := []string{}
+	failed := newResourceFailuresError("upgradeBackups")
+	var wg sync.WaitGroup
+	for i := 0; i < getBackupMigrationWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for volumeName := range volumeNames {
+				volumeMigrated, volumeFailed := migrateVolumeBackupStatus(volumeBackups[volumeName],
+					volumeNameToEngines[volumeName], volumeMap[volumeName], progressMonitor)
+
+				lock.Lock()
+				migrated = append(migrated, volumeMigrated...)
+				for name, err := range volumeFailed {
+					failed.add(name, err)
 				}
+				lock.Unlock()
 			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(migrated)
+	if len(failed.errs) > 0 {
+		return migrated, failed
+	}
+	return migrated, nil
+}
+
+// migrateVolumeBackupStatus copies the backup status from the engine of the volume to its backups.
+// It returns the names of the updated backups and the errors of the failed ones.
+func migrateVolumeBackupStatus(backups []*longhorn.Backup, engines []*longhorn.Engine, v *longhorn.Volume, progressMonitor *upgradeutil.ProgressMonitor) (migrated []string, failed map[string]error) {
+	failed = map[string]error{}
+	engine := getBackupEngine(engines, v)
+	for _, backup := range backups {
+		progressMonitor.Inc()
+		if engine == nil {
+			continue
 		}
 
 		// No corresponding backupStatus inside engine CR
@@ -90,68 +901,287 @@ func upgradeBackups(namespace string, lhClient *lhclientset.Clientset, resourceM
 		if !exist {
 			continue
 		}
+		if backupStatus == nil {
+			failed[backup.Name] = errors.Wrapf(fmt.Errorf("engine %v has a nil backup status", engine.Name), "failed to migrate backup %v", backup.Name)
+			continue
+		}
+
+		oldStatus := backup.Status.DeepCopy()
+		copyEngineBackupStatus(backup, backupStatus)
+		if !reflect.DeepEqual(*oldStatus, backup.Status) {
+			migrated = append(migrated, backup.Name)
+		}
+	}
+	return migrated, failed
+}
+
+// ValidateBackupURLSchemes returns the sorted names of the backups whose migrated URL scheme
+// doesn't match the backup target type (e.g. s3 or nfs). These backups are stale or belong to
+// another backup target, so they are logged for the operator to review.
+func ValidateBackupURLSchemes(backups map[string]*longhorn.Backup, backupTargetType string) []string {
+	mismatched := []string{}
+	for name, backup := range backups {
+		if backup.Status.URL == "" {
+			continue
+		}
+		scheme, err := util.CheckBackupType(backup.Status.URL)
+		if err != nil {
+			logrus.Warnf("Failed to parse the URL %v of backup %v: %v", backup.Status.URL, name, err)
+			mismatched = append(mismatched, name)
+			continue
+		}
+		if scheme != backupTargetType {
+			logrus.Warnf("The URL scheme %v of backup %v doesn't match the backup target type %v, please review it", scheme, name, backupTargetType)
+			mismatched = append(mismatched, name)
+		}
+	}
+	sort.Strings(mismatched)
+	return mismatched
+}
+
+// warnMissingBackupMigrationSource warns the operators if there are backups but no engines and volumes
+// at all, e.g. after a disaster, since the backup status cannot be migrated without the engines.
+func warnMissingBackupMigrationSource(backupCount, engineCount, volumeCount int) {
+	if backupCount == 0 || engineCount != 0 || volumeCount != 0 {
+		return
+	}
+	logrus.Warnf(upgradeLogPrefix+"found %v backups but no engines or volumes, the backup status cannot be migrated due to the missing source data", backupCount)
+}
+
+// getBackupVolumeName correlates the backup with its volume. The owner references of the backup
+// to the volume or the engine are preferred over the label, which can be stale. A discrepancy
+// between them is logged.
+func getBackupVolumeName(backup *longhorn.Backup, engineMap map[string]*longhorn.Engine) (string, bool) {
+	labelVolumeName, labelExist := backup.Labels[types.LonghornLabelBackupVolume]
+
+	ownerVolumeName := ""
+	for _, ref := range backup.OwnerReferences {
+		switch ref.Kind {
+		case types.LonghornKindVolume:
+			ownerVolumeName = ref.Name
+		case types.LonghornKindEngine:
+			if e, exist := engineMap[ref.Name]; exist {
+				ownerVolumeName = e.Spec.VolumeName
+			}
+		}
+		if ownerVolumeName != "" {
+			break
+		}
+	}
+
+	if ownerVolumeName == "" {
+		return labelVolumeName, labelExist
+	}
+	if labelExist && labelVolumeName != ownerVolumeName {
+		logrus.Warnf("Backup %v is labeled with volume %v but owned by volume %v, will use the owner", backup.Name, labelVolumeName, ownerVolumeName)
+	}
+	return ownerVolumeName, true
+}
 
-		backup.Status.Progress = backupStatus.Progress
-		backup.Status.URL = backupStatus.BackupURL
-		backup.Status.Error = backupStatus.Error
-		backup.Status.SnapshotName = backupStatus.SnapshotName
-		backup.Status.State = engineapi.ConvertEngineBackupState(backupStatus.State)
-		backup.Status.ReplicaAddress = backupStatus.ReplicaAddress
+// getBackupEngine returns the engine holding the backup status of the volume.
+// The running engine on the volume node is chosen if the volume has multiple engines.
+func getBackupEngine(engines []*longhorn.Engine, v *longhorn.Volume) *longhorn.Engine {
+	switch len(engines) {
+	case 0:
+		// No engine CR found
+		return nil
+	case 1:
+		return engines[0]
+	}
+
+	if v == nil {
+		return nil
+	}
+	for _, e := range engines {
+		if e.Spec.NodeID == v.Status.CurrentNodeID &&
+			e.Spec.DesireState == longhorn.InstanceStateRunning &&
+			e.Status.CurrentState == longhorn.InstanceStateRunning {
+			return e
+		}
 	}
 	return nil
 }
 
-func upgradeEngines(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) (err error) {
+func copyEngineBackupStatus(backup *longhorn.Backup, backupStatus *longhorn.EngineBackupStatus) {
+	backup.Status.Progress = backupStatus.Progress
+	backup.Status.URL = backupStatus.BackupURL
+	backup.Status.Error = backupStatus.Error
+	backup.Status.SnapshotName = getBackupSnapshotName(backup, backupStatus)
+	backup.Status.State = engineapi.ConvertEngineBackupState(backupStatus.State)
+	backup.Status.ReplicaAddress = backupStatus.ReplicaAddress
+}
+
+// getBackupSnapshotName avoids overwriting the snapshot name with an empty value, which breaks
+// the snapshot correlation later. The name is recovered from the backup CR itself if possible.
+func getBackupSnapshotName(backup *longhorn.Backup, backupStatus *longhorn.EngineBackupStatus) string {
+	if backupStatus.SnapshotName != "" {
+		return backupStatus.SnapshotName
+	}
+	if backup.Spec.SnapshotName != "" {
+		logrus.Infof("Recovered the empty snapshot name of backup %v from its spec", backup.Name)
+		return backup.Spec.SnapshotName
+	}
+	if backup.Status.SnapshotName != "" {
+		logrus.Infof("Kept the existing snapshot name of backup %v since the engine backup status has an empty one", backup.Name)
+		return backup.Status.SnapshotName
+	}
+	logrus.Warnf("Failed to recover the empty snapshot name of backup %v during upgrade", backup.Name)
+	return ""
+}
+
+// upgradeEngines upgrades the engines, and records the engines and volumes failed to be upgraded in
+// failures, which holds the backups failed to be migrated already.
+func upgradeEngines(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, failures FailureManifest, durations StepDurations, overall *upgradeutil.OverallProgressMonitor) (modified ModifiedResources, activeChanges []EngineActiveChange, err error) {
 	defer func() {
 		err = errors.Wrapf(err, upgradeLogPrefix+"upgrade engines failed")
 	}()
 
 	// Do the field update separately to avoid messing up.
+	modified = ModifiedResources{}
 
-	if err := checkAndRemoveEngineBackupStatus(namespace, lhClient, resourceMaps); err != nil {
-		return err
+	done := durations.track("checkAndRemoveEngineBackupStatus")
+	removed, err := checkAndRemoveEngineBackupStatus(namespace, lhClient, resourceMaps, failures["upgradeBackups"], nil, overall)
+	done()
+	if err := failures.collect(err); err != nil {
+		return nil, nil, err
 	}
+	modified.add("checkAndRemoveEngineBackupStatus", removed)
 
-	if err := checkAndUpdateEngineActiveState(namespace, lhClient, resourceMaps); err != nil {
-		return err
+	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, nil, err
 	}
+	before := getEngineActiveStates(engineMap)
+	done = durations.track("checkAndUpdateEngineActiveState")
+	activated, err := checkAndUpdateEngineActiveState(namespace, lhClient, resourceMaps, nil, overall)
+	done()
+	if err := failures.collect(err); err != nil {
+		return nil, nil, err
+	}
+	modified.add("checkAndUpdateEngineActiveState", activated)
+	activeChanges = diffEngineActiveStates(engineMap, before, getEngineActiveStates(engineMap))
 
-	return nil
+	return modified, activeChanges, nil
+}
+
+func getEngineActiveStates(engineMap map[string]*longhorn.Engine) map[string]bool {
+	states := map[string]bool{}
+	for name, e := range engineMap {
+		states[name] = e.Spec.Active
+	}
+	return states
 }
 
-func checkAndRemoveEngineBackupStatus(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) error {
+// diffEngineActiveStates returns the changes between the engine active flags captured before and
+// after, sorted by the engine name. The engines whose flag is unchanged are left out.
+func diffEngineActiveStates(engineMap map[string]*longhorn.Engine, before, after map[string]bool) []EngineActiveChange {
+	changes := []EngineActiveChange{}
+	for name, newActive := range after {
+		oldActive, exist := before[name]
+		if !exist || oldActive == newActive {
+			continue
+		}
+		change := EngineActiveChange{
+			EngineName: name,
+			OldActive:  oldActive,
+			NewActive:  newActive,
+		}
+		if e, exist := engineMap[name]; exist {
+			change.VolumeName = e.Spec.VolumeName
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].EngineName < changes[j].EngineName
+	})
+	return changes
+}
+
+// checkAndRemoveEngineBackupStatus clears the backup status of the engines in the scope. The engines
+// holding the status of the backups failed to be migrated are kept for the retry, and returned in a
+// *resourceFailuresError.
+func checkAndRemoveEngineBackupStatus(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, failedBackups []string, scope upgradeScope, overall *upgradeutil.OverallProgressMonitor) ([]string, error) {
 	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	backupMap, err := upgradeutil.ListAndUpdateBackupsInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
 	}
 
-	progressMonitor := upgradeutil.NewProgressMonitor("checkAndRemoveEngineBackupStatus", 0, len(engineMap))
+	removed := []string{}
+	failed := newResourceFailuresError("checkAndRemoveEngineBackupStatus")
+	progressMonitor := overall.NewProgressMonitor("checkAndRemoveEngineBackupStatus", 0, len(engineMap))
 	for _, engine := range engineMap {
 		progressMonitor.Inc()
+		if !scope.includes(engine.Name) {
+			continue
+		}
+		if kept := findEngineBackupStatuses(engine, failedBackups); len(kept) > 0 {
+			failed.add(engine.Name, fmt.Errorf("kept the backup status of engine %v since backups %v failed to migrate", engine.Name, kept))
+			continue
+		}
+		if dangling := findDanglingEngineBackupStatuses(engine, backupMap); len(dangling) > 0 {
+			logrus.Warnf(upgradeLogPrefix+"engine %v has the backup status of the nonexistent backups %v, which is dropped along with the engine backup status", engine.Name, dangling)
+		}
+		if engine.Status.BackupStatus != nil {
+			removed = append(removed, engine.Name)
+		}
 		engine.Status.BackupStatus = nil
 	}
 
-	return nil
+	if len(failed.errs) > 0 {
+		return removed, failed
+	}
+	return removed, nil
 }
 
-func checkAndUpdateEngineActiveState(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}) error {
-	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
-	if err != nil {
-		return err
+// findEngineBackupStatuses returns the sorted names of the backups whose status is held by the engine.
+func findEngineBackupStatuses(engine *longhorn.Engine, backupNames []string) []string {
+	found := []string{}
+	for _, name := range backupNames {
+		if _, exist := engine.Status.BackupStatus[name]; exist {
+			found = append(found, name)
+		}
 	}
+	sort.Strings(found)
+	return found
+}
 
-	volumeEngineMap := map[string][]*longhorn.Engine{}
-	for _, e := range engineMap {
-		if e.Spec.VolumeName == "" {
-			// Cannot do anything in the upgrade path if there is really an orphan engine CR.
-			continue
+// findDanglingEngineBackupStatuses returns the sorted names of the backups in the engine backup status
+// without a backup CR, whose status has nowhere to be migrated to.
+func findDanglingEngineBackupStatuses(engine *longhorn.Engine, backupMap map[string]*longhorn.Backup) []string {
+	dangling := []string{}
+	for name := range engine.Status.BackupStatus {
+		if _, exist := backupMap[name]; !exist {
+			dangling = append(dangling, name)
 		}
-		volumeEngineMap[e.Spec.VolumeName] = append(volumeEngineMap[e.Spec.VolumeName], e)
+	}
+	sort.Strings(dangling)
+	return dangling
+}
+
+// checkAndUpdateEngineActiveState sets the current engine of each volume in the scope active if none
+// is, and returns the names of the engines set active. The volumes failed to be checked are returned
+// in a *resourceFailuresError.
+func checkAndUpdateEngineActiveState(namespace string, lhClient *lhclientset.Clientset, resourceMaps map[string]interface{}, scope upgradeScope, overall *upgradeutil.OverallProgressMonitor) ([]string, error) {
+	engineMap, err := upgradeutil.ListAndUpdateEnginesInProvidedCache(namespace, lhClient, resourceMaps)
+	if err != nil {
+		return nil, err
 	}
 
-	progressMonitor := upgradeutil.NewProgressMonitor("checkAndUpdateEngineActiveState", 0, len(volumeEngineMap))
+	activated := []string{}
+	failed := newResourceFailuresError("checkAndUpdateEngineActiveState")
+
+	volumeEngineMap := groupEnginesByVolume(engineMap)
+	progressMonitor := overall.NewProgressMonitor("checkAndUpdateEngineActiveState", 0, len(volumeEngineMap))
 	for volumeName, engineList := range volumeEngineMap {
 		progressMonitor.Inc()
+		if !scope.includes(volumeName) {
+			continue
+		}
+		// Only fix up the engines if needed, so an already correct engine is left untouched.
 		skip := false
 		for _, e := range engineList {
 			if e.Spec.Active {
@@ -163,29 +1193,118 @@ func checkAndUpdateEngineActiveState(namespace string, lhClient *lhclientset.Cli
 			continue
 		}
 
-		var currentEngine *longhorn.Engine
-		if len(engineList) == 1 {
-			currentEngine = engineList[0]
-		} else {
-			v, err := upgradeutil.GetVolumeFromProvidedCache(namespace, lhClient, resourceMaps, volumeName)
-			if err != nil {
-				return err
+		v, err := upgradeutil.GetVolumeFromProvidedCache(namespace, lhClient, resourceMaps, volumeName)
+		if err != nil {
+			// The sole engine doesn't need the volume to be picked
+			if len(engineList) != 1 || !apierrors.IsNotFound(err) {
+				failed.add(volumeName, errors.Wrapf(err, "failed to get volume %v of engines %v", volumeName, engineNames(engineList)))
+				continue
 			}
-			for i := range engineList {
-				if (v.Spec.NodeID != "" && v.Spec.NodeID == engineList[i].Spec.NodeID) ||
-					(v.Status.CurrentNodeID != "" && v.Status.CurrentNodeID == engineList[i].Spec.NodeID) ||
-					(v.Status.PendingNodeID != "" && v.Status.PendingNodeID == engineList[i].Spec.NodeID) {
-					currentEngine = engineList[i]
-					break
-				}
+		}
+		if v != nil && v.DeletionTimestamp != nil {
+			logrus.Infof("Volume %v is being deleted, will not set any engine active for it during upgrade", volumeName)
+			continue
+		}
+		if len(engineList) == 1 {
+			engineList[0].Spec.Active = true
+			activated = append(activated, engineList[0].Name)
+			continue
+		}
+
+		var currentEngine *longhorn.Engine
+		for i := range engineList {
+			if (v.Spec.NodeID != "" && v.Spec.NodeID == engineList[i].Spec.NodeID) ||
+				(v.Status.CurrentNodeID != "" && v.Status.CurrentNodeID == engineList[i].Spec.NodeID) ||
+				(v.Status.PendingNodeID != "" && v.Status.PendingNodeID == engineList[i].Spec.NodeID) {
+				currentEngine = engineList[i]
+				break
 			}
 		}
+		if currentEngine == nil && v.Spec.NodeID == "" && v.Status.CurrentNodeID == "" && v.Status.PendingNodeID == "" {
+			currentEngine = pickDetachedVolumeEngine(v, engineList)
+			logrus.Infof("Volume %v is detached, set engine %v of engines %v active by the detached volume heuristic during upgrade",
+				volumeName, currentEngine.Name, engineNames(engineList))
+		}
 		if currentEngine == nil {
 			logrus.Errorf("Failed to get the current engine for volume %v during upgrade, will ignore it and continue", volumeName)
 			continue
 		}
 		currentEngine.Spec.Active = true
+		activated = append(activated, currentEngine.Name)
 	}
 
-	return nil
+	sort.Strings(activated)
+	if len(failed.errs) > 0 {
+		return activated, failed
+	}
+	return activated, nil
+}
+
+// pickDetachedVolumeEngine deterministically picks the engine of a detached volume, which has no
+// node to match the engines against. The engines with the engine image of the volume are preferred,
+// then the most recently created one, then the lowest name.
+func pickDetachedVolumeEngine(v *longhorn.Volume, engines []*longhorn.Engine) *longhorn.Engine {
+	candidates := []*longhorn.Engine{}
+	for _, e := range engines {
+		if v.Spec.EngineImage != "" && e.Spec.EngineImage == v.Spec.EngineImage {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = engines
+	}
+
+	picked := candidates[0]
+	for _, e := range candidates[1:] {
+		switch {
+		case e.CreationTimestamp.After(picked.CreationTimestamp.Time):
+			picked = e
+		case e.CreationTimestamp.Equal(&picked.CreationTimestamp) && e.Name < picked.Name:
+			picked = e
+		}
+	}
+	return picked
+}
+
+// warnMislabeledEngines logs the engines whose volume label disagrees with the volume in the spec,
+// which are indexed by the spec, and the engines without the volume in the spec, which are skipped.
+// It returns the sorted names of the mislabeled engines.
+func warnMislabeledEngines(engineMap map[string]*longhorn.Engine) []string {
+	mislabeled := []string{}
+	for _, e := range engineMap {
+		labelVolumeName := e.Labels[types.LonghornLabelVolume]
+		if e.Spec.VolumeName == "" {
+			logrus.Errorf(upgradeLogPrefix+"engine %v labeled with volume %v has no volume in spec, it's skipped", e.Name, labelVolumeName)
+			continue
+		}
+		if labelVolumeName != "" && labelVolumeName != e.Spec.VolumeName {
+			logrus.Warnf(upgradeLogPrefix+"engine %v is labeled with volume %v but belongs to volume %v in spec, will use the spec", e.Name, labelVolumeName, e.Spec.VolumeName)
+			mislabeled = append(mislabeled, e.Name)
+		}
+	}
+	sort.Strings(mislabeled)
+	return mislabeled
+}
+
+// groupEnginesByVolume groups the engines by the volume in the spec rather than the volume label,
+// which may be corrupted.
+func groupEnginesByVolume(engineMap map[string]*longhorn.Engine) map[string][]*longhorn.Engine {
+	volumeEngineMap := map[string][]*longhorn.Engine{}
+	for _, e := range engineMap {
+		if e.Spec.VolumeName == "" {
+			// Cannot do anything in the upgrade path if there is really an orphan engine CR.
+			continue
+		}
+		volumeEngineMap[e.Spec.VolumeName] = append(volumeEngineMap[e.Spec.VolumeName], e)
+	}
+	return volumeEngineMap
+}
+
+func engineNames(engines []*longhorn.Engine) []string {
+	names := make([]string, 0, len(engines))
+	for _, e := range engines {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,1172 @@
+package v122to123
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+
+	longhorn "github.com/longhorn/longhorn-manager/k8s/pkg/apis/longhorn/v1beta2"
+	lhclientset "github.com/longhorn/longhorn-manager/k8s/pkg/client/clientset/versioned"
+	"github.com/longhorn/longhorn-manager/types"
+	"github.com/longhorn/longhorn-manager/util"
+)
+
+const testNamespace = "longhorn-system"
+
+// newTestResourceMaps returns the resource cache prepopulated with the provided resources,
+// so the upgrade functions never need to list them via the client.
+func newTestResourceMaps(backups []*longhorn.Backup, engines []*longhorn.Engine, volumes []*longhorn.Volume) map[string]interface{} {
+	backupMap := map[string]*longhorn.Backup{}
+	for _, b := range backups {
+		backupMap[b.Name] = b
+	}
+	engineMap := map[string]*longhorn.Engine{}
+	for _, e := range engines {
+		engineMap[e.Name] = e
+	}
+	volumeMap := map[string]*longhorn.Volume{}
+	for _, v := range volumes {
+		volumeMap[v.Name] = v
+	}
+	return map[string]interface{}{
+		types.LonghornKindBackup:  backupMap,
+		types.LonghornKindEngine:  engineMap,
+		types.LonghornKindVolume:  volumeMap,
+		types.LonghornKindSetting: map[string]*longhorn.Setting{},
+	}
+}
+
+func newTestBackup(name, volumeName string) *longhorn.Backup {
+	b := &longhorn.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{},
+		},
+	}
+	if volumeName != "" {
+		b.Labels[types.LonghornLabelBackupVolume] = volumeName
+	}
+	return b
+}
+
+func newTestEngine(name, volumeName, nodeID string) *longhorn.Engine {
+	e := &longhorn.Engine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				types.LonghornLabelVolume: volumeName,
+			},
+		},
+	}
+	e.Spec.VolumeName = volumeName
+	e.Spec.NodeID = nodeID
+	e.Status.BackupStatus = map[string]*longhorn.EngineBackupStatus{}
+	return e
+}
+
+func newTestVolume(name, currentNodeID string) *longhorn.Volume {
+	v := &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+	v.Status.CurrentNodeID = currentNodeID
+	return v
+}
+
+func TestUpgradeBackupsSnapshotName(t *testing.T) {
+	normal := newTestBackup("backup-normal", "vol")
+	recovered := newTestBackup("backup-recovered", "vol")
+	recovered.Spec.SnapshotName = "snap-from-spec"
+
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[normal.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		BackupURL:    "s3://backupbucket@us-east-1/?backup=backup-normal&volume=vol",
+		SnapshotName: "snap-normal",
+		State:        "complete",
+	}
+	engine.Status.BackupStatus[recovered.Name] = &longhorn.EngineBackupStatus{
+		Progress: 100,
+		State:    "complete",
+	}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{normal, recovered}, []*longhorn.Engine{engine}, nil)
+	if _, err := upgradeBackups(testNamespace, nil, resourceMaps, "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if normal.Status.SnapshotName != "snap-normal" {
+		t.Fatalf("normal backup snapshot name = %v, expected = snap-normal", normal.Status.SnapshotName)
+	}
+	if normal.Status.State != longhorn.BackupStateCompleted {
+		t.Fatalf("normal backup state = %v, expected = %v", normal.Status.State, longhorn.BackupStateCompleted)
+	}
+	if recovered.Status.SnapshotName != "snap-from-spec" {
+		t.Fatalf("recovered backup snapshot name = %v, expected = snap-from-spec", recovered.Status.SnapshotName)
+	}
+}
+
+func TestMigrateVolumeBackups(t *testing.T) {
+	target := newTestBackup("backup-target", "vol1")
+	unchanged := newTestBackup("backup-unchanged", "vol1")
+	other := newTestBackup("backup-other", "vol2")
+
+	engine1 := newTestEngine("vol1-e-0", "vol1", "node-1")
+	engine1.Status.BackupStatus[target.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		SnapshotName: "snap-1",
+		State:        "complete",
+	}
+	engine2 := newTestEngine("vol2-e-0", "vol2", "node-1")
+	engine2.Status.BackupStatus[other.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		SnapshotName: "snap-2",
+		State:        "complete",
+	}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{target, unchanged, other}, []*longhorn.Engine{engine1, engine2}, nil)
+	migrated, err := migrateBackupsInProvidedCache(testNamespace, nil, resourceMaps, backupMigrationOptions{volumeName: "vol1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrated) != 1 || migrated[0] != target.Name {
+		t.Fatalf("migrated = %v, expected = [%v]", migrated, target.Name)
+	}
+	if target.Status.SnapshotName != "snap-1" {
+		t.Fatalf("target backup snapshot name = %v, expected = snap-1", target.Status.SnapshotName)
+	}
+	if other.Status.SnapshotName != "" {
+		t.Fatalf("backup of the other volume is unexpectedly migrated")
+	}
+
+	// Migrating again updates nothing
+	if migrated, err = migrateBackupsInProvidedCache(testNamespace, nil, resourceMaps, backupMigrationOptions{volumeName: "vol1"}); err != nil || len(migrated) != 0 {
+		t.Fatalf("migrated = %v, err = %v, expected nothing migrated again", migrated, err)
+	}
+}
+
+func TestMigrateFilteredBackups(t *testing.T) {
+	selector, err := labels.Parse("backup-target=s3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testCases := map[string]struct {
+		opts     backupMigrationOptions
+		expected []string
+	}{
+		"volume name prefix": {
+			opts:     backupMigrationOptions{volumeNamePrefix: "pvc-a"},
+			expected: []string{"backup-1", "backup-2"},
+		},
+		"label selector": {
+			opts:     backupMigrationOptions{selector: selector},
+			expected: []string{"backup-1", "backup-3"},
+		},
+		"label selector and volume name prefix": {
+			opts:     backupMigrationOptions{selector: selector, volumeNamePrefix: "pvc-a"},
+			expected: []string{"backup-1"},
+		},
+		"no match": {
+			opts:     backupMigrationOptions{volumeNamePrefix: "pvc-c"},
+			expected: []string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		backups := []*longhorn.Backup{
+			newTestBackup("backup-1", "pvc-a1"),
+			newTestBackup("backup-2", "pvc-a2"),
+			newTestBackup("backup-3", "pvc-b1"),
+		}
+		backups[0].Labels["backup-target"] = "s3"
+		backups[2].Labels["backup-target"] = "s3"
+
+		var engines []*longhorn.Engine
+		for _, b := range backups {
+			volumeName := b.Labels[types.LonghornLabelBackupVolume]
+			e := newTestEngine(volumeName+"-e-0", volumeName, "node-1")
+			e.Status.BackupStatus[b.Name] = &longhorn.EngineBackupStatus{Progress: 100, SnapshotName: "snap-" + b.Name, State: "complete"}
+			engines = append(engines, e)
+		}
+
+		resourceMaps := newTestResourceMaps(backups, engines, nil)
+		migrated, err := migrateBackupsInProvidedCache(testNamespace, nil, resourceMaps, tc.opts)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(migrated, tc.expected) {
+			t.Fatalf("%v: migrated = %v, expected = %v", name, migrated, tc.expected)
+		}
+		for _, b := range backups {
+			touched := b.Status.SnapshotName != ""
+			if touched != util.Contains(tc.expected, b.Name) {
+				t.Fatalf("%v: backup %v touched = %v, expected the matching backups only", name, b.Name, touched)
+			}
+		}
+	}
+}
+
+func TestCheckAndRemoveEngineBackupStatusDangling(t *testing.T) {
+	backup := newTestBackup("backup-1", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[backup.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	engine.Status.BackupStatus["backup-deleted"] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{backup}, []*longhorn.Engine{engine}, nil)
+	backupMap := resourceMaps[types.LonghornKindBackup].(map[string]*longhorn.Backup)
+	if dangling := findDanglingEngineBackupStatuses(engine, backupMap); !reflect.DeepEqual(dangling, []string{"backup-deleted"}) {
+		t.Fatalf("dangling = %v, expected [backup-deleted]", dangling)
+	}
+
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	removed, err := checkAndRemoveEngineBackupStatus(testNamespace, nil, resourceMaps, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{engine.Name}) || engine.Status.BackupStatus != nil {
+		t.Fatalf("removed = %v, backup status = %v, expected the engine backup status cleared", removed, engine.Status.BackupStatus)
+	}
+	if output := buf.String(); !strings.Contains(output, "backup-deleted") || strings.Contains(output, "backup-1]") {
+		t.Fatalf("expected a warning about the dangling backup status only, got %q", output)
+	}
+}
+
+func TestEstimateBackupStatusCleanupSavings(t *testing.T) {
+	empty := newTestEngine("vol1-e-0", "vol1", "node-1")
+	cleared := newTestEngine("vol2-e-0", "vol2", "node-1")
+	cleared.Status.BackupStatus = nil
+	single := newTestEngine("vol3-e-0", "vol3", "node-1")
+	single.Status.BackupStatus["backup-1"] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	multiple := newTestEngine("vol4-e-0", "vol4", "node-1")
+	multiple.Status.BackupStatus["backup-2"] = &longhorn.EngineBackupStatus{Progress: 100, SnapshotName: "snap-2", State: "complete"}
+	multiple.Status.BackupStatus["backup-3"] = &longhorn.EngineBackupStatus{Progress: 50, Error: "timeout", State: "error"}
+
+	singleStatus := `{"backup-1":{"progress":100,"snapshotName":"","state":"complete","replicaAddress":""}}`
+	multipleStatus := `{"backup-2":{"progress":100,"snapshotName":"snap-2","state":"complete","replicaAddress":""},` +
+		`"backup-3":{"progress":50,"error":"timeout","snapshotName":"","state":"error","replicaAddress":""}}`
+	// Each non-empty backup status is replaced by null, and the empty ones are not counted
+	expected := int64(len(singleStatus) + len(multipleStatus) - 2*len("null"))
+
+	resourceMaps := newTestResourceMaps(nil, []*longhorn.Engine{empty, cleared, single, multiple}, nil)
+	savings, err := estimateBackupStatusCleanupSavingsInProvidedCache(testNamespace, nil, resourceMaps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if savings != expected || savings <= 0 {
+		t.Fatalf("savings = %v, expected %v", savings, expected)
+	}
+	if single.Status.BackupStatus == nil || len(multiple.Status.BackupStatus) != 2 {
+		t.Fatalf("engine backup status is unexpectedly modified")
+	}
+}
+
+func TestValidateResourceMaps(t *testing.T) {
+	wellFormed := newTestResourceMaps([]*longhorn.Backup{newTestBackup("backup", "vol")}, []*longhorn.Engine{newTestEngine("vol-e-0", "vol", "node-1")}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+	if err := ValidateResourceMaps(wellFormed); err != nil {
+		t.Fatalf("unexpected error for well-formed resource maps: %v", err)
+	}
+
+	missing := newTestResourceMaps(nil, nil, nil)
+	delete(missing, types.LonghornKindVolume)
+	if err := ValidateResourceMaps(missing); err == nil {
+		t.Fatalf("expected an error for missing volumes")
+	}
+	if err := validateResourceMaps(missing, false); err != nil {
+		t.Fatalf("unexpected error for partially cached resource maps: %v", err)
+	}
+
+	wrongType := newTestResourceMaps(nil, nil, nil)
+	wrongType[types.LonghornKindEngine] = map[string]*longhorn.Volume{}
+	if err := ValidateResourceMaps(wrongType); err == nil {
+		t.Fatalf("expected an error for mis-typed engines")
+	}
+
+	nilPointer := newTestResourceMaps(nil, nil, nil)
+	nilPointer[types.LonghornKindBackup].(map[string]*longhorn.Backup)["backup"] = nil
+	if err := ValidateResourceMaps(nilPointer); err == nil {
+		t.Fatalf("expected an error for nil backup")
+	}
+}
+
+func TestCheckAndUpdateEngineActiveStateTerminatingVolume(t *testing.T) {
+	e1 := newTestEngine("vol-e-0", "vol", "node-1")
+	e2 := newTestEngine("vol-e-1", "vol", "node-2")
+	v := newTestVolume("vol", "node-1")
+	now := metav1.Now()
+	v.DeletionTimestamp = &now
+
+	resourceMaps := newTestResourceMaps(nil, []*longhorn.Engine{e1, e2}, []*longhorn.Volume{v})
+	if _, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e1.Spec.Active || e2.Spec.Active {
+		t.Fatalf("expected no active engine for the terminating volume")
+	}
+
+	v.DeletionTimestamp = nil
+	if _, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !e1.Spec.Active || e2.Spec.Active {
+		t.Fatalf("expected engine on the volume node to be active")
+	}
+
+	// The sole engine of a terminating volume is not set active either
+	single := newTestEngine("single-e-0", "single", "node-1")
+	singleVolume := newTestVolume("single", "node-1")
+	singleVolume.DeletionTimestamp = &now
+	resourceMaps = newTestResourceMaps(nil, []*longhorn.Engine{single}, []*longhorn.Volume{singleVolume})
+	if _, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if single.Spec.Active {
+		t.Fatalf("expected the sole engine of the terminating volume not to be active")
+	}
+
+	singleVolume.DeletionTimestamp = nil
+	if _, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !single.Spec.Active {
+		t.Fatalf("expected the sole engine to be active")
+	}
+}
+
+func TestCheckAndUpdateEngineActiveStateSingleEngine(t *testing.T) {
+	active := newTestEngine("vol-1-e-0", "vol-1", "node-1")
+	active.Spec.Active = true
+	inactive := newTestEngine("vol-2-e-0", "vol-2", "node-1")
+	expectedActive := active.DeepCopy()
+
+	resourceMaps := newTestResourceMaps(nil, []*longhorn.Engine{active, inactive}, nil)
+	if _, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(active, expectedActive) {
+		t.Fatalf("expected the already active engine to be untouched, got %+v", active.Spec)
+	}
+	if !inactive.Spec.Active {
+		t.Fatalf("expected the sole inactive engine to be set active")
+	}
+}
+
+func TestCheckAndUpdateEngineActiveStateDetachedVolume(t *testing.T) {
+	for name, tc := range map[string]struct {
+		volumeImage    string
+		engineImages   map[string]string
+		expectedActive string
+	}{
+		"lowest name": {
+			expectedActive: "vol-e-0",
+		},
+		"volume engine image": {
+			volumeImage:    "longhornio/longhorn-engine:v1.2.3",
+			engineImages:   map[string]string{"vol-e-0": "longhornio/longhorn-engine:v1.2.2", "vol-e-1": "longhornio/longhorn-engine:v1.2.3"},
+			expectedActive: "vol-e-1",
+		},
+	} {
+		e1 := newTestEngine("vol-e-1", "vol", "")
+		e0 := newTestEngine("vol-e-0", "vol", "")
+		e1.Spec.EngineImage = tc.engineImages[e1.Name]
+		e0.Spec.EngineImage = tc.engineImages[e0.Name]
+		v := newTestVolume("vol", "")
+		v.Spec.EngineImage = tc.volumeImage
+
+		resourceMaps := newTestResourceMaps(nil, []*longhorn.Engine{e1, e0}, []*longhorn.Volume{v})
+		activated, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(activated, []string{tc.expectedActive}) {
+			t.Fatalf("%v: activated = %v, expected %v", name, activated, tc.expectedActive)
+		}
+	}
+
+	// The newer engine wins over the lower name
+	e0 := newTestEngine("vol-e-0", "vol", "")
+	e1 := newTestEngine("vol-e-1", "vol", "")
+	e1.CreationTimestamp = metav1.Now()
+	resourceMaps := newTestResourceMaps(nil, []*longhorn.Engine{e0, e1}, []*longhorn.Volume{newTestVolume("vol", "")})
+	if _, err := checkAndUpdateEngineActiveState(testNamespace, nil, resourceMaps, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e0.Spec.Active || !e1.Spec.Active {
+		t.Fatalf("expected the most recently created engine to be active")
+	}
+}
+
+func TestUpgradeBackupsStartAfter(t *testing.T) {
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	var backups []*longhorn.Backup
+	for _, name := range []string{"backup-d", "backup-a", "backup-c", "backup-b", "backup-e"} {
+		backups = append(backups, newTestBackup(name, "vol"))
+		engine.Status.BackupStatus[name] = &longhorn.EngineBackupStatus{
+			Progress:     100,
+			SnapshotName: "snap-" + name,
+			State:        "complete",
+		}
+	}
+
+	resourceMaps := newTestResourceMaps(backups, []*longhorn.Engine{engine}, nil)
+	migrated, err := migrateBackupsInProvidedCache(testNamespace, nil, resourceMaps, backupMigrationOptions{startAfter: "backup-b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"backup-c", "backup-d", "backup-e"}
+	if !reflect.DeepEqual(migrated, expected) {
+		t.Fatalf("migrated = %v, expected = %v", migrated, expected)
+	}
+	for _, b := range backups {
+		if (b.Name <= "backup-b") != (b.Status.SnapshotName == "") {
+			t.Fatalf("backup %v snapshot name = %q, unexpected migration result", b.Name, b.Status.SnapshotName)
+		}
+	}
+}
+
+func TestUpgradeBackupsConcurrent(t *testing.T) {
+	defer SetBackupMigrationWorkers(0)
+
+	// newBackupSet returns 100 volumes with 50 backups each, the first backup of every 10th volume
+	// having a nil backup status in the engine
+	newBackupSet := func() ([]*longhorn.Backup, map[string]interface{}) {
+		var backups []*longhorn.Backup
+		var engines []*longhorn.Engine
+		for i := 0; i < 100; i++ {
+			volumeName := fmt.Sprintf("vol-%03d", i)
+			e := newTestEngine(volumeName+"-e-0", volumeName, "node-1")
+			for j := 0; j < 50; j++ {
+				b := newTestBackup(fmt.Sprintf("backup-%03d-%03d", j, i), volumeName)
+				backups = append(backups, b)
+				if i%10 == 0 && j == 0 {
+					e.Status.BackupStatus[b.Name] = nil
+					continue
+				}
+				e.Status.BackupStatus[b.Name] = &longhorn.EngineBackupStatus{
+					Progress:     100,
+					SnapshotName: "snap-" + b.Name,
+					State:        "complete",
+				}
+			}
+			engines = append(engines, e)
+		}
+		return backups, newTestResourceMaps(backups, engines, nil)
+	}
+
+	SetBackupMigrationWorkers(1)
+	_, serialResourceMaps := newBackupSet()
+	serialMigrated, serialErr := migrateBackupsInProvidedCache(testNamespace, nil, serialResourceMaps, backupMigrationOptions{})
+
+	SetBackupMigrationWorkers(8)
+	backups, resourceMaps := newBackupSet()
+	migrated, err := migrateBackupsInProvidedCache(testNamespace, nil, resourceMaps, backupMigrationOptions{})
+
+	if len(migrated) != 100*50-10 {
+		t.Fatalf("migrated %v backups, expected %v", len(migrated), 100*50-10)
+	}
+	if !reflect.DeepEqual(migrated, serialMigrated) {
+		t.Fatalf("migrated = %v, expected the same as the serial migration %v", migrated, serialMigrated)
+	}
+	failures, ok := err.(*resourceFailuresError)
+	if !ok || len(failures.errs) != 10 {
+		t.Fatalf("err = %v, expected 10 failed backups", err)
+	}
+	if serialErr == nil || err.Error() != serialErr.Error() {
+		t.Fatalf("err = %v, expected the same as the serial migration %v", err, serialErr)
+	}
+	for _, b := range backups {
+		_, failed := failures.errs[b.Name]
+		if failed != (b.Status.SnapshotName == "") {
+			t.Fatalf("backup %v snapshot name = %q, failed = %v", b.Name, b.Status.SnapshotName, failed)
+		}
+		if !failed && b.Status.SnapshotName != "snap-"+b.Name {
+			t.Fatalf("backup %v snapshot name = %v, expected = snap-%v", b.Name, b.Status.SnapshotName, b.Name)
+		}
+	}
+}
+
+func TestValidateBackupURLSchemes(t *testing.T) {
+	newBackupWithURL := func(name, url string) *longhorn.Backup {
+		b := newTestBackup(name, "vol")
+		b.Status.URL = url
+		return b
+	}
+
+	testCases := map[string]struct {
+		backupTargetType string
+		backups          []*longhorn.Backup
+		expected         []string
+	}{
+		"matching scheme": {
+			backupTargetType: "s3",
+			backups: []*longhorn.Backup{
+				newBackupWithURL("backup-1", "s3://bucket@us-east-1/?backup=backup-1&volume=vol"),
+				newBackupWithURL("backup-2", ""),
+			},
+			expected: []string{},
+		},
+		"mismatched scheme": {
+			backupTargetType: "nfs",
+			backups: []*longhorn.Backup{
+				newBackupWithURL("backup-1", "nfs://longhorn-test-nfs-svc:/opt/backupstore?backup=backup-1&volume=vol"),
+				newBackupWithURL("backup-3", "s3://bucket@us-east-1/?backup=backup-3&volume=vol"),
+				newBackupWithURL("backup-2", "s3://bucket@us-east-1/?backup=backup-2&volume=vol"),
+			},
+			expected: []string{"backup-2", "backup-3"},
+		},
+		"invalid URL": {
+			backupTargetType: "s3",
+			backups: []*longhorn.Backup{
+				newBackupWithURL("backup-1", "://invalid"),
+			},
+			expected: []string{"backup-1"},
+		},
+	}
+
+	for name, tc := range testCases {
+		backups := newTestResourceMaps(tc.backups, nil, nil)[types.LonghornKindBackup].(map[string]*longhorn.Backup)
+		mismatched := ValidateBackupURLSchemes(backups, tc.backupTargetType)
+		if !reflect.DeepEqual(mismatched, tc.expected) {
+			t.Fatalf("%v: mismatched backups = %v, expected %v", name, mismatched, tc.expected)
+		}
+	}
+}
+
+func TestUpgradeResourcesValidatesBackupURLSchemes(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+	defer SetFailureManifestPath("")
+	SetFailureManifestPath(filepath.Join(t.TempDir(), "failures.json"))
+
+	matching := newTestBackup("backup-s3", "vol")
+	stale := newTestBackup("backup-nfs", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[matching.Name] = &longhorn.EngineBackupStatus{
+		Progress:  100,
+		State:     "complete",
+		BackupURL: "s3://bucket@us-east-1/?backup=backup-s3&volume=vol",
+	}
+	engine.Status.BackupStatus[stale.Name] = &longhorn.EngineBackupStatus{
+		Progress:  100,
+		State:     "complete",
+		BackupURL: "nfs://longhorn-test-nfs-svc:/opt/backupstore?backup=backup-nfs&volume=vol",
+	}
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{matching, stale}, []*longhorn.Engine{engine}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+	settingName := string(types.SettingNameBackupTarget)
+	resourceMaps[types.LonghornKindSetting].(map[string]*longhorn.Setting)[settingName] = &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{Name: settingName},
+		Value:      "s3://bucket@us-east-1/",
+	}
+
+	if err := UpgradeResources(testNamespace, nil, resourceMaps, false, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if output := buf.String(); !strings.Contains(output, "1 migrated backups don't match the s3 backup target") ||
+		!strings.Contains(output, "[backup-nfs]") || strings.Contains(output, "scheme s3 of backup") {
+		t.Fatalf("expected a warning about the backup of the other backup target only, got %q", output)
+	}
+}
+
+func TestBackfillBackupVolumeLabels(t *testing.T) {
+	unlabeled := newTestBackup("backup-unlabeled", "")
+	ambiguous := newTestBackup("backup-ambiguous", "")
+	ambiguous.Status.VolumeName = "vol2"
+	unknown := newTestBackup("backup-unknown", "")
+
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[unlabeled.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		BackupURL:    "s3://backupbucket@us-east-1/?backup=backup-unlabeled&volume=vol",
+		SnapshotName: "snap-unlabeled",
+		State:        "complete",
+	}
+	engine.Status.BackupStatus[ambiguous.Name] = &longhorn.EngineBackupStatus{
+		Progress: 100,
+		State:    "complete",
+	}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{unlabeled, ambiguous, unknown}, []*longhorn.Engine{engine}, nil)
+	if _, err := backfillBackupVolumeLabels(testNamespace, nil, resourceMaps); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unlabeled.Labels[types.LonghornLabelBackupVolume] != "vol" {
+		t.Fatalf("backup volume label = %v, expected vol", unlabeled.Labels[types.LonghornLabelBackupVolume])
+	}
+	for _, b := range []*longhorn.Backup{ambiguous, unknown} {
+		if _, exist := b.Labels[types.LonghornLabelBackupVolume]; exist {
+			t.Fatalf("expected no backup volume label backfilled for backup %v", b.Name)
+		}
+	}
+
+	if _, err := upgradeBackups(testNamespace, nil, resourceMaps, "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unlabeled.Status.SnapshotName != "snap-unlabeled" || unlabeled.Status.State != longhorn.BackupStateCompleted {
+		t.Fatalf("expected the backfilled backup to be migrated, got status %+v", unlabeled.Status)
+	}
+	if ambiguous.Status.State != "" {
+		t.Fatalf("expected the ambiguous backup not to be migrated, got state %v", ambiguous.Status.State)
+	}
+}
+
+func TestUpgradeBackupsMissingSource(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	t.Cleanup(func() {
+		logrus.SetOutput(os.Stderr)
+	})
+
+	backup := newTestBackup("backup-1", "vol")
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{backup}, nil, nil)
+	if _, err := upgradeBackups(testNamespace, nil, resourceMaps, "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "no engines or volumes") {
+		t.Fatalf("expected a warning for the missing engines and volumes, got log %q", buf.String())
+	}
+
+	buf.Reset()
+	resourceMaps = newTestResourceMaps(nil, nil, nil)
+	if _, err := upgradeBackups(testNamespace, nil, resourceMaps, "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "no engines or volumes") {
+		t.Fatalf("expected no warning without backups, got log %q", buf.String())
+	}
+}
+
+func TestGetBackupVolumeName(t *testing.T) {
+	engine := newTestEngine("vol-e-0", "vol-engine", "node-1")
+	engineMap := map[string]*longhorn.Engine{engine.Name: engine}
+
+	testCases := map[string]struct {
+		label          string
+		ownerRefs      []metav1.OwnerReference
+		expectedVolume string
+		expectedExist  bool
+	}{
+		"label only": {
+			label:          "vol-label",
+			expectedVolume: "vol-label",
+			expectedExist:  true,
+		},
+		"volume owner reference only": {
+			ownerRefs:      []metav1.OwnerReference{{Kind: types.LonghornKindVolume, Name: "vol-owner"}},
+			expectedVolume: "vol-owner",
+			expectedExist:  true,
+		},
+		"engine owner reference only": {
+			ownerRefs:      []metav1.OwnerReference{{Kind: types.LonghornKindEngine, Name: engine.Name}},
+			expectedVolume: "vol-engine",
+			expectedExist:  true,
+		},
+		"conflicting label and owner reference": {
+			label:          "vol-label",
+			ownerRefs:      []metav1.OwnerReference{{Kind: types.LonghornKindVolume, Name: "vol-owner"}},
+			expectedVolume: "vol-owner",
+			expectedExist:  true,
+		},
+		"unknown engine owner reference": {
+			label:          "vol-label",
+			ownerRefs:      []metav1.OwnerReference{{Kind: types.LonghornKindEngine, Name: "unknown"}},
+			expectedVolume: "vol-label",
+			expectedExist:  true,
+		},
+		"none": {
+			expectedExist: false,
+		},
+	}
+
+	for name, tc := range testCases {
+		backup := newTestBackup("backup-1", tc.label)
+		backup.OwnerReferences = tc.ownerRefs
+		volumeName, exist := getBackupVolumeName(backup, engineMap)
+		if volumeName != tc.expectedVolume || exist != tc.expectedExist {
+			t.Fatalf("%v: volume = %v, exist = %v, expected %v and %v", name, volumeName, exist, tc.expectedVolume, tc.expectedExist)
+		}
+	}
+}
+
+func TestUpgradeResourcesIdempotent(t *testing.T) {
+	labeled := newTestBackup("backup-labeled", "vol")
+	unlabeled := newTestBackup("backup-unlabeled", "")
+
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[labeled.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		BackupURL:    "s3://backupbucket@us-east-1/?backup=backup-labeled&volume=vol",
+		SnapshotName: "snap-labeled",
+		State:        "complete",
+	}
+	engine.Status.BackupStatus[unlabeled.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		BackupURL:    "s3://backupbucket@us-east-1/?backup=backup-unlabeled&volume=vol",
+		SnapshotName: "snap-unlabeled",
+		State:        "complete",
+	}
+	volume := newTestVolume("vol", "node-1")
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{labeled, unlabeled}, []*longhorn.Engine{engine}, []*longhorn.Volume{volume})
+	modified, err := UpgradeResourcesWithReport(testNamespace, nil, resourceMaps, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ModifiedResources{
+		"backfillBackupVolumeLabels":       {"backup-unlabeled"},
+		"upgradeBackups":                   {"backup-labeled", "backup-unlabeled"},
+		"checkAndRemoveEngineBackupStatus": {"vol-e-0"},
+		"checkAndUpdateEngineActiveState":  {"vol-e-0"},
+	}
+	if !reflect.DeepEqual(modified, expected) {
+		t.Fatalf("modified resources of the first run = %v, expected %v", modified, expected)
+	}
+
+	modified, err = UpgradeResourcesWithReport(testNamespace, nil, resourceMaps, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if modified.Count() != 0 {
+		t.Fatalf("modified resources of the second run = %v, expected none", modified)
+	}
+}
+
+func TestEngineActiveChanges(t *testing.T) {
+	sole := newTestEngine("vol1-e-0", "vol1", "node-1")
+	alreadyActive := newTestEngine("vol2-e-0", "vol2", "node-1")
+	alreadyActive.Spec.Active = true
+	current := newTestEngine("vol3-e-0", "vol3", "node-1")
+	stale := newTestEngine("vol3-e-1", "vol3", "node-2")
+	volumes := []*longhorn.Volume{
+		newTestVolume("vol1", "node-1"),
+		newTestVolume("vol2", "node-1"),
+		newTestVolume("vol3", "node-1"),
+	}
+
+	resourceMaps := newTestResourceMaps(nil, []*longhorn.Engine{sole, alreadyActive, current, stale}, volumes)
+	result, err := UpgradeResourcesWithResult(testNamespace, nil, resourceMaps, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []EngineActiveChange{
+		{EngineName: "vol1-e-0", VolumeName: "vol1", OldActive: false, NewActive: true},
+		{EngineName: "vol3-e-0", VolumeName: "vol3", OldActive: false, NewActive: true},
+	}
+	if !reflect.DeepEqual(result.EngineActiveChanges, expected) {
+		t.Fatalf("engine active changes = %v, expected %v", result.EngineActiveChanges, expected)
+	}
+
+	result, err = UpgradeResourcesWithResult(testNamespace, nil, resourceMaps, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.EngineActiveChanges) != 0 {
+		t.Fatalf("engine active changes of the second run = %v, expected none", result.EngineActiveChanges)
+	}
+}
+
+func TestMislabeledEngine(t *testing.T) {
+	backup := newTestBackup("backup-1", "vol-a")
+	mislabeled := newTestEngine("vol-a-e-0", "vol-b", "node-1")
+	mislabeled.Spec.VolumeName = "vol-a"
+	mislabeled.Status.BackupStatus[backup.Name] = &longhorn.EngineBackupStatus{
+		Progress:     100,
+		BackupURL:    "s3://backupbucket@us-east-1/?backup=backup-1&volume=vol-a",
+		SnapshotName: "snap-1",
+		State:        "complete",
+	}
+	noSpec := newTestEngine("vol-b-e-0", "vol-b", "node-1")
+	noSpec.Spec.VolumeName = ""
+	engineMap := map[string]*longhorn.Engine{mislabeled.Name: mislabeled, noSpec.Name: noSpec}
+
+	if names := warnMislabeledEngines(engineMap); !reflect.DeepEqual(names, []string{mislabeled.Name}) {
+		t.Fatalf("mislabeled engines = %v, expected %v", names, []string{mislabeled.Name})
+	}
+	grouped := groupEnginesByVolume(engineMap)
+	if len(grouped) != 1 || len(grouped["vol-a"]) != 1 || grouped["vol-a"][0] != mislabeled {
+		t.Fatalf("engines grouped by volume = %v, expected only %v under vol-a", grouped, mislabeled.Name)
+	}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{backup}, []*longhorn.Engine{mislabeled, noSpec},
+		[]*longhorn.Volume{newTestVolume("vol-a", "node-1"), newTestVolume("vol-b", "node-1")})
+	migrated, err := migrateBackupsInProvidedCache(testNamespace, nil, resourceMaps, backupMigrationOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(migrated, []string{backup.Name}) {
+		t.Fatalf("migrated = %v, expected the backup indexed by the engine spec", migrated)
+	}
+	if backup.Status.SnapshotName != "snap-1" {
+		t.Fatalf("snapshot name = %v, expected snap-1", backup.Status.SnapshotName)
+	}
+}
+
+func TestFindInconsistentBackupStatuses(t *testing.T) {
+	newBackupWithStatus := func(name, url string, progress int) *longhorn.Backup {
+		b := newTestBackup(name, "vol")
+		b.Status.State = longhorn.BackupStateCompleted
+		b.Status.URL = url
+		b.Status.Progress = progress
+		return b
+	}
+	consistent := newBackupWithStatus("backup-consistent", "s3://backupbucket@us-east-1/?backup=backup-consistent&volume=vol", 100)
+	emptyURL := newBackupWithStatus("backup-empty-url", "", 100)
+	partial := newBackupWithStatus("backup-partial", "s3://backupbucket@us-east-1/?backup=backup-partial&volume=vol", 50)
+	inProgress := newTestBackup("backup-in-progress", "vol")
+	inProgress.Status.State = longhorn.BackupStateInProgress
+
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[emptyURL.Name] = &longhorn.EngineBackupStatus{
+		Progress:  100,
+		BackupURL: "s3://backupbucket@us-east-1/?backup=backup-empty-url&volume=vol",
+		State:     "complete",
+	}
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{consistent, emptyURL, partial, inProgress}, []*longhorn.Engine{engine}, nil)
+	inconsistent, err := findInconsistentBackupStatusesInProvidedCache(testNamespace, nil, resourceMaps, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"backup-empty-url", "backup-partial"}; !reflect.DeepEqual(inconsistent, expected) {
+		t.Fatalf("inconsistent backups = %v, expected %v", inconsistent, expected)
+	}
+	if emptyURL.Status.URL != "" {
+		t.Fatalf("expected no backup to be modified without repair")
+	}
+
+	repaired, err := findInconsistentBackupStatusesInProvidedCache(testNamespace, nil, resourceMaps, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"backup-empty-url"}; !reflect.DeepEqual(repaired, expected) {
+		t.Fatalf("repaired backups = %v, expected %v", repaired, expected)
+	}
+	if emptyURL.Status.URL != engine.Status.BackupStatus[emptyURL.Name].BackupURL {
+		t.Fatalf("backup URL = %v, expected the URL of the engine backup status", emptyURL.Status.URL)
+	}
+	if partial.Status.Progress != 50 {
+		t.Fatalf("expected the backup without engine backup status to be left as is")
+	}
+}
+
+func TestCheckSourceVersion(t *testing.T) {
+	testCases := map[string]struct {
+		version       *string
+		expectedError bool
+	}{
+		"matching":               {version: stringPtr("v1.2.2")},
+		"older":                  {version: stringPtr("v1.1.2")},
+		"missing setting":        {version: nil},
+		"empty version":          {version: stringPtr("")},
+		"already upgraded":       {version: stringPtr("v1.2.3"), expectedError: true},
+		"newer":                  {version: stringPtr("v1.3.0"), expectedError: true},
+		"invalid version string": {version: stringPtr("1.2.2")},
+		"custom build":           {version: stringPtr("master-head")},
+	}
+
+	for name, tc := range testCases {
+		resourceMaps := newTestResourceMaps(nil, nil, nil)
+		if tc.version != nil {
+			settingName := string(types.SettingNameCurrentLonghornVersion)
+			resourceMaps[types.LonghornKindSetting].(map[string]*longhorn.Setting)[settingName] = &longhorn.Setting{
+				ObjectMeta: metav1.ObjectMeta{Name: settingName},
+				Value:      *tc.version,
+			}
+		}
+
+		_, err := UpgradeResourcesWithReport(testNamespace, nil, resourceMaps, nil)
+		if tc.expectedError != (err != nil) {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestUpgradeErrorContext(t *testing.T) {
+	good := newTestBackup("backup-good", "vol")
+	bad := newTestBackup("backup-bad", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[good.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	engine.Status.BackupStatus[bad.Name] = nil
+
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{good, bad}, []*longhorn.Engine{engine}, nil)
+	_, err := upgradeBackups(testNamespace, nil, resourceMaps, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "backup-bad") || !strings.Contains(err.Error(), "vol-e-0") {
+		t.Fatalf("expected an error naming the failing backup and engine, got %v", err)
+	}
+	if strings.Contains(err.Error(), "backup-good") {
+		t.Fatalf("expected the error to name the failing backup only, got %v", err)
+	}
+}
+
+func TestUpgradeResourcesOutput(t *testing.T) {
+	defer SetFailureManifestPath("")
+	SetFailureManifestPath(filepath.Join(t.TempDir(), "failures.json"))
+
+	for name, upgrade := range map[string]func(resourceMaps map[string]interface{}, out io.Writer) error{
+		"UpgradeResources": func(resourceMaps map[string]interface{}, out io.Writer) error {
+			return UpgradeResources(testNamespace, nil, resourceMaps, false, out)
+		},
+		"UpgradeResourcesWithReport": func(resourceMaps map[string]interface{}, out io.Writer) error {
+			_, err := UpgradeResourcesWithReport(testNamespace, nil, resourceMaps, out)
+			return err
+		},
+	} {
+		backup := newTestBackup("backup-1", "vol")
+		engine := newTestEngine("vol-e-0", "vol", "node-1")
+		engine.Status.BackupStatus[backup.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+		resourceMaps := newTestResourceMaps([]*longhorn.Backup{backup}, []*longhorn.Engine{engine}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+
+		var out bytes.Buffer
+		if err := upgrade(resourceMaps, &out); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		for _, expected := range []string{
+			"upgradeBackups: current progress 100% (1/1)",
+			"checkAndRemoveEngineBackupStatus: current progress 100% (1/1)",
+			"checkAndUpdateEngineActiveState: current progress 100% (1/1)",
+			"upgradeResources: 100% of upgrade complete (3/3)",
+			"modified 3 resources",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Fatalf("%v: expected %q in the streamed output:\n%v", name, expected, out.String())
+			}
+		}
+	}
+}
+
+func TestUpgradeStepDurations(t *testing.T) {
+	// Every reading of the fake clock advances it by a second, so each step takes a second
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	clock := time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	backup := newTestBackup("backup-1", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[backup.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete"}
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{backup}, []*longhorn.Engine{engine}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+
+	var out bytes.Buffer
+	result, err := UpgradeResourcesWithResult(testNamespace, nil, resourceMaps, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := StepDurations{}
+	for _, step := range DescribeSteps() {
+		expected[step.Name] = time.Second
+	}
+	if !reflect.DeepEqual(result.StepDurations, expected) {
+		t.Fatalf("step durations = %v, expected %v", result.StepDurations, expected)
+	}
+	if !strings.Contains(out.String(), "step upgradeBackups took 1s") {
+		t.Fatalf("expected the step durations in the streamed output:\n%v", out.String())
+	}
+}
+
+func TestDryRunUpgradeResources(t *testing.T) {
+	backup := newTestBackup("backup-1", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[backup.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete", SnapshotName: "snap-1"}
+	resourceMaps := newTestResourceMaps([]*longhorn.Backup{backup}, []*longhorn.Engine{engine}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+	expectedBackup := backup.DeepCopy()
+	expectedEngine := engine.DeepCopy()
+
+	// Without a client the upgrade would fail to persist anything
+	if err := UpgradeResources(testNamespace, nil, resourceMaps, true, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	outputs := []string{}
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		changes, err := DryRunUpgradeResources(testNamespace, nil, resourceMaps, &out)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fields := map[string]bool{}
+		for _, change := range changes {
+			fields[change.Kind+"/"+change.Name+" "+change.Field] = true
+		}
+		for _, field := range []string{
+			types.LonghornKindBackup + "/backup-1 status.snapshotName",
+			types.LonghornKindEngine + "/vol-e-0 spec.active",
+			types.LonghornKindEngine + "/vol-e-0 status.backupStatus.backup-1.state",
+		} {
+			if !fields[field] {
+				t.Fatalf("changes = %v, expected a change of %v", changes, field)
+			}
+		}
+		// The step durations vary across the runs, unlike the changes
+		dryRunLines := []string{}
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.Contains(line, "dry run: ") {
+				dryRunLines = append(dryRunLines, line)
+			}
+		}
+		outputs = append(outputs, strings.Join(dryRunLines, "\n"))
+	}
+	if !strings.Contains(outputs[0], "dry run: "+types.LonghornKindEngine+"/vol-e-0 spec.active: false -> true") {
+		t.Fatalf("expected the field changes in the output:\n%v", outputs[0])
+	}
+	if outputs[0] != outputs[1] {
+		t.Fatalf("expected the same output of the dry runs:\n%v\n%v", outputs[0], outputs[1])
+	}
+	if !reflect.DeepEqual(backup, expectedBackup) || !reflect.DeepEqual(engine, expectedEngine) {
+		t.Fatalf("expected the cached resources to be untouched by the dry run")
+	}
+}
+
+func TestDryRunUpgradeResourcesNoWrites(t *testing.T) {
+	backup := newTestBackup("backup-1", "vol")
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	engine.Status.BackupStatus[backup.Name] = &longhorn.EngineBackupStatus{Progress: 100, State: "complete", SnapshotName: "snap-1"}
+	lists := map[string]interface{}{
+		"backups":  &longhorn.BackupList{Items: []longhorn.Backup{*backup}},
+		"engines":  &longhorn.EngineList{Items: []longhorn.Engine{*engine}},
+		"volumes":  &longhorn.VolumeList{Items: []longhorn.Volume{*newTestVolume("vol", "node-1")}},
+		"settings": &longhorn.SettingList{},
+	}
+
+	var mutex sync.Mutex
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+		list, ok := lists[path.Base(r.URL.Path)]
+		if r.Method != http.MethodGet || !ok {
+			http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			t.Errorf("failed to encode %v: %v", r.URL.Path, err)
+		}
+	}))
+	defer server.Close()
+	lhClient, err := lhclientset.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	changes, err := DryRunUpgradeResources(testNamespace, lhClient, map[string]interface{}{}, io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changes) == 0 {
+		t.Fatalf("expected the changes of the listed resources")
+	}
+	if err := UpgradeResources(testNamespace, lhClient, map[string]interface{}{}, true, io.Discard); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(requests) == 0 {
+		t.Fatalf("expected the resources to be listed via the client")
+	}
+	for _, request := range requests {
+		if !strings.HasPrefix(request, http.MethodGet+" ") {
+			t.Fatalf("requests = %v, expected no write in the dry run", requests)
+		}
+	}
+}
+
+func TestAssertNoOrphanedBackups(t *testing.T) {
+	testCases := map[string]struct {
+		engines  []*longhorn.Engine
+		volumes  []*longhorn.Volume
+		expected []string
+	}{
+		"correlated via volume": {
+			volumes:  []*longhorn.Volume{newTestVolume("vol", "node-1")},
+			expected: []string{},
+		},
+		"correlated via engine": {
+			engines:  []*longhorn.Engine{newTestEngine("vol-e-0", "vol", "node-1")},
+			expected: []string{},
+		},
+		"orphaned": {
+			engines:  []*longhorn.Engine{newTestEngine("other-e-0", "other", "node-1")},
+			volumes:  []*longhorn.Volume{newTestVolume("other", "node-1")},
+			expected: []string{"backup-1"},
+		},
+	}
+
+	for name, tc := range testCases {
+		// The backup without the volume label cannot be correlated at all, so it's not reported
+		backups := []*longhorn.Backup{newTestBackup("backup-1", "vol"), newTestBackup("backup-unlabeled", "")}
+		resourceMaps := newTestResourceMaps(backups, tc.engines, tc.volumes)
+		orphaned, err := findOrphanedBackupsInProvidedCache(testNamespace, nil, resourceMaps)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(orphaned, tc.expected) {
+			t.Fatalf("%v: orphaned = %v, expected %v", name, orphaned, tc.expected)
+		}
+	}
+}
+
+func TestAssertAllBackupsHaveState(t *testing.T) {
+	newMigratableBackup := func(name string, engine *longhorn.Engine) *longhorn.Backup {
+		engine.Status.BackupStatus[name] = &longhorn.EngineBackupStatus{
+			Progress:  100,
+			BackupURL: "s3://backupbucket@us-east-1/?backup=" + name + "&volume=vol",
+			State:     "complete",
+		}
+		return newTestBackup(name, "vol")
+	}
+
+	engine := newTestEngine("vol-e-0", "vol", "node-1")
+	backups := []*longhorn.Backup{newMigratableBackup("backup-1", engine), newMigratableBackup("backup-2", engine)}
+	resourceMaps := newTestResourceMaps(backups, []*longhorn.Engine{engine}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+	if _, err := UpgradeResourcesWithReport(testNamespace, nil, resourceMaps, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stateless, err := findBackupsWithoutStateInProvidedCache(testNamespace, nil, resourceMaps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stateless) != 0 {
+		t.Fatalf("stateless backups = %v, expected all backups to be migrated", stateless)
+	}
+
+	// The engine has no backup status for the stragglers
+	engine = newTestEngine("vol-e-0", "vol", "node-1")
+	backups = []*longhorn.Backup{newMigratableBackup("backup-1", engine), newTestBackup("backup-3", "vol"), newTestBackup("backup-2", "vol")}
+	resourceMaps = newTestResourceMaps(backups, []*longhorn.Engine{engine}, []*longhorn.Volume{newTestVolume("vol", "node-1")})
+	if _, err := UpgradeResourcesWithReport(testNamespace, nil, resourceMaps, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stateless, err = findBackupsWithoutStateInProvidedCache(testNamespace, nil, resourceMaps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"backup-2", "backup-3"}; !reflect.DeepEqual(stateless, expected) {
+		t.Fatalf("stateless backups = %v, expected %v", stateless, expected)
+	}
+}